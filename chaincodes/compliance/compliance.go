@@ -0,0 +1,635 @@
+// compliance.go - AMMC registry of securities and brokers and per-trade compliance checks
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ComplianceContract provides the regulator's functions on the regulatory channel
+type ComplianceContract struct {
+	contractapi.Contract
+}
+
+// RegisteredSecurity represents a security approved by AMMC for trading
+type RegisteredSecurity struct {
+	SecurityID        string  `json:"securityID"`
+	Symbol            string  `json:"symbol"`
+	Name              string  `json:"name"`
+	IssuerID          string  `json:"issuerID"`
+	TotalShares       int     `json:"totalShares"`
+	ReferencePrice    Money   `json:"referencePrice"`
+	MaxPriceDeviation float64 `json:"maxPriceDeviation"` // percent away from the reference price
+	Restricted        bool    `json:"restricted"`
+	Status            string  `json:"status"` // approved, suspended
+	RegisteredAt      string  `json:"registeredAt"`
+	LastUpdated       string  `json:"lastUpdated"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// LicensedBroker represents a broker licensed by AMMC
+type LicensedBroker struct {
+	BrokerID     string `json:"brokerID"`
+	Name         string `json:"name"`
+	MinCapital   Money  `json:"minCapital"`
+	RiskLevel    string `json:"riskLevel"` // low, medium, high
+	Status       string `json:"status"`    // licensed, suspended, revoked
+	RegisteredAt string `json:"registeredAt"`
+	LastUpdated  string `json:"lastUpdated"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// Trade represents a matched trade imported from the trading channel for review
+type Trade struct {
+	TradeID      string `json:"tradeID"`
+	BuyOrderID   string `json:"buyOrderID"`
+	SellOrderID  string `json:"sellOrderID"`
+	BuyBrokerID  string `json:"buyBrokerID"`
+	SellBrokerID string `json:"sellBrokerID"`
+	BuyClientID  string `json:"buyClientID"`
+	SellClientID string `json:"sellClientID"`
+	SecurityID   string `json:"securityID"`
+	Quantity     int    `json:"quantity"`
+	Price        Money  `json:"price"`
+	Status       string `json:"status"` // pending, approved, rejected
+	MatchTime    string `json:"matchTime"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// ComplianceCheck records the outcome of a regulator's review of a trade
+type ComplianceCheck struct {
+	CheckID     string   `json:"checkID"` // check-<tradeID>
+	TradeID     string   `json:"tradeID"`
+	RegulatorID string   `json:"regulatorID"`
+	Status      string   `json:"status"` // approved, rejected
+	Reasons     []string `json:"reasons"`
+	CheckedAt   string   `json:"checkedAt"`
+}
+
+// function to get the caller's organization
+func (c *ComplianceContract) getClientOrgID(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get MSP ID: %v", err)
+	}
+
+	return mspID, nil
+}
+
+// requireRegulator checks that the caller belongs to AMMC
+func (c *ComplianceContract) requireRegulator(ctx contractapi.TransactionContextInterface) error {
+	mspID, err := c.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	if mspID != "AMMCMSP" {
+		return fmt.Errorf("only AMMC is authorized to perform this operation")
+	}
+
+	return nil
+}
+
+// getTxTime returns the transaction timestamp, which is the same on every endorsing peer
+func (c *ComplianceContract) getTxTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+}
+
+// InitLedger initializes the ledger
+func (c *ComplianceContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
+	return nil
+}
+
+// AddSecurity registers a security approved for trading (reference price in centimes,
+// price deviation limit in percent)
+func (c *ComplianceContract) AddSecurity(ctx contractapi.TransactionContextInterface, securityID, symbol, name, issuerID string, totalShares int, referencePriceCentimes int64, maxPriceDeviation float64, restricted bool) error {
+	referencePrice := Money(referencePriceCentimes)
+
+	err := c.requireRegulator(ctx)
+	if err != nil {
+		return err
+	}
+
+	existingJSON, err := ctx.GetStub().GetState("security-" + securityID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("security %s is already registered", securityID)
+	}
+
+	if totalShares <= 0 {
+		return fmt.Errorf("total shares must be positive")
+	}
+	if referencePrice <= 0 {
+		return fmt.Errorf("reference price must be positive")
+	}
+	if maxPriceDeviation <= 0 {
+		return fmt.Errorf("maximum price deviation must be positive")
+	}
+
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	security := RegisteredSecurity{
+		SecurityID:        securityID,
+		Symbol:            symbol,
+		Name:              name,
+		IssuerID:          issuerID,
+		TotalShares:       totalShares,
+		ReferencePrice:    referencePrice,
+		MaxPriceDeviation: maxPriceDeviation,
+		Restricted:        restricted,
+		Status:            "approved",
+		RegisteredAt:      now.Format(time.RFC3339),
+		LastUpdated:       now.Format(time.RFC3339),
+	}
+
+	return c.putSecurity(ctx, &security)
+}
+
+// putSecurity stores a registered security
+func (c *ComplianceContract) putSecurity(ctx contractapi.TransactionContextInterface, security *RegisteredSecurity) error {
+	securityJSON, err := json.Marshal(security)
+	if err != nil {
+		return fmt.Errorf("failed to marshal security: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("security-"+security.SecurityID, securityJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put security in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetSecurity retrieves a registered security
+func (c *ComplianceContract) GetSecurity(ctx contractapi.TransactionContextInterface, securityID string) (*RegisteredSecurity, error) {
+	securityJSON, err := ctx.GetStub().GetState("security-" + securityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if securityJSON == nil {
+		return nil, fmt.Errorf("security %s is not registered", securityID)
+	}
+
+	var security RegisteredSecurity
+	err = json.Unmarshal(securityJSON, &security)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal security: %v", err)
+	}
+
+	return &security, nil
+}
+
+// UpdateSecurityStatus approves or suspends a registered security
+func (c *ComplianceContract) UpdateSecurityStatus(ctx contractapi.TransactionContextInterface, securityID, newStatus string) error {
+	err := c.requireRegulator(ctx)
+	if err != nil {
+		return err
+	}
+
+	if newStatus != "approved" && newStatus != "suspended" {
+		return fmt.Errorf("invalid status: must be 'approved' or 'suspended'")
+	}
+
+	security, err := c.GetSecurity(ctx, securityID)
+	if err != nil {
+		return err
+	}
+
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	security.Status = newStatus
+	security.LastUpdated = now.Format(time.RFC3339)
+
+	return c.putSecurity(ctx, security)
+}
+
+// GetAllSecurities retrieves all registered securities
+func (c *ComplianceContract) GetAllSecurities(ctx contractapi.TransactionContextInterface) ([]*RegisteredSecurity, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("security-", "security-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get securities: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var securities []*RegisteredSecurity
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate securities: %v", err)
+		}
+
+		var security RegisteredSecurity
+		err = json.Unmarshal(queryResponse.Value, &security)
+		if err != nil {
+			continue // Skip if not a valid RegisteredSecurity
+		}
+		securities = append(securities, &security)
+	}
+
+	return securities, nil
+}
+
+// AddBroker licenses a broker (minimum capital in centimes)
+func (c *ComplianceContract) AddBroker(ctx contractapi.TransactionContextInterface, brokerID, name string, minCapitalCentimes int64, riskLevel string) error {
+	minCapital := Money(minCapitalCentimes)
+
+	err := c.requireRegulator(ctx)
+	if err != nil {
+		return err
+	}
+
+	existingJSON, err := ctx.GetStub().GetState("broker-" + brokerID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("broker %s is already licensed", brokerID)
+	}
+
+	if riskLevel != "low" && riskLevel != "medium" && riskLevel != "high" {
+		return fmt.Errorf("invalid risk level: must be 'low', 'medium', or 'high'")
+	}
+	if minCapital < 0 {
+		return fmt.Errorf("minimum capital must not be negative")
+	}
+
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	broker := LicensedBroker{
+		BrokerID:     brokerID,
+		Name:         name,
+		MinCapital:   minCapital,
+		RiskLevel:    riskLevel,
+		Status:       "licensed",
+		RegisteredAt: now.Format(time.RFC3339),
+		LastUpdated:  now.Format(time.RFC3339),
+	}
+
+	return c.putBroker(ctx, &broker)
+}
+
+// putBroker stores a licensed broker
+func (c *ComplianceContract) putBroker(ctx contractapi.TransactionContextInterface, broker *LicensedBroker) error {
+	brokerJSON, err := json.Marshal(broker)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broker: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("broker-"+broker.BrokerID, brokerJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put broker in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetBroker retrieves a licensed broker
+func (c *ComplianceContract) GetBroker(ctx contractapi.TransactionContextInterface, brokerID string) (*LicensedBroker, error) {
+	brokerJSON, err := ctx.GetStub().GetState("broker-" + brokerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if brokerJSON == nil {
+		return nil, fmt.Errorf("broker %s is not licensed", brokerID)
+	}
+
+	var broker LicensedBroker
+	err = json.Unmarshal(brokerJSON, &broker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal broker: %v", err)
+	}
+
+	return &broker, nil
+}
+
+// UpdateBrokerStatus changes the licence status of a broker
+func (c *ComplianceContract) UpdateBrokerStatus(ctx contractapi.TransactionContextInterface, brokerID, newStatus string) error {
+	err := c.requireRegulator(ctx)
+	if err != nil {
+		return err
+	}
+
+	if newStatus != "licensed" && newStatus != "suspended" && newStatus != "revoked" {
+		return fmt.Errorf("invalid status: must be 'licensed', 'suspended', or 'revoked'")
+	}
+
+	broker, err := c.GetBroker(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	broker.Status = newStatus
+	broker.LastUpdated = now.Format(time.RFC3339)
+
+	return c.putBroker(ctx, broker)
+}
+
+// GetAllBrokers retrieves all licensed brokers
+func (c *ComplianceContract) GetAllBrokers(ctx contractapi.TransactionContextInterface) ([]*LicensedBroker, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("broker-", "broker-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get brokers: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var brokers []*LicensedBroker
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate brokers: %v", err)
+		}
+
+		var broker LicensedBroker
+		err = json.Unmarshal(queryResponse.Value, &broker)
+		if err != nil {
+			continue // Skip if not a valid LicensedBroker
+		}
+		brokers = append(brokers, &broker)
+	}
+
+	return brokers, nil
+}
+
+// ImportTrade copies a matched trade from the trading channel for review
+func (c *ComplianceContract) ImportTrade(ctx contractapi.TransactionContextInterface,
+	tradeID, buyOrderID, sellOrderID, buyBrokerID, sellBrokerID, buyClientID, sellClientID, securityID string,
+	quantity int, priceCentimes int64, status, matchTime string) error {
+
+	mspID, err := c.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != "AMMCMSP" && mspID != "StockMarketMSP" {
+		return fmt.Errorf("only AMMC and the stock market are authorized to import trades")
+	}
+
+	// Check if trade already exists (prevents duplicate trade creation)
+	existingTradeJSON, err := ctx.GetStub().GetState(tradeID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingTradeJSON != nil {
+		return fmt.Errorf("trade %s already exists", tradeID)
+	}
+
+	trade := Trade{
+		TradeID:      tradeID,
+		BuyOrderID:   buyOrderID,
+		SellOrderID:  sellOrderID,
+		BuyBrokerID:  buyBrokerID,
+		SellBrokerID: sellBrokerID,
+		BuyClientID:  buyClientID,
+		SellClientID: sellClientID,
+		SecurityID:   securityID,
+		Quantity:     quantity,
+		Price:        Money(priceCentimes),
+		Status:       status,
+		MatchTime:    matchTime,
+	}
+
+	tradeJSON, err := json.Marshal(trade)
+	if err != nil {
+		return fmt.Errorf("failed to marshal trade: %v", err)
+	}
+
+	return ctx.GetStub().PutState(tradeID, tradeJSON)
+}
+
+// GetTrade retrieves an imported trade
+func (c *ComplianceContract) GetTrade(ctx contractapi.TransactionContextInterface, tradeID string) (*Trade, error) {
+	tradeJSON, err := ctx.GetStub().GetState(tradeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trade from world state: %v", err)
+	}
+	if tradeJSON == nil {
+		return nil, fmt.Errorf("trade %s does not exist", tradeID)
+	}
+
+	var trade Trade
+	err = json.Unmarshal(tradeJSON, &trade)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal trade: %v", err)
+	}
+
+	return &trade, nil
+}
+
+// PerformTradeCheck reviews an imported trade against the registry, sanctions and
+// restrictions and records the outcome under check-<tradeID>
+func (c *ComplianceContract) PerformTradeCheck(ctx contractapi.TransactionContextInterface, tradeID, regulatorID string) error {
+	err := c.requireRegulator(ctx)
+	if err != nil {
+		return err
+	}
+
+	checkID := "check-" + tradeID
+	existingJSON, err := ctx.GetStub().GetState(checkID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("compliance check for trade %s already exists", tradeID)
+	}
+
+	trade, err := c.GetTrade(ctx, tradeID)
+	if err != nil {
+		return err
+	}
+
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	restrictions, err := c.GetRestrictionSet(ctx)
+	if err != nil {
+		return err
+	}
+
+	reasons := []string{}
+
+	// Security must be registered, approved and not restricted
+	security, err := c.GetSecurity(ctx, trade.SecurityID)
+	if err != nil {
+		reasons = append(reasons, fmt.Sprintf("security %s is not registered", trade.SecurityID))
+	} else {
+		if security.Status != "approved" {
+			reasons = append(reasons, fmt.Sprintf("security %s is %s", trade.SecurityID, security.Status))
+		}
+		if restrictions.isSecurityRestricted(trade.SecurityID) {
+			reasons = append(reasons, fmt.Sprintf("security %s is restricted", trade.SecurityID))
+		}
+
+		// Price must stay within the permitted deviation from the reference price. The limit
+		// is compared against the centime difference scaled up, so no division is rounded.
+		difference := math.Abs(float64(trade.Price - security.ReferencePrice))
+		if difference*100 > security.MaxPriceDeviation*float64(security.ReferencePrice) {
+			deviation := difference / float64(security.ReferencePrice) * 100
+			reasons = append(reasons, fmt.Sprintf("price %v deviates %.2f%% from reference price %v (limit %.2f%%)",
+				trade.Price, deviation, security.ReferencePrice, security.MaxPriceDeviation))
+		}
+
+		if trade.Quantity > security.TotalShares {
+			reasons = append(reasons, fmt.Sprintf("quantity %d exceeds the %d shares outstanding", trade.Quantity, security.TotalShares))
+		}
+	}
+
+	// Both brokers must hold a licence and not be under sanction
+	for _, brokerID := range []string{trade.BuyBrokerID, trade.SellBrokerID} {
+		broker, err := c.GetBroker(ctx, brokerID)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("broker %s is not licensed", brokerID))
+		} else if broker.Status != "licensed" {
+			reasons = append(reasons, fmt.Sprintf("broker %s licence is %s", brokerID, broker.Status))
+		}
+		if restrictions.isBrokerSanctioned(brokerID) {
+			reasons = append(reasons, fmt.Sprintf("broker %s is under sanction", brokerID))
+		}
+	}
+
+	// Clients must not be sanctioned or on an insider blackout list for the issuer
+	for _, party := range []struct{ brokerID, clientID string }{
+		{trade.BuyBrokerID, trade.BuyClientID},
+		{trade.SellBrokerID, trade.SellClientID},
+	} {
+		if party.clientID == "" {
+			continue
+		}
+		if restrictions.isClientSanctioned(party.clientID) {
+			reasons = append(reasons, fmt.Sprintf("client %s is under sanction", party.clientID))
+		}
+		if security != nil && restrictions.isClientBlackedOut(party.brokerID, party.clientID, security.IssuerID) {
+			reasons = append(reasons, fmt.Sprintf("client %s is on the insider blackout list for issuer %s", party.clientID, security.IssuerID))
+		}
+	}
+
+	check := ComplianceCheck{
+		CheckID:     checkID,
+		TradeID:     tradeID,
+		RegulatorID: regulatorID,
+		Status:      "approved",
+		Reasons:     reasons,
+		CheckedAt:   now.Format(time.RFC3339),
+	}
+	if len(reasons) > 0 {
+		check.Status = "rejected"
+	}
+
+	checkJSON, err := json.Marshal(check)
+	if err != nil {
+		return fmt.Errorf("failed to marshal compliance check: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(checkID, checkJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put compliance check in ledger: %v", err)
+	}
+
+	// Keep the imported trade's status in line with the check
+	trade.Status = check.Status
+	tradeJSON, err := json.Marshal(trade)
+	if err != nil {
+		return fmt.Errorf("failed to marshal trade: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(tradeID, tradeJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update trade in ledger: %v", err)
+	}
+
+	// Emit an event for the completed check
+	err = ctx.GetStub().SetEvent("ComplianceCheckCompleted", checkJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set ComplianceCheckCompleted event: %v", err)
+	}
+
+	return nil
+}
+
+// GetComplianceCheck retrieves a compliance check by ID (check-<tradeID>)
+func (c *ComplianceContract) GetComplianceCheck(ctx contractapi.TransactionContextInterface, checkID string) (*ComplianceCheck, error) {
+	checkJSON, err := ctx.GetStub().GetState(checkID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if checkJSON == nil {
+		return nil, fmt.Errorf("compliance check %s does not exist", checkID)
+	}
+
+	var check ComplianceCheck
+	err = json.Unmarshal(checkJSON, &check)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal compliance check: %v", err)
+	}
+
+	return &check, nil
+}
+
+// GetComplianceChecksByStatus retrieves all compliance checks with the given status
+func (c *ComplianceContract) GetComplianceChecksByStatus(ctx contractapi.TransactionContextInterface, status string) ([]*ComplianceCheck, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("check-", "check-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get compliance checks: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var checks []*ComplianceCheck
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate compliance checks: %v", err)
+		}
+
+		var check ComplianceCheck
+		err = json.Unmarshal(queryResponse.Value, &check)
+		if err != nil {
+			continue // Skip if not a valid ComplianceCheck
+		}
+
+		if check.Status == status {
+			checks = append(checks, &check)
+		}
+	}
+
+	return checks, nil
+}
+
+func main() {
+	chaincode, err := contractapi.NewChaincode(&ComplianceContract{})
+	if err != nil {
+		fmt.Printf("Error creating compliance chaincode: %s", err.Error())
+		return
+	}
+
+	if err := chaincode.Start(); err != nil {
+		fmt.Printf("Error starting compliance chaincode: %s", err.Error())
+	}
+}
@@ -0,0 +1,133 @@
+// compliance_test.go - Tests of trade reviews against the registry, sanctions and restrictions
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setUpRegistry registers SEC001 of issuer APP001 at a reference price of 1.00 with a 10%
+// deviation limit, and licenses BROKER1 and BROKER2
+func setUpRegistry(t *testing.T, l *mockLedger) {
+	t.Helper()
+	c := &ComplianceContract{}
+
+	l.must(t, "AMMCMSP", func(ctx txCtx) error {
+		return c.AddSecurity(ctx, "SEC001", "ATW", "Attijariwafa", "APP001", 1000, 100, 10, false)
+	})
+	for _, brokerID := range []string{"BROKER1", "BROKER2"} {
+		brokerID := brokerID
+		l.must(t, "AMMCMSP", func(ctx txCtx) error { return c.AddBroker(ctx, brokerID, brokerID, 100000000, "low") })
+	}
+}
+
+// checkTrade imports a trade of 10 SEC001 between clients of BROKER1 and BROKER2 and
+// returns its compliance check
+func checkTrade(t *testing.T, l *mockLedger, tradeID, buyClientID, sellClientID string, price int64) *ComplianceCheck {
+	t.Helper()
+	c := &ComplianceContract{}
+
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		return c.ImportTrade(ctx, tradeID, "order-b", "order-s", "BROKER1", "BROKER2", buyClientID, sellClientID,
+			"SEC001", 10, price, "matched", "2026-03-02T09:00:00Z")
+	})
+	l.must(t, "AMMCMSP", func(ctx txCtx) error { return c.PerformTradeCheck(ctx, tradeID, "REG1") })
+
+	var check *ComplianceCheck
+	l.must(t, "AMMCMSP", func(ctx txCtx) error {
+		var err error
+		check, err = c.GetComplianceCheck(ctx, "check-"+tradeID)
+		return err
+	})
+	return check
+}
+
+func TestPerformTradeCheck(t *testing.T) {
+	l := newLedger()
+	c := &ComplianceContract{}
+	setUpRegistry(t, l)
+	l.must(t, "AMMCMSP", func(ctx txCtx) error {
+		return c.IssueRestriction(ctx, "R1", "blackout", "", "APP001", "", "C2", "insider", "")
+	})
+	l.must(t, "AMMCMSP", func(ctx txCtx) error {
+		return c.IssueSanction(ctx, "S1", "client", "C3", "market abuse", 500000, "")
+	})
+
+	if check := checkTrade(t, l, "T1", "C1", "C4", 105); check.Status != "approved" || len(check.Reasons) != 0 {
+		t.Errorf("clean trade check = %+v", check)
+	}
+
+	check := checkTrade(t, l, "T2", "C2", "C3", 111)
+	want := []string{
+		"price 1.11 deviates 11.00% from reference price 1.00 (limit 10.00%)",
+		"client C2 is on the insider blackout list for issuer APP001",
+		"client C3 is under sanction",
+	}
+	if check.Status != "rejected" || !reflect.DeepEqual(check.Reasons, want) {
+		t.Errorf("check = %+v, want reasons %q", check, want)
+	}
+
+	l.must(t, "AMMCMSP", func(ctx txCtx) error {
+		trade, err := c.GetTrade(ctx, "T2")
+		if err != nil {
+			return err
+		}
+		if trade.Status != "rejected" {
+			t.Errorf("trade status = %s, want rejected", trade.Status)
+		}
+		return nil
+	})
+
+	l.mustFail(t, "AMMCMSP", func(ctx txCtx) error { return c.PerformTradeCheck(ctx, "T2", "REG1") })
+}
+
+func TestOnlyAMMCIssuesMeasures(t *testing.T) {
+	l := newLedger()
+	c := &ComplianceContract{}
+
+	for _, mspID := range []string{"StockMarketMSP", "Broker1MSP"} {
+		l.mustFail(t, mspID, func(ctx txCtx) error { return c.IssueSanction(ctx, "S1", "client", "C9", "abuse", 0, "") })
+		l.mustFail(t, mspID, func(ctx txCtx) error {
+			return c.IssueRestriction(ctx, "R1", "security", "SEC001", "", "", "", "halt", "")
+		})
+		l.mustFail(t, mspID, func(ctx txCtx) error { return c.PerformTradeCheck(ctx, "T1", "REG1") })
+	}
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error {
+		return c.ImportTrade(ctx, "T1", "order-b", "order-s", "BROKER1", "BROKER2", "", "", "SEC001", 10, 100, "matched", "2026-03-02T09:00:00Z")
+	})
+}
+
+func TestRestrictionSetDropsExpiredAndLiftedMeasures(t *testing.T) {
+	l := newLedger()
+	c := &ComplianceContract{}
+	setUpRegistry(t, l)
+	l.must(t, "AMMCMSP", func(ctx txCtx) error {
+		return c.IssueSanction(ctx, "S1", "broker", "BROKER2", "late reporting", 0, "2026-03-03T00:00:00Z")
+	})
+	l.must(t, "AMMCMSP", func(ctx txCtx) error {
+		return c.IssueRestriction(ctx, "R1", "security", "SEC001", "", "", "", "pending announcement", "")
+	})
+
+	restrictionSet := func() *RestrictionSet {
+		var set *RestrictionSet
+		l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+			var err error
+			set, err = c.GetRestrictionSet(ctx)
+			return err
+		})
+		return set
+	}
+
+	set := restrictionSet()
+	if !reflect.DeepEqual(set.SanctionedBrokers, []string{"BROKER2"}) || !reflect.DeepEqual(set.RestrictedSecurities, []string{"SEC001"}) {
+		t.Fatalf("restriction set = %+v", set)
+	}
+
+	l.now = time.Date(2026, 3, 3, 9, 0, 0, 0, time.UTC)
+	l.must(t, "AMMCMSP", func(ctx txCtx) error { return c.LiftRestriction(ctx, "R1") })
+	set = restrictionSet()
+	if len(set.SanctionedBrokers) != 0 || len(set.RestrictedSecurities) != 0 {
+		t.Errorf("restriction set after expiry = %+v", set)
+	}
+}
@@ -0,0 +1,27 @@
+// money_test.go - Tests of the migration of float-valued amounts
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMigrateMoneyJSON(t *testing.T) {
+	migrated, changed, err := migrateMoneyJSON([]byte(`{"brokerID":"BROKER1","minCapital":1500000.5}`))
+	if err != nil || !changed {
+		t.Fatalf("licensed broker not migrated: %v", err)
+	}
+	var broker map[string]interface{}
+	err = json.Unmarshal(migrated, &broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broker["minCapital"] != float64(150000050) || broker["moneySchema"] != float64(moneySchemaCentimes) {
+		t.Errorf("migrated licensed broker = %s", migrated)
+	}
+
+	_, changed, err = migrateMoneyJSON(migrated)
+	if err != nil || changed {
+		t.Errorf("record tagged with a money schema was migrated again: %v", err)
+	}
+}
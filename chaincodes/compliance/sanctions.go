@@ -0,0 +1,588 @@
+// sanctions.go - AMMC-issued sanctions and trading restrictions
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Sanction represents a disciplinary measure against a broker or a client
+type Sanction struct {
+	SanctionID  string `json:"sanctionID"`
+	SubjectType string `json:"subjectType"` // broker, client
+	SubjectID   string `json:"subjectID"`
+	Reason      string `json:"reason"`
+	Penalty     Money  `json:"penalty"`
+	Status      string `json:"status"` // active, lifted
+	IssuedBy    string `json:"issuedBy"`
+	IssuedAt    string `json:"issuedAt"`
+	ExpiresAt   string `json:"expiresAt"` // RFC3339, empty for no expiry
+	LiftedAt    string `json:"liftedAt"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// Restriction represents a trading restriction: a restricted security, or a client
+// placed on the insider blackout list of an issuer
+type Restriction struct {
+	RestrictionID   string `json:"restrictionID"`
+	RestrictionType string `json:"restrictionType"` // security, blackout
+	SecurityID      string `json:"securityID"`      // for security restrictions
+	IssuerID        string `json:"issuerID"`        // for blackouts
+	BrokerID        string `json:"brokerID"`        // for blackouts, the client's broker (empty for any broker)
+	ClientID        string `json:"clientID"`        // for blackouts
+	Reason          string `json:"reason"`
+	Status          string `json:"status"` // active, lifted
+	IssuedBy        string `json:"issuedBy"`
+	IssuedAt        string `json:"issuedAt"`
+	ExpiresAt       string `json:"expiresAt"` // RFC3339, empty for no expiry
+	LiftedAt        string `json:"liftedAt"`
+}
+
+// Blackout is a client barred from trading the securities of an issuer
+type Blackout struct {
+	BrokerID string `json:"brokerID"`
+	ClientID string `json:"clientID"`
+	IssuerID string `json:"issuerID"`
+}
+
+// RestrictionSet is the full set of restrictions in force at a point in time
+type RestrictionSet struct {
+	RestrictedSecurities []string   `json:"restrictedSecurities"`
+	SanctionedBrokers    []string   `json:"sanctionedBrokers"`
+	SanctionedClients    []string   `json:"sanctionedClients"`
+	Blackouts            []Blackout `json:"blackouts"`
+	GeneratedAt          string     `json:"generatedAt"`
+}
+
+// isActive reports whether a measure with the given status and expiry is in force at now
+func isActive(status, expiresAt string, now time.Time) (bool, error) {
+	if status != "active" {
+		return false, nil
+	}
+	if expiresAt == "" {
+		return true, nil
+	}
+
+	expiry, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return false, fmt.Errorf("invalid expiry date %s: %v", expiresAt, err)
+	}
+
+	return now.Before(expiry), nil
+}
+
+// validateExpiry checks that an optional expiry date is a valid RFC3339 time in the future
+func validateExpiry(expiresAt string, now time.Time) error {
+	if expiresAt == "" {
+		return nil
+	}
+
+	expiry, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return fmt.Errorf("expiry date must be in RFC3339 format: %v", err)
+	}
+	if !expiry.After(now) {
+		return fmt.Errorf("expiry date must be in the future")
+	}
+
+	return nil
+}
+
+// IssueSanction sanctions a broker or a client. expiresAt is an RFC3339 time, or empty
+// for a sanction that stays in force until it is lifted. The penalty is in centimes.
+func (c *ComplianceContract) IssueSanction(ctx contractapi.TransactionContextInterface, sanctionID, subjectType, subjectID, reason string, penaltyCentimes int64, expiresAt string) error {
+	penalty := Money(penaltyCentimes)
+
+	err := c.requireRegulator(ctx)
+	if err != nil {
+		return err
+	}
+
+	existingJSON, err := ctx.GetStub().GetState("sanction-" + sanctionID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("sanction %s already exists", sanctionID)
+	}
+
+	if subjectType != "broker" && subjectType != "client" {
+		return fmt.Errorf("invalid subject type: must be 'broker' or 'client'")
+	}
+	if subjectID == "" {
+		return fmt.Errorf("subject ID must not be empty")
+	}
+	if penalty < 0 {
+		return fmt.Errorf("penalty must not be negative")
+	}
+
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = validateExpiry(expiresAt, now)
+	if err != nil {
+		return err
+	}
+
+	mspID, err := c.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	sanction := Sanction{
+		SanctionID:  sanctionID,
+		SubjectType: subjectType,
+		SubjectID:   subjectID,
+		Reason:      reason,
+		Penalty:     penalty,
+		Status:      "active",
+		IssuedBy:    mspID,
+		IssuedAt:    now.Format(time.RFC3339),
+		ExpiresAt:   expiresAt,
+		LiftedAt:    "",
+	}
+
+	sanctionJSON, err := json.Marshal(sanction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal sanction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("sanction-"+sanctionID, sanctionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put sanction in ledger: %v", err)
+	}
+
+	// Emit an event for the new sanction
+	err = ctx.GetStub().SetEvent("SanctionIssued", sanctionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set SanctionIssued event: %v", err)
+	}
+
+	return nil
+}
+
+// GetSanction retrieves a sanction by ID
+func (c *ComplianceContract) GetSanction(ctx contractapi.TransactionContextInterface, sanctionID string) (*Sanction, error) {
+	sanctionJSON, err := ctx.GetStub().GetState("sanction-" + sanctionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if sanctionJSON == nil {
+		return nil, fmt.Errorf("sanction %s does not exist", sanctionID)
+	}
+
+	var sanction Sanction
+	err = json.Unmarshal(sanctionJSON, &sanction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sanction: %v", err)
+	}
+
+	return &sanction, nil
+}
+
+// LiftSanction ends a sanction before its expiry
+func (c *ComplianceContract) LiftSanction(ctx contractapi.TransactionContextInterface, sanctionID string) error {
+	err := c.requireRegulator(ctx)
+	if err != nil {
+		return err
+	}
+
+	sanction, err := c.GetSanction(ctx, sanctionID)
+	if err != nil {
+		return err
+	}
+	if sanction.Status != "active" {
+		return fmt.Errorf("sanction %s is not active", sanctionID)
+	}
+
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	sanction.Status = "lifted"
+	sanction.LiftedAt = now.Format(time.RFC3339)
+
+	sanctionJSON, err := json.Marshal(sanction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal sanction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("sanction-"+sanctionID, sanctionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update sanction in ledger: %v", err)
+	}
+
+	// Emit an event for the lifted sanction
+	err = ctx.GetStub().SetEvent("SanctionLifted", sanctionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set SanctionLifted event: %v", err)
+	}
+
+	return nil
+}
+
+// getAllSanctions retrieves every sanction ever issued
+func (c *ComplianceContract) getAllSanctions(ctx contractapi.TransactionContextInterface) ([]*Sanction, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("sanction-", "sanction-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sanctions: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var sanctions []*Sanction
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate sanctions: %v", err)
+		}
+
+		var sanction Sanction
+		err = json.Unmarshal(queryResponse.Value, &sanction)
+		if err != nil {
+			continue // Skip if not a valid Sanction
+		}
+		sanctions = append(sanctions, &sanction)
+	}
+
+	return sanctions, nil
+}
+
+// GetSanctionsBySubject retrieves all sanctions, active or not, issued against a broker or client
+func (c *ComplianceContract) GetSanctionsBySubject(ctx contractapi.TransactionContextInterface, subjectType, subjectID string) ([]*Sanction, error) {
+	sanctions, err := c.getAllSanctions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Sanction
+	for _, sanction := range sanctions {
+		if sanction.SubjectType == subjectType && sanction.SubjectID == subjectID {
+			result = append(result, sanction)
+		}
+	}
+
+	return result, nil
+}
+
+// GetActiveSanctions retrieves all sanctions in force at the time of the transaction
+func (c *ComplianceContract) GetActiveSanctions(ctx contractapi.TransactionContextInterface) ([]*Sanction, error) {
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sanctions, err := c.getAllSanctions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Sanction
+	for _, sanction := range sanctions {
+		active, err := isActive(sanction.Status, sanction.ExpiresAt, now)
+		if err != nil {
+			return nil, err
+		}
+		if active {
+			result = append(result, sanction)
+		}
+	}
+
+	return result, nil
+}
+
+// IssueRestriction places a trading restriction. For a "security" restriction securityID
+// is required; for a "blackout" clientID and issuerID are required and brokerID may be
+// empty to cover the client at any broker. expiresAt is an RFC3339 time or empty.
+func (c *ComplianceContract) IssueRestriction(ctx contractapi.TransactionContextInterface, restrictionID, restrictionType, securityID, issuerID, brokerID, clientID, reason, expiresAt string) error {
+	err := c.requireRegulator(ctx)
+	if err != nil {
+		return err
+	}
+
+	existingJSON, err := ctx.GetStub().GetState("restriction-" + restrictionID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("restriction %s already exists", restrictionID)
+	}
+
+	switch restrictionType {
+	case "security":
+		if securityID == "" {
+			return fmt.Errorf("security restrictions require a security ID")
+		}
+	case "blackout":
+		if clientID == "" || issuerID == "" {
+			return fmt.Errorf("blackout restrictions require a client ID and an issuer ID")
+		}
+	default:
+		return fmt.Errorf("invalid restriction type: must be 'security' or 'blackout'")
+	}
+
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = validateExpiry(expiresAt, now)
+	if err != nil {
+		return err
+	}
+
+	mspID, err := c.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	restriction := Restriction{
+		RestrictionID:   restrictionID,
+		RestrictionType: restrictionType,
+		SecurityID:      securityID,
+		IssuerID:        issuerID,
+		BrokerID:        brokerID,
+		ClientID:        clientID,
+		Reason:          reason,
+		Status:          "active",
+		IssuedBy:        mspID,
+		IssuedAt:        now.Format(time.RFC3339),
+		ExpiresAt:       expiresAt,
+		LiftedAt:        "",
+	}
+
+	restrictionJSON, err := json.Marshal(restriction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal restriction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("restriction-"+restrictionID, restrictionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put restriction in ledger: %v", err)
+	}
+
+	// Emit an event for the new restriction
+	err = ctx.GetStub().SetEvent("RestrictionIssued", restrictionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set RestrictionIssued event: %v", err)
+	}
+
+	return nil
+}
+
+// GetRestriction retrieves a restriction by ID
+func (c *ComplianceContract) GetRestriction(ctx contractapi.TransactionContextInterface, restrictionID string) (*Restriction, error) {
+	restrictionJSON, err := ctx.GetStub().GetState("restriction-" + restrictionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if restrictionJSON == nil {
+		return nil, fmt.Errorf("restriction %s does not exist", restrictionID)
+	}
+
+	var restriction Restriction
+	err = json.Unmarshal(restrictionJSON, &restriction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal restriction: %v", err)
+	}
+
+	return &restriction, nil
+}
+
+// LiftRestriction ends a restriction before its expiry
+func (c *ComplianceContract) LiftRestriction(ctx contractapi.TransactionContextInterface, restrictionID string) error {
+	err := c.requireRegulator(ctx)
+	if err != nil {
+		return err
+	}
+
+	restriction, err := c.GetRestriction(ctx, restrictionID)
+	if err != nil {
+		return err
+	}
+	if restriction.Status != "active" {
+		return fmt.Errorf("restriction %s is not active", restrictionID)
+	}
+
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	restriction.Status = "lifted"
+	restriction.LiftedAt = now.Format(time.RFC3339)
+
+	restrictionJSON, err := json.Marshal(restriction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal restriction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("restriction-"+restrictionID, restrictionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update restriction in ledger: %v", err)
+	}
+
+	// Emit an event for the lifted restriction
+	err = ctx.GetStub().SetEvent("RestrictionLifted", restrictionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set RestrictionLifted event: %v", err)
+	}
+
+	return nil
+}
+
+// GetActiveRestrictions retrieves all restrictions in force at the time of the transaction
+func (c *ComplianceContract) GetActiveRestrictions(ctx contractapi.TransactionContextInterface) ([]*Restriction, error) {
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange("restriction-", "restriction-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get restrictions: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var restrictions []*Restriction
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate restrictions: %v", err)
+		}
+
+		var restriction Restriction
+		err = json.Unmarshal(queryResponse.Value, &restriction)
+		if err != nil {
+			continue // Skip if not a valid Restriction
+		}
+
+		active, err := isActive(restriction.Status, restriction.ExpiresAt, now)
+		if err != nil {
+			return nil, err
+		}
+		if active {
+			restrictions = append(restrictions, &restriction)
+		}
+	}
+
+	return restrictions, nil
+}
+
+// GetRestrictionSet assembles every restriction in force: restricted or suspended securities,
+// sanctioned or unlicensed brokers, sanctioned clients and insider blackouts
+func (c *ComplianceContract) GetRestrictionSet(ctx contractapi.TransactionContextInterface) (*RestrictionSet, error) {
+	now, err := c.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	securities := make(map[string]bool)
+	brokers := make(map[string]bool)
+	clients := make(map[string]bool)
+	set := RestrictionSet{
+		Blackouts:   []Blackout{},
+		GeneratedAt: now.Format(time.RFC3339),
+	}
+
+	registered, err := c.GetAllSecurities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, security := range registered {
+		if security.Restricted || security.Status != "approved" {
+			securities[security.SecurityID] = true
+		}
+	}
+
+	licensed, err := c.GetAllBrokers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, broker := range licensed {
+		if broker.Status != "licensed" {
+			brokers[broker.BrokerID] = true
+		}
+	}
+
+	sanctions, err := c.GetActiveSanctions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, sanction := range sanctions {
+		if sanction.SubjectType == "broker" {
+			brokers[sanction.SubjectID] = true
+		} else {
+			clients[sanction.SubjectID] = true
+		}
+	}
+
+	restrictions, err := c.GetActiveRestrictions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, restriction := range restrictions {
+		if restriction.RestrictionType == "security" {
+			securities[restriction.SecurityID] = true
+		} else {
+			set.Blackouts = append(set.Blackouts, Blackout{
+				BrokerID: restriction.BrokerID,
+				ClientID: restriction.ClientID,
+				IssuerID: restriction.IssuerID,
+			})
+		}
+	}
+
+	set.RestrictedSecurities = sortedKeys(securities)
+	set.SanctionedBrokers = sortedKeys(brokers)
+	set.SanctionedClients = sortedKeys(clients)
+
+	return &set, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RestrictionSet) isSecurityRestricted(securityID string) bool {
+	return contains(r.RestrictedSecurities, securityID)
+}
+
+func (r *RestrictionSet) isBrokerSanctioned(brokerID string) bool {
+	return contains(r.SanctionedBrokers, brokerID)
+}
+
+func (r *RestrictionSet) isClientSanctioned(clientID string) bool {
+	return contains(r.SanctionedClients, clientID)
+}
+
+func (r *RestrictionSet) isClientBlackedOut(brokerID, clientID, issuerID string) bool {
+	for _, blackout := range r.Blackouts {
+		if blackout.ClientID == clientID && blackout.IssuerID == issuerID &&
+			(blackout.BrokerID == "" || blackout.BrokerID == brokerID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+// buyin.go - Buy-in orders placed for buyers whose seller failed to deliver
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// CreateBuyInOrder places the buy-in order of a settlement instruction whose seller failed
+// to deliver, as a buy order for the instruction's buyer. buyInID, the quantity and the
+// limit price (in centimes) come from the BuyInOpened event on the settlement channel; the
+// buy-in ID is also the order ID. Only the stock market can place buy-in orders, and the
+// trades they match carry the buy-in ID back to settlement.
+func (c *OrderMatchingContract) CreateBuyInOrder(ctx contractapi.TransactionContextInterface, buyInID, brokerID, clientID, securityID string, quantity int, limitPriceCentimes int64) error {
+	limitPrice := Money(limitPriceCentimes)
+
+	mspID, err := c.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != "StockMarketMSP" {
+		return fmt.Errorf("only the stock market is authorized to create buy-in orders")
+	}
+
+	if quantity <= 0 {
+		return fmt.Errorf("quantity must be positive")
+	}
+	if limitPrice <= 0 {
+		return fmt.Errorf("price must be positive")
+	}
+
+	currentTime, err := c.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	order := Order{
+		OrderID:      buyInID,
+		BrokerID:     brokerID,
+		ClientID:     clientID,
+		SecurityID:   securityID,
+		Side:         "buy",
+		Quantity:     quantity,
+		Price:        limitPrice,
+		Status:       "pending",
+		CreateTime:   currentTime,
+		UpdateTime:   currentTime,
+		RemainingQty: quantity,
+		BuyInID:      buyInID,
+	}
+
+	return c.submitOrder(ctx, &order, mspID)
+}
@@ -0,0 +1,43 @@
+// buyin_test.go - Tests of buy-in orders
+package main
+
+import (
+	"testing"
+)
+
+// listSecurity lists SEC001 at 1.00
+func listSecurity(t *testing.T, l *mockLedger) {
+	t.Helper()
+	c := &OrderMatchingContract{}
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		return c.CreateSecurity(ctx, "SEC001", "ATW", "ISS001", "Attijariwafa", 1000, 100)
+	})
+}
+
+func TestCreateBuyInOrder(t *testing.T) {
+	l := newLedger()
+	c := &OrderMatchingContract{}
+	listSecurity(t, l)
+
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error {
+		return c.CreateBuyInOrder(ctx, "buyin-1", "broker1", "C1", "SEC001", 10, 120)
+	})
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		return c.CreateBuyInOrder(ctx, "buyin-1", "broker1", "C1", "SEC001", 10, 120)
+	})
+
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		order, err := c.GetOrder(ctx, "buyin-1")
+		if err != nil {
+			return err
+		}
+		if order.Side != "buy" || order.BuyInID != "buyin-1" || order.Price != 120 || order.RemainingQty != 10 {
+			t.Errorf("buy-in order = %+v", order)
+		}
+		// Every endorser stamps the order with the proposal's time
+		if order.CreateTime != "2026-03-02T09:00:00Z" || order.UpdateTime != order.CreateTime {
+			t.Errorf("buy-in order created at %s, updated at %s", order.CreateTime, order.UpdateTime)
+		}
+		return nil
+	})
+}
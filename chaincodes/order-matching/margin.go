@@ -0,0 +1,152 @@
+// margin.go - Brokers restricted for missing a margin call on the settlement channel
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// MarginRestriction is a broker that missed a margin call, relayed by the stock market
+// from the MarginCallsEnforced event of the settlement channel
+type MarginRestriction struct {
+	BrokerID     string `json:"brokerID"`
+	CallID       string `json:"callID"`
+	RestrictedAt string `json:"restrictedAt"`
+	RelayedBy    string `json:"relayedBy"`
+	TxID         string `json:"txID"`
+}
+
+// marginRestrictionObjectType is the composite key object type of margin restrictions
+const marginRestrictionObjectType = "marginRestriction"
+
+// RestrictBroker bars a broker that missed a margin call from placing new orders
+func (c *OrderMatchingContract) RestrictBroker(ctx contractapi.TransactionContextInterface, brokerID, callID string) error {
+	mspID, err := c.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != "StockMarketMSP" {
+		return fmt.Errorf("only the stock market is authorized to restrict brokers")
+	}
+
+	restrictedAt, err := c.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	restriction := MarginRestriction{
+		BrokerID:     brokerID,
+		CallID:       callID,
+		RestrictedAt: restrictedAt,
+		RelayedBy:    mspID,
+		TxID:         ctx.GetStub().GetTxID(),
+	}
+
+	restrictionJSON, err := json.Marshal(restriction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal margin restriction: %v", err)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(marginRestrictionObjectType, []string{strings.ToLower(brokerID)})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, restrictionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put margin restriction in ledger: %v", err)
+	}
+
+	// Emit an event for the restricted broker
+	err = ctx.GetStub().SetEvent("BrokerRestricted", restrictionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set BrokerRestricted event: %v", err)
+	}
+
+	return nil
+}
+
+// LiftBrokerRestriction lets a broker place orders again once it met its margin call
+func (c *OrderMatchingContract) LiftBrokerRestriction(ctx contractapi.TransactionContextInterface, brokerID string) error {
+	mspID, err := c.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != "StockMarketMSP" {
+		return fmt.Errorf("only the stock market is authorized to lift broker restrictions")
+	}
+
+	restriction, err := c.marginRestriction(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+	if restriction == nil {
+		return fmt.Errorf("broker %s is not restricted", brokerID)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(marginRestrictionObjectType, []string{strings.ToLower(brokerID)})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete margin restriction: %v", err)
+	}
+
+	return nil
+}
+
+// marginRestriction returns a broker's margin restriction, nil if it is not restricted.
+// Broker IDs are compared case-insensitively, as for the AMMC restriction set.
+func (c *OrderMatchingContract) marginRestriction(ctx contractapi.TransactionContextInterface, brokerID string) (*MarginRestriction, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(marginRestrictionObjectType, []string{strings.ToLower(brokerID)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	restrictionJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if restrictionJSON == nil {
+		return nil, nil
+	}
+
+	var restriction MarginRestriction
+	err = json.Unmarshal(restrictionJSON, &restriction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal margin restriction: %v", err)
+	}
+
+	return &restriction, nil
+}
+
+// GetMarginRestrictions retrieves every broker restricted for missing a margin call
+func (c *OrderMatchingContract) GetMarginRestrictions(ctx contractapi.TransactionContextInterface) ([]*MarginRestriction, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(marginRestrictionObjectType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get margin restrictions: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	restrictions := []*MarginRestriction{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate margin restrictions: %v", err)
+		}
+
+		var restriction MarginRestriction
+		err = json.Unmarshal(queryResponse.Value, &restriction)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal margin restriction: %v", err)
+		}
+		restrictions = append(restrictions, &restriction)
+	}
+
+	return restrictions, nil
+}
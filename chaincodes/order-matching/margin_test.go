@@ -0,0 +1,64 @@
+// margin_test.go - Tests of brokers restricted for missing a margin call
+package main
+
+import (
+	"testing"
+)
+
+// orderStatus returns the status of an order
+func orderStatus(t *testing.T, l *mockLedger, orderID string) string {
+	t.Helper()
+	c := &OrderMatchingContract{}
+
+	var status string
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		order, err := c.GetOrder(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		status = order.Status
+		return nil
+	})
+	return status
+}
+
+func TestRestrictedBrokerCanOnlyPlaceBuyIns(t *testing.T) {
+	l := newLedger()
+	c := &OrderMatchingContract{}
+	listSecurity(t, l)
+
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error { return c.RestrictBroker(ctx, "broker1", "call-1") })
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error { return c.RestrictBroker(ctx, "broker1", "call-1") })
+
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		restrictions, err := c.GetMarginRestrictions(ctx)
+		if err != nil {
+			return err
+		}
+		if len(restrictions) != 1 || restrictions[0].CallID != "call-1" || restrictions[0].RestrictedAt != "2026-03-02T09:00:00Z" {
+			t.Errorf("margin restrictions = %+v", restrictions)
+		}
+		return nil
+	})
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		return c.CreateOrder(ctx, "order-1", "broker1", "C1", "SEC001", "buy", 10, 100)
+	})
+	if status := orderStatus(t, l, "order-1"); status != "rejected" {
+		t.Fatalf("order of restricted broker is %s, want rejected", status)
+	}
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		return c.CreateBuyInOrder(ctx, "buyin-1", "broker1", "C1", "SEC001", 10, 120)
+	})
+	if status := orderStatus(t, l, "buyin-1"); status != "pending" {
+		t.Fatalf("buy-in order of restricted broker is %s, want pending", status)
+	}
+
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error { return c.LiftBrokerRestriction(ctx, "broker1") })
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		return c.CreateOrder(ctx, "order-2", "broker1", "C1", "SEC001", "buy", 10, 100)
+	})
+	if status := orderStatus(t, l, "order-2"); status != "pending" {
+		t.Fatalf("order after restriction was lifted is %s, want pending", status)
+	}
+}
@@ -0,0 +1,195 @@
+// mockstub_test.go - In-memory ledger for the order matching contract tests
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+)
+
+// txCtx is the transaction context passed to the contract in tests
+type txCtx = contractapi.TransactionContextInterface
+
+// mockLedger is the committed world state of a channel. As on Fabric, a transaction does
+// not read its own writes: they are only committed once it succeeds.
+type mockLedger struct {
+	state      map[string][]byte
+	now        time.Time
+	txCount    int
+	events     []string
+	lastEvents map[string][]byte // last payload by event name
+}
+
+// newLedger returns an empty ledger whose clock is a Monday morning
+func newLedger() *mockLedger {
+	return &mockLedger{
+		state:      map[string][]byte{},
+		now:        time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC),
+		lastEvents: map[string][]byte{},
+	}
+}
+
+// mockStub is the stub of one transaction. Writes are buffered until commit.
+type mockStub struct {
+	shim.ChaincodeStubInterface
+	ledger       *mockLedger
+	writes       map[string][]byte
+	txID         string
+	timestamp    time.Time
+	eventName    string
+	eventPayload []byte
+}
+
+// mockIterator iterates over a sorted range of keys
+type mockIterator struct {
+	keys   []string
+	values map[string][]byte
+	next   int
+}
+
+func (it *mockIterator) HasNext() bool { return it.next < len(it.keys) }
+func (it *mockIterator) Close() error  { return nil }
+func (it *mockIterator) Next() (*queryresult.KV, error) {
+	key := it.keys[it.next]
+	it.next++
+	return &queryresult.KV{Key: key, Value: it.values[key]}, nil
+}
+
+// rangeOf returns the keys in [start, end), composite keys only when asked for
+func rangeOf(values map[string][]byte, start, end string, composite bool) *mockIterator {
+	it := &mockIterator{values: values}
+	for key := range values {
+		if strings.HasPrefix(key, "\x00") != composite {
+			continue
+		}
+		if key >= start && (end == "" || key < end) {
+			it.keys = append(it.keys, key)
+		}
+	}
+	sort.Strings(it.keys)
+	return it
+}
+
+func (s *mockStub) GetTxID() string                     { return s.txID }
+func (s *mockStub) GetState(key string) ([]byte, error) { return s.ledger.state[key], nil }
+
+func (s *mockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.timestamp.Unix(), Nanos: int32(s.timestamp.Nanosecond())}, nil
+}
+
+func (s *mockStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("empty key")
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *mockStub) DelState(key string) error {
+	s.writes[key] = nil
+	return nil
+}
+
+func (s *mockStub) GetStateByRange(start, end string) (shim.StateQueryIteratorInterface, error) {
+	return rangeOf(s.ledger.state, start, end, false), nil
+}
+
+func (s *mockStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return "\x00" + objectType + "\x00" + strings.Join(attributes, "\x00") + "\x00", nil
+}
+
+func (s *mockStub) SplitCompositeKey(key string) (string, []string, error) {
+	parts := strings.Split(strings.Trim(key, "\x00"), "\x00")
+	return parts[0], parts[1:], nil
+}
+
+func (s *mockStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, _ := s.CreateCompositeKey(objectType, attributes)
+	if len(attributes) == 0 {
+		prefix = "\x00" + objectType + "\x00"
+	}
+	return rangeOf(s.ledger.state, prefix, prefix+"\U0010ffff", true), nil
+}
+
+func (s *mockStub) SetEvent(name string, payload []byte) error {
+	s.eventName, s.eventPayload = name, payload
+	return nil
+}
+
+// mockIdentity is a client of an organization
+type mockIdentity struct{ mspID string }
+
+func (id *mockIdentity) GetID() (string, error)                         { return "client-" + id.mspID, nil }
+func (id *mockIdentity) GetMSPID() (string, error)                      { return id.mspID, nil }
+func (id *mockIdentity) GetAttributeValue(string) (string, bool, error) { return "", false, nil }
+func (id *mockIdentity) AssertAttributeValue(string, string) error      { return nil }
+func (id *mockIdentity) GetX509Certificate() (*x509.Certificate, error) { return nil, nil }
+
+// mockContext is the transaction context
+type mockContext struct {
+	stub     *mockStub
+	identity cid.ClientIdentity
+}
+
+func (ctx *mockContext) GetStub() shim.ChaincodeStubInterface  { return ctx.stub }
+func (ctx *mockContext) GetClientIdentity() cid.ClientIdentity { return ctx.identity }
+
+// tx runs fn as one transaction submitted by an organization, and commits its writes
+// only if it succeeds
+func (l *mockLedger) tx(t *testing.T, mspID string, fn func(ctx txCtx) error) error {
+	t.Helper()
+	l.txCount++
+	stub := &mockStub{
+		ledger:    l,
+		writes:    map[string][]byte{},
+		txID:      fmt.Sprintf("tx%04d", l.txCount),
+		timestamp: l.now,
+	}
+
+	err := fn(&mockContext{stub: stub, identity: &mockIdentity{mspID: mspID}})
+	if err != nil {
+		return err
+	}
+
+	for key, value := range stub.writes {
+		if value == nil {
+			delete(l.state, key)
+		} else {
+			l.state[key] = value
+		}
+	}
+	if stub.eventName != "" {
+		l.events = append(l.events, stub.eventName)
+		l.lastEvents[stub.eventName] = stub.eventPayload
+	}
+
+	return nil
+}
+
+// must runs a transaction that has to succeed
+func (l *mockLedger) must(t *testing.T, mspID string, fn func(ctx txCtx) error) {
+	t.Helper()
+	err := l.tx(t, mspID, fn)
+	if err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+}
+
+// mustFail runs a transaction that has to fail, and returns its error
+func (l *mockLedger) mustFail(t *testing.T, mspID string, fn func(ctx txCtx) error) error {
+	t.Helper()
+	err := l.tx(t, mspID, fn)
+	if err == nil {
+		t.Fatalf("transaction succeeded, expected it to fail")
+	}
+	return err
+}
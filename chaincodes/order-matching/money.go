@@ -0,0 +1,243 @@
+// money.go - Fixed-point prices and migration of float-valued state
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Money is a price or cash amount in Moroccan dirhams held as an integer number of
+// centimes (minor units, MoneyScale decimal places). It is encoded in JSON and passed to
+// chaincode functions as that integer, e.g. a price of 150.25 MAD is 15025.
+//
+// Rounding rules: prices are compared and copied exactly and are never rounded
+// implicitly. The only rounding happens when float-valued state written before this
+// type existed is migrated, which rounds half away from zero to the centime.
+type Money int64
+
+// MoneyScale is the number of decimal places in a Money amount (1 MAD = 100 centimes)
+const MoneyScale = 2
+
+// moneyUnit is the number of minor units in one dirham
+const moneyUnit = 100
+
+// String formats the amount in dirhams, e.g. 15025 -> "150.25"
+func (m Money) String() string {
+	sign := ""
+	units := int64(m)
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, units/moneyUnit, MoneyScale, units%moneyUnit)
+}
+
+// moneySchemaObjectType is the composite key object type of the migration marker
+const moneySchemaObjectType = "moneySchema"
+
+// legacyAmountToMoney converts a float amount in dirhams, as written by earlier versions
+// of the chaincode, to Money. The decimal text is rounded half away from zero to the
+// centime without going through float arithmetic, so 150.24999999999997 becomes 15025.
+func legacyAmountToMoney(text string) (Money, error) {
+	if strings.ContainsAny(text, "eE") {
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid amount %s: %v", text, err)
+		}
+		return Money(math.Round(f * moneyUnit)), nil
+	}
+
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimPrefix(text, "-")
+
+	whole, fraction := text, ""
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		whole, fraction = text[:i], text[i+1:]
+	}
+
+	roundUp := len(fraction) > MoneyScale && fraction[MoneyScale] >= '5'
+	for len(fraction) < MoneyScale {
+		fraction += "0"
+	}
+
+	units, err := strconv.ParseInt(whole+fraction[:MoneyScale], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %s: %v", text, err)
+	}
+	if roundUp {
+		units++
+	}
+	if negative {
+		units = -units
+	}
+
+	return Money(units), nil
+}
+
+// moneySchemaCentimes is the version of stored records whose amounts are Money. Records
+// written before amounts became Money carry no version.
+const moneySchemaCentimes = 1
+
+// MoneySchema tags a stored record with the version of its amounts, so the migration can
+// skip records that are already in centimes. It always encodes as moneySchemaCentimes.
+type MoneySchema int
+
+// MarshalJSON encodes the current version, whatever version the record was read with
+func (MoneySchema) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Itoa(moneySchemaCentimes)), nil
+}
+
+// legacyMoneyFields are the JSON fields that held float prices before prices became Money
+var legacyMoneyFields = []string{"price", "currentPrice", "priceHistory"}
+
+// migrateMoneyJSON rewrites the float prices of a stored record as centimes.
+// It reports false when the record holds no float prices and needs no rewrite,
+// or when it is tagged with a MoneySchema and already in centimes.
+func migrateMoneyJSON(value []byte) ([]byte, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+
+	var record map[string]interface{}
+	if err := decoder.Decode(&record); err != nil {
+		return nil, false, nil // Not a JSON object, nothing to migrate
+	}
+	if _, ok := record["moneySchema"]; ok {
+		return nil, false, nil // Written in centimes
+	}
+
+	changed := false
+	for _, field := range legacyMoneyFields {
+		switch amount := record[field].(type) {
+		case json.Number:
+			converted, err := legacyAmountToMoney(amount.String())
+			if err != nil {
+				return nil, false, err
+			}
+			record[field] = int64(converted)
+			changed = true
+
+		case []interface{}:
+			for i, item := range amount {
+				number, ok := item.(json.Number)
+				if !ok {
+					continue
+				}
+				converted, err := legacyAmountToMoney(number.String())
+				if err != nil {
+					return nil, false, err
+				}
+				amount[i] = int64(converted)
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return nil, false, nil
+	}
+	record["moneySchema"] = moneySchemaCentimes
+
+	migrated, err := json.Marshal(record)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal migrated record: %v", err)
+	}
+
+	return migrated, true, nil
+}
+
+// MigrateMoneyState converts the float prices of securities, orders, trades and order
+// rejections in the world state to centimes. It can only be run once, by the stock
+// market; records written since carry a MoneySchema and are skipped.
+func (c *OrderMatchingContract) MigrateMoneyState(ctx contractapi.TransactionContextInterface) (int, error) {
+	mspID, err := c.getClientOrgID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if mspID != "StockMarketMSP" {
+		return 0, fmt.Errorf("only the stock market can migrate ledger prices")
+	}
+
+	markerKey, err := ctx.GetStub().CreateCompositeKey(moneySchemaObjectType, []string{"current"})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	markerJSON, err := ctx.GetStub().GetState(markerKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if markerJSON != nil {
+		return 0, fmt.Errorf("ledger prices have already been migrated to centimes")
+	}
+
+	migrated := 0
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get world state: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	// Composite keys are not returned by the plain range scan, so rejections are scanned separately
+	rejectionsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderRejectionObjectType, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get order rejections: %v", err)
+	}
+	defer rejectionsIterator.Close()
+
+	for _, iterator := range []shim.StateQueryIteratorInterface{resultsIterator, rejectionsIterator} {
+		for iterator.HasNext() {
+			queryResponse, err := iterator.Next()
+			if err != nil {
+				return 0, fmt.Errorf("failed to iterate world state: %v", err)
+			}
+
+			value, changed, err := migrateMoneyJSON(queryResponse.Value)
+			if err != nil {
+				return 0, fmt.Errorf("failed to migrate %s: %v", queryResponse.Key, err)
+			}
+			if !changed {
+				continue
+			}
+
+			err = ctx.GetStub().PutState(queryResponse.Key, value)
+			if err != nil {
+				return 0, fmt.Errorf("failed to update %s in ledger: %v", queryResponse.Key, err)
+			}
+			migrated++
+		}
+	}
+
+	marker := struct {
+		Scale       int    `json:"scale"`
+		Records     int    `json:"records"`
+		MigratedBy  string `json:"migratedBy"`
+		TxID        string `json:"txID"`
+		Description string `json:"description"`
+	}{
+		Scale:       MoneyScale,
+		Records:     migrated,
+		MigratedBy:  mspID,
+		TxID:        ctx.GetStub().GetTxID(),
+		Description: "prices are integer centimes",
+	}
+
+	markerJSON, err = json.Marshal(marker)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal migration marker: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(markerKey, markerJSON)
+	if err != nil {
+		return 0, fmt.Errorf("failed to put migration marker in ledger: %v", err)
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,52 @@
+// money_test.go - Tests of the migration of float-valued prices
+package main
+
+import (
+	"testing"
+)
+
+func TestMigrateMoneyStateSkipsRecordsInCentimes(t *testing.T) {
+	l := newLedger()
+	c := &OrderMatchingContract{}
+	listSecurity(t, l)
+
+	// Records left by the float-valued chaincode
+	l.state["SEC009"] = []byte(`{"securityID":"SEC009","currentPrice":150.25,"priceHistory":[150,150.249999999],"status":"active"}`)
+	l.state["\x00orderRejection\x00order-9\x00"] = []byte(`{"orderID":"order-9","price":12.5}`)
+
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error {
+		_, err := c.MigrateMoneyState(ctx)
+		return err
+	})
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		migrated, err := c.MigrateMoneyState(ctx)
+		if migrated != 2 {
+			t.Errorf("migrated %d records, want 2", migrated)
+		}
+		return err
+	})
+
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		listed, err := c.GetSecurity(ctx, "SEC001")
+		if err != nil {
+			return err
+		}
+		if listed.CurrentPrice != 100 {
+			t.Errorf("price in centimes became %d", listed.CurrentPrice)
+		}
+
+		legacy, err := c.GetSecurity(ctx, "SEC009")
+		if err != nil {
+			return err
+		}
+		if legacy.CurrentPrice != 15025 || len(legacy.PriceHistory) != 2 || legacy.PriceHistory[1] != 15025 {
+			t.Errorf("migrated security = %+v", legacy)
+		}
+		return nil
+	})
+
+	l.mustFail(t, "StockMarketMSP", func(ctx txCtx) error {
+		_, err := c.MigrateMoneyState(ctx)
+		return err
+	})
+}
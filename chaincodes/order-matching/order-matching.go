@@ -17,43 +17,68 @@ type OrderMatchingContract struct {
 
 // Security represents a listed security in the stock market
 type Security struct {
-	SecurityID     string    `json:"securityID"`
-	Symbol         string    `json:"symbol"`
-	IssuerID       string    `json:"issuerID"`
-	Name           string    `json:"name"`
-	TotalShares    int       `json:"totalShares"`
-	CurrentPrice   float64   `json:"currentPrice"`
-	PriceHistory   []float64 `json:"priceHistory"`
-	Status         string    `json:"status"` // active, suspended, delisted
-	LastUpdateTime string    `json:"lastUpdateTime"`
+	SecurityID     string  `json:"securityID"`
+	Symbol         string  `json:"symbol"`
+	IssuerID       string  `json:"issuerID"`
+	Name           string  `json:"name"`
+	TotalShares    int     `json:"totalShares"`
+	CurrentPrice   Money   `json:"currentPrice"`
+	PriceHistory   []Money `json:"priceHistory"`
+	Status         string  `json:"status"` // active, suspended, delisted
+	LastUpdateTime string  `json:"lastUpdateTime"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
 }
 
 // Order represents a buy or sell order in the stock market
 type Order struct {
-	OrderID      string  `json:"orderID"`
-	BrokerID     string  `json:"brokerID"`
-	SecurityID   string  `json:"securityID"`
-	Side         string  `json:"side"` // buy or sell
-	Quantity     int     `json:"quantity"`
-	Price        float64 `json:"price"`
-	Status       string  `json:"status"` // pending, matched, executed, canceled
-	CreateTime   string  `json:"createTime"`
-	UpdateTime   string  `json:"updateTime"`
-	RemainingQty int     `json:"remainingQty"`
+	OrderID      string `json:"orderID"`
+	BrokerID     string `json:"brokerID"`
+	ClientID     string `json:"clientID"` // empty for the broker's own (house) orders
+	SecurityID   string `json:"securityID"`
+	Side         string `json:"side"` // buy or sell
+	Quantity     int    `json:"quantity"`
+	Price        Money  `json:"price"`
+	Status       string `json:"status"` // pending, matched, executed, canceled, rejected
+	CreateTime   string `json:"createTime"`
+	UpdateTime   string `json:"updateTime"`
+	RemainingQty int    `json:"remainingQty"`
+	BuyInID      string `json:"buyInID"`  // set on buy-in orders (see buyin.go)
+	Sequence     int64  `json:"sequence"` // order of arrival in the book, from 1
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// arrivedBefore tells whether an order reached the book before another. Orders stored
+// before sequences were kept have none and compare by creation time.
+func (order *Order) arrivedBefore(other *Order) bool {
+	if order.Sequence != 0 && other.Sequence != 0 {
+		return order.Sequence < other.Sequence
+	}
+	if order.CreateTime != other.CreateTime {
+		return order.CreateTime < other.CreateTime
+	}
+	return order.Sequence < other.Sequence
 }
 
 // Trade represents a matched trade between buy and sell orders
 type Trade struct {
-	TradeID      string  `json:"tradeID"`
-	BuyOrderID   string  `json:"buyOrderID"`
-	SellOrderID  string  `json:"sellOrderID"`
-	BuyBrokerID  string  `json:"buyBrokerID"`
-	SellBrokerID string  `json:"sellBrokerID"`
-	SecurityID   string  `json:"securityID"`
-	Quantity     int     `json:"quantity"`
-	Price        float64 `json:"price"`
-	Status       string  `json:"status"` // pending, settled
-	MatchTime    string  `json:"matchTime"`
+	TradeID      string `json:"tradeID"`
+	BuyOrderID   string `json:"buyOrderID"`
+	SellOrderID  string `json:"sellOrderID"`
+	BuyBrokerID  string `json:"buyBrokerID"`
+	SellBrokerID string `json:"sellBrokerID"`
+	BuyClientID  string `json:"buyClientID"`
+	SellClientID string `json:"sellClientID"`
+	SecurityID   string `json:"securityID"`
+	Quantity     int    `json:"quantity"`
+	Price        Money  `json:"price"`
+	Status       string `json:"status"` // pending, settled
+	MatchTime    string `json:"matchTime"`
+	BuyInID      string `json:"buyInID"`   // set when the buy order was a buy-in order
+	MakerSide    string `json:"makerSide"` // buy, sell: the side of the order that rested first
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
 }
 
 // function to get the caller's organization
@@ -69,14 +94,25 @@ func (c *OrderMatchingContract) getClientOrgID(ctx contractapi.TransactionContex
 	return mspID, nil
 }
 
+// function to get the transaction's timestamp, which every endorser agrees on
+func (c *OrderMatchingContract) getTransactionTimestamp(ctx contractapi.TransactionContextInterface) (string, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC().Format(time.RFC3339), nil
+}
+
 // InitLedger initializes the ledger with sample data
 func (c *OrderMatchingContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
 	// Initialize with empty data
 	return nil
 }
 
-// CreateSecurity creates a new security in the ledger
-func (c *OrderMatchingContract) CreateSecurity(ctx contractapi.TransactionContextInterface, securityID, symbol, issuerID, name string, totalShares int, initialPrice float64) error {
+// CreateSecurity creates a new security in the ledger (initial price in centimes)
+func (c *OrderMatchingContract) CreateSecurity(ctx contractapi.TransactionContextInterface, securityID, symbol, issuerID, name string, totalShares int, initialPriceCentimes int64) error {
+	initialPrice := Money(initialPriceCentimes)
+
 	exists, err := c.SecurityExists(ctx, securityID)
 	if err != nil {
 		return fmt.Errorf("failed to check if security exists: %v", err)
@@ -92,7 +128,7 @@ func (c *OrderMatchingContract) CreateSecurity(ctx contractapi.TransactionContex
 		Name:           name,
 		TotalShares:    totalShares,
 		CurrentPrice:   initialPrice,
-		PriceHistory:   []float64{initialPrice},
+		PriceHistory:   []Money{initialPrice},
 		Status:         "active",
 		LastUpdateTime: time.Now().Format(time.RFC3339),
 	}
@@ -179,7 +215,11 @@ func (c *OrderMatchingContract) UpdateSecurityStatus(ctx contractapi.Transaction
 }
 
 // CreateOrder creates a new order in the ledger
-func (c *OrderMatchingContract) CreateOrder(ctx contractapi.TransactionContextInterface, orderID, brokerID, securityID, side string, quantity int, price float64) error {
+// clientID identifies the broker's client (beneficial owner); leave it empty for house orders.
+// The limit price is in centimes.
+// Orders that breach the AMMC restriction set are stored with status "rejected".
+func (c *OrderMatchingContract) CreateOrder(ctx contractapi.TransactionContextInterface, orderID, brokerID, clientID, securityID, side string, quantity int, priceCentimes int64) error {
+	price := Money(priceCentimes)
 
 	// Check caller's organization
 	mspID, err := c.getClientOrgID(ctx)
@@ -198,15 +238,6 @@ func (c *OrderMatchingContract) CreateOrder(ctx contractapi.TransactionContextIn
 		return fmt.Errorf("brokers can only submit orders for themselves")
 	}
 
-	// Check if the order already exists
-	exists, err := c.OrderExists(ctx, orderID)
-	if err != nil {
-		return fmt.Errorf("failed to check if order exists: %v", err)
-	}
-	if exists {
-		return fmt.Errorf("order %s already exists", orderID)
-	}
-
 	// Validate order type
 	if side != "buy" && side != "sell" {
 		return fmt.Errorf("order side must be 'buy' or 'sell'")
@@ -220,20 +251,15 @@ func (c *OrderMatchingContract) CreateOrder(ctx contractapi.TransactionContextIn
 		return fmt.Errorf("price must be positive")
 	}
 
-	// Verify the security exists and is active
-	security, err := c.GetSecurity(ctx, securityID)
+	// Create order object
+	currentTime, err := c.getTransactionTimestamp(ctx)
 	if err != nil {
 		return err
 	}
-	if security.Status != "active" {
-		return fmt.Errorf("security %s is not active for trading", securityID)
-	}
-
-	// Create order object
-	currentTime := time.Now().Format(time.RFC3339)
 	order := Order{
 		OrderID:      orderID,
 		BrokerID:     brokerID,
+		ClientID:     clientID,
 		SecurityID:   securityID,
 		Side:         side,
 		Quantity:     quantity,
@@ -244,13 +270,68 @@ func (c *OrderMatchingContract) CreateOrder(ctx contractapi.TransactionContextIn
 		RemainingQty: quantity,
 	}
 
+	return c.submitOrder(ctx, &order, mspID)
+}
+
+// submitOrder checks a new order against the security and the AMMC restriction set and
+// stores it
+func (c *OrderMatchingContract) submitOrder(ctx contractapi.TransactionContextInterface, order *Order, mspID string) error {
+	// Check if the order already exists
+	exists, err := c.OrderExists(ctx, order.OrderID)
+	if err != nil {
+		return fmt.Errorf("failed to check if order exists: %v", err)
+	}
+	if exists {
+		return fmt.Errorf("order %s already exists", order.OrderID)
+	}
+
+	// Verify the security exists and is active
+	security, err := c.GetSecurity(ctx, order.SecurityID)
+	if err != nil {
+		return err
+	}
+	if security.Status != "active" {
+		return fmt.Errorf("security %s is not active for trading", order.SecurityID)
+	}
+
+	// Pre-trade compliance checks against the replicated AMMC restriction set.
+	// A violating order is recorded as rejected rather than failing the transaction,
+	// so the rejection stays on the ledger for audit.
+	restrictions, err := c.GetRestrictionSet(ctx)
+	if err != nil {
+		return err
+	}
+	reasons := restrictions.checkOrder(order, security)
+
+	// Brokers that missed a margin call cannot place new orders; buy-in orders close out
+	// existing obligations and are still accepted
+	if order.BuyInID == "" {
+		marginRestriction, err := c.marginRestriction(ctx, order.BrokerID)
+		if err != nil {
+			return err
+		}
+		if marginRestriction != nil {
+			reasons = append(reasons, fmt.Sprintf("broker %s missed margin call %s", order.BrokerID, marginRestriction.CallID))
+		}
+	}
+
+	if len(reasons) > 0 {
+		return c.rejectOrder(ctx, order, reasons, restrictions, mspID)
+	}
+
+	// Timestamps only have a second's precision: the sequence orders orders of the same time
+	order.Sequence, err = c.nextOrderSequence(ctx)
+	if err != nil {
+		return err
+	}
+
 	// Store the order in the ledger
 	orderJSON, err := json.Marshal(order)
 	if err != nil {
 		return fmt.Errorf("failed to marshal order: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(orderID, orderJSON)
+	err = ctx.GetStub().PutState(order.OrderID, orderJSON)
 	if err != nil {
 		return fmt.Errorf("failed to put order in ledger: %v", err)
 	}
@@ -264,6 +345,35 @@ func (c *OrderMatchingContract) CreateOrder(ctx contractapi.TransactionContextIn
 	return nil
 }
 
+// nextOrderSequence returns the sequence of the next order stored in the book
+func (c *OrderMatchingContract) nextOrderSequence(ctx contractapi.TransactionContextInterface) (int64, error) {
+	sequenceJSON, err := ctx.GetStub().GetState("orderSequence")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read from world state: %v", err)
+	}
+
+	var sequence int64
+	if sequenceJSON != nil {
+		err = json.Unmarshal(sequenceJSON, &sequence)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unmarshal order sequence: %v", err)
+		}
+	}
+	sequence++
+
+	sequenceJSON, err = json.Marshal(sequence)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal order sequence: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("orderSequence", sequenceJSON)
+	if err != nil {
+		return 0, fmt.Errorf("failed to put order sequence in ledger: %v", err)
+	}
+
+	return sequence, nil
+}
+
 // OrderExists checks if an order with given ID exists
 func (c *OrderMatchingContract) OrderExists(ctx contractapi.TransactionContextInterface, orderID string) (bool, error) {
 	orderJSON, err := ctx.GetStub().GetState(orderID)
@@ -428,7 +538,7 @@ func (c *OrderMatchingContract) MatchOrders(ctx contractapi.TransactionContextIn
 		if buyOrders[i].Price != buyOrders[j].Price {
 			return buyOrders[i].Price > buyOrders[j].Price
 		}
-		return buyOrders[i].CreateTime < buyOrders[j].CreateTime
+		return buyOrders[i].arrivedBefore(buyOrders[j])
 	})
 
 	// Sort sell orders by price (lowest first) and time (oldest first)
@@ -436,12 +546,15 @@ func (c *OrderMatchingContract) MatchOrders(ctx contractapi.TransactionContextIn
 		if sellOrders[i].Price != sellOrders[j].Price {
 			return sellOrders[i].Price < sellOrders[j].Price
 		}
-		return sellOrders[i].CreateTime < sellOrders[j].CreateTime
+		return sellOrders[i].arrivedBefore(sellOrders[j])
 	})
 
 	// Match orders
 	matchCount := 0
-	currentTime := time.Now().Format(time.RFC3339)
+	currentTime, err := c.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
 
 	for _, buyOrder := range buyOrders {
 		// Skip if buy order is fully matched
@@ -464,17 +577,27 @@ func (c *OrderMatchingContract) MatchOrders(ctx contractapi.TransactionContextIn
 				tradeID := fmt.Sprintf("trade-%s-%s-%d", buyOrder.OrderID, sellOrder.OrderID, matchCount)
 				matchCount++
 
+				// The older order made the market; the newer one took it
+				makerSide := "sell"
+				if buyOrder.arrivedBefore(sellOrder) {
+					makerSide = "buy"
+				}
+
 				trade := Trade{
 					TradeID:      tradeID,
 					BuyOrderID:   buyOrder.OrderID,
 					SellOrderID:  sellOrder.OrderID,
 					BuyBrokerID:  buyOrder.BrokerID,
 					SellBrokerID: sellOrder.BrokerID,
+					BuyClientID:  buyOrder.ClientID,
+					SellClientID: sellOrder.ClientID,
 					SecurityID:   securityID,
 					Quantity:     matchQty,
 					Price:        sellOrder.Price, // Use sell price (first in the book)
 					Status:       "pending",
 					MatchTime:    currentTime,
+					BuyInID:      buyOrder.BuyInID,
+					MakerSide:    makerSide,
 				}
 
 				// Store the matched trade
@@ -788,20 +911,26 @@ func (c *OrderMatchingContract) InitiateSettlement(ctx contractapi.TransactionCo
 
 	// Create settlement event
 	settlementInitiation := struct {
-		TradeID      string  `json:"tradeID"`
-		BuyBrokerID  string  `json:"buyBrokerID"`
-		SellBrokerID string  `json:"sellBrokerID"`
-		SecurityID   string  `json:"securityID"`
-		Quantity     int     `json:"quantity"`
-		Price        float64 `json:"price"`
-		InitiatedAt  string  `json:"initiatedAt"`
+		TradeID      string `json:"tradeID"`
+		BuyBrokerID  string `json:"buyBrokerID"`
+		SellBrokerID string `json:"sellBrokerID"`
+		BuyClientID  string `json:"buyClientID"`
+		SellClientID string `json:"sellClientID"`
+		SecurityID   string `json:"securityID"`
+		Quantity     int    `json:"quantity"`
+		Price        Money  `json:"price"`
+		BuyInID      string `json:"buyInID"`
+		InitiatedAt  string `json:"initiatedAt"`
 	}{
 		TradeID:      trade.TradeID,
 		BuyBrokerID:  trade.BuyBrokerID,
 		SellBrokerID: trade.SellBrokerID,
+		BuyClientID:  trade.BuyClientID,
+		SellClientID: trade.SellClientID,
 		SecurityID:   trade.SecurityID,
 		Quantity:     trade.Quantity,
 		Price:        trade.Price,
+		BuyInID:      trade.BuyInID,
 		InitiatedAt:  time.Now().Format(time.RFC3339),
 	}
 
@@ -0,0 +1,44 @@
+// order-matching_test.go - Tests of the order book and matching
+package main
+
+import (
+	"testing"
+)
+
+func TestMakerIsTheOrderThatArrivedFirst(t *testing.T) {
+	l := newLedger()
+	c := &OrderMatchingContract{}
+	listSecurity(t, l)
+
+	// Both orders are placed in the same second: only their sequence tells them apart
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		return c.CreateOrder(ctx, "order-b", "broker1", "", "SEC001", "buy", 10, 100)
+	})
+	l.must(t, "Broker2MSP", func(ctx txCtx) error {
+		return c.CreateOrder(ctx, "order-s", "broker2", "", "SEC001", "sell", 10, 100)
+	})
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error { return c.MatchOrders(ctx, "SEC001") })
+
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		buy, err := c.GetOrder(ctx, "order-b")
+		if err != nil {
+			return err
+		}
+		sell, err := c.GetOrder(ctx, "order-s")
+		if err != nil {
+			return err
+		}
+		if buy.CreateTime != sell.CreateTime || buy.Sequence != 1 || sell.Sequence != 2 {
+			t.Errorf("orders created at %s #%d and %s #%d", buy.CreateTime, buy.Sequence, sell.CreateTime, sell.Sequence)
+		}
+
+		trade, err := c.GetTrade(ctx, "trade-order-b-order-s-0")
+		if err != nil {
+			return err
+		}
+		if trade.MakerSide != "buy" || trade.MatchTime != "2026-03-02T09:00:00Z" {
+			t.Errorf("trade = %+v", *trade)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,323 @@
+// restrictions.go - Pre-trade checks against the AMMC restriction set
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Blackout is a client barred from trading the securities of an issuer
+type Blackout struct {
+	BrokerID string `json:"brokerID"` // empty for any broker
+	ClientID string `json:"clientID"`
+	IssuerID string `json:"issuerID"`
+}
+
+// RestrictionSet is the copy of the AMMC restriction set replicated onto the trading
+// ledger. It is produced by GetRestrictionSet on the compliance chaincode.
+type RestrictionSet struct {
+	RestrictedSecurities []string   `json:"restrictedSecurities"`
+	SanctionedBrokers    []string   `json:"sanctionedBrokers"`
+	SanctionedClients    []string   `json:"sanctionedClients"`
+	Blackouts            []Blackout `json:"blackouts"`
+	GeneratedAt          string     `json:"generatedAt"`
+	Version              int        `json:"version"`
+	SyncedBy             string     `json:"syncedBy"`
+	SyncTxID             string     `json:"syncTxID"`
+}
+
+// OrderRejection is the audit record of an order refused by the pre-trade checks
+type OrderRejection struct {
+	OrderID            string   `json:"orderID"`
+	BrokerID           string   `json:"brokerID"`
+	ClientID           string   `json:"clientID"`
+	SecurityID         string   `json:"securityID"`
+	Side               string   `json:"side"`
+	Quantity           int      `json:"quantity"`
+	Price              Money    `json:"price"`
+	Reasons            []string `json:"reasons"`
+	RestrictionVersion int      `json:"restrictionVersion"`
+	SubmittedBy        string   `json:"submittedBy"`
+	TxID               string   `json:"txID"`
+	RejectedAt         string   `json:"rejectedAt"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// Composite key object types; composite keys stay out of the plain range scans over orders
+const (
+	restrictionSetObjectType = "restrictionSet"
+	orderRejectionObjectType = "orderRejection"
+)
+
+// SyncRestrictions replicates the AMMC restriction set onto the trading ledger.
+// restrictionSetJSON is the output of GetRestrictionSet on the regulatory channel.
+// Only AMMC can sync restrictions, and a set older than the current one is refused.
+func (c *OrderMatchingContract) SyncRestrictions(ctx contractapi.TransactionContextInterface, restrictionSetJSON string) error {
+	mspID, err := c.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != "AMMCMSP" {
+		return fmt.Errorf("only AMMC is authorized to sync restrictions")
+	}
+
+	var set RestrictionSet
+	err = json.Unmarshal([]byte(restrictionSetJSON), &set)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal restriction set: %v", err)
+	}
+
+	generatedAt, err := time.Parse(time.RFC3339, set.GeneratedAt)
+	if err != nil {
+		return fmt.Errorf("restriction set generation time must be in RFC3339 format: %v", err)
+	}
+
+	current, err := c.GetRestrictionSet(ctx)
+	if err != nil {
+		return err
+	}
+	if current.GeneratedAt != "" {
+		currentGeneratedAt, err := time.Parse(time.RFC3339, current.GeneratedAt)
+		if err != nil {
+			return fmt.Errorf("invalid generation time on current restriction set: %v", err)
+		}
+		if generatedAt.Before(currentGeneratedAt) {
+			return fmt.Errorf("restriction set generated at %s is older than the current one (%s)", set.GeneratedAt, current.GeneratedAt)
+		}
+	}
+
+	if set.RestrictedSecurities == nil {
+		set.RestrictedSecurities = []string{}
+	}
+	if set.SanctionedBrokers == nil {
+		set.SanctionedBrokers = []string{}
+	}
+	if set.SanctionedClients == nil {
+		set.SanctionedClients = []string{}
+	}
+	if set.Blackouts == nil {
+		set.Blackouts = []Blackout{}
+	}
+	set.Version = current.Version + 1
+	set.SyncedBy = mspID
+	set.SyncTxID = ctx.GetStub().GetTxID()
+
+	setJSON, err := json.Marshal(set)
+	if err != nil {
+		return fmt.Errorf("failed to marshal restriction set: %v", err)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(restrictionSetObjectType, []string{"current"})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, setJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put restriction set in ledger: %v", err)
+	}
+
+	// Emit an event for the new restriction set
+	err = ctx.GetStub().SetEvent("RestrictionsSynced", setJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set RestrictionsSynced event: %v", err)
+	}
+
+	return nil
+}
+
+// GetRestrictionSet retrieves the restriction set in force on the trading ledger.
+// Until AMMC syncs one, the set is empty (version 0) and no order is restricted.
+func (c *OrderMatchingContract) GetRestrictionSet(ctx contractapi.TransactionContextInterface) (*RestrictionSet, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(restrictionSetObjectType, []string{"current"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	setJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if setJSON == nil {
+		return &RestrictionSet{
+			RestrictedSecurities: []string{},
+			SanctionedBrokers:    []string{},
+			SanctionedClients:    []string{},
+			Blackouts:            []Blackout{},
+		}, nil
+	}
+
+	var set RestrictionSet
+	err = json.Unmarshal(setJSON, &set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal restriction set: %v", err)
+	}
+
+	return &set, nil
+}
+
+// checkOrder lists the reasons, if any, why the restriction set forbids an order.
+// Broker IDs are compared case-insensitively since the regulator's registry and the
+// trading ledger do not share a naming convention.
+func (r *RestrictionSet) checkOrder(order *Order, security *Security) []string {
+	reasons := []string{}
+
+	for _, securityID := range r.RestrictedSecurities {
+		if securityID == order.SecurityID {
+			reasons = append(reasons, fmt.Sprintf("security %s is restricted", order.SecurityID))
+			break
+		}
+	}
+
+	for _, brokerID := range r.SanctionedBrokers {
+		if strings.EqualFold(brokerID, order.BrokerID) {
+			reasons = append(reasons, fmt.Sprintf("broker %s is under sanction", order.BrokerID))
+			break
+		}
+	}
+
+	if order.ClientID == "" {
+		return reasons
+	}
+
+	for _, clientID := range r.SanctionedClients {
+		if clientID == order.ClientID {
+			reasons = append(reasons, fmt.Sprintf("client %s is under sanction", order.ClientID))
+			break
+		}
+	}
+
+	for _, blackout := range r.Blackouts {
+		if blackout.ClientID == order.ClientID && blackout.IssuerID == security.IssuerID &&
+			(blackout.BrokerID == "" || strings.EqualFold(blackout.BrokerID, order.BrokerID)) {
+			reasons = append(reasons, fmt.Sprintf("client %s is on the insider blackout list for issuer %s", order.ClientID, security.IssuerID))
+			break
+		}
+	}
+
+	return reasons
+}
+
+// rejectOrder stores a rejected order together with its audit record and emits an
+// OrderRejected event
+func (c *OrderMatchingContract) rejectOrder(ctx contractapi.TransactionContextInterface, order *Order, reasons []string, set *RestrictionSet, mspID string) error {
+	order.Status = "rejected"
+	order.RemainingQty = 0
+
+	orderJSON, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("failed to marshal order: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(order.OrderID, orderJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put order in ledger: %v", err)
+	}
+
+	rejection := OrderRejection{
+		OrderID:            order.OrderID,
+		BrokerID:           order.BrokerID,
+		ClientID:           order.ClientID,
+		SecurityID:         order.SecurityID,
+		Side:               order.Side,
+		Quantity:           order.Quantity,
+		Price:              order.Price,
+		Reasons:            reasons,
+		RestrictionVersion: set.Version,
+		SubmittedBy:        mspID,
+		TxID:               ctx.GetStub().GetTxID(),
+		RejectedAt:         order.UpdateTime,
+	}
+
+	rejectionJSON, err := json.Marshal(rejection)
+	if err != nil {
+		return fmt.Errorf("failed to marshal order rejection: %v", err)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(orderRejectionObjectType, []string{order.OrderID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, rejectionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put order rejection in ledger: %v", err)
+	}
+
+	// Emit an event for the rejected order
+	err = ctx.GetStub().SetEvent("OrderRejected", rejectionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set OrderRejected event: %v", err)
+	}
+
+	return nil
+}
+
+// GetOrderRejection retrieves the audit record of a rejected order
+func (c *OrderMatchingContract) GetOrderRejection(ctx contractapi.TransactionContextInterface, orderID string) (*OrderRejection, error) {
+	// Enforces the same visibility rules as the order itself
+	_, err := c.GetOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(orderRejectionObjectType, []string{orderID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	rejectionJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if rejectionJSON == nil {
+		return nil, fmt.Errorf("order %s was not rejected", orderID)
+	}
+
+	var rejection OrderRejection
+	err = json.Unmarshal(rejectionJSON, &rejection)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal order rejection: %v", err)
+	}
+
+	return &rejection, nil
+}
+
+// GetOrderRejections retrieves every order rejection (StockMarket and AMMC only)
+func (c *OrderMatchingContract) GetOrderRejections(ctx contractapi.TransactionContextInterface) ([]*OrderRejection, error) {
+	mspID, err := c.getClientOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if mspID != "StockMarketMSP" && mspID != "AMMCMSP" {
+		return nil, fmt.Errorf("only StockMarket and AMMC can view all order rejections")
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderRejectionObjectType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order rejections: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var rejections []*OrderRejection
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate order rejections: %v", err)
+		}
+
+		var rejection OrderRejection
+		err = json.Unmarshal(queryResponse.Value, &rejection)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal order rejection: %v", err)
+		}
+		rejections = append(rejections, &rejection)
+	}
+
+	return rejections, nil
+}
@@ -0,0 +1,74 @@
+// restrictions_test.go - Tests of the pre-trade checks against the AMMC restriction set
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// restrictionSetJSON sanctions BROKER2 and blacks out client C2 for issuer ISS001
+const restrictionSetJSON = `{"restrictedSecurities":[],"sanctionedBrokers":["BROKER2"],"sanctionedClients":[],` +
+	`"blackouts":[{"brokerID":"","clientID":"C2","issuerID":"ISS001"}],"generatedAt":"2026-03-02T09:00:00Z"}`
+
+func TestOnlyAMMCSyncsRestrictions(t *testing.T) {
+	l := newLedger()
+	c := &OrderMatchingContract{}
+
+	l.mustFail(t, "StockMarketMSP", func(ctx txCtx) error { return c.SyncRestrictions(ctx, restrictionSetJSON) })
+	l.must(t, "AMMCMSP", func(ctx txCtx) error { return c.SyncRestrictions(ctx, restrictionSetJSON) })
+
+	// A set older than the one in force is refused
+	l.mustFail(t, "AMMCMSP", func(ctx txCtx) error {
+		return c.SyncRestrictions(ctx, `{"generatedAt":"2026-03-01T09:00:00Z"}`)
+	})
+
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		set, err := c.GetRestrictionSet(ctx)
+		if err != nil {
+			return err
+		}
+		if set.Version != 1 || set.SyncedBy != "AMMCMSP" || !reflect.DeepEqual(set.SanctionedBrokers, []string{"BROKER2"}) {
+			t.Errorf("restriction set = %+v", set)
+		}
+		return nil
+	})
+}
+
+func TestRestrictedOrdersAreRejected(t *testing.T) {
+	l := newLedger()
+	c := &OrderMatchingContract{}
+	listSecurity(t, l)
+	l.must(t, "AMMCMSP", func(ctx txCtx) error { return c.SyncRestrictions(ctx, restrictionSetJSON) })
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return c.CreateOrder(ctx, "order-1", "broker1", "C1", "SEC001", "buy", 10, 100) })
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return c.CreateOrder(ctx, "order-2", "broker1", "C2", "SEC001", "buy", 10, 100) })
+	l.must(t, "Broker2MSP", func(ctx txCtx) error { return c.CreateOrder(ctx, "order-3", "broker2", "", "SEC001", "sell", 10, 100) })
+
+	for orderID, want := range map[string]string{"order-1": "pending", "order-2": "rejected", "order-3": "rejected"} {
+		if status := orderStatus(t, l, orderID); status != want {
+			t.Errorf("%s is %s, want %s", orderID, status, want)
+		}
+	}
+
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		rejections, err := c.GetOrderRejections(ctx)
+		if err != nil {
+			return err
+		}
+		reasons := map[string][]string{}
+		for _, rejection := range rejections {
+			if rejection.RestrictionVersion != 1 {
+				t.Errorf("%s was checked against version %d", rejection.OrderID, rejection.RestrictionVersion)
+			}
+			reasons[rejection.OrderID] = rejection.Reasons
+		}
+		want := map[string][]string{
+			"order-2": {"client C2 is on the insider blackout list for issuer ISS001"},
+			"order-3": {"broker broker2 is under sanction"},
+		}
+		if !reflect.DeepEqual(reasons, want) {
+			t.Errorf("rejection reasons = %q, want %q", reasons, want)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,215 @@
+// affirmations.go - Buyer-side and seller-side affirmation of settlement instructions
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Affirmation is one broker's confirmation of the terms of a settlement instruction.
+// Expected terms left empty (zero) by the broker are not matched.
+type Affirmation struct {
+	InstructionID      string   `json:"instructionID"`
+	Side               string   `json:"side"` // buy, sell
+	BrokerID           string   `json:"brokerID"`
+	ExpectedSecurityID string   `json:"expectedSecurityID"`
+	ExpectedQuantity   int      `json:"expectedQuantity"`
+	ExpectedPrice      Money    `json:"expectedPrice"`
+	Status             string   `json:"status"` // affirmed, mismatched
+	Mismatches         []string `json:"mismatches"`
+	AffirmedBy         string   `json:"affirmedBy"`
+	AffirmedAt         string   `json:"affirmedAt"`
+	TxID               string   `json:"txID"`
+}
+
+// Affirmation status of each side of an instruction
+const (
+	affirmationMissing    = ""
+	affirmationAffirmed   = "affirmed"
+	affirmationMismatched = "mismatched"
+	affirmationDeemed     = "deemed" // not affirmed by the deadline, settled on the instruction's terms
+)
+
+// affirmationDeadlineFor returns the affirmation deadline of a trade: the end of the trade date
+func affirmationDeadlineFor(tradeDate time.Time) time.Time {
+	day := time.Date(tradeDate.Year(), tradeDate.Month(), tradeDate.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, 1)
+}
+
+// AffirmInstruction records the buyer-side or seller-side affirmation of a settlement
+// instruction by the broker on that side. expectedSecurityID, expectedQuantity and
+// expectedPriceCentimes are the terms the broker expects; empty or zero values are not
+// checked. An affirmation whose terms do not match is stored as "mismatched" and does not
+// count towards validation; the broker can affirm again.
+func (s *SettlementContract) AffirmInstruction(ctx contractapi.TransactionContextInterface, instructionID, side, expectedSecurityID string, expectedQuantity int, expectedPriceCentimes int64) error {
+	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
+	if err != nil {
+		return err
+	}
+
+	if instruction.Status != "pending" {
+		return fmt.Errorf("only pending instructions can be affirmed, current status: %s", instruction.Status)
+	}
+
+	var brokerID string
+	switch side {
+	case "buy":
+		brokerID = instruction.BuyBrokerID
+	case "sell":
+		brokerID = instruction.SellBrokerID
+	default:
+		return fmt.Errorf("affirmation side must be 'buy' or 'sell'")
+	}
+
+	// Each side can only be affirmed by the broker on that side
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != brokerMSPID(brokerID) {
+		return fmt.Errorf("only %s can affirm the %s side of instruction %s", brokerMSPID(brokerID), side, instructionID)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	affirmation := Affirmation{
+		InstructionID:      instructionID,
+		Side:               side,
+		BrokerID:           brokerID,
+		ExpectedSecurityID: expectedSecurityID,
+		ExpectedQuantity:   expectedQuantity,
+		ExpectedPrice:      Money(expectedPriceCentimes),
+		Status:             affirmationAffirmed,
+		Mismatches:         []string{},
+		AffirmedBy:         mspID,
+		AffirmedAt:         currentTime,
+		TxID:               s.getTransactionID(ctx),
+	}
+
+	// Match the broker's expected terms against the instruction
+	if expectedSecurityID != "" && expectedSecurityID != instruction.SecurityID {
+		affirmation.Mismatches = append(affirmation.Mismatches,
+			fmt.Sprintf("security %s does not match %s", expectedSecurityID, instruction.SecurityID))
+	}
+	if expectedQuantity != 0 && expectedQuantity != instruction.Quantity {
+		affirmation.Mismatches = append(affirmation.Mismatches,
+			fmt.Sprintf("quantity %d does not match %d", expectedQuantity, instruction.Quantity))
+	}
+	if affirmation.ExpectedPrice != 0 && affirmation.ExpectedPrice != instruction.Price {
+		affirmation.Mismatches = append(affirmation.Mismatches,
+			fmt.Sprintf("price %v does not match %v", affirmation.ExpectedPrice, instruction.Price))
+	}
+	if len(affirmation.Mismatches) > 0 {
+		affirmation.Status = affirmationMismatched
+	}
+
+	affirmationJSON, err := json.Marshal(affirmation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal affirmation: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("affirmation-"+instructionID+"-"+side, affirmationJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put affirmation in ledger: %v", err)
+	}
+
+	if side == "buy" {
+		instruction.BuyAffirmation = affirmation.Status
+	} else {
+		instruction.SellAffirmation = affirmation.Status
+	}
+
+	// Both sides affirmed: the instruction becomes eligible for settlement
+	eventName := "SettlementInstructionAffirmed"
+	if instruction.BuyAffirmation == affirmationAffirmed && instruction.SellAffirmation == affirmationAffirmed {
+		instruction.Status = "validated"
+		eventName = "SettlementInstructionValidated"
+	} else if affirmation.Status == affirmationMismatched {
+		eventName = "SettlementInstructionMismatched"
+	}
+
+	instructionJSON, err := json.Marshal(instruction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settlement instruction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(instructionID, instructionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent(eventName, affirmationJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set %s event: %v", eventName, err)
+	}
+
+	return nil
+}
+
+// GetAffirmation retrieves the affirmation of one side (buy or sell) of an instruction
+func (s *SettlementContract) GetAffirmation(ctx contractapi.TransactionContextInterface, instructionID, side string) (*Affirmation, error) {
+	affirmationJSON, err := ctx.GetStub().GetState("affirmation-" + instructionID + "-" + side)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if affirmationJSON == nil {
+		return nil, fmt.Errorf("the %s side of instruction %s has not been affirmed", side, instructionID)
+	}
+
+	var affirmation Affirmation
+	err = json.Unmarshal(affirmationJSON, &affirmation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal affirmation: %v", err)
+	}
+
+	return &affirmation, nil
+}
+
+// applyAffirmationDeadline reports whether an instruction is eligible for settlement:
+// both sides affirmed, or the affirmation deadline has passed. Past the deadline, sides
+// without a matching affirmation are deemed to accept the instruction's terms, which come
+// from the exchange's matched trade, and the instruction is marked validated. The caller
+// stores the instruction.
+func (s *SettlementContract) applyAffirmationDeadline(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction) (bool, error) {
+	if instruction.Status == "validated" {
+		return true, nil
+	}
+	if instruction.Status != "pending" {
+		return false, nil
+	}
+
+	// Instructions created before affirmations existed carry no deadline
+	if instruction.AffirmationDeadline == "" {
+		instruction.Status = "validated"
+		return true, nil
+	}
+
+	deadline, err := time.Parse(time.RFC3339, instruction.AffirmationDeadline)
+	if err != nil {
+		return false, fmt.Errorf("invalid affirmation deadline on instruction %s: %v", instruction.InstructionID, err)
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return false, err
+	}
+	if txTime.Before(deadline) {
+		return false, nil
+	}
+
+	if instruction.BuyAffirmation != affirmationAffirmed {
+		instruction.BuyAffirmation = affirmationDeemed
+	}
+	if instruction.SellAffirmation != affirmationAffirmed {
+		instruction.SellAffirmation = affirmationDeemed
+	}
+	instruction.Status = "validated"
+
+	return true, nil
+}
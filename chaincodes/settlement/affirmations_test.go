@@ -0,0 +1,99 @@
+// affirmations_test.go - Tests of buyer-side and seller-side affirmation
+package main
+
+import (
+	"testing"
+)
+
+// setUpInstruction creates an unaffirmed instruction for broker1 to buy 10 SEC002 at 1.00
+// from broker2
+func setUpInstruction(t *testing.T, l *mockLedger) {
+	t.Helper()
+	s := &SettlementContract{}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 10, 100, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+}
+
+// instructionOf returns a settlement instruction as Maroclear sees it
+func instructionOf(t *testing.T, l *mockLedger, instructionID string) *SettlementInstruction {
+	t.Helper()
+	s := &SettlementContract{}
+
+	var instruction *SettlementInstruction
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		instruction, err = s.GetSettlementInstruction(ctx, instructionID)
+		return err
+	})
+	return instruction
+}
+
+func TestMismatchedAffirmationDoesNotValidate(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpInstruction(t, l)
+
+	// Only the broker on a side can affirm it
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error {
+		return s.AffirmInstruction(ctx, "instruction-trade-1", "buy", "", 0, 0)
+	})
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		return s.AffirmInstruction(ctx, "instruction-trade-1", "buy", "SEC002", 5, 100)
+	})
+	l.must(t, "Broker2MSP", func(ctx txCtx) error {
+		return s.AffirmInstruction(ctx, "instruction-trade-1", "sell", "SEC002", 10, 100)
+	})
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		affirmation, err := s.GetAffirmation(ctx, "instruction-trade-1", "buy")
+		if err != nil {
+			return err
+		}
+		if affirmation.Status != affirmationMismatched || len(affirmation.Mismatches) != 1 {
+			t.Errorf("buy affirmation = %+v", affirmation)
+		}
+		return nil
+	})
+	if instruction := instructionOf(t, l, "instruction-trade-1"); instruction.Status != "pending" {
+		t.Fatalf("instruction with a mismatched side is %s", instruction.Status)
+	}
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ValidateSettlementInstruction(ctx, "instruction-trade-1")
+	})
+
+	// The broker affirms again on the instruction's terms
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		return s.AffirmInstruction(ctx, "instruction-trade-1", "buy", "SEC002", 10, 100)
+	})
+	instruction := instructionOf(t, l, "instruction-trade-1")
+	if instruction.Status != "validated" || instruction.BuyAffirmation != affirmationAffirmed || instruction.SellAffirmation != affirmationAffirmed {
+		t.Fatalf("instruction = %+v", instruction)
+	}
+}
+
+func TestUnaffirmedSidesAreDeemedAfterDeadline(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpInstruction(t, l)
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		return s.AffirmInstruction(ctx, "instruction-trade-1", "buy", "", 0, 0)
+	})
+
+	if instruction := instructionOf(t, l, "instruction-trade-1"); instruction.Status != "pending" || instruction.SellAffirmation == affirmationDeemed {
+		t.Fatalf("instruction before the deadline = %+v", instruction)
+	}
+
+	// The affirmation deadline is the end of the trade date
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+
+	instruction := instructionOf(t, l, "instruction-trade-1")
+	if instruction.Status != "completed" || instruction.BuyAffirmation != affirmationAffirmed || instruction.SellAffirmation != affirmationDeemed {
+		t.Fatalf("instruction = %+v", instruction)
+	}
+}
@@ -0,0 +1,393 @@
+// book.go - Accounts touched by a settlement of several instructions in one transaction
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// accountBook caches every account a multi-instruction settlement reads, so that each
+// instruction sees the postings of the ones before it: reads within a transaction do not
+// see its own writes. Accounts are only stored by save, in the order they were loaded,
+// and the movements posted to them are journaled then.
+type accountBook struct {
+	brokerAccounts   map[string]*BrokerAccount           // by broker ID
+	securities       map[string]*SecuritiesAccount       // by account ID
+	clientAccounts   map[string]*ClientAccount           // by client account key
+	clientSecurities map[string]*ClientSecuritiesAccount // by account ID
+
+	brokerOrder           []*BrokerAccount
+	securitiesOrder       []*SecuritiesAccount
+	clientAccountsOrder   []*ClientAccount
+	clientSecuritiesOrder []*ClientSecuritiesAccount
+
+	settled []*SettlementInstruction // instructions whose holds were consumed
+	journal *pendingJournal          // movements posted to the accounts
+}
+
+// newAccountBook returns an empty account book
+func newAccountBook() *accountBook {
+	return &accountBook{
+		brokerAccounts:   map[string]*BrokerAccount{},
+		securities:       map[string]*SecuritiesAccount{},
+		clientAccounts:   map[string]*ClientAccount{},
+		clientSecurities: map[string]*ClientSecuritiesAccount{},
+		journal:          newPendingJournal(),
+	}
+}
+
+// clone returns a copy of the book whose accounts can be posted to without changing this one
+func (book *accountBook) clone() *accountBook {
+	copied := newAccountBook()
+
+	for _, account := range book.brokerOrder {
+		account := *account
+		copied.brokerAccounts[account.BrokerID] = &account
+		copied.brokerOrder = append(copied.brokerOrder, &account)
+	}
+	for _, account := range book.securitiesOrder {
+		account := *account
+		copied.securities[account.AccountID] = &account
+		copied.securitiesOrder = append(copied.securitiesOrder, &account)
+	}
+	for _, account := range book.clientAccountsOrder {
+		account := *account
+		copied.clientAccounts[clientAccountKey(account.BrokerID, account.ClientID)] = &account
+		copied.clientAccountsOrder = append(copied.clientAccountsOrder, &account)
+	}
+	for _, account := range book.clientSecuritiesOrder {
+		account := *account
+		copied.clientSecurities[account.AccountID] = &account
+		copied.clientSecuritiesOrder = append(copied.clientSecuritiesOrder, &account)
+	}
+	copied.settled = append(copied.settled, book.settled...)
+	copied.journal = book.journal.clone()
+
+	return copied
+}
+
+// try settles instructions together on a copy of the book and returns the copy, or nil
+// when they cannot all settle: an account would be left short, or a client is not verified.
+// The instructions themselves are left untouched; the copy settles copies of them.
+func (book *accountBook) try(ctx contractapi.TransactionContextInterface, s *SettlementContract, instructions []*SettlementInstruction, currentTime string) *accountBook {
+	trial := book.clone()
+	for _, instruction := range instructions {
+		instruction := *instruction
+		if trial.settle(ctx, s, &instruction, currentTime) != nil {
+			return nil
+		}
+	}
+	if trial.check() != nil {
+		return nil
+	}
+
+	return trial
+}
+
+// brokerAccount returns the broker's cash account, loading it on first use
+func (book *accountBook) brokerAccount(ctx contractapi.TransactionContextInterface, s *SettlementContract, brokerID string) (*BrokerAccount, error) {
+	if account, ok := book.brokerAccounts[brokerID]; ok {
+		return account, nil
+	}
+
+	account, err := s.getOrNewBrokerAccount(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+	book.brokerAccounts[brokerID] = account
+	book.brokerOrder = append(book.brokerOrder, account)
+
+	return account, nil
+}
+
+// securitiesAccount returns the broker's securities account for a security, loading it on first use
+func (book *accountBook) securitiesAccount(ctx contractapi.TransactionContextInterface, s *SettlementContract, brokerID, securityID string) (*SecuritiesAccount, error) {
+	accountID := "securitiesAccount-" + brokerID + "-" + securityID
+	if account, ok := book.securities[accountID]; ok {
+		return account, nil
+	}
+
+	account, err := s.getOrNewSecuritiesAccount(ctx, brokerID, securityID)
+	if err != nil {
+		return nil, err
+	}
+	book.securities[accountID] = account
+	book.securitiesOrder = append(book.securitiesOrder, account)
+
+	return account, nil
+}
+
+// clientAccount returns a client's cash sub-account, loading it on first use. Clients
+// must have passed KYC to settle.
+func (book *accountBook) clientAccount(ctx contractapi.TransactionContextInterface, s *SettlementContract, brokerID, clientID string) (*ClientAccount, error) {
+	key := clientAccountKey(brokerID, clientID)
+	if account, ok := book.clientAccounts[key]; ok {
+		return account, nil
+	}
+
+	account, err := s.getVerifiedClientAccount(ctx, brokerID, clientID)
+	if err != nil {
+		return nil, err
+	}
+	book.clientAccounts[key] = account
+	book.clientAccountsOrder = append(book.clientAccountsOrder, account)
+
+	return account, nil
+}
+
+// clientSecuritiesAccount returns a client's holding of a security, loading it on first use
+func (book *accountBook) clientSecuritiesAccount(ctx contractapi.TransactionContextInterface, s *SettlementContract, brokerID, clientID, securityID string) (*ClientSecuritiesAccount, error) {
+	accountID := clientSecuritiesAccountKey(brokerID, clientID, securityID)
+	if account, ok := book.clientSecurities[accountID]; ok {
+		return account, nil
+	}
+
+	account, err := s.getOrNewClientSecuritiesAccount(ctx, brokerID, clientID, securityID)
+	if err != nil {
+		return nil, err
+	}
+	book.clientSecurities[accountID] = account
+	book.clientSecuritiesOrder = append(book.clientSecuritiesOrder, account)
+
+	return account, nil
+}
+
+// load loads every account an instruction settles against, without posting to them
+func (book *accountBook) load(ctx contractapi.TransactionContextInterface, s *SettlementContract, instruction *SettlementInstruction) error {
+	for _, brokerID := range []string{instruction.BuyBrokerID, instruction.SellBrokerID} {
+		_, err := book.brokerAccount(ctx, s, brokerID)
+		if err != nil {
+			return err
+		}
+		_, err = book.securitiesAccount(ctx, s, brokerID, instruction.SecurityID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if instruction.BuyClientID != "" {
+		_, err := book.clientAccount(ctx, s, instruction.BuyBrokerID, instruction.BuyClientID)
+		if err != nil {
+			return err
+		}
+		_, err = book.clientSecuritiesAccount(ctx, s, instruction.BuyBrokerID, instruction.BuyClientID, instruction.SecurityID)
+		if err != nil {
+			return err
+		}
+	}
+	if instruction.SellClientID != "" {
+		_, err := book.clientAccount(ctx, s, instruction.SellBrokerID, instruction.SellClientID)
+		if err != nil {
+			return err
+		}
+		_, err = book.clientSecuritiesAccount(ctx, s, instruction.SellBrokerID, instruction.SellClientID, instruction.SecurityID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// settle posts an instruction in full to the cached accounts, consuming its holds: the
+// buyer pays its total amount and receives its quantity, the seller the reverse
+func (book *accountBook) settle(ctx contractapi.TransactionContextInterface, s *SettlementContract, instruction *SettlementInstruction, currentTime string) error {
+	heldAmount, heldQuantity := instruction.heldAmounts()
+	amount, quantity := instruction.TotalAmount, instruction.Quantity
+
+	buyerAccount, err := book.brokerAccount(ctx, s, instruction.BuyBrokerID)
+	if err != nil {
+		return err
+	}
+	buyerSecurities, err := book.securitiesAccount(ctx, s, instruction.BuyBrokerID, instruction.SecurityID)
+	if err != nil {
+		return err
+	}
+	sellerAccount, err := book.brokerAccount(ctx, s, instruction.SellBrokerID)
+	if err != nil {
+		return err
+	}
+	sellerSecurities, err := book.securitiesAccount(ctx, s, instruction.SellBrokerID, instruction.SecurityID)
+	if err != nil {
+		return err
+	}
+
+	// Buyer: pays cash, receives securities
+	buyerAccount.Balance -= amount
+	buyerAccount.LastUpdated = currentTime
+	buyerSecurities.Quantity += quantity
+	buyerSecurities.LastUpdated = currentTime
+
+	if instruction.BuyClientID != "" {
+		clientCash, err := book.clientAccount(ctx, s, instruction.BuyBrokerID, instruction.BuyClientID)
+		if err != nil {
+			return err
+		}
+		clientSecurities, err := book.clientSecuritiesAccount(ctx, s, instruction.BuyBrokerID, instruction.BuyClientID, instruction.SecurityID)
+		if err != nil {
+			return err
+		}
+
+		clientCash.Balance -= amount
+		clientCash.ReservedBalance -= heldAmount
+		clientCash.LastUpdated = currentTime
+		buyerAccount.ClientBalance -= amount
+
+		clientSecurities.Quantity += quantity
+		clientSecurities.LastUpdated = currentTime
+		buyerSecurities.ClientQty += quantity
+	} else {
+		buyerAccount.ReservedBalance -= heldAmount
+	}
+
+	// Seller: delivers securities, receives cash
+	sellerAccount.Balance += amount
+	sellerAccount.LastUpdated = currentTime
+	sellerSecurities.Quantity -= quantity
+	sellerSecurities.LastUpdated = currentTime
+
+	if instruction.SellClientID != "" {
+		clientCash, err := book.clientAccount(ctx, s, instruction.SellBrokerID, instruction.SellClientID)
+		if err != nil {
+			return err
+		}
+		clientSecurities, err := book.clientSecuritiesAccount(ctx, s, instruction.SellBrokerID, instruction.SellClientID, instruction.SecurityID)
+		if err != nil {
+			return err
+		}
+
+		clientCash.Balance += amount
+		clientCash.LastUpdated = currentTime
+		sellerAccount.ClientBalance += amount
+
+		clientSecurities.Quantity -= quantity
+		clientSecurities.ReservedQty -= heldQuantity
+		clientSecurities.LastUpdated = currentTime
+		sellerSecurities.ClientQty -= quantity
+	} else {
+		sellerSecurities.ReservedQty -= heldQuantity
+	}
+
+	book.journal.deliver(instruction, amount, quantity, heldAmount, heldQuantity)
+
+	instruction.ReservedAmount = 0
+	instruction.ReservedQuantity = 0
+	book.settled = append(book.settled, instruction)
+
+	return nil
+}
+
+// shortfall returns the failure reason of an instruction that cannot settle against the
+// book's accounts: the buyer's cash or the seller's securities, counting the instruction's
+// own holds, do not cover it. It returns an empty reason when both are covered. The CCP's
+// side of a novated leg never fails: it performs once its other leg settles.
+func (book *accountBook) shortfall(ctx contractapi.TransactionContextInterface, s *SettlementContract, instruction *SettlementInstruction) (string, error) {
+	heldAmount, heldQuantity := instruction.heldAmounts()
+
+	var cashAvailable Money
+	if instruction.BuyBrokerID == ccpBrokerID {
+		cashAvailable = instruction.TotalAmount
+	} else if instruction.BuyClientID != "" {
+		account, err := book.clientAccount(ctx, s, instruction.BuyBrokerID, instruction.BuyClientID)
+		if err != nil {
+			return "", err
+		}
+		cashAvailable = account.available() + heldAmount
+	} else {
+		account, err := book.brokerAccount(ctx, s, instruction.BuyBrokerID)
+		if err != nil {
+			return "", err
+		}
+		cashAvailable = account.available() + heldAmount
+	}
+	if cashAvailable < instruction.TotalAmount {
+		return errorCodeInsufficientFunds, nil
+	}
+
+	var securitiesAvailable int
+	if instruction.SellBrokerID == ccpBrokerID {
+		securitiesAvailable = instruction.Quantity
+	} else if instruction.SellClientID != "" {
+		account, err := book.clientSecuritiesAccount(ctx, s, instruction.SellBrokerID, instruction.SellClientID, instruction.SecurityID)
+		if err != nil {
+			return "", err
+		}
+		securitiesAvailable = account.available() + heldQuantity
+	} else {
+		account, err := book.securitiesAccount(ctx, s, instruction.SellBrokerID, instruction.SecurityID)
+		if err != nil {
+			return "", err
+		}
+		securitiesAvailable = account.available() + heldQuantity
+	}
+	if securitiesAvailable < instruction.Quantity {
+		return errorCodeInsufficientSecurities, nil
+	}
+
+	return "", nil
+}
+
+// check reports the first account left with a negative available balance or negative holds
+func (book *accountBook) check() error {
+	for _, account := range book.brokerOrder {
+		if err := account.checkReservations(); err != nil {
+			return err
+		}
+	}
+	for _, account := range book.securitiesOrder {
+		if err := account.checkReservations(); err != nil {
+			return err
+		}
+	}
+	for _, account := range book.clientAccountsOrder {
+		if err := account.checkReservations(); err != nil {
+			return err
+		}
+	}
+	for _, account := range book.clientSecuritiesOrder {
+		if err := account.checkReservations(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save stores every cached account, journals the movements posted to them and deletes the
+// consumed holds
+func (book *accountBook) save(ctx contractapi.TransactionContextInterface, s *SettlementContract) error {
+	for _, account := range book.brokerOrder {
+		err := s.putBrokerAccount(ctx, account)
+		if err != nil {
+			return fmt.Errorf("failed to update broker account %s: %v", account.BrokerID, err)
+		}
+	}
+	for _, account := range book.securitiesOrder {
+		err := s.putSecuritiesAccount(ctx, account)
+		if err != nil {
+			return fmt.Errorf("failed to update securities account %s: %v", account.AccountID, err)
+		}
+	}
+	for _, account := range book.clientAccountsOrder {
+		err := s.putClientAccount(ctx, account)
+		if err != nil {
+			return fmt.Errorf("failed to update client account %s: %v", account.ClientID, err)
+		}
+	}
+	for _, account := range book.clientSecuritiesOrder {
+		err := s.putClientSecuritiesAccount(ctx, account)
+		if err != nil {
+			return fmt.Errorf("failed to update client securities account %s: %v", account.AccountID, err)
+		}
+	}
+	s.journalMoves(ctx, book.journal)
+
+	for _, instruction := range book.settled {
+		err := s.deleteInstructionHolds(ctx, instruction)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
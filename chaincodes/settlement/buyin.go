@@ -0,0 +1,358 @@
+// buyin.go - Extension period and buy-in of instructions the seller fails to deliver
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	// buyInExtensionDays is the number of business days after its first fail that a seller
+	// can still deliver before it is bought in
+	buyInExtensionDays = 4
+
+	// buyInLimitMarkupPercent is how far above the instruction price the buy-in order may buy
+	buyInLimitMarkupPercent = 10
+)
+
+// BuyIn tracks the buy-in of an instruction whose seller failed to deliver. Stages:
+// extension (the seller can still deliver), buy_in (a buy-in order is open on the trading
+// side for the buyer), completed (the buyer received the securities and the seller was
+// charged the price difference) and compensated (the buy-in failed and the buyer was
+// compensated in cash).
+type BuyIn struct {
+	BuyInID           string   `json:"buyInID"`
+	Stage             string   `json:"stage"` // extension, buy_in, completed, compensated
+	FailedAt          string   `json:"failedAt"`
+	ExtensionDeadline string   `json:"extensionDeadline"` // YYYY-MM-DD, last business day of the extension period
+	OpenedAt          string   `json:"openedAt"`
+	Quantity          int      `json:"quantity"`
+	LimitPrice        Money    `json:"limitPrice"`
+	TradeIDs          []string `json:"tradeIDs"` // buy-in trades, imported from the trading ledger
+	BuyInCost         Money    `json:"buyInCost"`
+	PriceDifference   Money    `json:"priceDifference"` // charged to the failing seller
+	FailureReason     string   `json:"failureReason"`
+	CompletedAt       string   `json:"completedAt"`
+}
+
+// extendOrBuyIn handles a seller fail: the first fail opens the extension period, fails
+// within it leave the instruction in the settlement queue, and a fail after it opens the
+// buy-in. The buy-in releases the instruction's holds, so the buyer's cash can pay for the
+// buy-in trades. A novated sell leg is closed out by the CCP instead.
+func (s *SettlementContract) extendOrBuyIn(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, currentTime string) error {
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	if instruction.BuyIn == nil {
+		deadline, err := s.addBusinessDays(ctx, txTime, buyInExtensionDays)
+		if err != nil {
+			return err
+		}
+
+		instruction.BuyIn = &BuyIn{
+			BuyInID:           "buyIn-" + instruction.InstructionID,
+			Stage:             "extension",
+			FailedAt:          currentTime,
+			ExtensionDeadline: deadline.Format(calendarDateLayout),
+			Quantity:          instruction.Quantity,
+			TradeIDs:          []string{},
+		}
+
+		return s.putInstruction(ctx, instruction, "SettlementExtended")
+	}
+
+	if txTime.Format(calendarDateLayout) <= instruction.BuyIn.ExtensionDeadline {
+		return nil
+	}
+
+	// The CCP closes out a novated sell leg instead of buying in (see ccp.go)
+	if instruction.NovatedLeg == novatedLegSell {
+		return s.closeOutNovatedFail(ctx, instruction, currentTime)
+	}
+
+	err = s.releaseInstructionHolds(ctx, instruction, currentTime)
+	if err != nil {
+		return err
+	}
+
+	instruction.Status = "buy_in"
+	instruction.BuyIn.Stage = "buy_in"
+	instruction.BuyIn.OpenedAt = currentTime
+	instruction.BuyIn.Quantity = instruction.Quantity
+	instruction.BuyIn.LimitPrice = instruction.Price * (100 + buyInLimitMarkupPercent) / 100
+
+	// The event carries the buy-in order the stock market places on the trading ledger
+	return s.putInstruction(ctx, instruction, "BuyInOpened")
+}
+
+// GetOpenBuyIns retrieves the instructions whose buy-in order is open
+func (s *SettlementContract) GetOpenBuyIns(ctx contractapi.TransactionContextInterface) ([]*SettlementInstruction, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("instruction-", "instruction-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instructions: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var instructions []*SettlementInstruction
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate instructions: %v", err)
+		}
+
+		var instruction SettlementInstruction
+		err = json.Unmarshal(queryResponse.Value, &instruction)
+		if err != nil {
+			continue // Skip if not a valid SettlementInstruction
+		}
+
+		if instruction.Status == "buy_in" {
+			instructions = append(instructions, &instruction)
+		}
+	}
+
+	return instructions, nil
+}
+
+// CompleteBuyIn closes a buy-in once its trades have settled: the buy-in trades must have
+// delivered the instruction's quantity to its buyer. The failing seller is charged what
+// the buy-in cost above the instruction amount, from its own funds first and then through
+// the default waterfall, and the buyer is paid it.
+func (s *SettlementContract) CompleteBuyIn(ctx contractapi.TransactionContextInterface, instructionID string, buyInTradeIDs []string) error {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
+	if err != nil {
+		return err
+	}
+	if instruction.Status != "buy_in" {
+		return fmt.Errorf("instruction %s has no open buy-in, current status: %s", instructionID, instruction.Status)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A transaction does not read its own writes, so the used-trade records below cannot
+	// catch a trade passed twice
+	seen := make(map[string]bool)
+	for _, tradeID := range buyInTradeIDs {
+		if seen[tradeID] {
+			return fmt.Errorf("buy-in trade %s is listed more than once", tradeID)
+		}
+		seen[tradeID] = true
+	}
+
+	var quantity int
+	var cost Money
+	for _, tradeID := range buyInTradeIDs {
+		trade, err := s.GetTrade(ctx, tradeID)
+		if err != nil {
+			return fmt.Errorf("failed to get buy-in trade: %v", err)
+		}
+		if trade.Status != "settled" {
+			return fmt.Errorf("buy-in trade %s is not settled, current status: %s", tradeID, trade.Status)
+		}
+		if trade.SecurityID != instruction.SecurityID || trade.BuyBrokerID != instruction.BuyBrokerID || trade.BuyClientID != instruction.BuyClientID {
+			return fmt.Errorf("trade %s did not buy %s for the buyer of instruction %s", tradeID, instruction.SecurityID, instructionID)
+		}
+
+		usedByJSON, err := ctx.GetStub().GetState("buyInTrade-" + tradeID)
+		if err != nil {
+			return fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if usedByJSON != nil {
+			return fmt.Errorf("trade %s already completed the buy-in of %s", tradeID, string(usedByJSON))
+		}
+
+		err = ctx.GetStub().PutState("buyInTrade-"+tradeID, []byte(instructionID))
+		if err != nil {
+			return fmt.Errorf("failed to put buy-in trade in ledger: %v", err)
+		}
+
+		quantity += trade.Quantity
+		cost += trade.Price.Times(trade.Quantity)
+	}
+
+	if quantity != instruction.Quantity {
+		return fmt.Errorf("buy-in trades deliver %d of the %d securities of instruction %s", quantity, instruction.Quantity, instructionID)
+	}
+
+	// The seller is charged the difference only when the buy-in cost more
+	difference := cost - instruction.TotalAmount
+	if difference < 0 {
+		difference = 0
+	}
+	if difference > 0 {
+		err = s.chargeBuyInDifference(ctx, instruction, difference, currentTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	instruction.Status = "bought_in"
+	instruction.CompletedAt = currentTime
+	instruction.BuyIn.Stage = "completed"
+	instruction.BuyIn.TradeIDs = buyInTradeIDs
+	instruction.BuyIn.BuyInCost = cost
+	instruction.BuyIn.PriceDifference = difference
+	instruction.BuyIn.CompletedAt = currentTime
+
+	trade, err := s.GetTrade(ctx, instruction.TradeID)
+	if err != nil {
+		return fmt.Errorf("failed to get trade: %v", err)
+	}
+
+	trade.Status = "bought_in"
+
+	tradeJSON, err := json.Marshal(trade)
+	if err != nil {
+		return fmt.Errorf("failed to marshal trade: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(instruction.TradeID, tradeJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update trade in ledger: %v", err)
+	}
+
+	return s.putInstruction(ctx, instruction, "BuyInCompleted")
+}
+
+// FailBuyIn closes a buy-in that could not buy the securities: the instruction fails and
+// the buyer is compensated in cash, as for any other fail
+func (s *SettlementContract) FailBuyIn(ctx contractapi.TransactionContextInterface, instructionID, reason string) error {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
+	if err != nil {
+		return err
+	}
+	if instruction.Status != "buy_in" {
+		return fmt.Errorf("instruction %s has no open buy-in, current status: %s", instructionID, instruction.Status)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	instruction.Status = "failed"
+	instruction.CompletedAt = currentTime
+	instruction.BuyIn.Stage = "compensated"
+	instruction.BuyIn.FailureReason = reason
+	instruction.BuyIn.CompletedAt = currentTime
+
+	instructionJSON, err := json.Marshal(instruction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settlement instruction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(instructionID, instructionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
+	}
+
+	return s.compensateFail(ctx, instruction, "seller_insufficient_securities", currentTime)
+}
+
+// chargeBuyInDifference moves the extra cost of a buy-in from the failing seller to the buyer
+func (s *SettlementContract) chargeBuyInDifference(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, difference Money, currentTime string) error {
+	sellerAccount, err := s.getOrNewBrokerAccount(ctx, instruction.SellBrokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get seller broker account: %v", err)
+	}
+
+	buyerAccount := sellerAccount
+	if instruction.BuyBrokerID != instruction.SellBrokerID {
+		buyerAccount, err = s.getOrNewBrokerAccount(ctx, instruction.BuyBrokerID)
+		if err != nil {
+			return fmt.Errorf("failed to get buyer broker account: %v", err)
+		}
+	}
+
+	// The seller's own funds first, then the default waterfall
+	err = s.collectFromBroker(ctx, sellerAccount, difference, journalHolder(instruction.BuyBrokerID, instruction.BuyClientID),
+		instruction.InstructionID, "buy_in_difference", currentTime)
+	if err != nil {
+		return err
+	}
+
+	// The buyer is paid the difference; a client's payment belongs to the client
+	buyerAccount.Balance += difference
+	buyerAccount.LastUpdated = currentTime
+
+	if instruction.BuyClientID != "" {
+		clientAccount, err := s.GetClientAccount(ctx, instruction.BuyBrokerID, instruction.BuyClientID)
+		if err != nil {
+			return fmt.Errorf("failed to get buyer client account: %v", err)
+		}
+
+		clientAccount.Balance += difference
+		clientAccount.LastUpdated = currentTime
+		buyerAccount.ClientBalance += difference
+
+		err = s.putClientAccount(ctx, clientAccount)
+		if err != nil {
+			return fmt.Errorf("failed to update buyer client account: %v", err)
+		}
+	}
+
+	err = s.putBrokerAccount(ctx, sellerAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update seller broker account: %v", err)
+	}
+	if buyerAccount != sellerAccount {
+		err = s.putBrokerAccount(ctx, buyerAccount)
+		if err != nil {
+			return fmt.Errorf("failed to update buyer broker account: %v", err)
+		}
+	}
+
+	return s.putTransaction(ctx, &Transaction{
+		TransactionID: "transaction-buy-in-" + instruction.InstructionID,
+		Type:          "buy_in_difference",
+		FromID:        instruction.SellBrokerID,
+		ToID:          instruction.BuyBrokerID,
+		ToClientID:    instruction.BuyClientID,
+		Amount:        difference,
+		InstructionID: instruction.InstructionID,
+		Status:        "completed",
+		Timestamp:     currentTime,
+	})
+}
+
+// collectFromBroker debits an amount owed by a broker from its available own funds first,
+// and covers the rest through the default waterfall (see defaults.go). payee is the
+// journal account the amount is owed to, and reference names the instruction or charge it
+// is owed for. The caller stores the broker account.
+func (s *SettlementContract) collectFromBroker(ctx contractapi.TransactionContextInterface, account *BrokerAccount, amount Money, payee, reference, reason, currentTime string) error {
+	fromAccount := amount
+	if available := account.available(); available < fromAccount {
+		fromAccount = available
+		if fromAccount < 0 {
+			fromAccount = 0
+		}
+	}
+	account.Balance -= fromAccount
+	account.LastUpdated = currentTime
+	s.journalMove(ctx, journalHolder(account.BrokerID, ""), payee, journalCash, int64(fromAccount))
+
+	remaining := amount - fromAccount
+	if remaining <= 0 {
+		return nil
+	}
+
+	_, err := s.coverDefault(ctx, account.BrokerID, remaining, payee, reference, reason, currentTime)
+	return err
+}
@@ -0,0 +1,156 @@
+// buyin_test.go - Tests of the extension period and buy-in of failed deliveries
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// cashBalance returns a broker's cash balance
+func cashBalance(t *testing.T, l *mockLedger, brokerID string) Money {
+	t.Helper()
+	s := &SettlementContract{}
+
+	var balance Money
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		account, err := s.GetBrokerAccount(ctx, brokerID)
+		if err != nil {
+			return err
+		}
+		balance = account.Balance
+		return nil
+	})
+	return balance
+}
+
+// runBatchOn runs the settlement batch on a day and returns the outcome of the instruction
+func runBatchOn(t *testing.T, l *mockLedger, day time.Time, instructionID string) *InstructionOutcome {
+	t.Helper()
+	s := &SettlementContract{}
+	l.now = day
+
+	var outcome *InstructionOutcome
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		run, err := s.BatchSettlement(ctx)
+		if err != nil {
+			return err
+		}
+		for _, o := range run.Outcomes {
+			if o.InstructionID == instructionID {
+				outcome = o
+			}
+		}
+		return nil
+	})
+	if outcome == nil {
+		t.Fatalf("batch of %s has no outcome for %s", day.Format("2006-01-02"), instructionID)
+	}
+	return outcome
+}
+
+func TestFailedDeliveryIsBoughtInAfterExtension(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 1000, 10000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+
+	// broker2 holds 800 of the 1,000 SEC002 it sold: the first fail opens the extension
+	// period and the instruction is recycled within it
+	for _, day := range []time.Time{
+		time.Date(2026, 3, 5, 10, 0, 0, 0, time.UTC),
+		time.Date(2026, 3, 9, 10, 0, 0, 0, time.UTC),
+	} {
+		outcome := runBatchOn(t, l, day, "instruction-trade-1")
+		if outcome.Outcome != "recycled" || outcome.ErrorCode != "seller_insufficient_securities" {
+			t.Fatalf("outcome on %s = %+v", day.Format("2006-01-02"), *outcome)
+		}
+	}
+	instruction := instructionOf(t, l, "instruction-trade-1")
+	if instruction.BuyIn == nil || instruction.BuyIn.Stage != "extension" || instruction.BuyIn.ExtensionDeadline != "2026-03-11" {
+		t.Fatalf("instruction in extension = %+v", instruction)
+	}
+
+	// After the extension period the buy-in opens and the holds are released
+	if outcome := runBatchOn(t, l, time.Date(2026, 3, 12, 10, 0, 0, 0, time.UTC), "instruction-trade-1"); outcome.Outcome != "buy_in" {
+		t.Fatalf("outcome after the extension = %+v", *outcome)
+	}
+	instruction = instructionOf(t, l, "instruction-trade-1")
+	if instruction.Status != "buy_in" || instruction.BuyIn.Stage != "buy_in" || instruction.ReservedAmount != 0 || instruction.ReservedQuantity != 0 {
+		t.Fatalf("instruction in buy-in = %+v", instruction)
+	}
+
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.CompleteBuyIn(ctx, "instruction-trade-1", []string{"trade-bi"})
+	})
+
+	// broker1 buys the securities from broker3 at 1.20 each
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateBrokerAccount(ctx, "broker3", 0) })
+	l.must(t, "Broker3MSP", func(ctx txCtx) error { return s.DepositSecurities(ctx, "broker3", "SEC002", 1000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-bi", "order-bi", "order-s3", "broker1", "broker3", "", "",
+			"SEC002", 1000, 12000, "pending", "2026-03-12T10:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-bi") })
+	l.now = time.Date(2026, 3, 17, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-bi") })
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.CompleteBuyIn(ctx, "instruction-trade-1", []string{"trade-bi"})
+	})
+	instruction = instructionOf(t, l, "instruction-trade-1")
+	if instruction.Status != "bought_in" || instruction.BuyIn.Stage != "completed" ||
+		instruction.BuyIn.BuyInCost != 12000000 || instruction.BuyIn.PriceDifference != 2000000 {
+		t.Fatalf("completed buy-in = %+v", instruction.BuyIn)
+	}
+
+	// broker2 pays the 20,000.00 the buy-in cost above the original trade
+	if balance := cashBalance(t, l, "broker1"); balance != 150000000-12000000+2000000 {
+		t.Errorf("broker1 balance = %v", balance)
+	}
+	if balance := cashBalance(t, l, "broker2"); balance != 50000000-2000000 {
+		t.Errorf("broker2 balance = %v", balance)
+	}
+	if quantity := securitiesHeld(t, l, "broker1", "SEC002"); quantity != 1000 {
+		t.Errorf("broker1 holds %d SEC002, want 1000", quantity)
+	}
+
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.CompleteBuyIn(ctx, "instruction-trade-1", []string{"trade-bi"})
+	})
+}
+
+func TestBuyInTradeCountsOnce(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 1000, 10000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	for _, day := range []int{5, 9, 12} {
+		runBatchOn(t, l, time.Date(2026, 3, day, 10, 0, 0, 0, time.UTC), "instruction-trade-1")
+	}
+
+	// A buy-in trade for half the quantity, passed twice
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateBrokerAccount(ctx, "broker3", 0) })
+	l.must(t, "Broker3MSP", func(ctx txCtx) error { return s.DepositSecurities(ctx, "broker3", "SEC002", 500) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-bi", "order-bi", "order-s3", "broker1", "broker3", "", "",
+			"SEC002", 500, 12000, "pending", "2026-03-12T10:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-bi") })
+	l.now = time.Date(2026, 3, 17, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-bi") })
+
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.CompleteBuyIn(ctx, "instruction-trade-1", []string{"trade-bi", "trade-bi"})
+	})
+	if instruction := instructionOf(t, l, "instruction-trade-1"); instruction.Status != "buy_in" {
+		t.Fatalf("instruction bought in with 500 of 1,000 securities: %+v", instruction)
+	}
+}
@@ -0,0 +1,359 @@
+// calendar.go - Business-day calendar and settlement cycles per instrument class
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Holiday is a day on which Maroclear does not settle, in addition to weekends
+type Holiday struct {
+	Date    string `json:"date"` // YYYY-MM-DD
+	Name    string `json:"name"`
+	AddedBy string `json:"addedBy"`
+	AddedAt string `json:"addedAt"`
+}
+
+// SettlementCycle is the number of business days between trade date and settlement
+// date (T+Days) for one instrument class
+type SettlementCycle struct {
+	InstrumentClass string `json:"instrumentClass"`
+	Days            int    `json:"days"`
+	UpdatedBy       string `json:"updatedBy"`
+	LastUpdated     string `json:"lastUpdated"`
+}
+
+// InstrumentClassAssignment maps a security to the instrument class whose settlement
+// cycle applies to its trades
+type InstrumentClassAssignment struct {
+	SecurityID      string `json:"securityID"`
+	InstrumentClass string `json:"instrumentClass"`
+	UpdatedBy       string `json:"updatedBy"`
+	LastUpdated     string `json:"lastUpdated"`
+}
+
+// Securities without an assigned class are equities, and classes without a configured
+// cycle settle T+3
+const (
+	defaultInstrumentClass = "equity"
+	defaultSettlementDays  = 3
+	maxSettlementDays      = 3
+	calendarDateLayout     = "2006-01-02"
+)
+
+// requireMaroclear ensures the caller belongs to Maroclear and returns its MSP ID
+func (s *SettlementContract) requireMaroclear(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return "", err
+	}
+	if mspID != "MaroclearMSP" {
+		return "", fmt.Errorf("only Maroclear is authorized to perform this operation")
+	}
+	return mspID, nil
+}
+
+// AddHoliday adds a public holiday (date as YYYY-MM-DD) to the settlement calendar
+func (s *SettlementContract) AddHoliday(ctx contractapi.TransactionContextInterface, date, name string) error {
+	mspID, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	day, err := time.Parse(calendarDateLayout, date)
+	if err != nil {
+		return fmt.Errorf("holiday date must be in YYYY-MM-DD format: %v", err)
+	}
+	if isWeekend(day) {
+		return fmt.Errorf("%s is already a weekend day", date)
+	}
+
+	existingJSON, err := ctx.GetStub().GetState("holiday-" + date)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("%s is already a holiday", date)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	holiday := Holiday{
+		Date:    date,
+		Name:    name,
+		AddedBy: mspID,
+		AddedAt: currentTime,
+	}
+
+	holidayJSON, err := json.Marshal(holiday)
+	if err != nil {
+		return fmt.Errorf("failed to marshal holiday: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("holiday-"+date, holidayJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put holiday in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// RemoveHoliday removes a public holiday from the settlement calendar. Instructions
+// already created keep the settlement date computed when they were created.
+func (s *SettlementContract) RemoveHoliday(ctx contractapi.TransactionContextInterface, date string) error {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = time.Parse(calendarDateLayout, date)
+	if err != nil {
+		return fmt.Errorf("holiday date must be in YYYY-MM-DD format: %v", err)
+	}
+
+	existingJSON, err := ctx.GetStub().GetState("holiday-" + date)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingJSON == nil {
+		return fmt.Errorf("%s is not a holiday", date)
+	}
+
+	err = ctx.GetStub().DelState("holiday-" + date)
+	if err != nil {
+		return fmt.Errorf("failed to delete holiday from ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetHolidays retrieves every holiday in the settlement calendar, in date order
+func (s *SettlementContract) GetHolidays(ctx contractapi.TransactionContextInterface) ([]*Holiday, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("holiday-", "holiday-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get holidays: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var holidays []*Holiday
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate holidays: %v", err)
+		}
+
+		var holiday Holiday
+		err = json.Unmarshal(queryResponse.Value, &holiday)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal holiday: %v", err)
+		}
+		holidays = append(holidays, &holiday)
+	}
+
+	return holidays, nil
+}
+
+// IsBusinessDay reports whether Maroclear settles on a date (YYYY-MM-DD)
+func (s *SettlementContract) IsBusinessDay(ctx contractapi.TransactionContextInterface, date string) (bool, error) {
+	day, err := time.Parse(calendarDateLayout, date)
+	if err != nil {
+		return false, fmt.Errorf("date must be in YYYY-MM-DD format: %v", err)
+	}
+
+	return s.isBusinessDay(ctx, day)
+}
+
+// isWeekend reports whether a day falls on Saturday or Sunday
+func isWeekend(day time.Time) bool {
+	return day.Weekday() == time.Saturday || day.Weekday() == time.Sunday
+}
+
+// isBusinessDay reports whether a day is neither a weekend day nor a holiday
+func (s *SettlementContract) isBusinessDay(ctx contractapi.TransactionContextInterface, day time.Time) (bool, error) {
+	if isWeekend(day) {
+		return false, nil
+	}
+
+	holidayJSON, err := ctx.GetStub().GetState("holiday-" + day.Format(calendarDateLayout))
+	if err != nil {
+		return false, fmt.Errorf("failed to read from world state: %v", err)
+	}
+
+	return holidayJSON == nil, nil
+}
+
+// addBusinessDays returns the settlement day for a trade date and a cycle of days
+// business days. For T+0 a trade made on a weekend or holiday settles on the next
+// business day.
+func (s *SettlementContract) addBusinessDays(ctx contractapi.TransactionContextInterface, tradeDate time.Time, days int) (time.Time, error) {
+	day := time.Date(tradeDate.Year(), tradeDate.Month(), tradeDate.Day(), 0, 0, 0, 0, time.UTC)
+
+	for {
+		businessDay, err := s.isBusinessDay(ctx, day)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if businessDay {
+			break
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+
+	for added := 0; added < days; {
+		day = day.AddDate(0, 0, 1)
+
+		businessDay, err := s.isBusinessDay(ctx, day)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if businessDay {
+			added++
+		}
+	}
+
+	return day, nil
+}
+
+// SetSettlementCycle sets the settlement cycle (T+0 through T+3) of an instrument class
+func (s *SettlementContract) SetSettlementCycle(ctx contractapi.TransactionContextInterface, instrumentClass string, days int) error {
+	mspID, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if instrumentClass == "" {
+		return fmt.Errorf("instrument class must not be empty")
+	}
+	if days < 0 || days > maxSettlementDays {
+		return fmt.Errorf("settlement cycle must be between T+0 and T+%d", maxSettlementDays)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	cycle := SettlementCycle{
+		InstrumentClass: instrumentClass,
+		Days:            days,
+		UpdatedBy:       mspID,
+		LastUpdated:     currentTime,
+	}
+
+	cycleJSON, err := json.Marshal(cycle)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settlement cycle: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("settlementCycle-"+instrumentClass, cycleJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put settlement cycle in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetSettlementCycle retrieves the settlement cycle of an instrument class
+// (T+3 until Maroclear configures one)
+func (s *SettlementContract) GetSettlementCycle(ctx contractapi.TransactionContextInterface, instrumentClass string) (*SettlementCycle, error) {
+	cycleJSON, err := ctx.GetStub().GetState("settlementCycle-" + instrumentClass)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if cycleJSON == nil {
+		return &SettlementCycle{
+			InstrumentClass: instrumentClass,
+			Days:            defaultSettlementDays,
+		}, nil
+	}
+
+	var cycle SettlementCycle
+	err = json.Unmarshal(cycleJSON, &cycle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal settlement cycle: %v", err)
+	}
+
+	return &cycle, nil
+}
+
+// SetInstrumentClass assigns a security to an instrument class
+func (s *SettlementContract) SetInstrumentClass(ctx contractapi.TransactionContextInterface, securityID, instrumentClass string) error {
+	mspID, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if instrumentClass == "" {
+		return fmt.Errorf("instrument class must not be empty")
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	assignment := InstrumentClassAssignment{
+		SecurityID:      securityID,
+		InstrumentClass: instrumentClass,
+		UpdatedBy:       mspID,
+		LastUpdated:     currentTime,
+	}
+
+	assignmentJSON, err := json.Marshal(assignment)
+	if err != nil {
+		return fmt.Errorf("failed to marshal instrument class: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("instrumentClass-"+securityID, assignmentJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put instrument class in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetInstrumentClass retrieves the instrument class of a security ("equity" unless assigned)
+func (s *SettlementContract) GetInstrumentClass(ctx contractapi.TransactionContextInterface, securityID string) (string, error) {
+	assignmentJSON, err := ctx.GetStub().GetState("instrumentClass-" + securityID)
+	if err != nil {
+		return "", fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if assignmentJSON == nil {
+		return defaultInstrumentClass, nil
+	}
+
+	var assignment InstrumentClassAssignment
+	err = json.Unmarshal(assignmentJSON, &assignment)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal instrument class: %v", err)
+	}
+
+	return assignment.InstrumentClass, nil
+}
+
+// settlementDateFor computes the settlement date of a trade from its trade date and the
+// settlement cycle of the security's instrument class. It returns the cycle used.
+func (s *SettlementContract) settlementDateFor(ctx contractapi.TransactionContextInterface, securityID string, tradeDate time.Time) (time.Time, int, error) {
+	instrumentClass, err := s.GetInstrumentClass(ctx, securityID)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	cycle, err := s.GetSettlementCycle(ctx, instrumentClass)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	settlementDate, err := s.addBusinessDays(ctx, tradeDate, cycle.Days)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	return settlementDate, cycle.Days, nil
+}
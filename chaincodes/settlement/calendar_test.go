@@ -0,0 +1,88 @@
+// calendar_test.go - Tests of the business-day calendar and settlement cycles
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSettlementDateSkipsWeekendsAndHolidays(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.AddHoliday(ctx, "2026-03-09", "Test holiday") })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetSettlementCycle(ctx, "bond", 0) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetInstrumentClass(ctx, "BOND01", "bond") })
+
+	dates := []struct {
+		securityID, tradeDate, settlementDate string
+		days                                  int
+	}{
+		{"SEC001", "2026-03-02", "2026-03-05", 3}, // equities default to T+3
+		{"SEC001", "2026-03-05", "2026-03-11", 3}, // over a weekend and a Monday holiday
+		{"BOND01", "2026-03-06", "2026-03-06", 0},
+		{"BOND01", "2026-03-07", "2026-03-10", 0}, // a Saturday trade settles on the next business day
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		for _, d := range dates {
+			tradeDate, err := time.Parse(calendarDateLayout, d.tradeDate)
+			if err != nil {
+				return err
+			}
+			settlementDate, days, err := s.settlementDateFor(ctx, d.securityID, tradeDate)
+			if err != nil {
+				return err
+			}
+			if settlementDate.Format(calendarDateLayout) != d.settlementDate || days != d.days {
+				t.Errorf("%s traded %s settles %s at T+%d, want %s at T+%d", d.securityID, d.tradeDate,
+					settlementDate.Format(calendarDateLayout), days, d.settlementDate, d.days)
+			}
+		}
+		return nil
+	})
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		businessDay, err := s.IsBusinessDay(ctx, "2026-03-09")
+		if businessDay {
+			t.Error("holiday is a business day")
+		}
+		return err
+	})
+}
+
+func TestSettlementCycleLimits(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error { return s.SetSettlementCycle(ctx, "equity", 2) })
+	for _, days := range []int{-1, 4} {
+		days := days
+		l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetSettlementCycle(ctx, "equity", days) })
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetSettlementCycle(ctx, "equity", 2) })
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		cycle, err := s.GetSettlementCycle(ctx, "equity")
+		if err != nil {
+			return err
+		}
+		if cycle.Days != 2 || cycle.UpdatedBy != "MaroclearMSP" {
+			t.Errorf("equity cycle = %+v", cycle)
+		}
+		return nil
+	})
+}
+
+func TestCalendarRejectsMalformedDates(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error { return s.RemoveHoliday(ctx, "2026/03/09") })
+	for _, matchTime := range []string{"", "2026-03-02 09:00"} {
+		matchTime := matchTime
+		l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+			return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+				"SEC002", 10, 100, "pending", matchTime, "")
+		})
+	}
+}
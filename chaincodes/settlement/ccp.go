@@ -0,0 +1,476 @@
+// ccp.go - Central counterparty mode: novation of trades into legs against the CCP
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ccpBrokerID is the account of the central counterparty. Its cash and securities accounts
+// are kept in Maroclear's own collection (see collections_config.json).
+const ccpBrokerID = "ccp"
+
+// Clearing modes. In bilateral mode an instruction links the buyer and the seller directly;
+// in central counterparty mode every trade is novated into two legs against the CCP.
+const (
+	clearingModeBilateral = "bilateral"
+	clearingModeCCP       = "ccp"
+)
+
+// Legs of a novated trade
+const (
+	novatedLegBuy  = "buy"  // the buyer against the CCP
+	novatedLegSell = "sell" // the CCP against the seller
+)
+
+// ClearingMode is how new trades are cleared
+type ClearingMode struct {
+	Mode        string `json:"mode"` // bilateral, ccp
+	UpdatedBy   string `json:"updatedBy"`
+	LastUpdated string `json:"lastUpdated"`
+}
+
+// Novation records a trade replaced by two legs against the CCP, for audit: the buyer
+// settles with the CCP and the CCP with the seller. Both legs keep the trade's ID.
+type Novation struct {
+	TradeID      string `json:"tradeID"`
+	BuyLegID     string `json:"buyLegID"`
+	SellLegID    string `json:"sellLegID"`
+	BuyBrokerID  string `json:"buyBrokerID"`
+	SellBrokerID string `json:"sellBrokerID"`
+	CCPID        string `json:"ccpID"`
+	NovatedAt    string `json:"novatedAt"`
+}
+
+// SetClearingMode switches how trades imported from now on are cleared: bilateral or ccp.
+// Instructions already created keep the mode they were created in.
+func (s *SettlementContract) SetClearingMode(ctx contractapi.TransactionContextInterface, mode string) error {
+	mspID, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if mode != clearingModeBilateral && mode != clearingModeCCP {
+		return fmt.Errorf("clearing mode must be %s or %s", clearingModeBilateral, clearingModeCCP)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	clearingMode := ClearingMode{
+		Mode:        mode,
+		UpdatedBy:   mspID,
+		LastUpdated: currentTime,
+	}
+
+	clearingModeJSON, err := json.Marshal(clearingMode)
+	if err != nil {
+		return fmt.Errorf("failed to marshal clearing mode: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("clearingMode", clearingModeJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put clearing mode in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetClearingMode retrieves the clearing mode (bilateral until Maroclear sets it)
+func (s *SettlementContract) GetClearingMode(ctx contractapi.TransactionContextInterface) (*ClearingMode, error) {
+	clearingModeJSON, err := ctx.GetStub().GetState("clearingMode")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if clearingModeJSON == nil {
+		return &ClearingMode{Mode: clearingModeBilateral}, nil
+	}
+
+	var clearingMode ClearingMode
+	err = json.Unmarshal(clearingModeJSON, &clearingMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal clearing mode: %v", err)
+	}
+
+	return &clearingMode, nil
+}
+
+// GetNovation retrieves how a trade was novated
+func (s *SettlementContract) GetNovation(ctx contractapi.TransactionContextInterface, tradeID string) (*Novation, error) {
+	novation, err := s.getNovation(ctx, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	if novation == nil {
+		return nil, fmt.Errorf("trade %s was not novated", tradeID)
+	}
+
+	return novation, nil
+}
+
+// getNovation returns how a trade was novated, nil if it was not
+func (s *SettlementContract) getNovation(ctx contractapi.TransactionContextInterface, tradeID string) (*Novation, error) {
+	novationJSON, err := ctx.GetStub().GetState("novation-" + tradeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if novationJSON == nil {
+		return nil, nil
+	}
+
+	var novation Novation
+	err = json.Unmarshal(novationJSON, &novation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal novation: %v", err)
+	}
+
+	return &novation, nil
+}
+
+// novateInstruction replaces a new instruction by a buy leg, the buyer against the CCP, and
+// a sell leg, the CCP against the seller, and places each broker's holds on its leg. The
+// CCP's sides are affirmed and never held: it performs once its other leg settles.
+func (s *SettlementContract) novateInstruction(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, currentTime string) error {
+	// The legs' holds may be placed on the same accounts
+	ctx = withWriteCache(ctx)
+
+	buyLeg, sellLeg := *instruction, *instruction
+
+	buyLeg.InstructionID = instruction.InstructionID + "-" + novatedLegBuy
+	buyLeg.SellBrokerID = ccpBrokerID
+	buyLeg.SellClientID = ""
+	buyLeg.SellAffirmation = affirmationAffirmed
+	buyLeg.NovatedLeg = novatedLegBuy
+
+	sellLeg.InstructionID = instruction.InstructionID + "-" + novatedLegSell
+	sellLeg.BuyBrokerID = ccpBrokerID
+	sellLeg.BuyClientID = ""
+	sellLeg.BuyAffirmation = affirmationAffirmed
+	sellLeg.NovatedLeg = novatedLegSell
+
+	buyLeg.PairedInstructionID = sellLeg.InstructionID
+	sellLeg.PairedInstructionID = buyLeg.InstructionID
+
+	for _, leg := range []*SettlementInstruction{&buyLeg, &sellLeg} {
+		legs, err := s.loadClientLegs(ctx, leg)
+		if err != nil {
+			return fmt.Errorf("failed to load client accounts: %v", err)
+		}
+
+		holds, err := s.loadInstructionHolds(ctx, leg, legs)
+		if err != nil {
+			return err
+		}
+
+		holds.reserve(leg, currentTime)
+
+		err = holds.save(ctx, s)
+		if err != nil {
+			return err
+		}
+
+		legJSON, err := json.Marshal(leg)
+		if err != nil {
+			return fmt.Errorf("failed to marshal settlement instruction: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(leg.InstructionID, legJSON)
+		if err != nil {
+			return fmt.Errorf("failed to put settlement instruction in ledger: %v", err)
+		}
+	}
+
+	novation := Novation{
+		TradeID:      instruction.TradeID,
+		BuyLegID:     buyLeg.InstructionID,
+		SellLegID:    sellLeg.InstructionID,
+		BuyBrokerID:  instruction.BuyBrokerID,
+		SellBrokerID: instruction.SellBrokerID,
+		CCPID:        ccpBrokerID,
+		NovatedAt:    currentTime,
+	}
+
+	novationJSON, err := json.Marshal(novation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal novation: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("novation-"+instruction.TradeID, novationJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put novation in ledger: %v", err)
+	}
+
+	// Emit an event for the novation
+	err = ctx.GetStub().SetEvent("TradeNovated", novationJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set TradeNovated event: %v", err)
+	}
+
+	return nil
+}
+
+// executeNovatedSettlement settles a novated leg together with its paired leg, so the CCP
+// passes the cash and securities straight through. A broker that cannot settle its leg
+// fails as on any instruction, and the CCP, made whole through the default waterfall,
+// still settles the other leg when its own accounts cover it. Legs only fail when
+// failUnsettled is set (see executeSettlement).
+func (s *SettlementContract) executeNovatedSettlement(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, failUnsettled bool) error {
+	// The other leg settles against the accounts left by a fail
+	ctx = withWriteCache(ctx)
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	instructions := []*SettlementInstruction{instruction}
+	paired, err := s.GetSettlementInstruction(ctx, instruction.PairedInstructionID)
+	if err != nil {
+		return err
+	}
+	if paired.isLive() {
+		eligible, err := s.applyAffirmationDeadline(ctx, paired)
+		if err != nil {
+			return err
+		}
+		if eligible {
+			instructions = append(instructions, paired)
+		}
+	}
+
+	book := newAccountBook()
+	if trial := book.try(ctx, s, instructions, currentTime); trial != nil {
+		return s.saveNovatedSettlement(ctx, trial, currentTime)
+	}
+
+	// Fail the legs whose broker cannot settle
+	progress := false
+	for _, leg := range instructions {
+		failureReason, err := book.shortfall(ctx, s, leg)
+		if err != nil {
+			return err
+		}
+		if failureReason == "" {
+			continue
+		}
+		if !failUnsettled {
+			return fmt.Errorf("instruction %s cannot settle (%s) and stays in the settlement queue", leg.InstructionID, failureReason)
+		}
+
+		err = s.processFail(ctx, leg.InstructionID, failureReason)
+		if err != nil {
+			return err
+		}
+		progress = true
+	}
+
+	// The legs still live settle alone when the CCP's accounts cover them
+	for _, leg := range instructions {
+		current, err := s.GetSettlementInstruction(ctx, leg.InstructionID)
+		if err != nil {
+			return err
+		}
+		if !current.isLive() {
+			continue
+		}
+		current.Status = leg.Status
+
+		if trial := newAccountBook().try(ctx, s, []*SettlementInstruction{current}, currentTime); trial != nil {
+			err = s.saveNovatedSettlement(ctx, trial, currentTime)
+			if err != nil {
+				return err
+			}
+			progress = true
+		}
+	}
+
+	if !progress {
+		return fmt.Errorf("instruction %s awaits the CCP's side, which settles with paired leg %s", instruction.InstructionID, instruction.PairedInstructionID)
+	}
+
+	return nil
+}
+
+// saveNovatedSettlement stores the legs settled through an account book and their accounts
+func (s *SettlementContract) saveNovatedSettlement(ctx contractapi.TransactionContextInterface, book *accountBook, currentTime string) error {
+	err := book.save(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	for _, leg := range book.settled {
+		err = s.recordSettlement(ctx, leg, currentTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	settledJSON, err := json.Marshal(book.settled)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settled legs: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("NovatedSettlementExecuted", settledJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set NovatedSettlementExecuted event: %v", err)
+	}
+
+	return nil
+}
+
+// queuedPair returns the paired leg of a novated instruction when it is also in the queue
+func queuedPair(queue []*SettlementInstruction, instruction *SettlementInstruction) *SettlementInstruction {
+	if instruction.PairedInstructionID == "" {
+		return nil
+	}
+	for _, queued := range queue {
+		if queued.InstructionID == instruction.PairedInstructionID {
+			return queued
+		}
+	}
+	return nil
+}
+
+// closeOutNovatedFail closes a novated sell leg whose seller did not deliver by the end of
+// its extension period. The CCP does not buy in: the sell leg fails and the CCP is
+// compensated through the default waterfall. The buy leg then settles from the CCP's own
+// securities if it holds enough, or is closed out and the CCP pays the buyer the same
+// compensation.
+func (s *SettlementContract) closeOutNovatedFail(ctx contractapi.TransactionContextInterface, sellLeg *SettlementInstruction, currentTime string) error {
+	err := s.releaseInstructionHolds(ctx, sellLeg, currentTime)
+	if err != nil {
+		return err
+	}
+
+	sellLeg.Status = "failed"
+	sellLeg.CompletedAt = currentTime
+	sellLeg.BuyIn.FailureReason = "closed_out_by_ccp"
+	sellLeg.BuyIn.CompletedAt = currentTime
+
+	sellLegJSON, err := json.Marshal(sellLeg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settlement instruction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(sellLeg.InstructionID, sellLegJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
+	}
+
+	err = s.compensateFail(ctx, sellLeg, "seller_insufficient_securities", currentTime)
+	if err != nil {
+		return err
+	}
+
+	buyLeg, err := s.GetSettlementInstruction(ctx, sellLeg.PairedInstructionID)
+	if err != nil {
+		return err
+	}
+	if !buyLeg.isLive() {
+		return nil
+	}
+
+	eligible, err := s.applyAffirmationDeadline(ctx, buyLeg)
+	if err != nil {
+		return err
+	}
+	if eligible {
+		if trial := newAccountBook().try(ctx, s, []*SettlementInstruction{buyLeg}, currentTime); trial != nil {
+			return s.saveNovatedSettlement(ctx, trial, currentTime)
+		}
+	}
+
+	err = s.releaseInstructionHolds(ctx, buyLeg, currentTime)
+	if err != nil {
+		return err
+	}
+
+	buyLeg.Status = "failed"
+	buyLeg.CompletedAt = currentTime
+
+	buyLegJSON, err := json.Marshal(buyLeg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settlement instruction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(buyLeg.InstructionID, buyLegJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
+	}
+
+	// The CCP passes the compensation on; a client's compensation belongs to the client
+	amount := buyLeg.Price.Times(buyLeg.Quantity)
+
+	ccpAccount, err := s.getOrNewBrokerAccount(ctx, ccpBrokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get CCP account: %v", err)
+	}
+
+	buyerAccount, err := s.getOrNewBrokerAccount(ctx, buyLeg.BuyBrokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get buyer broker account: %v", err)
+	}
+
+	ccpAccount.Balance -= amount
+	ccpAccount.LastUpdated = currentTime
+	buyerAccount.Balance += amount
+	buyerAccount.LastUpdated = currentTime
+
+	if buyLeg.BuyClientID != "" {
+		clientAccount, err := s.GetClientAccount(ctx, buyLeg.BuyBrokerID, buyLeg.BuyClientID)
+		if err != nil {
+			return fmt.Errorf("failed to get buyer client account: %v", err)
+		}
+
+		clientAccount.Balance += amount
+		clientAccount.LastUpdated = currentTime
+		buyerAccount.ClientBalance += amount
+
+		err = s.putClientAccount(ctx, clientAccount)
+		if err != nil {
+			return fmt.Errorf("failed to update buyer client account: %v", err)
+		}
+	}
+
+	err = s.putBrokerAccount(ctx, ccpAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update CCP account: %v", err)
+	}
+
+	err = s.putBrokerAccount(ctx, buyerAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update buyer broker account: %v", err)
+	}
+	s.journalMove(ctx, journalHolder(ccpBrokerID, ""), journalHolder(buyLeg.BuyBrokerID, buyLeg.BuyClientID), journalCash, int64(amount))
+
+	return s.putTransaction(ctx, &Transaction{
+		TransactionID: "transaction-compensation-" + buyLeg.InstructionID,
+		Type:          "compensation",
+		FromID:        ccpBrokerID,
+		ToID:          buyLeg.BuyBrokerID,
+		ToClientID:    buyLeg.BuyClientID,
+		Amount:        amount,
+		InstructionID: buyLeg.InstructionID,
+		Status:        "completed",
+		Timestamp:     currentTime,
+	})
+}
+
+// novatedTradeSettled reports whether the trade of a settled leg is settled: a novated
+// trade is settled once both its legs are
+func (s *SettlementContract) novatedTradeSettled(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction) (bool, error) {
+	if instruction.PairedInstructionID == "" {
+		return true, nil
+	}
+
+	paired, err := s.GetSettlementInstruction(ctx, instruction.PairedInstructionID)
+	if err != nil {
+		return false, err
+	}
+
+	return paired.Status == "completed", nil
+}
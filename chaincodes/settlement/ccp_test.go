@@ -0,0 +1,110 @@
+// ccp_test.go - Tests of trades novated to the central counterparty
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setUpNovatedTrade switches to CCP clearing and novates a trade of broker1 buying SEC002
+// from broker2
+func setUpNovatedTrade(t *testing.T, l *mockLedger, quantity int, priceCentimes int64) {
+	t.Helper()
+	s := &SettlementContract{}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetClearingMode(ctx, "ccp") })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", quantity, priceCentimes, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+}
+
+func TestNovatedTradeSettlesThroughTheCCP(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpNovatedTrade(t, l, 100, 1000)
+
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		novation, err := s.GetNovation(ctx, "trade-1")
+		if err != nil {
+			return err
+		}
+		if novation.BuyLegID != "instruction-trade-1-buy" || novation.SellLegID != "instruction-trade-1-sell" || novation.CCPID != "ccp" {
+			t.Errorf("novation = %+v", *novation)
+		}
+		return nil
+	})
+
+	// Executing either leg settles both against the CCP, which is left flat
+	l.now = time.Date(2026, 3, 5, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1-buy") })
+	for _, id := range []string{"instruction-trade-1-buy", "instruction-trade-1-sell"} {
+		if instruction := instructionOf(t, l, id); instruction.Status != "completed" {
+			t.Errorf("%s is %s, want completed", id, instruction.Status)
+		}
+	}
+	if balance := cashBalance(t, l, "broker1"); balance != 150000000-100000 {
+		t.Errorf("broker1 balance = %v", balance)
+	}
+	if balance := cashBalance(t, l, "broker2"); balance != 50000000+100000 {
+		t.Errorf("broker2 balance = %v", balance)
+	}
+	if quantity := securitiesHeld(t, l, "broker1", "SEC002"); quantity != 100 {
+		t.Errorf("broker1 holds %d SEC002, want 100", quantity)
+	}
+	if quantity := securitiesHeld(t, l, "ccp", "SEC002"); quantity != 0 {
+		t.Errorf("the CCP holds %d SEC002, want 0", quantity)
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		trade, err := s.GetTrade(ctx, "trade-1")
+		if err != nil {
+			return err
+		}
+		if trade.Status != "settled" {
+			t.Errorf("trade is %s, want settled", trade.Status)
+		}
+		return nil
+	})
+}
+
+func TestCCPPaysTheSellerWhenTheBuyerDefaults(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpNovatedTrade(t, l, 100, 10000000)
+
+	// broker1 cannot pay 10,000,000.00. Only the final settlement run fails its leg; the CCP
+	// then still pays broker2 and keeps the securities.
+	l.now = settlementDay
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1-sell") })
+	if instruction := instructionOf(t, l, "instruction-trade-1-buy"); instruction.Status != "pending" {
+		t.Fatalf("buy leg is %s outside the settlement run, want pending", instruction.Status)
+	}
+	runBatchOn(t, l, settlementDay, "instruction-trade-1-sell")
+
+	if instruction := instructionOf(t, l, "instruction-trade-1-sell"); instruction.Status != "completed" {
+		t.Errorf("sell leg is %s, want completed", instruction.Status)
+	}
+	if instruction := instructionOf(t, l, "instruction-trade-1-buy"); instruction.Status != "failed" {
+		t.Errorf("buy leg is %s, want failed", instruction.Status)
+	}
+	if balance := cashBalance(t, l, "broker2"); balance != 50000000+1000000000 {
+		t.Errorf("broker2 balance = %v", balance)
+	}
+	if quantity := securitiesHeld(t, l, "ccp", "SEC002"); quantity != 100 {
+		t.Errorf("the CCP holds %d SEC002, want 100", quantity)
+	}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		losses, err := s.GetDefaultLosses(ctx, "broker1")
+		if err != nil {
+			return err
+		}
+		if len(losses) != 1 || losses[0].Amount != 1000000000 {
+			t.Errorf("broker1 default losses = %v", losses)
+		}
+		return nil
+	})
+}
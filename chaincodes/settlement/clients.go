@@ -0,0 +1,761 @@
+// clients.go - Client (beneficial owner) sub-accounts held under each broker
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ClientAccount represents a client's cash sub-account under a broker.
+// The broker's BrokerAccount.ClientBalance is the omnibus total of these balances.
+type ClientAccount struct {
+	ClientID        string `json:"clientID"`
+	BrokerID        string `json:"brokerID"`
+	Name            string `json:"name"`
+	KYCStatus       string `json:"kycStatus"` // pending, verified, rejected, suspended
+	Balance         Money  `json:"balance"`
+	ReservedBalance Money  `json:"reservedBalance"`
+	CreatedAt       string `json:"createdAt"`
+	LastUpdated     string `json:"lastUpdated"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// ClientSecuritiesAccount represents a client's holding of a security under a broker.
+// The broker's SecuritiesAccount.ClientQty is the omnibus total of these quantities.
+type ClientSecuritiesAccount struct {
+	AccountID   string `json:"accountID"`
+	ClientID    string `json:"clientID"`
+	BrokerID    string `json:"brokerID"`
+	SecurityID  string `json:"securityID"`
+	Quantity    int    `json:"quantity"`
+	ReservedQty int    `json:"reservedQty"`
+	LastUpdated string `json:"lastUpdated"`
+}
+
+// SecuritySegregation compares client holdings of one security with the broker's omnibus total
+type SecuritySegregation struct {
+	SecurityID     string `json:"securityID"`
+	ClientQuantity int    `json:"clientQuantity"`
+	OmnibusQty     int    `json:"omnibusQty"`
+	Reconciled     bool   `json:"reconciled"`
+}
+
+// SegregationReport proves that the sum of a broker's client sub-accounts equals the omnibus totals
+type SegregationReport struct {
+	BrokerID       string                `json:"brokerID"`
+	ClientCount    int                   `json:"clientCount"`
+	ClientCash     Money                 `json:"clientCash"`
+	OmnibusCash    Money                 `json:"omnibusCash"`
+	CashReconciled bool                  `json:"cashReconciled"`
+	Securities     []SecuritySegregation `json:"securities"`
+	Segregated     bool                  `json:"segregated"`
+	CheckedAt      string                `json:"checkedAt"`
+}
+
+func clientAccountKey(brokerID, clientID string) string {
+	return "clientAccount-" + brokerID + "-" + clientID
+}
+
+func clientSecuritiesAccountKey(brokerID, clientID, securityID string) string {
+	return "clientSecuritiesAccount-" + brokerID + "-" + clientID + "-" + securityID
+}
+
+func isValidKYCStatus(status string) bool {
+	return status == "pending" || status == "verified" || status == "rejected" || status == "suspended"
+}
+
+// checkReservations ensures the sub-account's holds are not negative and do not exceed its balance
+func (account *ClientAccount) checkReservations() error {
+	if account.ReservedBalance < 0 || account.available() < 0 {
+		return fmt.Errorf("reserved balance %v of client %s is outside its balance %v",
+			account.ReservedBalance, account.ClientID, account.Balance)
+	}
+	return nil
+}
+
+// checkReservations ensures the sub-account's held quantity is not negative and does not
+// exceed its quantity
+func (account *ClientSecuritiesAccount) checkReservations() error {
+	if account.ReservedQty < 0 || account.available() < 0 {
+		return fmt.Errorf("reserved quantity %d of %s is outside its quantity %d",
+			account.ReservedQty, account.AccountID, account.Quantity)
+	}
+	return nil
+}
+
+// putClientAccount stores a client cash sub-account in the broker's collection
+func (s *SettlementContract) putClientAccount(ctx contractapi.TransactionContextInterface, account *ClientAccount) error {
+	err := account.checkReservations()
+	if err != nil {
+		return err
+	}
+
+	accountJSON, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("failed to marshal client account: %v", err)
+	}
+
+	err = s.putAccountState(ctx, account.BrokerID, clientAccountKey(account.BrokerID, account.ClientID), accountJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put client account in collection: %v", err)
+	}
+
+	return nil
+}
+
+// putClientSecuritiesAccount stores a client securities sub-account in the broker's collection
+func (s *SettlementContract) putClientSecuritiesAccount(ctx contractapi.TransactionContextInterface, account *ClientSecuritiesAccount) error {
+	err := account.checkReservations()
+	if err != nil {
+		return err
+	}
+
+	accountJSON, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("failed to marshal client securities account: %v", err)
+	}
+
+	err = s.putAccountState(ctx, account.BrokerID, account.AccountID, accountJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put client securities account in collection: %v", err)
+	}
+
+	return nil
+}
+
+// CreateClientAccount opens a cash sub-account for a client of a broker
+func (s *SettlementContract) CreateClientAccount(ctx contractapi.TransactionContextInterface, brokerID, clientID, name, kycStatus string) error {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	if clientID == "" {
+		return fmt.Errorf("client ID must not be empty")
+	}
+	if !isValidKYCStatus(kycStatus) {
+		return fmt.Errorf("invalid KYC status: must be 'pending', 'verified', 'rejected', or 'suspended'")
+	}
+
+	// The broker must already have an omnibus account to hold the client's cash
+	_, err = s.GetBrokerAccount(ctx, brokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get broker account: %v", err)
+	}
+
+	accountJSON, err := s.getPrivateState(ctx, brokerID, clientAccountKey(brokerID, clientID))
+	if err != nil {
+		return fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	if accountJSON != nil {
+		return fmt.Errorf("client account %s already exists for broker %s", clientID, brokerID)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	account := ClientAccount{
+		ClientID:        clientID,
+		BrokerID:        brokerID,
+		Name:            name,
+		KYCStatus:       kycStatus,
+		Balance:         0,
+		ReservedBalance: 0,
+		CreatedAt:       currentTime,
+		LastUpdated:     currentTime,
+	}
+
+	err = s.putClientAccount(ctx, &account)
+	if err != nil {
+		return fmt.Errorf("failed to store client account: %v", err)
+	}
+
+	return nil
+}
+
+// GetClientAccount retrieves a client cash sub-account
+func (s *SettlementContract) GetClientAccount(ctx contractapi.TransactionContextInterface, brokerID, clientID string) (*ClientAccount, error) {
+	accountJSON, err := s.getPrivateState(ctx, brokerID, clientAccountKey(brokerID, clientID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	if accountJSON == nil {
+		return nil, fmt.Errorf("client account %s does not exist for broker %s", clientID, brokerID)
+	}
+
+	var account ClientAccount
+	err = json.Unmarshal(accountJSON, &account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal client account: %v", err)
+	}
+
+	return &account, nil
+}
+
+// GetClientSecuritiesAccount retrieves a client's holding of a security
+func (s *SettlementContract) GetClientSecuritiesAccount(ctx contractapi.TransactionContextInterface, brokerID, clientID, securityID string) (*ClientSecuritiesAccount, error) {
+	accountJSON, err := s.getPrivateState(ctx, brokerID, clientSecuritiesAccountKey(brokerID, clientID, securityID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	if accountJSON == nil {
+		return nil, fmt.Errorf("securities account for client %s of broker %s and security %s does not exist", clientID, brokerID, securityID)
+	}
+
+	var account ClientSecuritiesAccount
+	err = json.Unmarshal(accountJSON, &account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal client securities account: %v", err)
+	}
+
+	return &account, nil
+}
+
+// getOrNewClientSecuritiesAccount returns the client's holding of a security, or an empty one
+func (s *SettlementContract) getOrNewClientSecuritiesAccount(ctx contractapi.TransactionContextInterface, brokerID, clientID, securityID string) (*ClientSecuritiesAccount, error) {
+	accountID := clientSecuritiesAccountKey(brokerID, clientID, securityID)
+	accountJSON, err := s.getPrivateState(ctx, brokerID, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	if accountJSON == nil {
+		return &ClientSecuritiesAccount{
+			AccountID:  accountID,
+			ClientID:   clientID,
+			BrokerID:   brokerID,
+			SecurityID: securityID,
+		}, nil
+	}
+
+	var account ClientSecuritiesAccount
+	err = json.Unmarshal(accountJSON, &account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal client securities account: %v", err)
+	}
+
+	return &account, nil
+}
+
+// getOrNewBrokerAccount returns the broker's cash account, or an empty one
+func (s *SettlementContract) getOrNewBrokerAccount(ctx contractapi.TransactionContextInterface, brokerID string) (*BrokerAccount, error) {
+	accountJSON, err := s.getPrivateState(ctx, brokerID, "brokerAccount-"+brokerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	if accountJSON == nil {
+		return &BrokerAccount{BrokerID: brokerID}, nil
+	}
+
+	var account BrokerAccount
+	err = json.Unmarshal(accountJSON, &account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal broker account: %v", err)
+	}
+
+	return &account, nil
+}
+
+// getOrNewSecuritiesAccount returns the broker's securities account for a security, or an empty one
+func (s *SettlementContract) getOrNewSecuritiesAccount(ctx contractapi.TransactionContextInterface, brokerID, securityID string) (*SecuritiesAccount, error) {
+	accountID := "securitiesAccount-" + brokerID + "-" + securityID
+	accountJSON, err := s.getPrivateState(ctx, brokerID, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	if accountJSON == nil {
+		return &SecuritiesAccount{
+			AccountID:  accountID,
+			BrokerID:   brokerID,
+			SecurityID: securityID,
+		}, nil
+	}
+
+	var account SecuritiesAccount
+	err = json.Unmarshal(accountJSON, &account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal securities account: %v", err)
+	}
+
+	return &account, nil
+}
+
+// getVerifiedClientAccount retrieves a client account and checks that the client may settle
+func (s *SettlementContract) getVerifiedClientAccount(ctx contractapi.TransactionContextInterface, brokerID, clientID string) (*ClientAccount, error) {
+	account, err := s.GetClientAccount(ctx, brokerID, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if account.KYCStatus != "verified" {
+		return nil, fmt.Errorf("client %s of broker %s has KYC status %s", clientID, brokerID, account.KYCStatus)
+	}
+
+	return account, nil
+}
+
+// UpdateClientKYCStatus updates the KYC status of a client
+func (s *SettlementContract) UpdateClientKYCStatus(ctx contractapi.TransactionContextInterface, brokerID, clientID, kycStatus string) error {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	if !isValidKYCStatus(kycStatus) {
+		return fmt.Errorf("invalid KYC status: must be 'pending', 'verified', 'rejected', or 'suspended'")
+	}
+
+	account, err := s.GetClientAccount(ctx, brokerID, clientID)
+	if err != nil {
+		return err
+	}
+
+	account.KYCStatus = kycStatus
+	account.LastUpdated, err = s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = s.putClientAccount(ctx, account)
+	if err != nil {
+		return fmt.Errorf("failed to update client account: %v", err)
+	}
+
+	return nil
+}
+
+// DepositClientFunds credits cash received from a client to the client's sub-account (amount in centimes)
+// and to the broker's omnibus account
+func (s *SettlementContract) DepositClientFunds(ctx contractapi.TransactionContextInterface, brokerID, clientID string, amountCentimes int64) error {
+	amount := Money(amountCentimes)
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	if amount <= 0 {
+		return fmt.Errorf("deposit amount must be positive")
+	}
+
+	clientAccount, err := s.getVerifiedClientAccount(ctx, brokerID, clientID)
+	if err != nil {
+		return err
+	}
+
+	brokerAccount, err := s.GetBrokerAccount(ctx, brokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get broker account: %v", err)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	clientAccount.Balance += amount
+	clientAccount.LastUpdated = currentTime
+
+	brokerAccount.Balance += amount
+	brokerAccount.ClientBalance += amount
+	brokerAccount.LastUpdated = currentTime
+
+	err = s.putClientAccount(ctx, clientAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update client account: %v", err)
+	}
+
+	err = s.putBrokerAccount(ctx, brokerAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update broker account: %v", err)
+	}
+	s.journalMove(ctx, journalSystem, journalHolder(brokerID, clientID), journalCash, int64(amount))
+
+	transaction := Transaction{
+		TransactionID: fmt.Sprintf("transaction-client-deposit-%s-%s-%s", brokerID, clientID, s.getTransactionID(ctx)),
+		Type:          "deposit",
+		FromID:        "external",
+		ToID:          brokerID,
+		FromClientID:  "",
+		ToClientID:    clientID,
+		SecurityID:    "",
+		Amount:        amount,
+		InstructionID: "",
+		Status:        "completed",
+		Timestamp:     currentTime,
+	}
+
+	return s.putTransaction(ctx, &transaction)
+}
+
+// WithdrawClientFunds pays cash out of a client's sub-account and the broker's omnibus account
+// (amount in centimes)
+func (s *SettlementContract) WithdrawClientFunds(ctx contractapi.TransactionContextInterface, brokerID, clientID string, amountCentimes int64) error {
+	amount := Money(amountCentimes)
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	if amount <= 0 {
+		return fmt.Errorf("withdrawal amount must be positive")
+	}
+
+	clientAccount, err := s.GetClientAccount(ctx, brokerID, clientID)
+	if err != nil {
+		return err
+	}
+
+	if clientAccount.available() < amount {
+		return fmt.Errorf("insufficient available balance for withdrawal")
+	}
+
+	brokerAccount, err := s.GetBrokerAccount(ctx, brokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get broker account: %v", err)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	clientAccount.Balance -= amount
+	clientAccount.LastUpdated = currentTime
+
+	brokerAccount.Balance -= amount
+	brokerAccount.ClientBalance -= amount
+	brokerAccount.LastUpdated = currentTime
+
+	err = s.putClientAccount(ctx, clientAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update client account: %v", err)
+	}
+
+	err = s.putBrokerAccount(ctx, brokerAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update broker account: %v", err)
+	}
+	s.journalMove(ctx, journalHolder(brokerID, clientID), journalSystem, journalCash, int64(amount))
+
+	transaction := Transaction{
+		TransactionID: fmt.Sprintf("transaction-client-withdrawal-%s-%s-%s", brokerID, clientID, s.getTransactionID(ctx)),
+		Type:          "withdrawal",
+		FromID:        brokerID,
+		ToID:          "external",
+		FromClientID:  clientID,
+		ToClientID:    "",
+		SecurityID:    "",
+		Amount:        amount,
+		InstructionID: "",
+		Status:        "completed",
+		Timestamp:     currentTime,
+	}
+
+	return s.putTransaction(ctx, &transaction)
+}
+
+// DepositClientSecurities credits securities transferred in by a client to the client's
+// sub-account and to the broker's omnibus securities account
+func (s *SettlementContract) DepositClientSecurities(ctx contractapi.TransactionContextInterface, brokerID, clientID, securityID string, quantity int) error {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	if quantity <= 0 {
+		return fmt.Errorf("deposit quantity must be positive")
+	}
+
+	_, err = s.getVerifiedClientAccount(ctx, brokerID, clientID)
+	if err != nil {
+		return err
+	}
+
+	clientSecurities, err := s.getOrNewClientSecuritiesAccount(ctx, brokerID, clientID, securityID)
+	if err != nil {
+		return err
+	}
+
+	securitiesAccount, err := s.getOrNewSecuritiesAccount(ctx, brokerID, securityID)
+	if err != nil {
+		return err
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	clientSecurities.Quantity += quantity
+	clientSecurities.LastUpdated = currentTime
+
+	securitiesAccount.Quantity += quantity
+	securitiesAccount.ClientQty += quantity
+	securitiesAccount.LastUpdated = currentTime
+
+	err = s.putClientSecuritiesAccount(ctx, clientSecurities)
+	if err != nil {
+		return fmt.Errorf("failed to update client securities account: %v", err)
+	}
+
+	err = s.putSecuritiesAccount(ctx, securitiesAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update securities account: %v", err)
+	}
+	s.journalMove(ctx, journalIssuer, journalHolder(brokerID, clientID), securityID, int64(quantity))
+
+	transaction := Transaction{
+		TransactionID: fmt.Sprintf("transaction-client-sec-deposit-%s-%s-%s-%s", brokerID, clientID, securityID, s.getTransactionID(ctx)),
+		Type:          "security_deposit",
+		FromID:        "external",
+		ToID:          brokerID,
+		FromClientID:  "",
+		ToClientID:    clientID,
+		SecurityID:    securityID,
+		Quantity:      quantity,
+		InstructionID: "",
+		Status:        "completed",
+		Timestamp:     currentTime,
+	}
+
+	return s.putTransaction(ctx, &transaction)
+}
+
+// GetClientAccountsByBroker retrieves all client cash sub-accounts of a broker
+func (s *SettlementContract) GetClientAccountsByBroker(ctx contractapi.TransactionContextInterface, brokerID string) ([]*ClientAccount, error) {
+	prefix := "clientAccount-" + brokerID + "-"
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByRange(brokerCollection(brokerID), prefix, prefix+"~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client accounts: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var accounts []*ClientAccount
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate client accounts: %v", err)
+		}
+
+		var account ClientAccount
+		err = json.Unmarshal(queryResponse.Value, &account)
+		if err != nil {
+			continue // Skip if not a valid ClientAccount
+		}
+
+		if account.BrokerID == brokerID {
+			accounts = append(accounts, &account)
+		}
+	}
+
+	return accounts, nil
+}
+
+// GetClientSecuritiesByBroker retrieves all client securities sub-accounts of a broker
+func (s *SettlementContract) GetClientSecuritiesByBroker(ctx contractapi.TransactionContextInterface, brokerID string) ([]*ClientSecuritiesAccount, error) {
+	prefix := "clientSecuritiesAccount-" + brokerID + "-"
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByRange(brokerCollection(brokerID), prefix, prefix+"~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client securities accounts: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var accounts []*ClientSecuritiesAccount
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate client securities accounts: %v", err)
+		}
+
+		var account ClientSecuritiesAccount
+		err = json.Unmarshal(queryResponse.Value, &account)
+		if err != nil {
+			continue // Skip if not a valid ClientSecuritiesAccount
+		}
+
+		if account.BrokerID == brokerID {
+			accounts = append(accounts, &account)
+		}
+	}
+
+	return accounts, nil
+}
+
+// getSecuritiesAccountsByBroker retrieves all of a broker's securities accounts
+func (s *SettlementContract) getSecuritiesAccountsByBroker(ctx contractapi.TransactionContextInterface, brokerID string) ([]*SecuritiesAccount, error) {
+	prefix := "securitiesAccount-" + brokerID + "-"
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByRange(brokerCollection(brokerID), prefix, prefix+"~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get securities accounts: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var accounts []*SecuritiesAccount
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate securities accounts: %v", err)
+		}
+
+		var account SecuritiesAccount
+		err = json.Unmarshal(queryResponse.Value, &account)
+		if err != nil {
+			continue // Skip if not a valid SecuritiesAccount
+		}
+
+		if account.BrokerID == brokerID {
+			accounts = append(accounts, &account)
+		}
+	}
+
+	return accounts, nil
+}
+
+// VerifySegregation checks that the client sub-accounts of a broker add up to the
+// omnibus client totals kept on the broker's cash and securities accounts
+func (s *SettlementContract) VerifySegregation(ctx contractapi.TransactionContextInterface, brokerID string) (*SegregationReport, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	brokerAccount, err := s.GetBrokerAccount(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	clientAccounts, err := s.GetClientAccountsByBroker(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	clientSecurities, err := s.GetClientSecuritiesByBroker(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	securitiesAccounts, err := s.getSecuritiesAccountsByBroker(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	checkedAt, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := SegregationReport{
+		BrokerID:    brokerID,
+		ClientCount: len(clientAccounts),
+		OmnibusCash: brokerAccount.ClientBalance,
+		Securities:  []SecuritySegregation{},
+		CheckedAt:   checkedAt,
+	}
+
+	for _, account := range clientAccounts {
+		report.ClientCash += account.Balance
+	}
+	report.CashReconciled = report.ClientCash == report.OmnibusCash
+
+	clientQuantities := make(map[string]int)
+	for _, account := range clientSecurities {
+		clientQuantities[account.SecurityID] += account.Quantity
+	}
+
+	report.Segregated = report.CashReconciled
+	for _, account := range securitiesAccounts {
+		segregation := SecuritySegregation{
+			SecurityID:     account.SecurityID,
+			ClientQuantity: clientQuantities[account.SecurityID],
+			OmnibusQty:     account.ClientQty,
+		}
+		segregation.Reconciled = segregation.ClientQuantity == segregation.OmnibusQty
+		delete(clientQuantities, account.SecurityID)
+
+		report.Securities = append(report.Securities, segregation)
+		report.Segregated = report.Segregated && segregation.Reconciled
+	}
+
+	// Client holdings without an omnibus account can never reconcile
+	for securityID, quantity := range clientQuantities {
+		report.Securities = append(report.Securities, SecuritySegregation{
+			SecurityID:     securityID,
+			ClientQuantity: quantity,
+			OmnibusQty:     0,
+			Reconciled:     false,
+		})
+		report.Segregated = false
+	}
+
+	return &report, nil
+}
+
+// clientLegs holds the client sub-accounts touched by a settlement instruction.
+// Fields are nil for the side of a trade made for the broker's own (house) account.
+type clientLegs struct {
+	buyerCash        *ClientAccount
+	buyerSecurities  *ClientSecuritiesAccount
+	sellerCash       *ClientAccount
+	sellerSecurities *ClientSecuritiesAccount
+}
+
+// loadClientLegs loads the client sub-accounts named on an instruction
+func (s *SettlementContract) loadClientLegs(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction) (*clientLegs, error) {
+	legs := &clientLegs{}
+	var err error
+
+	if instruction.BuyClientID != "" {
+		legs.buyerCash, err = s.getVerifiedClientAccount(ctx, instruction.BuyBrokerID, instruction.BuyClientID)
+		if err != nil {
+			return nil, err
+		}
+		legs.buyerSecurities, err = s.getOrNewClientSecuritiesAccount(ctx, instruction.BuyBrokerID, instruction.BuyClientID, instruction.SecurityID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A client trading with itself settles against the same sub-accounts
+	if instruction.SellClientID != "" && instruction.SellBrokerID == instruction.BuyBrokerID && instruction.SellClientID == instruction.BuyClientID {
+		legs.sellerCash = legs.buyerCash
+		legs.sellerSecurities = legs.buyerSecurities
+	} else if instruction.SellClientID != "" {
+		legs.sellerCash, err = s.getVerifiedClientAccount(ctx, instruction.SellBrokerID, instruction.SellClientID)
+		if err != nil {
+			return nil, err
+		}
+		legs.sellerSecurities, err = s.getOrNewClientSecuritiesAccount(ctx, instruction.SellBrokerID, instruction.SellClientID, instruction.SecurityID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return legs, nil
+}
+
+// save stores every client sub-account touched by the instruction
+func (legs *clientLegs) save(ctx contractapi.TransactionContextInterface, s *SettlementContract) error {
+	for i, account := range []*ClientAccount{legs.buyerCash, legs.sellerCash} {
+		if account == nil || (i == 1 && account == legs.buyerCash) {
+			continue
+		}
+		err := s.putClientAccount(ctx, account)
+		if err != nil {
+			return fmt.Errorf("failed to update client account %s: %v", account.ClientID, err)
+		}
+	}
+
+	for i, account := range []*ClientSecuritiesAccount{legs.buyerSecurities, legs.sellerSecurities} {
+		if account == nil || (i == 1 && account == legs.buyerSecurities) {
+			continue
+		}
+		err := s.putClientSecuritiesAccount(ctx, account)
+		if err != nil {
+			return fmt.Errorf("failed to update client securities account %s: %v", account.AccountID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+// clients_test.go - Tests of client sub-accounts and their settlement
+package main
+
+import (
+	"testing"
+)
+
+// setUpClientTrade creates a verified buyer and seller client with cash and securities,
+// and an affirmed instruction for the buyer to pay 10.00 for 10 SEC000
+func setUpClientTrade(t *testing.T, l *mockLedger, buyBrokerID, buyClientID, sellBrokerID, sellClientID string) {
+	t.Helper()
+	s := &SettlementContract{}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.CreateClientAccount(ctx, buyBrokerID, buyClientID, "Buyer", "verified")
+	})
+	if sellBrokerID != buyBrokerID || sellClientID != buyClientID {
+		l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+			return s.CreateClientAccount(ctx, sellBrokerID, sellClientID, "Seller", "verified")
+		})
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.DepositClientFunds(ctx, buyBrokerID, buyClientID, 5000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.DepositClientSecurities(ctx, sellBrokerID, sellClientID, "SEC000", 50)
+	})
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", buyBrokerID, sellBrokerID, buyClientID, sellClientID,
+			"SEC000", 10, 100, "pending", "2026-03-02T09:00:00Z", "buy")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	l.must(t, brokerMSPID(buyBrokerID), func(ctx txCtx) error {
+		return s.AffirmInstruction(ctx, "instruction-trade-1", "buy", "SEC000", 10, 100)
+	})
+	l.must(t, brokerMSPID(sellBrokerID), func(ctx txCtx) error {
+		return s.AffirmInstruction(ctx, "instruction-trade-1", "sell", "SEC000", 10, 100)
+	})
+}
+
+func TestExecuteSettlementBetweenClientsOfSameBroker(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpClientTrade(t, l, "broker2", "C1", "broker2", "C2")
+
+	var balanceBefore Money
+	var quantityBefore int
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		account, err := s.GetBrokerAccount(ctx, "broker2")
+		if err != nil {
+			return err
+		}
+		securities, err := s.GetSecuritiesAccount(ctx, "broker2", "SEC000")
+		if err != nil {
+			return err
+		}
+		balanceBefore, quantityBefore = account.Balance, securities.Quantity
+		return nil
+	})
+
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		account, err := s.GetBrokerAccount(ctx, "broker2")
+		if err != nil {
+			return err
+		}
+		if account.Balance != balanceBefore {
+			t.Errorf("broker balance changed from %v to %v", balanceBefore, account.Balance)
+		}
+		if account.ClientBalance != 5000 {
+			t.Errorf("client balance total is %v, want 50.00", account.ClientBalance)
+		}
+
+		securities, err := s.GetSecuritiesAccount(ctx, "broker2", "SEC000")
+		if err != nil {
+			return err
+		}
+		if securities.Quantity != quantityBefore {
+			t.Errorf("broker quantity changed from %d to %d", quantityBefore, securities.Quantity)
+		}
+		if securities.ClientQty != 50 {
+			t.Errorf("client quantity total is %d, want 50", securities.ClientQty)
+		}
+
+		buyer, err := s.GetClientAccount(ctx, "broker2", "C1")
+		if err != nil {
+			return err
+		}
+		seller, err := s.GetClientAccount(ctx, "broker2", "C2")
+		if err != nil {
+			return err
+		}
+		if buyer.Balance != 4000 || seller.Balance != 1000 {
+			t.Errorf("client balances are %v and %v, want 40.00 and 10.00", buyer.Balance, seller.Balance)
+		}
+
+		report, err := s.VerifySegregation(ctx, "broker2")
+		if err != nil {
+			return err
+		}
+		if !report.Segregated {
+			t.Errorf("broker2 is not segregated: %+v", report)
+		}
+		return nil
+	})
+}
+
+func TestExecuteSettlementOfClientWithItself(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpClientTrade(t, l, "broker2", "C1", "broker2", "C1")
+
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		client, err := s.GetClientAccount(ctx, "broker2", "C1")
+		if err != nil {
+			return err
+		}
+		if client.Balance != 5000 || client.ReservedBalance != 0 {
+			t.Errorf("client balance is %v with %v reserved, want 50.00 and none", client.Balance, client.ReservedBalance)
+		}
+
+		holding, err := s.GetClientSecuritiesAccount(ctx, "broker2", "C1", "SEC000")
+		if err != nil {
+			return err
+		}
+		if holding.Quantity != 50 || holding.ReservedQty != 0 {
+			t.Errorf("client holding is %d with %d reserved, want 50 and none", holding.Quantity, holding.ReservedQty)
+		}
+
+		report, err := s.VerifySegregation(ctx, "broker2")
+		if err != nil {
+			return err
+		}
+		if !report.Segregated {
+			t.Errorf("broker2 is not segregated: %+v", report)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,446 @@
+// collateral.go - Securities pledged as guarantee collateral, valued with haircuts
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// CollateralEligibility makes a security eligible as guarantee collateral. Its value is
+// cut by the haircut, and it can make up at most the concentration limit of a broker's
+// collateral.
+type CollateralEligibility struct {
+	SecurityID                string `json:"securityID"`
+	HaircutPercent            int    `json:"haircutPercent"`
+	ConcentrationLimitPercent int    `json:"concentrationLimitPercent"`
+	UpdatedBy                 string `json:"updatedBy"`
+	LastUpdated               string `json:"lastUpdated"`
+}
+
+// CollateralPosition is the value of a security pledged by a broker
+type CollateralPosition struct {
+	SecurityID     string `json:"securityID"`
+	PledgedQty     int    `json:"pledgedQty"`
+	Price          Money  `json:"price"`     // latest closing price, zero without one
+	PriceDate      string `json:"priceDate"` // YYYY-MM-DD
+	MarketValue    Money  `json:"marketValue"`
+	HaircutPercent int    `json:"haircutPercent"`
+	HaircutValue   Money  `json:"haircutValue"`  // market value less the haircut
+	AdmittedValue  Money  `json:"admittedValue"` // haircut value within the concentration limit
+}
+
+// CollateralValuation is a broker's guarantee collateral: its cash deposit and the
+// admitted value of its pledged securities
+type CollateralValuation struct {
+	BrokerID        string                `json:"brokerID"`
+	ValuationDate   string                `json:"valuationDate"` // YYYY-MM-DD
+	CashDeposit     Money                 `json:"cashDeposit"`
+	Positions       []*CollateralPosition `json:"positions"`
+	SecuritiesValue Money                 `json:"securitiesValue"`
+	TotalValue      Money                 `json:"totalValue"`
+}
+
+// CollateralLiquidation records pledged securities taken from a defaulting broker at their
+// collateral value to cover a default loss. Maroclear sells them on the market.
+type CollateralLiquidation struct {
+	LiquidationID string `json:"liquidationID"`
+	BrokerID      string `json:"brokerID"`
+	SecurityID    string `json:"securityID"`
+	Quantity      int    `json:"quantity"`
+	UnitValue     Money  `json:"unitValue"` // closing price less the haircut
+	Proceeds      Money  `json:"proceeds"`
+	Reference     string `json:"reference"` // instruction or charge of the default
+	LiquidatedAt  string `json:"liquidatedAt"`
+}
+
+// SetCollateralEligibility makes a security eligible as guarantee collateral with a
+// haircut and a concentration limit, both in percent
+func (s *SettlementContract) SetCollateralEligibility(ctx contractapi.TransactionContextInterface, securityID string, haircutPercent, concentrationLimitPercent int) error {
+	mspID, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if haircutPercent < 0 || haircutPercent > 100 {
+		return fmt.Errorf("haircut must be between 0 and 100 percent")
+	}
+	if concentrationLimitPercent <= 0 || concentrationLimitPercent > 100 {
+		return fmt.Errorf("concentration limit must be between 1 and 100 percent")
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	eligibility := CollateralEligibility{
+		SecurityID:                securityID,
+		HaircutPercent:            haircutPercent,
+		ConcentrationLimitPercent: concentrationLimitPercent,
+		UpdatedBy:                 mspID,
+		LastUpdated:               currentTime,
+	}
+
+	eligibilityJSON, err := json.Marshal(eligibility)
+	if err != nil {
+		return fmt.Errorf("failed to marshal collateral eligibility: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("collateralEligibility-"+securityID, eligibilityJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put collateral eligibility in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetCollateralEligibility retrieves the collateral terms of an eligible security
+func (s *SettlementContract) GetCollateralEligibility(ctx contractapi.TransactionContextInterface, securityID string) (*CollateralEligibility, error) {
+	eligibilityJSON, err := ctx.GetStub().GetState("collateralEligibility-" + securityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if eligibilityJSON == nil {
+		return nil, fmt.Errorf("security %s is not eligible as collateral", securityID)
+	}
+
+	var eligibility CollateralEligibility
+	err = json.Unmarshal(eligibilityJSON, &eligibility)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal collateral eligibility: %v", err)
+	}
+
+	return &eligibility, nil
+}
+
+// pledgedAccounts returns a broker's securities accounts with pledged quantities. The
+// range only lists the accounts; each is read again so writes of the transaction are seen.
+func (s *SettlementContract) pledgedAccounts(ctx contractapi.TransactionContextInterface, brokerID string) ([]*SecuritiesAccount, error) {
+	accounts, err := s.getSecuritiesAccountsByBroker(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var pledged []*SecuritiesAccount
+	for _, account := range accounts {
+		current, err := s.GetSecuritiesAccount(ctx, brokerID, account.SecurityID)
+		if err != nil {
+			return nil, err
+		}
+		if current.PledgedQty > 0 {
+			pledged = append(pledged, current)
+		}
+	}
+
+	return pledged, nil
+}
+
+// collateralUnitValue returns the collateral value of one unit of a security on a day:
+// its latest closing price less the haircut. Securities without a closing price or no
+// longer eligible are worth nothing.
+func (s *SettlementContract) collateralUnitValue(ctx contractapi.TransactionContextInterface, securityID, date string) (Money, *ClosingPrice, int, error) {
+	haircutPercent := 100
+	eligibilityJSON, err := ctx.GetStub().GetState("collateralEligibility-" + securityID)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if eligibilityJSON != nil {
+		var eligibility CollateralEligibility
+		err = json.Unmarshal(eligibilityJSON, &eligibility)
+		if err != nil {
+			return 0, nil, 0, fmt.Errorf("failed to unmarshal collateral eligibility: %v", err)
+		}
+		haircutPercent = eligibility.HaircutPercent
+	}
+
+	closingPrice, err := s.latestClosingPrice(ctx, securityID, date)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if closingPrice == nil {
+		return 0, nil, haircutPercent, nil
+	}
+
+	return closingPrice.Price * Money(100-haircutPercent) / 100, closingPrice, haircutPercent, nil
+}
+
+// valueCollateral values a broker's guarantee collateral on the transaction date. Each
+// pledged security counts for its market value less its haircut, up to its concentration
+// limit of the broker's total collateral before limits.
+func (s *SettlementContract) valueCollateral(ctx contractapi.TransactionContextInterface, brokerID string) (*CollateralValuation, error) {
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	today := txTime.Format(calendarDateLayout)
+
+	cashDeposit, err := s.depositAmount(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	valuation := &CollateralValuation{
+		BrokerID:      brokerID,
+		ValuationDate: today,
+		CashDeposit:   cashDeposit,
+		Positions:     []*CollateralPosition{},
+	}
+
+	accounts, err := s.pledgedAccounts(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := map[string]int{}
+	total := cashDeposit
+	for _, account := range accounts {
+		position := &CollateralPosition{
+			SecurityID: account.SecurityID,
+			PledgedQty: account.PledgedQty,
+		}
+
+		unitValue, closingPrice, haircutPercent, err := s.collateralUnitValue(ctx, account.SecurityID, today)
+		if err != nil {
+			return nil, err
+		}
+		position.HaircutPercent = haircutPercent
+		if closingPrice != nil {
+			position.Price = closingPrice.Price
+			position.PriceDate = closingPrice.Date
+			position.MarketValue = closingPrice.Price.Times(account.PledgedQty)
+			position.HaircutValue = unitValue.Times(account.PledgedQty)
+		}
+
+		limits[account.SecurityID] = 100
+		eligibility, err := s.GetCollateralEligibility(ctx, account.SecurityID)
+		if err == nil {
+			limits[account.SecurityID] = eligibility.ConcentrationLimitPercent
+		}
+
+		total += position.HaircutValue
+		valuation.Positions = append(valuation.Positions, position)
+	}
+
+	for _, position := range valuation.Positions {
+		position.AdmittedValue = position.HaircutValue
+		if limit := total * Money(limits[position.SecurityID]) / 100; position.AdmittedValue > limit {
+			position.AdmittedValue = limit
+		}
+		valuation.SecuritiesValue += position.AdmittedValue
+	}
+	valuation.TotalValue = cashDeposit + valuation.SecuritiesValue
+
+	return valuation, nil
+}
+
+// GetCollateralValuation values a broker's guarantee collateral at the latest closing prices
+func (s *SettlementContract) GetCollateralValuation(ctx contractapi.TransactionContextInterface, brokerID string) (*CollateralValuation, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.valueCollateral(ctx, brokerID)
+}
+
+// PledgeSecurities pledges available securities of a broker's own account as guarantee
+// collateral. Pledged securities cannot be delivered or withdrawn until released.
+func (s *SettlementContract) PledgeSecurities(ctx contractapi.TransactionContextInterface, brokerID, securityID string, quantity int) error {
+	// The collateral is valued with the pledge
+	ctx = withWriteCache(ctx)
+
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	if quantity <= 0 {
+		return fmt.Errorf("quantity must be positive")
+	}
+
+	_, err = s.GetCollateralEligibility(ctx, securityID)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.GetSecuritiesAccount(ctx, brokerID, securityID)
+	if err != nil {
+		return err
+	}
+	if account.available() < quantity {
+		return fmt.Errorf("insufficient available securities in securities account")
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	account.PledgedQty += quantity
+	account.LastUpdated = currentTime
+
+	err = s.putSecuritiesAccount(ctx, account)
+	if err != nil {
+		return fmt.Errorf("failed to update securities account: %v", err)
+	}
+	s.journalMove(ctx, journalHolder(brokerID, ""), journalAccount(journalPledged, brokerID), securityID, int64(quantity))
+
+	// A pledge meets the broker's open margin call and lifts its restriction once covered
+	return s.applyMarginTopUp(ctx, brokerID, currentTime)
+}
+
+// ReleaseSecurities releases pledged securities back to a broker's available securities,
+// as long as its remaining collateral still meets its margin requirement and it has no
+// open margin call or restriction
+func (s *SettlementContract) ReleaseSecurities(ctx contractapi.TransactionContextInterface, brokerID, securityID string, quantity int) error {
+	// The requirement is checked against the collateral left after the release
+	ctx = withWriteCache(ctx)
+
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	if quantity <= 0 {
+		return fmt.Errorf("quantity must be positive")
+	}
+
+	status, err := s.GetBrokerMarginStatus(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+	if status.OpenCallID != "" {
+		return fmt.Errorf("broker %s has an open margin call %s", brokerID, status.OpenCallID)
+	}
+	if status.Restricted {
+		return fmt.Errorf("broker %s is restricted for missing margin call %s", brokerID, status.RestrictedCallID)
+	}
+
+	account, err := s.GetSecuritiesAccount(ctx, brokerID, securityID)
+	if err != nil {
+		return err
+	}
+	if account.PledgedQty < quantity {
+		return fmt.Errorf("only %d %s are pledged", account.PledgedQty, securityID)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	account.PledgedQty -= quantity
+	account.LastUpdated = currentTime
+
+	err = s.putSecuritiesAccount(ctx, account)
+	if err != nil {
+		return fmt.Errorf("failed to update securities account: %v", err)
+	}
+	s.journalMove(ctx, journalAccount(journalPledged, brokerID), journalHolder(brokerID, ""), securityID, int64(quantity))
+
+	requirement, err := s.GetMarginRequirement(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+	if requirement.Shortfall > 0 {
+		return fmt.Errorf("releasing %d %s would leave collateral of %v below the requirement of %v", quantity, securityID, requirement.Collateral, requirement.Required)
+	}
+
+	return nil
+}
+
+// liquidateCollateral takes a defaulting broker's pledged securities at their collateral
+// value until an amount is covered. Securities are taken in whole units, so it returns the
+// amount covered and the proceeds above the amount, both still to be paid by the market.
+func (s *SettlementContract) liquidateCollateral(ctx contractapi.TransactionContextInterface, brokerID string, amount Money, reference, currentTime string) (Money, Money, error) {
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	accounts, err := s.pledgedAccounts(ctx, brokerID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var covered, excess Money
+	for _, account := range accounts {
+		if covered >= amount {
+			break
+		}
+
+		unitValue, _, _, err := s.collateralUnitValue(ctx, account.SecurityID, txTime.Format(calendarDateLayout))
+		if err != nil {
+			return 0, 0, err
+		}
+		if unitValue <= 0 {
+			continue
+		}
+
+		// Whole units, enough to cover what is left
+		needed := amount - covered
+		quantity := int((needed + unitValue - 1) / unitValue)
+		if quantity > account.PledgedQty {
+			quantity = account.PledgedQty
+		}
+		proceeds := unitValue.Times(quantity)
+
+		account.Quantity -= quantity
+		account.PledgedQty -= quantity
+		account.LastUpdated = currentTime
+
+		err = s.putSecuritiesAccount(ctx, account)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to update securities account: %v", err)
+		}
+
+		// The securities are sold to the market; the caller pays out the proceeds
+		s.journalMove(ctx, journalAccount(journalPledged, brokerID), journalMarket, account.SecurityID, int64(quantity))
+
+		liquidation := CollateralLiquidation{
+			LiquidationID: "collateralLiquidation-" + reference + "-" + account.SecurityID + "-" + s.getTransactionID(ctx),
+			BrokerID:      brokerID,
+			SecurityID:    account.SecurityID,
+			Quantity:      quantity,
+			UnitValue:     unitValue,
+			Proceeds:      proceeds,
+			Reference:     reference,
+			LiquidatedAt:  currentTime,
+		}
+
+		liquidationJSON, err := json.Marshal(liquidation)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to marshal collateral liquidation: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(liquidation.LiquidationID, liquidationJSON)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to put collateral liquidation in ledger: %v", err)
+		}
+
+		err = s.putTransaction(ctx, &Transaction{
+			TransactionID: "transaction-" + liquidation.LiquidationID,
+			Type:          "collateral_liquidation",
+			FromID:        brokerID,
+			ToID:          "guarantee",
+			SecurityID:    account.SecurityID,
+			Amount:        proceeds,
+			Quantity:      quantity,
+			Status:        "completed",
+			Timestamp:     currentTime,
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if proceeds > needed {
+			excess += proceeds - needed
+			proceeds = needed
+		}
+		covered += proceeds
+	}
+
+	return covered, excess, nil
+}
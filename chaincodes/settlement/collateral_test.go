@@ -0,0 +1,115 @@
+// collateral_test.go - Tests of securities pledged as guarantee collateral
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPledgedCollateralIsValuedAndLiquidatedOnDefault(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.now = time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateGuaranteeDeposit(ctx, "broker2", 100000) })
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error { return s.ImportClosingPrice(ctx, "SEC002", "2026-02-27", 100000, 0) })
+
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error { return s.PledgeSecurities(ctx, "broker2", "SEC002", 100) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetCollateralEligibility(ctx, "SEC002", 20, 50) })
+	l.must(t, "Broker2MSP", func(ctx txCtx) error { return s.PledgeSecurities(ctx, "broker2", "SEC002", 100) })
+
+	// 100 SEC002 at 1,000.00 less a 20% haircut, limited to half of the collateral
+	l.must(t, "Broker2MSP", func(ctx txCtx) error {
+		valuation, err := s.GetCollateralValuation(ctx, "broker2")
+		if err != nil {
+			return err
+		}
+		if len(valuation.Positions) != 1 || valuation.Positions[0].HaircutValue != 8000000 ||
+			valuation.Positions[0].AdmittedValue != 4050000 || valuation.TotalValue != 4150000 {
+			t.Errorf("collateral valuation = %+v", *valuation)
+		}
+
+		balance, err := s.GetAvailableSecurities(ctx, "broker2", "", "SEC002")
+		if err != nil {
+			return err
+		}
+		if balance.Pledged != 100 || balance.Available != 700 {
+			t.Errorf("broker2 SEC002 = %+v", *balance)
+		}
+		return nil
+	})
+
+	// Pledged securities cannot be delivered, nor held ones pledged: only 700 of the 750
+	// sold are held
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetMarginParameters(ctx, 10, 0, 2) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 750, 1000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	if instruction := instructionOf(t, l, "instruction-trade-1"); instruction.ReservedQuantity != 700 {
+		t.Fatalf("instruction holds %d SEC002, want 700", instruction.ReservedQuantity)
+	}
+
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error { return s.PledgeSecurities(ctx, "broker2", "SEC002", 1) })
+	l.must(t, "Broker2MSP", func(ctx txCtx) error { return s.ReleaseSecurities(ctx, "broker2", "SEC002", 50) })
+
+	// broker2 fails on a purchase far beyond its cash: its deposit and then its remaining
+	// pledged securities cover the loss
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-2", "order-b2", "order-s2", "broker2", "broker1", "", "",
+			"SEC001", 10, 10000000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-2") })
+	l.now = time.Date(2026, 3, 5, 18, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ProcessFail(ctx, "instruction-trade-2", "buyer_insufficient_funds")
+	})
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		losses, err := s.GetDefaultLosses(ctx, "broker2")
+		if err != nil {
+			return err
+		}
+		if len(losses) != 1 || losses[0].Amount != 100000000 {
+			t.Fatalf("broker2 default losses = %v", losses)
+		}
+		checkLayers(t, losses[0].Layers, []LossLayer{
+			{Layer: layerDefaulterDeposit, BrokerID: "broker2", Amount: 100000},
+			{Layer: layerDefaulterCollateral, BrokerID: "broker2", Amount: 4000000},
+			{Layer: layerUncovered, Amount: 95900000},
+		})
+
+		account, err := s.GetSecuritiesAccount(ctx, "broker2", "SEC002")
+		if err != nil {
+			return err
+		}
+		if account.Quantity != 750 || account.PledgedQty != 0 || account.ReservedQty != 700 {
+			t.Errorf("broker2 SEC002 after the liquidation = %+v", *account)
+		}
+		return nil
+	})
+
+	// A full recovery returns both the deposit and the liquidated collateral to the deposit
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.DepositFunds(ctx, "broker2", 50000000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		losses, err := s.GetDefaultLosses(ctx, "broker2")
+		if err != nil {
+			return err
+		}
+		return s.RecoverDefaultLoss(ctx, losses[0].LossID, 100000000)
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		losses, err := s.GetDefaultLosses(ctx, "broker2")
+		if err != nil {
+			return err
+		}
+		if losses[0].Status != "recovered" {
+			t.Errorf("loss = %+v", *losses[0])
+		}
+		return nil
+	})
+	if amount := guaranteeDeposited(t, l, "broker2"); amount != 4100000 {
+		t.Errorf("broker2 deposit = %v, want 41,000.00", amount)
+	}
+}
@@ -0,0 +1,273 @@
+// collections.go - Private data collections holding broker balances
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// brokerCollection returns the Maroclear+broker private data collection that holds
+// a broker's cash account, securities accounts and guarantee deposit.
+// Collections are declared in collections_config.json.
+func brokerCollection(brokerID string) string {
+	return "maroclear-" + strings.ToLower(brokerID) + "-balances"
+}
+
+// getPrivateState reads a balance record from the broker's private data collection.
+//
+// Peers that are not members of the collection (for example the counterparty broker's
+// peer endorsing a settlement) cannot read it. In that case the submitting client may
+// pass the record in the transient map under the same key; it is only accepted if its
+// hash matches the private data hash committed on the channel.
+func (s *SettlementContract) getPrivateState(ctx contractapi.TransactionContextInterface, brokerID, key string) ([]byte, error) {
+	collection := brokerCollection(brokerID)
+
+	value, readErr := ctx.GetStub().GetPrivateData(collection, key)
+	if readErr == nil {
+		return value, nil
+	}
+
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private data %s from collection %s: %v", key, collection, readErr)
+	}
+
+	supplied, ok := transientMap[key]
+	if !ok {
+		return nil, fmt.Errorf("failed to read private data %s from collection %s: %v", key, collection, readErr)
+	}
+
+	onChainHash, err := ctx.GetStub().GetPrivateDataHash(collection, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private data hash for %s: %v", key, err)
+	}
+	if onChainHash == nil {
+		return nil, nil
+	}
+
+	suppliedHash := sha256.Sum256(supplied)
+	if !bytes.Equal(onChainHash, suppliedHash[:]) {
+		return nil, fmt.Errorf("transient value for %s does not match the private data hash on the channel", key)
+	}
+
+	return supplied, nil
+}
+
+// putPrivateState writes a balance record to the broker's private data collection
+func (s *SettlementContract) putPrivateState(ctx contractapi.TransactionContextInterface, brokerID, key string, value []byte) error {
+	return ctx.GetStub().PutPrivateData(brokerCollection(brokerID), key, value)
+}
+
+// putAccountState writes an account to the broker's collection. The first time the account
+// is stored, it also gets the broker's key-level endorsement policy.
+func (s *SettlementContract) putAccountState(ctx contractapi.TransactionContextInterface, brokerID, key string, value []byte) error {
+	policy, err := ctx.GetStub().GetPrivateDataValidationParameter(brokerCollection(brokerID), key)
+	if err != nil {
+		return fmt.Errorf("failed to read endorsement policy of %s: %v", key, err)
+	}
+	if policy == nil {
+		err = s.setAccountEndorsementPolicy(ctx, brokerID, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.putPrivateState(ctx, brokerID, key, value)
+}
+
+// checkReservations ensures the account's holds are not negative and do not exceed the
+// broker's own (house) balance
+func (account *BrokerAccount) checkReservations() error {
+	if account.ReservedBalance < 0 || account.available() < 0 {
+		return fmt.Errorf("reserved balance %v of broker %s is outside its house balance %v",
+			account.ReservedBalance, account.BrokerID, account.Balance-account.ClientBalance)
+	}
+	return nil
+}
+
+// checkReservations ensures the account's held and pledged quantities are not negative
+// and do not exceed the broker's own (house) quantity
+func (account *SecuritiesAccount) checkReservations() error {
+	if account.ReservedQty < 0 || account.PledgedQty < 0 || account.available() < 0 {
+		return fmt.Errorf("reserved quantity %d and pledged quantity %d of %s are outside its house quantity %d",
+			account.ReservedQty, account.PledgedQty, account.AccountID, account.Quantity-account.ClientQty)
+	}
+	return nil
+}
+
+// putBrokerAccount stores a broker cash account in the broker's collection
+func (s *SettlementContract) putBrokerAccount(ctx contractapi.TransactionContextInterface, account *BrokerAccount) error {
+	err := account.checkReservations()
+	if err != nil {
+		return err
+	}
+
+	accountJSON, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broker account: %v", err)
+	}
+
+	err = s.putAccountState(ctx, account.BrokerID, "brokerAccount-"+account.BrokerID, accountJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put broker account in collection: %v", err)
+	}
+
+	return nil
+}
+
+// putSecuritiesAccount stores a securities account in the broker's collection
+func (s *SettlementContract) putSecuritiesAccount(ctx contractapi.TransactionContextInterface, account *SecuritiesAccount) error {
+	err := account.checkReservations()
+	if err != nil {
+		return err
+	}
+
+	accountJSON, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("failed to marshal securities account: %v", err)
+	}
+
+	err = s.putAccountState(ctx, account.BrokerID, account.AccountID, accountJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put securities account in collection: %v", err)
+	}
+
+	return nil
+}
+
+// putGuaranteeDeposit stores a guarantee deposit in the broker's collection
+func (s *SettlementContract) putGuaranteeDeposit(ctx contractapi.TransactionContextInterface, deposit *GuaranteeDeposit) error {
+	depositJSON, err := json.Marshal(deposit)
+	if err != nil {
+		return fmt.Errorf("failed to marshal guarantee deposit: %v", err)
+	}
+
+	err = s.putAccountState(ctx, deposit.BrokerID, "guaranteeDeposit-"+deposit.BrokerID, depositJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put guarantee deposit in collection: %v", err)
+	}
+
+	return nil
+}
+
+// GetPrivateBalanceHash returns the hex-encoded hash of a broker's private balance record
+// (e.g. "brokerAccount-broker1" or "securitiesAccount-broker1-SEC001"). Any channel member
+// can read it, including organizations that are not members of the collection.
+func (s *SettlementContract) GetPrivateBalanceHash(ctx contractapi.TransactionContextInterface, brokerID, key string) (string, error) {
+	hash, err := ctx.GetStub().GetPrivateDataHash(brokerCollection(brokerID), key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read private data hash: %v", err)
+	}
+	if hash == nil {
+		return "", fmt.Errorf("private balance %s for broker %s does not exist", key, brokerID)
+	}
+
+	return hex.EncodeToString(hash), nil
+}
+
+// GetPrivateBalanceRecord returns a broker's private balance record exactly as stored, or an
+// empty string if there is none. Clients pass it in the transient map to peers that are not
+// members of the broker's collection (see getPrivateState). Only the broker and Maroclear
+// can read it.
+func (s *SettlementContract) GetPrivateBalanceRecord(ctx contractapi.TransactionContextInterface, brokerID, key string) (string, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return "", err
+	}
+
+	value, err := ctx.GetStub().GetPrivateData(brokerCollection(brokerID), key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+
+	return string(value), nil
+}
+
+// VerifyPrivateBalance lets a counterparty or the regulator check a balance record disclosed
+// off-chain by a broker against the hash committed on the channel
+func (s *SettlementContract) VerifyPrivateBalance(ctx contractapi.TransactionContextInterface, brokerID, key, valueJSON string) (bool, error) {
+	onChainHash, err := ctx.GetStub().GetPrivateDataHash(brokerCollection(brokerID), key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read private data hash: %v", err)
+	}
+	if onChainHash == nil {
+		return false, fmt.Errorf("private balance %s for broker %s does not exist", key, brokerID)
+	}
+
+	disclosedHash := sha256.Sum256([]byte(valueJSON))
+	return bytes.Equal(onChainHash, disclosedHash[:]), nil
+}
+
+// MigrateBrokerBalances moves the listed brokers' (comma-separated broker IDs) cash
+// accounts, securities accounts and guarantee deposits from the world state, where they
+// were kept before the broker collections, into their collections, and returns the number
+// of records moved. Records are moved as stored: amounts still in floats are converted by
+// MigrateMoneyState, which can run before or after it. Only Maroclear can run it.
+func (s *SettlementContract) MigrateBrokerBalances(ctx contractapi.TransactionContextInterface, brokerIDs string) (int, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, brokerID := range strings.Split(brokerIDs, ",") {
+		brokerID = strings.TrimSpace(brokerID)
+		if brokerID == "" {
+			continue
+		}
+
+		keys := []string{"brokerAccount-" + brokerID, "guaranteeDeposit-" + brokerID}
+
+		// The trailing dash keeps broker1's range from including broker10's accounts
+		prefix := "securitiesAccount-" + brokerID + "-"
+		resultsIterator, err := ctx.GetStub().GetStateByRange(prefix, prefix+"~")
+		if err != nil {
+			return 0, fmt.Errorf("failed to get securities accounts of broker %s: %v", brokerID, err)
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return 0, fmt.Errorf("failed to iterate securities accounts of broker %s: %v", brokerID, err)
+			}
+			keys = append(keys, queryResponse.Key)
+		}
+		resultsIterator.Close()
+
+		for _, key := range keys {
+			value, err := ctx.GetStub().GetState(key)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read %s from world state: %v", key, err)
+			}
+			if value == nil {
+				continue
+			}
+
+			existing, err := ctx.GetStub().GetPrivateDataHash(brokerCollection(brokerID), key)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read private data hash for %s: %v", key, err)
+			}
+			if existing != nil {
+				return 0, fmt.Errorf("%s is both in the world state and in the collection of broker %s", key, brokerID)
+			}
+
+			err = s.putAccountState(ctx, brokerID, key, value)
+			if err != nil {
+				return 0, err
+			}
+			err = ctx.GetStub().DelState(key)
+			if err != nil {
+				return 0, fmt.Errorf("failed to delete %s from world state: %v", key, err)
+			}
+			migrated++
+		}
+	}
+
+	return migrated, nil
+}
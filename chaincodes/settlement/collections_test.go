@@ -0,0 +1,133 @@
+// collections_test.go - Tests of the broker balance collections
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestGetPrivateBalanceRecordMatchesChannelHash(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error {
+		_, err := s.GetPrivateBalanceRecord(ctx, "broker1", "brokerAccount-broker1")
+		return err
+	})
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		record, err := s.GetPrivateBalanceRecord(ctx, "broker1", "brokerAccount-broker1")
+		if err != nil {
+			return err
+		}
+		hash, err := s.GetPrivateBalanceHash(ctx, "broker1", "brokerAccount-broker1")
+		if err != nil {
+			return err
+		}
+		recordHash := sha256.Sum256([]byte(record))
+		if hex.EncodeToString(recordHash[:]) != hash {
+			t.Errorf("record %s does not match the hash on the channel", record)
+		}
+
+		missing, err := s.GetPrivateBalanceRecord(ctx, "broker1", "securitiesAccount-broker1-SEC999")
+		if err != nil {
+			return err
+		}
+		if missing != "" {
+			t.Errorf("missing record = %q, want empty", missing)
+		}
+		return nil
+	})
+}
+
+func TestCounterpartyRecordsComeFromTheTransientMap(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpHouseTrade(t, l)
+	l.now = settlementDay
+
+	// broker2's peer endorses without being a member of broker1's collection
+	l.endorser = "Broker2MSP"
+	execute := func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") }
+	if err := l.tx(t, "Broker2MSP", execute); err == nil {
+		t.Fatalf("settled without broker1's records")
+	}
+
+	records := map[string][]byte{
+		"brokerAccount-broker1":            l.collection("maroclear-broker1-balances")["brokerAccount-broker1"],
+		"securitiesAccount-broker1-SEC002": nil, // not opened yet
+	}
+	tampered := map[string][]byte{
+		"brokerAccount-broker1":            []byte(`{"brokerID":"broker1","balance":999999999999}`),
+		"securitiesAccount-broker1-SEC002": nil,
+	}
+	if err := l.txWithTransient(t, "Broker2MSP", tampered, execute); err == nil {
+		t.Fatalf("settled with a record that does not match the channel hash")
+	}
+	if err := l.txWithTransient(t, "Broker2MSP", records, execute); err != nil {
+		t.Fatalf("settlement with broker1's records failed: %v", err)
+	}
+
+	l.endorser = ""
+	if instruction := instructionOf(t, l, "instruction-trade-1"); instruction.Status != "completed" {
+		t.Errorf("instruction is %s, want completed", instruction.Status)
+	}
+	if quantity := securitiesHeld(t, l, "broker1", "SEC002"); quantity != 10 {
+		t.Errorf("broker1 holds %d SEC002, want 10", quantity)
+	}
+}
+
+func TestBrokerBalancesMoveIntoCollections(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	// Records as the world state held them before the broker collections
+	l.state["brokerAccount-broker1"] = []byte(`{"brokerID":"broker1","balance":1500.5,"reservedBalance":0}`)
+	l.state["securitiesAccount-broker1-SEC001"] = []byte(`{"accountID":"securitiesAccount-broker1-SEC001","brokerID":"broker1","securityID":"SEC001","quantity":10}`)
+	l.state["securitiesAccount-broker10-SEC001"] = []byte(`{"accountID":"securitiesAccount-broker10-SEC001","brokerID":"broker10","securityID":"SEC001","quantity":5}`)
+	l.state["guaranteeDeposit-broker1"] = []byte(`{"brokerID":"broker1","amount":250}`)
+
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error {
+		_, err := s.MigrateBrokerBalances(ctx, "broker1")
+		return err
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		migrated, err := s.MigrateBrokerBalances(ctx, "broker1, broker2")
+		if migrated != 3 {
+			t.Errorf("%d records migrated, want 3", migrated)
+		}
+		return err
+	})
+
+	for _, key := range []string{"brokerAccount-broker1", "securitiesAccount-broker1-SEC001", "guaranteeDeposit-broker1"} {
+		if l.state[key] != nil {
+			t.Errorf("%s is still in the world state", key)
+		}
+		if l.collection("maroclear-broker1-balances")[key] == nil {
+			t.Errorf("%s is missing from broker1's collection", key)
+		}
+	}
+	if l.state["securitiesAccount-broker10-SEC001"] == nil {
+		t.Errorf("broker10's account was migrated with broker1's")
+	}
+	if orgs := accountOrgs(t, l, "broker1", "brokerAccount-broker1"); len(orgs) != 2 {
+		t.Errorf("migrated account is endorsed by %v", orgs)
+	}
+
+	// The float amounts are then converted in the collection
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.MigrateMoneyState(ctx, "broker1")
+		return err
+	})
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		account, err := s.GetBrokerAccount(ctx, "broker1")
+		if err != nil {
+			return err
+		}
+		if account.Balance != 150050 {
+			t.Errorf("broker1 balance = %v, want 1,500.50", account.Balance)
+		}
+		return nil
+	})
+}
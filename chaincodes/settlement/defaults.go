@@ -0,0 +1,974 @@
+// defaults.go - Default waterfall of the guarantee fund, replenishment and recoveries
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Layers of the default waterfall, in the order they absorb a loss. What the waterfall
+// cannot absorb is the fund's deficit, recovered through replenishment assessments.
+const (
+	layerDefaulterDeposit      = "defaulter_deposit"
+	layerDefaulterCollateral   = "defaulter_collateral"
+	layerDefaulterContribution = "defaulter_contribution"
+	layerSkinInTheGame         = "skin_in_the_game"
+	layerMutualized            = "mutualized"
+	layerUncovered             = "uncovered"
+)
+
+// FundContribution is a broker's mutualized contribution to the guarantee fund
+type FundContribution struct {
+	BrokerID         string `json:"brokerID"`
+	Amount           Money  `json:"amount"`
+	Required         Money  `json:"required"` // contribution the broker must maintain
+	OpenAssessmentID string `json:"openAssessmentID"`
+	LastUpdated      string `json:"lastUpdated"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// LossLayer is the part of a default loss absorbed by one layer of the waterfall, and
+// one broker's contribution for mutualized layers
+type LossLayer struct {
+	Layer     string `json:"layer"`
+	BrokerID  string `json:"brokerID"` // empty for skin in the game and the uncovered loss
+	Amount    Money  `json:"amount"`
+	Recovered Money  `json:"recovered"`
+}
+
+// DefaultLoss is an amount a defaulting broker could not pay from its own funds and how
+// the waterfall absorbed it. Amounts later recovered from the defaulter are returned to
+// the layers in reverse order.
+type DefaultLoss struct {
+	LossID      string       `json:"lossID"`
+	DefaulterID string       `json:"defaulterID"`
+	Reference   string       `json:"reference"` // instruction or charge the loss arose from
+	Reason      string       `json:"reason"`
+	Amount      Money        `json:"amount"`
+	Layers      []*LossLayer `json:"layers"`
+	Recovered   Money        `json:"recovered"`
+	Status      string       `json:"status"` // open, recovered
+	CreatedAt   string       `json:"createdAt"`
+	LastUpdated string       `json:"lastUpdated"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// ReplenishmentAssessment requires a broker to bring its fund contribution back to the
+// required amount, and to pay its share of the fund's deficit
+type ReplenishmentAssessment struct {
+	AssessmentID          string `json:"assessmentID"`
+	BrokerID              string `json:"brokerID"`
+	ContributionShortfall Money  `json:"contributionShortfall"`
+	DeficitShare          Money  `json:"deficitShare"`
+	Amount                Money  `json:"amount"`
+	Status                string `json:"status"` // open, paid
+	AssessedAt            string `json:"assessedAt"`
+	PaidAt                string `json:"paidAt"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// putGuaranteeFund stores the guarantee fund
+func (s *SettlementContract) putGuaranteeFund(ctx contractapi.TransactionContextInterface, fund *GuaranteeFund) error {
+	fundJSON, err := json.Marshal(fund)
+	if err != nil {
+		return fmt.Errorf("failed to marshal guarantee fund: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("guaranteeFund", fundJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update guarantee fund in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetFundContribution retrieves a broker's contribution to the guarantee fund, zero if
+// it has not contributed
+func (s *SettlementContract) GetFundContribution(ctx contractapi.TransactionContextInterface, brokerID string) (*FundContribution, error) {
+	contributionJSON, err := ctx.GetStub().GetState("fundContribution-" + brokerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if contributionJSON == nil {
+		return &FundContribution{BrokerID: brokerID}, nil
+	}
+
+	var contribution FundContribution
+	err = json.Unmarshal(contributionJSON, &contribution)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal fund contribution: %v", err)
+	}
+
+	return &contribution, nil
+}
+
+// putFundContribution stores a broker's fund contribution
+func (s *SettlementContract) putFundContribution(ctx contractapi.TransactionContextInterface, contribution *FundContribution) error {
+	contributionJSON, err := json.Marshal(contribution)
+	if err != nil {
+		return fmt.Errorf("failed to marshal fund contribution: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("fundContribution-"+contribution.BrokerID, contributionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put fund contribution in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// fundContributions returns every broker's fund contribution. The range only lists the
+// brokers; each contribution is read again so writes of the transaction are seen.
+func (s *SettlementContract) fundContributions(ctx contractapi.TransactionContextInterface) ([]*FundContribution, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("fundContribution-", "fundContribution-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fund contributions: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var brokerIDs []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate fund contributions: %v", err)
+		}
+
+		var contribution FundContribution
+		err = json.Unmarshal(queryResponse.Value, &contribution)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal fund contribution: %v", err)
+		}
+		brokerIDs = append(brokerIDs, contribution.BrokerID)
+	}
+
+	contributions := []*FundContribution{}
+	for _, brokerID := range brokerIDs {
+		contribution, err := s.GetFundContribution(ctx, brokerID)
+		if err != nil {
+			return nil, err
+		}
+		contributions = append(contributions, contribution)
+	}
+
+	return contributions, nil
+}
+
+// SetRequiredContribution sets the fund contribution a broker must maintain (in centimes)
+func (s *SettlementContract) SetRequiredContribution(ctx contractapi.TransactionContextInterface, brokerID string, requiredCentimes int64) error {
+	required := Money(requiredCentimes)
+
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if required < 0 {
+		return fmt.Errorf("required contribution must not be negative")
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	contribution, err := s.GetFundContribution(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	contribution.Required = required
+	contribution.LastUpdated = currentTime
+
+	return s.putFundContribution(ctx, contribution)
+}
+
+// ContributeToFund moves a broker's available own funds into its guarantee fund
+// contribution (amount in centimes)
+func (s *SettlementContract) ContributeToFund(ctx contractapi.TransactionContextInterface, brokerID string, amountCentimes int64) error {
+	amount := Money(amountCentimes)
+
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	if amount <= 0 {
+		return fmt.Errorf("contribution amount must be positive")
+	}
+
+	brokerAccount, err := s.GetBrokerAccount(ctx, brokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get broker account: %v", err)
+	}
+	if brokerAccount.available() < amount {
+		return fmt.Errorf("insufficient available balance in broker account")
+	}
+
+	contribution, err := s.GetFundContribution(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	guaranteeFund, err := s.GetGuaranteeFund(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get guarantee fund: %v", err)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	brokerAccount.Balance -= amount
+	brokerAccount.LastUpdated = currentTime
+
+	contribution.Amount += amount
+	contribution.LastUpdated = currentTime
+
+	guaranteeFund.Contributions += amount
+	guaranteeFund.TotalAmount += amount
+	guaranteeFund.LastUpdated = currentTime
+
+	err = s.putBrokerAccount(ctx, brokerAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update broker account: %v", err)
+	}
+
+	err = s.putFundContribution(ctx, contribution)
+	if err != nil {
+		return err
+	}
+	s.journalMove(ctx, journalHolder(brokerID, ""), journalAccount(journalFundContribution, brokerID), journalCash, int64(amount))
+
+	return s.putGuaranteeFund(ctx, guaranteeFund)
+}
+
+// AddSkinInTheGame adds the exchange's own capital to the guarantee fund (amount in
+// centimes). It absorbs losses after the defaulter's resources and before the other
+// brokers' contributions.
+func (s *SettlementContract) AddSkinInTheGame(ctx contractapi.TransactionContextInterface, amountCentimes int64) error {
+	amount := Money(amountCentimes)
+
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if amount <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+
+	guaranteeFund, err := s.GetGuaranteeFund(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get guarantee fund: %v", err)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	guaranteeFund.SkinInTheGame += amount
+	guaranteeFund.TotalAmount += amount
+	guaranteeFund.LastUpdated = currentTime
+
+	// The exchange pays its capital in from outside the ledger
+	s.journalMove(ctx, journalSystem, journalSkinInTheGame, journalCash, int64(amount))
+
+	return s.putGuaranteeFund(ctx, guaranteeFund)
+}
+
+// prorate splits an amount in proportion to weights. The centimes left over by rounding
+// down go one each to the first weights.
+func prorate(amount Money, weights []Money) []Money {
+	shares := make([]Money, len(weights))
+
+	var total Money
+	for _, weight := range weights {
+		total += weight
+	}
+	if total <= 0 || amount <= 0 {
+		return shares
+	}
+
+	allocated := Money(0)
+	for i, weight := range weights {
+		share := new(big.Int).Mul(big.NewInt(int64(amount)), big.NewInt(int64(weight)))
+		share.Quo(share, big.NewInt(int64(total)))
+		shares[i] = Money(share.Int64())
+		allocated += shares[i]
+	}
+
+	for i := 0; allocated < amount; i = (i + 1) % len(weights) {
+		if weights[i] > 0 {
+			shares[i]++
+			allocated++
+		}
+	}
+
+	return shares
+}
+
+// coverDefault pays an amount a broker failed to pay through the default waterfall: its
+// cash guarantee deposit, then its pledged securities (see collateral.go), then its fund
+// contribution, then the exchange's skin in the game, then the other brokers'
+// contributions pro rata. What remains is added to the fund's deficit. The loss is
+// recorded with the part each layer absorbed, and each part is journaled as paid to the
+// payee, the journal account of whoever the amount was owed to.
+func (s *SettlementContract) coverDefault(ctx contractapi.TransactionContextInterface, defaulterID string, amount Money, payee, reference, reason, currentTime string) (*DefaultLoss, error) {
+	guaranteeFund, err := s.GetGuaranteeFund(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get guarantee fund: %v", err)
+	}
+
+	loss := &DefaultLoss{
+		LossID:      "defaultLoss-" + reference + "-" + s.getTransactionID(ctx),
+		DefaulterID: defaulterID,
+		Reference:   reference,
+		Reason:      reason,
+		Amount:      amount,
+		Layers:      []*LossLayer{},
+		Status:      "open",
+		CreatedAt:   currentTime,
+		LastUpdated: currentTime,
+	}
+
+	remaining := amount
+	take := func(layer, brokerID string, available Money) Money {
+		taken := remaining
+		if available < taken {
+			taken = available
+		}
+		if taken <= 0 {
+			return 0
+		}
+		remaining -= taken
+		loss.Layers = append(loss.Layers, &LossLayer{Layer: layer, BrokerID: brokerID, Amount: taken})
+		return taken
+	}
+
+	// 1. The defaulter's cash guarantee deposit
+	depositJSON, err := s.getPrivateState(ctx, defaulterID, "guaranteeDeposit-"+defaulterID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	var deposit *GuaranteeDeposit
+	if depositJSON != nil {
+		deposit = &GuaranteeDeposit{}
+		err = json.Unmarshal(depositJSON, deposit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal guarantee deposit: %v", err)
+		}
+
+		if taken := take(layerDefaulterDeposit, defaulterID, deposit.Amount); taken > 0 {
+			deposit.Amount -= taken
+			deposit.LastUpdated = currentTime
+			guaranteeFund.TotalAmount -= taken
+
+			err = s.putGuaranteeDeposit(ctx, deposit)
+			if err != nil {
+				return nil, fmt.Errorf("failed to update guarantee deposit: %v", err)
+			}
+			s.journalMove(ctx, journalAccount(journalGuaranteeDeposit, defaulterID), payee, journalCash, int64(taken))
+		}
+	}
+
+	// 2. The defaulter's pledged securities, liquidated at their collateral value. Proceeds
+	// above the loss stay in its cash deposit.
+	if remaining > 0 {
+		covered, excess, err := s.liquidateCollateral(ctx, defaulterID, remaining, reference, currentTime)
+		if err != nil {
+			return nil, err
+		}
+		take(layerDefaulterCollateral, defaulterID, covered)
+		s.journalMove(ctx, journalMarket, payee, journalCash, int64(covered))
+
+		if excess > 0 {
+			if deposit == nil {
+				deposit = &GuaranteeDeposit{BrokerID: defaulterID}
+			}
+			deposit.Amount += excess
+			deposit.LastUpdated = currentTime
+			guaranteeFund.TotalAmount += excess
+
+			err = s.putGuaranteeDeposit(ctx, deposit)
+			if err != nil {
+				return nil, fmt.Errorf("failed to update guarantee deposit: %v", err)
+			}
+			s.journalMove(ctx, journalMarket, journalAccount(journalGuaranteeDeposit, defaulterID), journalCash, int64(excess))
+		}
+	}
+
+	// 3. The defaulter's fund contribution
+	contribution, err := s.GetFundContribution(ctx, defaulterID)
+	if err != nil {
+		return nil, err
+	}
+	if taken := take(layerDefaulterContribution, defaulterID, contribution.Amount); taken > 0 {
+		contribution.Amount -= taken
+		contribution.LastUpdated = currentTime
+		guaranteeFund.Contributions -= taken
+		guaranteeFund.TotalAmount -= taken
+
+		err = s.putFundContribution(ctx, contribution)
+		if err != nil {
+			return nil, err
+		}
+		s.journalMove(ctx, journalAccount(journalFundContribution, defaulterID), payee, journalCash, int64(taken))
+	}
+
+	// 4. The exchange's skin in the game
+	if taken := take(layerSkinInTheGame, "", guaranteeFund.SkinInTheGame); taken > 0 {
+		guaranteeFund.SkinInTheGame -= taken
+		guaranteeFund.TotalAmount -= taken
+		s.journalMove(ctx, journalSkinInTheGame, payee, journalCash, int64(taken))
+	}
+
+	// 5. The other brokers' contributions, in proportion to their size
+	if remaining > 0 {
+		contributions, err := s.fundContributions(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var others []*FundContribution
+		var weights []Money
+		var pool Money
+		for _, other := range contributions {
+			if other.BrokerID == defaulterID || other.Amount <= 0 {
+				continue
+			}
+			others = append(others, other)
+			weights = append(weights, other.Amount)
+			pool += other.Amount
+		}
+
+		mutualized := remaining
+		if pool < mutualized {
+			mutualized = pool
+		}
+
+		for i, share := range prorate(mutualized, weights) {
+			if share <= 0 {
+				continue
+			}
+			take(layerMutualized, others[i].BrokerID, share)
+
+			others[i].Amount -= share
+			others[i].LastUpdated = currentTime
+			guaranteeFund.Contributions -= share
+			guaranteeFund.TotalAmount -= share
+
+			err = s.putFundContribution(ctx, others[i])
+			if err != nil {
+				return nil, err
+			}
+			s.journalMove(ctx, journalAccount(journalFundContribution, others[i].BrokerID), payee, journalCash, int64(share))
+		}
+	}
+
+	// 6. Beyond the fund's resources: the deficit is recovered by replenishment assessments
+	if remaining > 0 {
+		guaranteeFund.Deficit += remaining
+		s.journalMove(ctx, journalFundDeficit, payee, journalCash, int64(remaining))
+		take(layerUncovered, "", remaining)
+	}
+
+	guaranteeFund.LastUpdated = currentTime
+	err = s.putGuaranteeFund(ctx, guaranteeFund)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.putDefaultLoss(ctx, loss)
+	if err != nil {
+		return nil, err
+	}
+
+	return loss, nil
+}
+
+// putDefaultLoss stores a default loss
+func (s *SettlementContract) putDefaultLoss(ctx contractapi.TransactionContextInterface, loss *DefaultLoss) error {
+	lossJSON, err := json.Marshal(loss)
+	if err != nil {
+		return fmt.Errorf("failed to marshal default loss: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(loss.LossID, lossJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put default loss in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetDefaultLoss retrieves a default loss by ID
+func (s *SettlementContract) GetDefaultLoss(ctx contractapi.TransactionContextInterface, lossID string) (*DefaultLoss, error) {
+	lossJSON, err := ctx.GetStub().GetState(lossID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if lossJSON == nil {
+		return nil, fmt.Errorf("default loss %s does not exist", lossID)
+	}
+
+	var loss DefaultLoss
+	err = json.Unmarshal(lossJSON, &loss)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal default loss: %v", err)
+	}
+
+	return &loss, nil
+}
+
+// GetDefaultLosses retrieves every default loss of a broker
+func (s *SettlementContract) GetDefaultLosses(ctx contractapi.TransactionContextInterface, defaulterID string) ([]*DefaultLoss, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("defaultLoss-", "defaultLoss-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default losses: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	losses := []*DefaultLoss{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate default losses: %v", err)
+		}
+
+		var loss DefaultLoss
+		err = json.Unmarshal(queryResponse.Value, &loss)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal default loss: %v", err)
+		}
+		if loss.DefaulterID == defaulterID {
+			losses = append(losses, &loss)
+		}
+	}
+
+	return losses, nil
+}
+
+// openDefaulters returns the brokers with default losses not yet recovered
+func (s *SettlementContract) openDefaulters(ctx contractapi.TransactionContextInterface) (map[string]bool, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("defaultLoss-", "defaultLoss-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default losses: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	defaulters := map[string]bool{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate default losses: %v", err)
+		}
+
+		var loss DefaultLoss
+		err = json.Unmarshal(queryResponse.Value, &loss)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal default loss: %v", err)
+		}
+		if loss.Status == "open" {
+			defaulters[loss.DefaulterID] = true
+		}
+	}
+
+	return defaulters, nil
+}
+
+// RecoverDefaultLoss collects an amount from the defaulter's available own funds (in
+// centimes) and returns it to the layers that absorbed the loss, in reverse order: the
+// fund's deficit first, then the other brokers pro rata, then the exchange's skin in the
+// game, then the defaulter's own contribution and collateral. Liquidated collateral is
+// returned to the defaulter's cash deposit.
+func (s *SettlementContract) RecoverDefaultLoss(ctx contractapi.TransactionContextInterface, lossID string, amountCentimes int64) error {
+	amount := Money(amountCentimes)
+
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if amount <= 0 {
+		return fmt.Errorf("recovery amount must be positive")
+	}
+
+	// The collateral and deposit layers are both returned to the defaulter's deposit
+	ctx = withWriteCache(ctx)
+
+	loss, err := s.GetDefaultLoss(ctx, lossID)
+	if err != nil {
+		return err
+	}
+	if outstanding := loss.Amount - loss.Recovered; amount > outstanding {
+		return fmt.Errorf("recovery of %v exceeds the outstanding loss of %v", amount, outstanding)
+	}
+
+	defaulterAccount, err := s.GetBrokerAccount(ctx, loss.DefaulterID)
+	if err != nil {
+		return fmt.Errorf("failed to get defaulter broker account: %v", err)
+	}
+	if defaulterAccount.available() < amount {
+		return fmt.Errorf("insufficient available balance in defaulter broker account")
+	}
+
+	guaranteeFund, err := s.GetGuaranteeFund(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get guarantee fund: %v", err)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	defaulterAccount.Balance -= amount
+	defaulterAccount.LastUpdated = currentTime
+
+	// Layers of the same kind are recovered together, mutualized ones pro rata
+	remaining := amount
+	for _, kind := range []string{layerUncovered, layerMutualized, layerSkinInTheGame, layerDefaulterContribution, layerDefaulterCollateral, layerDefaulterDeposit} {
+		var layers []*LossLayer
+		var weights []Money
+		var outstanding Money
+		for _, layer := range loss.Layers {
+			if layer.Layer == kind && layer.Amount > layer.Recovered {
+				layers = append(layers, layer)
+				weights = append(weights, layer.Amount-layer.Recovered)
+				outstanding += layer.Amount - layer.Recovered
+			}
+		}
+
+		recovered := remaining
+		if outstanding < recovered {
+			recovered = outstanding
+		}
+		remaining -= recovered
+
+		for i, share := range prorate(recovered, weights) {
+			if share <= 0 {
+				continue
+			}
+			layers[i].Recovered += share
+
+			switch kind {
+			case layerUncovered:
+				guaranteeFund.Deficit -= share
+				if guaranteeFund.DeficitAssessed > guaranteeFund.Deficit {
+					guaranteeFund.DeficitAssessed = guaranteeFund.Deficit
+				}
+				s.journalMove(ctx, journalHolder(loss.DefaulterID, ""), journalFundDeficit, journalCash, int64(share))
+			case layerSkinInTheGame:
+				guaranteeFund.SkinInTheGame += share
+				guaranteeFund.TotalAmount += share
+				s.journalMove(ctx, journalHolder(loss.DefaulterID, ""), journalSkinInTheGame, journalCash, int64(share))
+			case layerMutualized, layerDefaulterContribution:
+				contribution, err := s.GetFundContribution(ctx, layers[i].BrokerID)
+				if err != nil {
+					return err
+				}
+				contribution.Amount += share
+				contribution.LastUpdated = currentTime
+				guaranteeFund.Contributions += share
+				guaranteeFund.TotalAmount += share
+
+				err = s.putFundContribution(ctx, contribution)
+				if err != nil {
+					return err
+				}
+				s.journalMove(ctx, journalHolder(loss.DefaulterID, ""), journalAccount(journalFundContribution, contribution.BrokerID), journalCash, int64(share))
+			case layerDefaulterCollateral, layerDefaulterDeposit:
+				deposit, err := s.GetGuaranteeDeposit(ctx, loss.DefaulterID)
+				if err != nil {
+					return fmt.Errorf("failed to get guarantee deposit: %v", err)
+				}
+				deposit.Amount += share
+				deposit.LastUpdated = currentTime
+				guaranteeFund.TotalAmount += share
+
+				err = s.putGuaranteeDeposit(ctx, deposit)
+				if err != nil {
+					return fmt.Errorf("failed to update guarantee deposit: %v", err)
+				}
+				s.journalMove(ctx, journalHolder(loss.DefaulterID, ""), journalAccount(journalGuaranteeDeposit, loss.DefaulterID), journalCash, int64(share))
+			}
+		}
+	}
+
+	loss.Recovered += amount
+	loss.LastUpdated = currentTime
+	if loss.Recovered == loss.Amount {
+		loss.Status = "recovered"
+	}
+
+	err = s.putBrokerAccount(ctx, defaulterAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update defaulter broker account: %v", err)
+	}
+
+	guaranteeFund.LastUpdated = currentTime
+	err = s.putGuaranteeFund(ctx, guaranteeFund)
+	if err != nil {
+		return err
+	}
+
+	err = s.putDefaultLoss(ctx, loss)
+	if err != nil {
+		return err
+	}
+
+	err = s.putTransaction(ctx, &Transaction{
+		TransactionID: "transaction-recovery-" + lossID + "-" + s.getTransactionID(ctx),
+		Type:          "default_recovery",
+		FromID:        loss.DefaulterID,
+		ToID:          "guarantee",
+		Amount:        amount,
+		Status:        "completed",
+		Timestamp:     currentTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	lossJSON, err := json.Marshal(loss)
+	if err != nil {
+		return fmt.Errorf("failed to marshal default loss: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("DefaultLossRecovered", lossJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set DefaultLossRecovered event: %v", err)
+	}
+
+	return nil
+}
+
+// AssessReplenishment assesses every broker whose fund contribution is below its required
+// contribution for the difference, together with its share of the fund's deficit not yet
+// assessed, in proportion to the required contributions of the brokers without open
+// default losses. Brokers with an open assessment are not assessed again.
+func (s *SettlementContract) AssessReplenishment(ctx contractapi.TransactionContextInterface) ([]*ReplenishmentAssessment, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	guaranteeFund, err := s.GetGuaranteeFund(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get guarantee fund: %v", err)
+	}
+
+	contributions, err := s.fundContributions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	currentTime := txTime.Format(time.RFC3339)
+
+	// Brokers with open default losses owe them in full and take no share of the deficit
+	defaulters, err := s.openDefaulters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var assessed []*FundContribution
+	var weights []Money
+	for _, contribution := range contributions {
+		if contribution.OpenAssessmentID == "" && contribution.Required > 0 {
+			assessed = append(assessed, contribution)
+			if defaulters[contribution.BrokerID] {
+				weights = append(weights, 0)
+			} else {
+				weights = append(weights, contribution.Required)
+			}
+		}
+	}
+
+	deficitShares := prorate(guaranteeFund.Deficit-guaranteeFund.DeficitAssessed, weights)
+
+	assessments := []*ReplenishmentAssessment{}
+	for i, contribution := range assessed {
+		assessment := &ReplenishmentAssessment{
+			AssessmentID: "replenishment-" + contribution.BrokerID + "-" + s.getTransactionID(ctx),
+			BrokerID:     contribution.BrokerID,
+			DeficitShare: deficitShares[i],
+			Status:       "open",
+			AssessedAt:   currentTime,
+		}
+		if contribution.Amount < contribution.Required {
+			assessment.ContributionShortfall = contribution.Required - contribution.Amount
+		}
+		assessment.Amount = assessment.ContributionShortfall + assessment.DeficitShare
+		if assessment.Amount <= 0 {
+			continue
+		}
+
+		err = s.putReplenishmentAssessment(ctx, assessment)
+		if err != nil {
+			return nil, err
+		}
+
+		contribution.OpenAssessmentID = assessment.AssessmentID
+		contribution.LastUpdated = currentTime
+		err = s.putFundContribution(ctx, contribution)
+		if err != nil {
+			return nil, err
+		}
+
+		guaranteeFund.DeficitAssessed += assessment.DeficitShare
+		assessments = append(assessments, assessment)
+	}
+
+	guaranteeFund.LastUpdated = currentTime
+	err = s.putGuaranteeFund(ctx, guaranteeFund)
+	if err != nil {
+		return nil, err
+	}
+
+	assessmentsJSON, err := json.Marshal(assessments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal replenishment assessments: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("ReplenishmentAssessed", assessmentsJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set ReplenishmentAssessed event: %v", err)
+	}
+
+	return assessments, nil
+}
+
+// putReplenishmentAssessment stores a replenishment assessment
+func (s *SettlementContract) putReplenishmentAssessment(ctx contractapi.TransactionContextInterface, assessment *ReplenishmentAssessment) error {
+	assessmentJSON, err := json.Marshal(assessment)
+	if err != nil {
+		return fmt.Errorf("failed to marshal replenishment assessment: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(assessment.AssessmentID, assessmentJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put replenishment assessment in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetReplenishmentAssessment retrieves a replenishment assessment by ID
+func (s *SettlementContract) GetReplenishmentAssessment(ctx contractapi.TransactionContextInterface, assessmentID string) (*ReplenishmentAssessment, error) {
+	assessmentJSON, err := ctx.GetStub().GetState(assessmentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if assessmentJSON == nil {
+		return nil, fmt.Errorf("replenishment assessment %s does not exist", assessmentID)
+	}
+
+	var assessment ReplenishmentAssessment
+	err = json.Unmarshal(assessmentJSON, &assessment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal replenishment assessment: %v", err)
+	}
+
+	return &assessment, nil
+}
+
+// PayReplenishment pays a replenishment assessment from the broker's available own funds.
+// The deficit share covers the fund's deficit and the rest tops up the broker's
+// contribution.
+func (s *SettlementContract) PayReplenishment(ctx contractapi.TransactionContextInterface, assessmentID string) error {
+	assessment, err := s.GetReplenishmentAssessment(ctx, assessmentID)
+	if err != nil {
+		return err
+	}
+
+	err = s.authorizeBrokerOrMaroclear(ctx, assessment.BrokerID)
+	if err != nil {
+		return err
+	}
+
+	if assessment.Status != "open" {
+		return fmt.Errorf("replenishment assessment %s is already %s", assessmentID, assessment.Status)
+	}
+
+	brokerAccount, err := s.GetBrokerAccount(ctx, assessment.BrokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get broker account: %v", err)
+	}
+	if brokerAccount.available() < assessment.Amount {
+		return fmt.Errorf("insufficient available balance in broker account")
+	}
+
+	contribution, err := s.GetFundContribution(ctx, assessment.BrokerID)
+	if err != nil {
+		return err
+	}
+
+	guaranteeFund, err := s.GetGuaranteeFund(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get guarantee fund: %v", err)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Recoveries since the assessment may have reduced the deficit; the rest of the
+	// deficit share goes to the contribution
+	toDeficit := assessment.DeficitShare
+	if guaranteeFund.Deficit < toDeficit {
+		toDeficit = guaranteeFund.Deficit
+	}
+	toContribution := assessment.Amount - toDeficit
+
+	guaranteeFund.Deficit -= toDeficit
+	guaranteeFund.DeficitAssessed -= assessment.DeficitShare
+	if guaranteeFund.DeficitAssessed < 0 {
+		guaranteeFund.DeficitAssessed = 0
+	}
+	guaranteeFund.Contributions += toContribution
+	guaranteeFund.TotalAmount += toContribution
+	guaranteeFund.LastUpdated = currentTime
+
+	brokerAccount.Balance -= assessment.Amount
+	brokerAccount.LastUpdated = currentTime
+
+	contribution.Amount += toContribution
+	contribution.OpenAssessmentID = ""
+	contribution.LastUpdated = currentTime
+
+	assessment.Status = "paid"
+	assessment.PaidAt = currentTime
+
+	err = s.putBrokerAccount(ctx, brokerAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update broker account: %v", err)
+	}
+
+	err = s.putFundContribution(ctx, contribution)
+	if err != nil {
+		return err
+	}
+
+	err = s.putGuaranteeFund(ctx, guaranteeFund)
+	if err != nil {
+		return err
+	}
+	s.journalMove(ctx, journalHolder(assessment.BrokerID, ""), journalFundDeficit, journalCash, int64(toDeficit))
+	s.journalMove(ctx, journalHolder(assessment.BrokerID, ""), journalAccount(journalFundContribution, assessment.BrokerID), journalCash, int64(toContribution))
+
+	return s.putReplenishmentAssessment(ctx, assessment)
+}
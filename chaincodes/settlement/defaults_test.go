@@ -0,0 +1,182 @@
+// defaults_test.go - Tests of the default waterfall
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setUpDefault funds the guarantee fund and fails broker1 on a 100,000.00 purchase it
+// cannot pay, and returns the resulting default loss
+func setUpDefault(t *testing.T, l *mockLedger) *DefaultLoss {
+	t.Helper()
+	s := &SettlementContract{}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateGuaranteeDeposit(ctx, "broker1", 100000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateBrokerAccount(ctx, "broker3", 10000000) })
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.ContributeToFund(ctx, "broker1", 50000) })
+	l.must(t, "Broker2MSP", func(ctx txCtx) error { return s.ContributeToFund(ctx, "broker2", 300000) })
+	l.must(t, "Broker3MSP", func(ctx txCtx) error { return s.ContributeToFund(ctx, "broker3", 100000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.AddSkinInTheGame(ctx, 50000) })
+	for _, brokerID := range []string{"broker1", "broker2", "broker3"} {
+		brokerID := brokerID
+		l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetRequiredContribution(ctx, brokerID, 300000) })
+	}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 100, 100000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+
+	l.now = time.Date(2026, 3, 5, 18, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ProcessFail(ctx, "instruction-trade-1", "buyer_insufficient_funds")
+	})
+
+	var losses []*DefaultLoss
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		losses, err = s.GetDefaultLosses(ctx, "broker1")
+		return err
+	})
+	if len(losses) != 1 {
+		t.Fatalf("broker1 has %d default losses, want 1", len(losses))
+	}
+	return losses[0]
+}
+
+// checkLayers compares the layers of a default loss with the wanted ones
+func checkLayers(t *testing.T, got []*LossLayer, want []LossLayer) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("loss has %d layers, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if *got[i] != want[i] {
+			t.Errorf("layer %d = %+v, want %+v", i, *got[i], want[i])
+		}
+	}
+}
+
+func TestOnlyMaroclearCanFailInstructions(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 10, 100, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+
+	for _, mspID := range []string{"Broker1MSP", "Broker2MSP"} {
+		l.mustFail(t, mspID, func(ctx txCtx) error {
+			return s.ProcessFail(ctx, "instruction-trade-1", "seller_insufficient_securities")
+		})
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ProcessFail(ctx, "instruction-trade-1", "buyer_insufficient_funds")
+	})
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ProcessFail(ctx, "instruction-trade-1", "buyer_insufficient_funds")
+	})
+}
+
+func TestOnlyTheSettlementRunFailsInstructions(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 100, 10000000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+
+	// Not before the settlement date, and not by other brokers
+	l.now = time.Date(2026, 3, 3, 10, 0, 0, 0, time.UTC)
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	l.now = settlementDay
+	l.mustFail(t, "Broker3MSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+
+	// broker1 cannot pay 10,000,000.00: settling by hand leaves the instruction in the queue
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	if instruction := instructionOf(t, l, "instruction-trade-1"); !instruction.isLive() {
+		t.Fatalf("instruction failed outside the settlement run: %+v", instruction)
+	}
+
+	if outcome := runBatchOn(t, l, settlementDay, "instruction-trade-1"); outcome.Outcome != "failed" {
+		t.Fatalf("outcome of the final run = %+v", *outcome)
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		losses, err := s.GetDefaultLosses(ctx, "broker1")
+		if len(losses) != 1 {
+			t.Errorf("broker1 has %d default losses, want 1", len(losses))
+		}
+		return err
+	})
+}
+
+func TestDefaultWaterfall(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	loss := setUpDefault(t, l)
+
+	if loss.Amount != 10000000 || loss.Status != "open" {
+		t.Fatalf("loss = %+v", loss)
+	}
+	checkLayers(t, loss.Layers, []LossLayer{
+		{Layer: layerDefaulterDeposit, BrokerID: "broker1", Amount: 100000},
+		{Layer: layerDefaulterContribution, BrokerID: "broker1", Amount: 50000},
+		{Layer: layerSkinInTheGame, Amount: 50000},
+		{Layer: layerMutualized, BrokerID: "broker2", Amount: 300000},
+		{Layer: layerMutualized, BrokerID: "broker3", Amount: 100000},
+		{Layer: layerUncovered, Amount: 9400000},
+	})
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		fund, err := s.GetGuaranteeFund(ctx)
+		if err != nil {
+			return err
+		}
+		if fund.TotalAmount != 0 || fund.Deficit != 9400000 {
+			t.Errorf("guarantee fund = %+v", fund)
+		}
+		return nil
+	})
+}
+
+func TestRecoveredLossRefillsLayersInReverse(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	loss := setUpDefault(t, l)
+
+	// The uncovered loss is recovered first, then the mutualized layers pro rata
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.RecoverDefaultLoss(ctx, loss.LossID, 9600000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		recovered, err := s.GetDefaultLoss(ctx, loss.LossID)
+		if err != nil {
+			return err
+		}
+		if recovered.Recovered != 9600000 || recovered.Status != "open" {
+			t.Errorf("loss = %+v", recovered)
+		}
+		checkLayers(t, recovered.Layers, []LossLayer{
+			{Layer: layerDefaulterDeposit, BrokerID: "broker1", Amount: 100000},
+			{Layer: layerDefaulterContribution, BrokerID: "broker1", Amount: 50000},
+			{Layer: layerSkinInTheGame, Amount: 50000},
+			{Layer: layerMutualized, BrokerID: "broker2", Amount: 300000, Recovered: 150000},
+			{Layer: layerMutualized, BrokerID: "broker3", Amount: 100000, Recovered: 50000},
+			{Layer: layerUncovered, Amount: 9400000, Recovered: 9400000},
+		})
+
+		fund, err := s.GetGuaranteeFund(ctx)
+		if err != nil {
+			return err
+		}
+		if fund.TotalAmount != 200000 || fund.Deficit != 0 {
+			t.Errorf("guarantee fund = %+v", fund)
+		}
+		return nil
+	})
+}
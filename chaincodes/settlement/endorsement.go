@@ -0,0 +1,209 @@
+// endorsement.go - Key-level (state-based) endorsement policies on broker accounts
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// BrokerEndorsementPolicy lists the organizations whose peers must all endorse a change to
+// any of a broker's accounts. The chaincode-level policy of the settlement channel still
+// applies; this policy is set on each account key in the broker's collection.
+type BrokerEndorsementPolicy struct {
+	BrokerID    string   `json:"brokerID"`
+	Orgs        []string `json:"orgs"`
+	Version     int      `json:"version"`
+	UpdatedBy   string   `json:"updatedBy"`
+	LastUpdated string   `json:"lastUpdated"`
+}
+
+// defaultBrokerEndorsementOrgs returns the orgs that endorse a broker's accounts until
+// Maroclear rotates the policy: Maroclear and the broker's own organization. The CCP's
+// accounts are Maroclear's alone.
+func defaultBrokerEndorsementOrgs(brokerID string) []string {
+	if brokerID == ccpBrokerID {
+		return []string{"MaroclearMSP"}
+	}
+	return []string{"MaroclearMSP", brokerMSPID(brokerID)}
+}
+
+// GetBrokerEndorsementPolicy retrieves the endorsement policy applied to a broker's accounts
+func (s *SettlementContract) GetBrokerEndorsementPolicy(ctx contractapi.TransactionContextInterface, brokerID string) (*BrokerEndorsementPolicy, error) {
+	policyJSON, err := ctx.GetStub().GetState("endorsementPolicy-" + brokerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if policyJSON == nil {
+		return &BrokerEndorsementPolicy{
+			BrokerID: brokerID,
+			Orgs:     defaultBrokerEndorsementOrgs(brokerID),
+			Version:  0,
+		}, nil
+	}
+
+	var policy BrokerEndorsementPolicy
+	err = json.Unmarshal(policyJSON, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal endorsement policy: %v", err)
+	}
+
+	return &policy, nil
+}
+
+// GetAccountEndorsementOrgs lists the organizations currently required to endorse changes
+// to a single key in a broker's collection (e.g. "brokerAccount-broker1")
+func (s *SettlementContract) GetAccountEndorsementOrgs(ctx contractapi.TransactionContextInterface, brokerID, key string) ([]string, error) {
+	policy, err := ctx.GetStub().GetPrivateDataValidationParameter(brokerCollection(brokerID), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read endorsement policy of %s: %v", key, err)
+	}
+	if policy == nil {
+		return []string{}, nil
+	}
+
+	ep, err := statebased.NewStateEP(policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse endorsement policy of %s: %v", key, err)
+	}
+
+	orgs := ep.ListOrgs()
+	sort.Strings(orgs)
+	return orgs, nil
+}
+
+// setAccountEndorsementPolicy sets the broker's current key-level endorsement policy on an account key
+func (s *SettlementContract) setAccountEndorsementPolicy(ctx contractapi.TransactionContextInterface, brokerID, key string) error {
+	policy, err := s.GetBrokerEndorsementPolicy(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	return s.applyEndorsementPolicy(ctx, brokerID, key, policy.Orgs)
+}
+
+// applyEndorsementPolicy requires a peer of every listed org to endorse changes to the key
+func (s *SettlementContract) applyEndorsementPolicy(ctx contractapi.TransactionContextInterface, brokerID, key string, orgs []string) error {
+	ep, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create endorsement policy: %v", err)
+	}
+
+	err = ep.AddOrgs(statebased.RoleTypePeer, orgs...)
+	if err != nil {
+		return fmt.Errorf("failed to add orgs to endorsement policy: %v", err)
+	}
+
+	policy, err := ep.Policy()
+	if err != nil {
+		return fmt.Errorf("failed to build endorsement policy: %v", err)
+	}
+
+	err = ctx.GetStub().SetPrivateDataValidationParameter(brokerCollection(brokerID), key, policy)
+	if err != nil {
+		return fmt.Errorf("failed to set endorsement policy on %s: %v", key, err)
+	}
+
+	return nil
+}
+
+// RotateBrokerEndorsementPolicy replaces the orgs that must endorse changes to a broker's
+// accounts and re-applies the policy to every account in the broker's collection.
+// orgs is a comma-separated list of MSP IDs and must include MaroclearMSP.
+// Only Maroclear can rotate policies; the rotation itself must satisfy the policy
+// currently set on the accounts, so it is endorsed by the outgoing orgs as well.
+func (s *SettlementContract) RotateBrokerEndorsementPolicy(ctx contractapi.TransactionContextInterface, brokerID, orgs string) error {
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != "MaroclearMSP" {
+		return fmt.Errorf("only Maroclear can rotate endorsement policies")
+	}
+
+	var newOrgs []string
+	seen := make(map[string]bool)
+	for _, org := range strings.Split(orgs, ",") {
+		org = strings.TrimSpace(org)
+		if org == "" || seen[org] {
+			continue
+		}
+		seen[org] = true
+		newOrgs = append(newOrgs, org)
+	}
+	if !seen["MaroclearMSP"] {
+		return fmt.Errorf("endorsement policy must include MaroclearMSP")
+	}
+	sort.Strings(newOrgs)
+
+	policy, err := s.GetBrokerEndorsementPolicy(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	policy.Orgs = newOrgs
+	policy.Version++
+	policy.UpdatedBy = mspID
+	policy.LastUpdated, err = s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Re-apply the policy to every account the broker holds. Holds, journal lines and
+	// transaction records in the collection carry no policy.
+	for _, prefix := range accountKeyPrefixes {
+		err = s.rotateAccountPolicies(ctx, brokerID, prefix, newOrgs)
+		if err != nil {
+			return err
+		}
+	}
+
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("failed to marshal endorsement policy: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("endorsementPolicy-"+brokerID, policyJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put endorsement policy in ledger: %v", err)
+	}
+
+	// Emit an event for the rotation
+	err = ctx.GetStub().SetEvent("EndorsementPolicyRotated", policyJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set EndorsementPolicyRotated event: %v", err)
+	}
+
+	return nil
+}
+
+// accountKeyPrefixes are the prefixes of the records stored with putAccountState, which
+// carry the broker's endorsement policy
+var accountKeyPrefixes = []string{"brokerAccount-", "securitiesAccount-", "guaranteeDeposit-", "clientAccount-", "clientSecuritiesAccount-"}
+
+// rotateAccountPolicies applies the orgs to the broker's accounts whose keys start with prefix
+func (s *SettlementContract) rotateAccountPolicies(ctx contractapi.TransactionContextInterface, brokerID, prefix string, orgs []string) error {
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByRange(brokerCollection(brokerID), prefix, prefix+"~")
+	if err != nil {
+		return fmt.Errorf("failed to get broker accounts: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return fmt.Errorf("failed to iterate broker accounts: %v", err)
+		}
+
+		err = s.applyEndorsementPolicy(ctx, brokerID, queryResponse.Key, orgs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
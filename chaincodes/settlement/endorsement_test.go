@@ -0,0 +1,75 @@
+// endorsement_test.go - Tests of the key-level endorsement policies on broker accounts
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// accountOrgs returns the orgs that must endorse changes to a broker's account
+func accountOrgs(t *testing.T, l *mockLedger, brokerID, key string) []string {
+	t.Helper()
+	s := &SettlementContract{}
+
+	var orgs []string
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		orgs, err = s.GetAccountEndorsementOrgs(ctx, brokerID, key)
+		return err
+	})
+	return orgs
+}
+
+func TestAccountsGetEndorsementPolicyWhenFirstStored(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+
+	want := []string{"Broker1MSP", "MaroclearMSP"}
+	if orgs := accountOrgs(t, l, "broker1", "brokerAccount-broker1"); !reflect.DeepEqual(orgs, want) {
+		t.Fatalf("broker account orgs = %v, want %v", orgs, want)
+	}
+
+	// Reading an account the broker does not hold yet leaves no policy behind
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.getOrNewSecuritiesAccount(ctx, "broker1", "SEC999")
+		return err
+	})
+	if orgs := accountOrgs(t, l, "broker1", "securitiesAccount-broker1-SEC999"); len(orgs) != 0 {
+		t.Fatalf("unstored account has endorsement orgs %v", orgs)
+	}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		account, err := s.getOrNewSecuritiesAccount(ctx, "broker1", "SEC999")
+		if err != nil {
+			return err
+		}
+		return s.putSecuritiesAccount(ctx, account)
+	})
+	if orgs := accountOrgs(t, l, "broker1", "securitiesAccount-broker1-SEC999"); !reflect.DeepEqual(orgs, want) {
+		t.Fatalf("stored account orgs = %v, want %v", orgs, want)
+	}
+}
+
+func TestStoringAccountKeepsRotatedPolicy(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.RotateBrokerEndorsementPolicy(ctx, "broker1", "Broker1MSP,MaroclearMSP,AMMCMSP")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.DepositFunds(ctx, "broker1", 100) })
+
+	want := []string{"AMMCMSP", "Broker1MSP", "MaroclearMSP"}
+	if orgs := accountOrgs(t, l, "broker1", "brokerAccount-broker1"); !reflect.DeepEqual(orgs, want) {
+		t.Fatalf("broker account orgs = %v, want %v", orgs, want)
+	}
+
+	// Only accounts get the policy, not the transaction records kept beside them
+	for key := range l.collection("maroclear-broker1-balances") {
+		if strings.HasPrefix(key, "transaction-") && l.policies["maroclear-broker1-balances/"+key] != nil {
+			t.Errorf("%s has an endorsement policy", key)
+		}
+	}
+}
@@ -0,0 +1,725 @@
+// fees.go - Exchange and CSD fees, commissions and taxes charged at settlement
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// feeRateScale is the number of fee rate units in one: rates are in hundredths of a basis
+// point of the settled amount
+const feeRateScale = 1000000
+
+// Fee kinds. Exchange fees are paid to the stock market's fee account, CSD fees and taxes
+// to Maroclear's (which remits the taxes), and commissions by a client to its broker.
+const (
+	feeKindExchange   = "exchange"
+	feeKindCSD        = "csd"
+	feeKindTax        = "tax"
+	feeKindCommission = "commission"
+)
+
+// Fee accounts collecting the exchange and CSD fees
+const (
+	feeAccountExchange  = "exchange"
+	feeAccountMaroclear = "maroclear"
+)
+
+// FeeRule is one line of the fee schedule: a rate on the settled amount of one side of an
+// instruction, bounded by a minimum and a maximum per settlement
+type FeeRule struct {
+	RuleID      string `json:"ruleID"`
+	Kind        string `json:"kind"` // exchange, csd, tax, commission
+	Side        string `json:"side"` // buy, sell, any
+	Role        string `json:"role"` // maker, taker, any
+	Rate        int    `json:"rate"` // hundredths of a basis point
+	Minimum     Money  `json:"minimum"`
+	Maximum     Money  `json:"maximum"` // zero for no maximum
+	UpdatedBy   string `json:"updatedBy"`
+	LastUpdated string `json:"lastUpdated"`
+}
+
+// Fee is a fee charged to one side of an instruction when it settled
+type Fee struct {
+	FeeID         string `json:"feeID"`
+	RuleID        string `json:"ruleID"`
+	Kind          string `json:"kind"`
+	InstructionID string `json:"instructionID"`
+	TradeID       string `json:"tradeID"`
+	Date          string `json:"date"` // YYYY-MM-DD
+	BrokerID      string `json:"brokerID"`
+	ClientID      string `json:"clientID"` // client paying a commission
+	Side          string `json:"side"`
+	Role          string `json:"role"`
+	SettledAmount Money  `json:"settledAmount"`
+	Rate          int    `json:"rate"`
+	Amount        Money  `json:"amount"`
+	Outstanding   Money  `json:"outstanding"` // owed by the broker, not yet paid
+	PaidTo        string `json:"paidTo"`      // fee account, or the broker for a commission
+	TransactionID string `json:"transactionID"`
+	ChargedAt     string `json:"chargedAt"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// FeeAccount collects the fees paid to the stock market or to Maroclear
+type FeeAccount struct {
+	AccountID   string `json:"accountID"` // exchange, maroclear
+	Balance     Money  `json:"balance"`
+	LastUpdated string `json:"lastUpdated"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// FeeStatement is a broker's fees for a month
+type FeeStatement struct {
+	StatementID       string `json:"statementID"`
+	BrokerID          string `json:"brokerID"`
+	Month             string `json:"month"` // YYYY-MM
+	Fees              []*Fee `json:"fees"`
+	ExchangeFees      Money  `json:"exchangeFees"`
+	CSDFees           Money  `json:"csdFees"`
+	Taxes             Money  `json:"taxes"`
+	Total             Money  `json:"total"`             // paid by the broker
+	Outstanding       Money  `json:"outstanding"`       // of the total, still owed when issued
+	CommissionsEarned Money  `json:"commissionsEarned"` // paid by its clients
+	IssuedAt          string `json:"issuedAt"`
+}
+
+// feeKey returns the key of a fee. Keys start with the date so that a month's fees are
+// one range.
+func feeKey(date, instructionID, side, ruleID string) string {
+	return "fee-" + date + "-" + instructionID + "-" + side + "-" + ruleID
+}
+
+// feeAccountFor returns the fee account a kind of fee is paid to
+func feeAccountFor(kind string) string {
+	if kind == feeKindExchange {
+		return feeAccountExchange
+	}
+	return feeAccountMaroclear
+}
+
+// amount returns the fee on a settled amount, within the rule's minimum and maximum
+func (rule *FeeRule) amount(settled Money) Money {
+	fee := settled * Money(rule.Rate) / feeRateScale
+	if fee < rule.Minimum {
+		fee = rule.Minimum
+	}
+	if rule.Maximum > 0 && fee > rule.Maximum {
+		fee = rule.Maximum
+	}
+	return fee
+}
+
+// applies tells whether the rule applies to a side with a maker or taker role
+func (rule *FeeRule) applies(side, role string) bool {
+	return (rule.Side == "any" || rule.Side == side) && (rule.Role == "any" || rule.Role == role)
+}
+
+// SetFeeRule adds or replaces a line of the fee schedule. The rate is in hundredths of a
+// basis point of the settled amount, and the minimum and maximum are in centimes, a zero
+// maximum meaning none.
+func (s *SettlementContract) SetFeeRule(ctx contractapi.TransactionContextInterface, ruleID, kind, side, role string, rate int, minimumCentimes, maximumCentimes int64) error {
+	minimum, maximum := Money(minimumCentimes), Money(maximumCentimes)
+
+	mspID, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ruleID == "" {
+		return fmt.Errorf("rule ID is required")
+	}
+	if kind != feeKindExchange && kind != feeKindCSD && kind != feeKindTax && kind != feeKindCommission {
+		return fmt.Errorf("fee kind must be exchange, csd, tax or commission")
+	}
+	if side != "buy" && side != "sell" && side != "any" {
+		return fmt.Errorf("side must be buy, sell or any")
+	}
+	if role != "maker" && role != "taker" && role != "any" {
+		return fmt.Errorf("role must be maker, taker or any")
+	}
+	if rate < 0 || minimum < 0 || maximum < 0 {
+		return fmt.Errorf("rate, minimum and maximum must not be negative")
+	}
+	if maximum > 0 && maximum < minimum {
+		return fmt.Errorf("maximum %v is below the minimum %v", maximum, minimum)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	rule := FeeRule{
+		RuleID:      ruleID,
+		Kind:        kind,
+		Side:        side,
+		Role:        role,
+		Rate:        rate,
+		Minimum:     minimum,
+		Maximum:     maximum,
+		UpdatedBy:   mspID,
+		LastUpdated: currentTime,
+	}
+
+	ruleJSON, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("failed to marshal fee rule: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("feeRule-"+ruleID, ruleJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put fee rule in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// RemoveFeeRule removes a line of the fee schedule. Fees already charged are kept.
+func (s *SettlementContract) RemoveFeeRule(ctx contractapi.TransactionContextInterface, ruleID string) error {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	ruleJSON, err := ctx.GetStub().GetState("feeRule-" + ruleID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if ruleJSON == nil {
+		return fmt.Errorf("fee rule %s does not exist", ruleID)
+	}
+
+	err = ctx.GetStub().DelState("feeRule-" + ruleID)
+	if err != nil {
+		return fmt.Errorf("failed to delete fee rule: %v", err)
+	}
+
+	return nil
+}
+
+// GetFeeSchedule retrieves every line of the fee schedule (none until Maroclear sets them)
+func (s *SettlementContract) GetFeeSchedule(ctx contractapi.TransactionContextInterface) ([]*FeeRule, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("feeRule-", "feeRule-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fee rules: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	rules := []*FeeRule{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate fee rules: %v", err)
+		}
+
+		var rule FeeRule
+		err = json.Unmarshal(queryResponse.Value, &rule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal fee rule: %v", err)
+		}
+		rules = append(rules, &rule)
+	}
+
+	return rules, nil
+}
+
+// chargeSettlementFees charges the fees of the schedule on both sides of a settled
+// instruction (quantity and amount settled), and records a fee transaction for each. The
+// market's maker pays the maker rates and the other side the taker rates; trades imported
+// without a maker side pay taker rates on both sides. Brokers pay exchange and CSD fees and
+// taxes from their own funds; what they cannot pay stays outstanding on the fee, a
+// receivable collected by PayOutstandingFees. Commissions move from
+// the client's available funds to its broker, and house sides pay none. The CCP's sides pay
+// no fees. The caller's context must read its own writes.
+func (s *SettlementContract) chargeSettlementFees(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, amount Money, currentTime string) error {
+	rules, err := s.GetFeeSchedule(ctx)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	trade, err := s.GetTrade(ctx, instruction.TradeID)
+	if err != nil {
+		return fmt.Errorf("failed to get trade: %v", err)
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	date := txTime.Format(calendarDateLayout)
+
+	sides := []struct {
+		side, brokerID, clientID string
+	}{
+		{"buy", instruction.BuyBrokerID, instruction.BuyClientID},
+		{"sell", instruction.SellBrokerID, instruction.SellClientID},
+	}
+
+	for _, side := range sides {
+		if side.brokerID == ccpBrokerID {
+			continue
+		}
+
+		role := "taker"
+		if trade.MakerSide == side.side {
+			role = "maker"
+		}
+
+		for _, rule := range rules {
+			if !rule.applies(side.side, role) {
+				continue
+			}
+			if rule.Kind == feeKindCommission && side.clientID == "" {
+				continue
+			}
+
+			fee := &Fee{
+				FeeID:         feeKey(date, instruction.InstructionID, side.side, rule.RuleID),
+				RuleID:        rule.RuleID,
+				Kind:          rule.Kind,
+				InstructionID: instruction.InstructionID,
+				TradeID:       instruction.TradeID,
+				Date:          date,
+				BrokerID:      side.brokerID,
+				Side:          side.side,
+				Role:          role,
+				SettledAmount: amount,
+				Rate:          rule.Rate,
+				Amount:        rule.amount(amount),
+				TransactionID: "transaction-fee-" + instruction.InstructionID + "-" + side.side + "-" + rule.RuleID,
+				ChargedAt:     currentTime,
+			}
+
+			if rule.Kind == feeKindCommission {
+				fee.ClientID = side.clientID
+				err = s.collectCommission(ctx, fee, currentTime)
+			} else {
+				err = s.collectFee(ctx, fee, currentTime)
+			}
+			if err != nil {
+				return err
+			}
+			if fee.Amount <= 0 {
+				continue
+			}
+
+			feeJSON, err := json.Marshal(fee)
+			if err != nil {
+				return fmt.Errorf("failed to marshal fee: %v", err)
+			}
+
+			err = ctx.GetStub().PutState(fee.FeeID, feeJSON)
+			if err != nil {
+				return fmt.Errorf("failed to put fee in ledger: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// collectFee collects a fee from the broker into the fee account it is paid to. A fee is a
+// debt of the broker, not a settlement obligation: what its available own funds do not
+// cover stays outstanding instead of going through the default waterfall.
+func (s *SettlementContract) collectFee(ctx contractapi.TransactionContextInterface, fee *Fee, currentTime string) error {
+	if fee.Amount <= 0 {
+		return nil
+	}
+
+	fee.PaidTo = feeAccountFor(fee.Kind)
+	fee.Outstanding = fee.Amount
+
+	return s.payFee(ctx, fee, fee.TransactionID, currentTime)
+}
+
+// payFee pays as much of a fee's outstanding amount as the broker's available own funds
+// allow into the fee account it is paid to. The caller stores the fee.
+func (s *SettlementContract) payFee(ctx contractapi.TransactionContextInterface, fee *Fee, transactionID, currentTime string) error {
+	account, err := s.getOrNewBrokerAccount(ctx, fee.BrokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get broker account: %v", err)
+	}
+
+	paid := fee.Outstanding
+	if available := account.available(); available < paid {
+		paid = available
+	}
+	if paid <= 0 {
+		return nil
+	}
+
+	account.Balance -= paid
+	account.LastUpdated = currentTime
+
+	err = s.putBrokerAccount(ctx, account)
+	if err != nil {
+		return fmt.Errorf("failed to update broker account: %v", err)
+	}
+
+	feeAccount, err := s.getFeeAccount(ctx, fee.PaidTo)
+	if err != nil {
+		return err
+	}
+	feeAccount.Balance += paid
+	feeAccount.LastUpdated = currentTime
+
+	err = s.putFeeAccount(ctx, feeAccount)
+	if err != nil {
+		return err
+	}
+	s.journalMove(ctx, journalHolder(fee.BrokerID, ""), journalAccount(journalFeeAccount, fee.PaidTo), journalCash, int64(paid))
+
+	fee.Outstanding -= paid
+
+	return s.putTransaction(ctx, &Transaction{
+		TransactionID: transactionID,
+		Type:          "fee",
+		FromID:        fee.BrokerID,
+		ToID:          "feeAccount-" + feeAccount.AccountID,
+		Amount:        paid,
+		InstructionID: fee.InstructionID,
+		Status:        "completed",
+		Timestamp:     currentTime,
+	})
+}
+
+// PayOutstandingFees pays a broker's outstanding fees, oldest first, from its available own
+// funds, and returns the amount paid
+func (s *SettlementContract) PayOutstandingFees(ctx contractapi.TransactionContextInterface, brokerID string) (Money, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Each fee is paid from the account as left by the previous one
+	ctx = withWriteCache(ctx)
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	fees, err := s.feesInRange(ctx, "fee-", "fee-~")
+	if err != nil {
+		return 0, err
+	}
+
+	var total Money
+	for _, fee := range fees {
+		if fee.BrokerID != brokerID || fee.Outstanding <= 0 {
+			continue
+		}
+
+		outstanding := fee.Outstanding
+		err = s.payFee(ctx, fee, "transaction-fee-payment-"+fee.FeeID+"-"+s.getTransactionID(ctx), currentTime)
+		if err != nil {
+			return 0, err
+		}
+		if fee.Outstanding == outstanding {
+			break // No funds left
+		}
+		total += outstanding - fee.Outstanding
+
+		feeJSON, err := json.Marshal(fee)
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal fee: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(fee.FeeID, feeJSON)
+		if err != nil {
+			return 0, fmt.Errorf("failed to put fee in ledger: %v", err)
+		}
+	}
+
+	return total, nil
+}
+
+// collectCommission moves a commission from the client's available funds to its broker's
+// own funds. A client short of funds pays what it has available.
+func (s *SettlementContract) collectCommission(ctx contractapi.TransactionContextInterface, fee *Fee, currentTime string) error {
+	clientAccount, err := s.GetClientAccount(ctx, fee.BrokerID, fee.ClientID)
+	if err != nil {
+		return err
+	}
+
+	if available := clientAccount.available(); available < fee.Amount {
+		fee.Amount = available
+	}
+	if fee.Amount <= 0 {
+		return nil
+	}
+
+	account, err := s.getOrNewBrokerAccount(ctx, fee.BrokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get broker account: %v", err)
+	}
+
+	clientAccount.Balance -= fee.Amount
+	clientAccount.LastUpdated = currentTime
+	account.ClientBalance -= fee.Amount
+	account.LastUpdated = currentTime
+
+	err = s.putClientAccount(ctx, clientAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update client account: %v", err)
+	}
+
+	err = s.putBrokerAccount(ctx, account)
+	if err != nil {
+		return fmt.Errorf("failed to update broker account: %v", err)
+	}
+	s.journalMove(ctx, journalHolder(fee.BrokerID, fee.ClientID), journalHolder(fee.BrokerID, ""), journalCash, int64(fee.Amount))
+
+	fee.PaidTo = fee.BrokerID
+
+	return s.putTransaction(ctx, &Transaction{
+		TransactionID: fee.TransactionID,
+		Type:          "commission",
+		FromID:        fee.BrokerID,
+		ToID:          fee.BrokerID,
+		FromClientID:  fee.ClientID,
+		Amount:        fee.Amount,
+		InstructionID: fee.InstructionID,
+		Status:        "completed",
+		Timestamp:     currentTime,
+	})
+}
+
+// getFeeAccount returns a fee account, or an empty one if no fee was paid to it yet
+func (s *SettlementContract) getFeeAccount(ctx contractapi.TransactionContextInterface, accountID string) (*FeeAccount, error) {
+	accountJSON, err := ctx.GetStub().GetState("feeAccount-" + accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if accountJSON == nil {
+		return &FeeAccount{AccountID: accountID}, nil
+	}
+
+	var account FeeAccount
+	err = json.Unmarshal(accountJSON, &account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal fee account: %v", err)
+	}
+
+	return &account, nil
+}
+
+// putFeeAccount stores a fee account
+func (s *SettlementContract) putFeeAccount(ctx contractapi.TransactionContextInterface, account *FeeAccount) error {
+	accountJSON, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("failed to marshal fee account: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("feeAccount-"+account.AccountID, accountJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put fee account in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetFeeAccount retrieves the exchange or Maroclear fee account. The stock market can
+// see its own.
+func (s *SettlementContract) GetFeeAccount(ctx contractapi.TransactionContextInterface, accountID string) (*FeeAccount, error) {
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if mspID != "MaroclearMSP" && !(mspID == "StockMarketMSP" && accountID == feeAccountExchange) {
+		return nil, fmt.Errorf("organization %s is not authorized to view fee account %s", mspID, accountID)
+	}
+	if accountID != feeAccountExchange && accountID != feeAccountMaroclear {
+		return nil, fmt.Errorf("fee account must be exchange or maroclear")
+	}
+
+	return s.getFeeAccount(ctx, accountID)
+}
+
+// GetFees retrieves the fees charged to a broker and the commissions paid to it, for a
+// month (YYYY-MM) or for all months when month is empty
+func (s *SettlementContract) GetFees(ctx contractapi.TransactionContextInterface, brokerID, month string) ([]*Fee, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := "fee-"
+	if month != "" {
+		prefix += month + "-"
+	}
+
+	fees, err := s.feesInRange(ctx, prefix, prefix+"~")
+	if err != nil {
+		return nil, err
+	}
+
+	brokerFees := []*Fee{}
+	for _, fee := range fees {
+		if fee.BrokerID == brokerID {
+			brokerFees = append(brokerFees, fee)
+		}
+	}
+
+	return brokerFees, nil
+}
+
+// IssueFeeStatements issues every broker's fee statement for a month (YYYY-MM) once the
+// month has ended. Each month is issued once.
+func (s *SettlementContract) IssueFeeStatements(ctx contractapi.TransactionContextInterface, month string) ([]*FeeStatement, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = time.Parse("2006-01", month)
+	if err != nil {
+		return nil, fmt.Errorf("month must be in YYYY-MM format: %v", err)
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if month >= txTime.Format("2006-01") {
+		return nil, fmt.Errorf("fee statements of %s can only be issued after the month ends", month)
+	}
+
+	issuedJSON, err := ctx.GetStub().GetState("feeStatements-" + month)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if issuedJSON != nil {
+		return nil, fmt.Errorf("fee statements of %s are already issued", month)
+	}
+
+	currentTime := txTime.Format(time.RFC3339)
+
+	fees, err := s.feesInRange(ctx, "fee-"+month+"-", "fee-"+month+"-~")
+	if err != nil {
+		return nil, err
+	}
+
+	statements := []*FeeStatement{}
+	byBroker := map[string]*FeeStatement{}
+	for _, fee := range fees {
+		statement, ok := byBroker[fee.BrokerID]
+		if !ok {
+			statement = &FeeStatement{
+				StatementID: "feeStatement-" + month + "-" + fee.BrokerID,
+				BrokerID:    fee.BrokerID,
+				Month:       month,
+				Fees:        []*Fee{},
+				IssuedAt:    currentTime,
+			}
+			byBroker[fee.BrokerID] = statement
+			statements = append(statements, statement)
+		}
+
+		statement.Fees = append(statement.Fees, fee)
+		statement.Outstanding += fee.Outstanding
+		switch fee.Kind {
+		case feeKindExchange:
+			statement.ExchangeFees += fee.Amount
+		case feeKindCSD:
+			statement.CSDFees += fee.Amount
+		case feeKindTax:
+			statement.Taxes += fee.Amount
+		case feeKindCommission:
+			statement.CommissionsEarned += fee.Amount
+		}
+	}
+
+	statementIDs := []string{}
+	for _, statement := range statements {
+		statement.Total = statement.ExchangeFees + statement.CSDFees + statement.Taxes
+
+		statementJSON, err := json.Marshal(statement)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal fee statement: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(statement.StatementID, statementJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to put fee statement in ledger: %v", err)
+		}
+
+		statementIDs = append(statementIDs, statement.StatementID)
+	}
+
+	statementIDsJSON, err := json.Marshal(statementIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal fee statement IDs: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("feeStatements-"+month, statementIDsJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put fee statements in ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("FeeStatementsIssued", statementIDsJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set FeeStatementsIssued event: %v", err)
+	}
+
+	return statements, nil
+}
+
+// GetFeeStatement retrieves a broker's fee statement for a month (YYYY-MM)
+func (s *SettlementContract) GetFeeStatement(ctx contractapi.TransactionContextInterface, brokerID, month string) (*FeeStatement, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	statementJSON, err := ctx.GetStub().GetState("feeStatement-" + month + "-" + brokerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if statementJSON == nil {
+		return nil, fmt.Errorf("no fee statement of %s is issued for broker %s", month, brokerID)
+	}
+
+	var statement FeeStatement
+	err = json.Unmarshal(statementJSON, &statement)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal fee statement: %v", err)
+	}
+
+	return &statement, nil
+}
+
+// feesInRange retrieves the fees with keys in a range
+func (s *SettlementContract) feesInRange(ctx contractapi.TransactionContextInterface, startKey, endKey string) ([]*Fee, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fees: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var fees []*Fee
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate fees: %v", err)
+		}
+
+		var fee Fee
+		err = json.Unmarshal(queryResponse.Value, &fee)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal fee: %v", err)
+		}
+		fees = append(fees, &fee)
+	}
+
+	return fees, nil
+}
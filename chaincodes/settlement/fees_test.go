@@ -0,0 +1,204 @@
+// fees_test.go - Tests of the fee schedule, fee collection and monthly fee statements
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setUpFeeSchedule sets exchange fees by role, a capped CSD fee, a tax on sellers and a
+// commission charged to buying clients
+func setUpFeeSchedule(t *testing.T, l *mockLedger) {
+	t.Helper()
+	s := &SettlementContract{}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.SetFeeRule(ctx, "exchange-taker", "exchange", "any", "taker", 1000, 100, 0)
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.SetFeeRule(ctx, "exchange-maker", "exchange", "any", "maker", 500, 100, 0)
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetFeeRule(ctx, "csd", "csd", "any", "any", 200, 0, 1500) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetFeeRule(ctx, "tax", "tax", "sell", "any", 5000, 0, 0) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetFeeRule(ctx, "commission", "commission", "buy", "any", 2000, 0, 0) })
+}
+
+func TestFeesAreCollectedOnSettlement(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.now = time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error { return s.SetFeeRule(ctx, "csd", "csd", "any", "any", 1, 0, 0) })
+	setUpFeeSchedule(t, l)
+
+	// broker1 buys 100 SEC002 for itself from an aggressive seller, and 200 for its client
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.CreateClientAccount(ctx, "broker1", "C1", "Alice", "verified") })
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.DepositClientFunds(ctx, "broker1", "C1", 20100000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 100, 100000, "pending", "2026-03-02T09:00:00Z", "sell")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-2", "order-b2", "order-s2", "broker1", "broker2", "C1", "",
+			"SEC002", 200, 100000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-2") })
+
+	l.now = time.Date(2026, 3, 5, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-2") })
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		fees, err := s.GetFees(ctx, "broker2", "2026-03")
+		if err != nil {
+			return err
+		}
+		want := map[string]Money{
+			"instruction-trade-1/maker/exchange": 5000, "instruction-trade-1/maker/csd": 1500, "instruction-trade-1/maker/tax": 50000,
+			"instruction-trade-2/taker/exchange": 20000, "instruction-trade-2/taker/csd": 1500, "instruction-trade-2/taker/tax": 100000,
+		}
+		if len(fees) != len(want) {
+			t.Fatalf("broker2 paid %d fees, want %d", len(fees), len(want))
+		}
+		for _, fee := range fees {
+			if amount := want[fee.InstructionID+"/"+fee.Role+"/"+fee.Kind]; fee.Amount != amount {
+				t.Errorf("broker2 fee = %+v, want %v", *fee, amount)
+			}
+		}
+
+		// The commission moves from the client to its broker, which pays the other fees
+		client, err := s.GetClientAccount(ctx, "broker1", "C1")
+		if err != nil {
+			return err
+		}
+		if client.Balance != 60000 {
+			t.Errorf("C1 balance = %v, want 600.00", client.Balance)
+		}
+		report, err := s.VerifySegregation(ctx, "broker1")
+		if err != nil {
+			return err
+		}
+		if !report.Segregated {
+			t.Errorf("broker1 segregation = %+v", *report)
+		}
+
+		for accountID, want := range map[string]Money{"exchange": 55000, "maroclear": 156000} {
+			account, err := s.GetFeeAccount(ctx, accountID)
+			if err != nil {
+				return err
+			}
+			if account.Balance != want {
+				t.Errorf("%s fee account = %v, want %v", accountID, account.Balance, want)
+			}
+		}
+		return nil
+	})
+	if balance := cashBalance(t, l, "broker1"); balance != 150000000+20100000-30000000-11500-21500 {
+		t.Errorf("broker1 balance = %v", balance)
+	}
+	if balance := cashBalance(t, l, "broker2"); balance != 50000000+30000000-178000 {
+		t.Errorf("broker2 balance = %v", balance)
+	}
+}
+
+func TestFeeStatementsAreIssuedAfterTheMonth(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	setUpFeeSchedule(t, l)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 100, 100000, "pending", "2026-03-02T09:00:00Z", "sell")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	l.now = time.Date(2026, 3, 5, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.IssueFeeStatements(ctx, "2026-03")
+		return err
+	})
+	l.now = time.Date(2026, 4, 1, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.IssueFeeStatements(ctx, "2026-03")
+		return err
+	})
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.IssueFeeStatements(ctx, "2026-03")
+		return err
+	})
+
+	l.must(t, "Broker2MSP", func(ctx txCtx) error {
+		statement, err := s.GetFeeStatement(ctx, "broker2", "2026-03")
+		if err != nil {
+			return err
+		}
+		if statement.ExchangeFees != 5000 || statement.CSDFees != 1500 || statement.Taxes != 50000 ||
+			statement.Total != 56500 || len(statement.Fees) != 3 {
+			t.Errorf("broker2 statement = %+v", *statement)
+		}
+		return nil
+	})
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error {
+		_, err := s.GetFeeStatement(ctx, "broker1", "2026-03")
+		return err
+	})
+}
+
+func TestUnpaidFeesStayOutstanding(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	setUpFeeSchedule(t, l)
+
+	// broker1 spends all of its 1,500,000.00 on the trade and has nothing left for its fees
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 100, 1500000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+
+	outstanding := func() Money {
+		var total Money
+		l.must(t, "Broker1MSP", func(ctx txCtx) error {
+			fees, err := s.GetFees(ctx, "broker1", "2026-03")
+			for _, fee := range fees {
+				total += fee.Outstanding
+			}
+			return err
+		})
+		return total
+	}
+	if owed := outstanding(); owed != 151500 {
+		t.Fatalf("broker1 owes %v in fees, want 1,515.00", owed)
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		losses, err := s.GetDefaultLosses(ctx, "broker1")
+		if len(losses) != 0 {
+			t.Errorf("unpaid fees were covered as default losses: %v", losses)
+		}
+		return err
+	})
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.DepositFunds(ctx, "broker1", 200000) })
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error {
+		_, err := s.PayOutstandingFees(ctx, "broker1")
+		return err
+	})
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		paid, err := s.PayOutstandingFees(ctx, "broker1")
+		if paid != 151500 {
+			t.Errorf("paid %v, want 1,515.00", paid)
+		}
+		return err
+	})
+	if owed := outstanding(); owed != 0 {
+		t.Errorf("broker1 still owes %v in fees", owed)
+	}
+	if balance := cashBalance(t, l, "broker1"); balance != 200000-151500 {
+		t.Errorf("broker1 balance = %v", balance)
+	}
+}
@@ -0,0 +1,214 @@
+// holds.go - Named holds on cash and securities, and available balances
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Hold earmarks part of an account for one settlement instruction. An account's reserved
+// balance (or quantity) is the sum of its holds, and its available balance is what is left
+// for any other debit. Holds are kept in the holding broker's private data collection.
+type Hold struct {
+	HoldID        string `json:"holdID"`
+	InstructionID string `json:"instructionID"`
+	BrokerID      string `json:"brokerID"`
+	ClientID      string `json:"clientID"` // empty for holds on the broker's own (house) accounts
+	Asset         string `json:"asset"`    // cash, securities
+	SecurityID    string `json:"securityID"`
+	Amount        Money  `json:"amount"`   // for cash holds
+	Quantity      int    `json:"quantity"` // for securities holds
+	CreatedAt     string `json:"createdAt"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// AccountBalance shows the ledger, reserved and available balance of a cash account
+type AccountBalance struct {
+	BrokerID  string  `json:"brokerID"`
+	ClientID  string  `json:"clientID"` // empty for the broker's own (house) funds
+	Ledger    Money   `json:"ledger"`
+	Reserved  Money   `json:"reserved"`
+	Available Money   `json:"available"`
+	Holds     []*Hold `json:"holds"`
+}
+
+// SecuritiesBalance shows the ledger, reserved and available quantity of a securities account
+type SecuritiesBalance struct {
+	BrokerID   string  `json:"brokerID"`
+	ClientID   string  `json:"clientID"` // empty for the broker's own (house) securities
+	SecurityID string  `json:"securityID"`
+	Ledger     int     `json:"ledger"`
+	Reserved   int     `json:"reserved"`
+	Pledged    int     `json:"pledged"` // pledged as guarantee collateral, house securities only
+	Available  int     `json:"available"`
+	Holds      []*Hold `json:"holds"`
+}
+
+// holdKey returns the key of an instruction's hold on cash or securities
+func holdKey(instructionID, asset string) string {
+	return "hold-" + instructionID + "-" + asset
+}
+
+// available returns the broker's own funds that are not held: client funds belong to the
+// clients and are never available to the broker
+func (account *BrokerAccount) available() Money {
+	return account.Balance - account.ClientBalance - account.ReservedBalance
+}
+
+// available returns the broker's own securities that are neither held nor pledged
+func (account *SecuritiesAccount) available() int {
+	return account.Quantity - account.ClientQty - account.ReservedQty - account.PledgedQty
+}
+
+// available returns the client's funds that are not held
+func (account *ClientAccount) available() Money {
+	return account.Balance - account.ReservedBalance
+}
+
+// available returns the client's securities that are not held
+func (account *ClientSecuritiesAccount) available() int {
+	return account.Quantity - account.ReservedQty
+}
+
+// putHold stores a hold in the holding broker's collection
+func (s *SettlementContract) putHold(ctx contractapi.TransactionContextInterface, hold *Hold) error {
+	holdJSON, err := json.Marshal(hold)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hold: %v", err)
+	}
+
+	err = s.putPrivateState(ctx, hold.BrokerID, hold.HoldID, holdJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put hold in collection: %v", err)
+	}
+
+	return nil
+}
+
+// deleteHold removes a hold from the holding broker's collection
+func (s *SettlementContract) deleteHold(ctx contractapi.TransactionContextInterface, hold *Hold) error {
+	err := ctx.GetStub().DelPrivateData(brokerCollection(hold.BrokerID), hold.HoldID)
+	if err != nil {
+		return fmt.Errorf("failed to delete hold from collection: %v", err)
+	}
+
+	return nil
+}
+
+// deleteInstructionHolds removes the hold records of an instruction whose holds have been
+// consumed or released
+func (s *SettlementContract) deleteInstructionHolds(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction) error {
+	err := s.deleteHold(ctx, &Hold{HoldID: holdKey(instruction.InstructionID, "cash"), BrokerID: instruction.BuyBrokerID})
+	if err != nil {
+		return err
+	}
+
+	return s.deleteHold(ctx, &Hold{HoldID: holdKey(instruction.InstructionID, "securities"), BrokerID: instruction.SellBrokerID})
+}
+
+// GetHolds retrieves every hold on a broker's accounts and its clients' sub-accounts
+func (s *SettlementContract) GetHolds(ctx contractapi.TransactionContextInterface, brokerID string) ([]*Hold, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByRange(brokerCollection(brokerID), "hold-", "hold-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get holds: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var holds []*Hold
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate holds: %v", err)
+		}
+
+		var hold Hold
+		err = json.Unmarshal(queryResponse.Value, &hold)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal hold: %v", err)
+		}
+		holds = append(holds, &hold)
+	}
+
+	return holds, nil
+}
+
+// GetAvailableBalance shows the ledger, reserved and available cash of a broker's own
+// funds, or of one of its clients when clientID is not empty
+func (s *SettlementContract) GetAvailableBalance(ctx contractapi.TransactionContextInterface, brokerID, clientID string) (*AccountBalance, error) {
+	holds, err := s.GetHolds(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := AccountBalance{BrokerID: brokerID, ClientID: clientID, Holds: []*Hold{}}
+	if clientID == "" {
+		account, err := s.GetBrokerAccount(ctx, brokerID)
+		if err != nil {
+			return nil, err
+		}
+		balance.Ledger = account.Balance - account.ClientBalance
+		balance.Reserved = account.ReservedBalance
+		balance.Available = account.available()
+	} else {
+		account, err := s.GetClientAccount(ctx, brokerID, clientID)
+		if err != nil {
+			return nil, err
+		}
+		balance.Ledger = account.Balance
+		balance.Reserved = account.ReservedBalance
+		balance.Available = account.available()
+	}
+
+	for _, hold := range holds {
+		if hold.Asset == "cash" && hold.ClientID == clientID {
+			balance.Holds = append(balance.Holds, hold)
+		}
+	}
+
+	return &balance, nil
+}
+
+// GetAvailableSecurities shows the ledger, reserved and available quantity of a security
+// held by a broker for its own account, or by one of its clients when clientID is not empty
+func (s *SettlementContract) GetAvailableSecurities(ctx contractapi.TransactionContextInterface, brokerID, clientID, securityID string) (*SecuritiesBalance, error) {
+	holds, err := s.GetHolds(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := SecuritiesBalance{BrokerID: brokerID, ClientID: clientID, SecurityID: securityID, Holds: []*Hold{}}
+	if clientID == "" {
+		account, err := s.GetSecuritiesAccount(ctx, brokerID, securityID)
+		if err != nil {
+			return nil, err
+		}
+		balance.Ledger = account.Quantity - account.ClientQty
+		balance.Reserved = account.ReservedQty
+		balance.Pledged = account.PledgedQty
+		balance.Available = account.available()
+	} else {
+		account, err := s.GetClientSecuritiesAccount(ctx, brokerID, clientID, securityID)
+		if err != nil {
+			return nil, err
+		}
+		balance.Ledger = account.Quantity
+		balance.Reserved = account.ReservedQty
+		balance.Available = account.available()
+	}
+
+	for _, hold := range holds {
+		if hold.Asset == "securities" && hold.ClientID == clientID && hold.SecurityID == securityID {
+			balance.Holds = append(balance.Holds, hold)
+		}
+	}
+
+	return &balance, nil
+}
@@ -0,0 +1,40 @@
+// holds_test.go - Tests of holds and available balances
+package main
+
+import (
+	"testing"
+)
+
+func TestHeldFundsCannotBeWithdrawn(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpHouseTrade(t, l)
+
+	var balance *AccountBalance
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		var err error
+		balance, err = s.GetAvailableBalance(ctx, "broker1", "")
+		return err
+	})
+	if balance.Reserved != 1000 || balance.Available != balance.Ledger-1000 || len(balance.Holds) != 1 {
+		t.Fatalf("broker1 balance = %+v", balance)
+	}
+	if hold := balance.Holds[0]; hold.InstructionID != "instruction-trade-1" || hold.Amount != 1000 {
+		t.Fatalf("hold = %+v", hold)
+	}
+
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error { return s.WithdrawFunds(ctx, "broker1", int64(balance.Ledger)) })
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.WithdrawFunds(ctx, "broker1", int64(balance.Available)) })
+
+	// Settlement consumes the holds
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		var err error
+		balance, err = s.GetAvailableBalance(ctx, "broker1", "")
+		return err
+	})
+	if balance.Ledger != 0 || balance.Reserved != 0 || len(balance.Holds) != 0 {
+		t.Errorf("broker1 balance after settlement = %+v", balance)
+	}
+}
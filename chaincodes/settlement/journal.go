@@ -0,0 +1,857 @@
+// journal.go - Double-entry journal of movements and ledger conservation audit
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Asset of cash journal lines; securities lines use the security ID
+const journalCash = "cash"
+
+// Journal accounts. Balances held in the ledger are named after the record holding them,
+// with the broker ID after the colon, and the client ID after a slash for client
+// sub-accounts. A debit increases the account, a credit decreases it.
+const (
+	journalBroker           = "broker"           // broker's own cash and securities, neither held nor pledged
+	journalHeld             = "held"             // broker's own cash and securities held for instructions
+	journalPledged          = "pledged"          // broker's own securities pledged as guarantee collateral
+	journalClient           = "client"           // client's cash and securities that are not held
+	journalClientHeld       = "clientHeld"       // client's cash and securities held for instructions
+	journalGuaranteeDeposit = "guaranteeDeposit" // broker guarantee deposit
+	journalFundContribution = "fundContribution" // broker contribution to the guarantee fund
+	journalFeeAccount       = "feeAccount"       // exchange and Maroclear fee accounts
+	journalVariationOwed    = "variationOwed"    // variation margin a broker owes, carried as a negative balance
+	journalSkinInTheGame    = "skinInTheGame"    // the exchange's capital in the guarantee fund
+	journalFundDeficit      = "fundDeficit"      // losses the waterfall could not absorb, carried as a negative balance
+	journalCCPVariation     = "ccpVariation"     // variation margin of the CCP's unmarked sides
+	journalPenalties        = "penalties"        // penalties collected from net payers, all paid out to net receivers
+	journalBrokers          = "brokers"          // total of the brokers' lines in a public journal entry
+)
+
+// External journal accounts: the counterparts of value entering or leaving the ledger
+const (
+	journalSystem  = "system"  // cash paid in and out by participants
+	journalIssuer  = "issuer"  // securities deposited and withdrawn
+	journalMarket  = "market"  // cash and securities exchanged outside the ledger (collateral sales)
+	journalOpening = "opening" // balances held before the journal was opened
+)
+
+// isExternalJournalAccount tells whether an account is the counterpart of value entering
+// or leaving the ledger
+func isExternalJournalAccount(account string) bool {
+	switch account {
+	case journalSystem, journalIssuer, journalMarket, journalOpening:
+		return true
+	}
+	return false
+}
+
+// journalBrokerOf returns the broker whose record holds a journal account, or an empty
+// string for the shared and external accounts
+func journalBrokerOf(account string) string {
+	i := strings.Index(account, ":")
+	if i < 0 || account[:i] == journalFeeAccount {
+		return ""
+	}
+	brokerID := account[i+1:]
+	if j := strings.Index(brokerID, "/"); j >= 0 {
+		brokerID = brokerID[:j]
+	}
+	return brokerID
+}
+
+// JournalLine is a debit or a credit of one asset on one account, in centimes for cash
+// and units for securities
+type JournalLine struct {
+	Account string `json:"account"`
+	Asset   string `json:"asset"`
+	Debit   int64  `json:"debit"`
+	Credit  int64  `json:"credit"`
+}
+
+// JournalEntry holds the lines of every movement made by one transaction, a credit of the
+// account the value leaves followed by a debit of the account it enters. The lines of
+// brokers' records are kept in each broker's collection; the public entry only carries
+// their total per asset, on the brokers account.
+type JournalEntry struct {
+	EntryID   string         `json:"entryID"`
+	TxID      string         `json:"txID"`
+	Function  string         `json:"function"`
+	Lines     []*JournalLine `json:"lines"`
+	BrokerIDs []string       `json:"brokerIDs"` // brokers holding lines of the entry in their collection
+	PostedAt  string         `json:"postedAt"`
+}
+
+// AssetAudit is the conservation check of one asset: what the ledger holds must equal
+// what was paid in from the external accounts
+type AssetAudit struct {
+	Asset    string           `json:"asset"`
+	Held     int64            `json:"held"`
+	External map[string]int64 `json:"external"` // net paid in per external account
+	Balanced bool             `json:"balanced"`
+}
+
+// BalanceMismatch is an account whose stored balance differs from its journal
+type BalanceMismatch struct {
+	Account string `json:"account"`
+	Asset   string `json:"asset"`
+	Journal int64  `json:"journal"`
+	Stored  int64  `json:"stored"`
+}
+
+// LedgerAudit is the result of a ledger-wide audit of the journal
+type LedgerAudit struct {
+	Entries            int                `json:"entries"`
+	UnbalancedEntries  []string           `json:"unbalancedEntries"`
+	Assets             []*AssetAudit      `json:"assets"`
+	Mismatches         []*BalanceMismatch `json:"mismatches"`
+	FundTotalAmount    Money              `json:"fundTotalAmount"`
+	FundTotalExpected  Money              `json:"fundTotalExpected"`
+	FundContributions  Money              `json:"fundContributions"`
+	FundContributedSum Money              `json:"fundContributedSum"`
+	Conserved          bool               `json:"conserved"`
+	AuditedAt          string             `json:"auditedAt"`
+}
+
+// journalPosting identifies the balance of one asset on one account
+type journalPosting struct {
+	account string
+	asset   string
+}
+
+// pendingJournal collects the movements of a transaction until it is posted. Records
+// changed in memory before they are stored (see accountBook) collect their movements in a
+// journal of their own, posted to the transaction's when the records are stored.
+type pendingJournal struct {
+	lines []*JournalLine
+}
+
+// journalContext is the transaction context of the settlement contract. It carries the
+// journal of the transaction, posted once the transaction succeeds (see postJournal).
+type journalContext struct {
+	contractapi.TransactionContext
+	journal *pendingJournal
+}
+
+// pendingJournal returns the journal of the transaction
+func (ctx *journalContext) pendingJournal() *pendingJournal {
+	if ctx.journal == nil {
+		ctx.journal = newPendingJournal()
+	}
+	return ctx.journal
+}
+
+// newPendingJournal returns an empty journal
+func newPendingJournal() *pendingJournal {
+	return &pendingJournal{}
+}
+
+// journalOf returns the journal of the transaction, nil if the context carries none
+func journalOf(ctx contractapi.TransactionContextInterface) *pendingJournal {
+	if cached, ok := ctx.(*cachedContext); ok {
+		ctx = cached.TransactionContextInterface
+	}
+
+	journaled, ok := ctx.(interface{ pendingJournal() *pendingJournal })
+	if !ok {
+		return nil
+	}
+	return journaled.pendingJournal()
+}
+
+// move records a movement of an asset from one account to another: a credit of the
+// account it leaves and a debit of the account it enters. A negative amount moves the
+// asset the other way.
+func (journal *pendingJournal) move(from, to, asset string, amount int64) {
+	if amount < 0 {
+		from, to, amount = to, from, -amount
+	}
+	if amount == 0 || from == to {
+		return
+	}
+	journal.lines = append(journal.lines,
+		&JournalLine{Account: from, Asset: asset, Credit: amount},
+		&JournalLine{Account: to, Asset: asset, Debit: amount})
+}
+
+// append adds the movements collected in another journal
+func (journal *pendingJournal) append(other *pendingJournal) {
+	journal.lines = append(journal.lines, other.lines...)
+}
+
+// clone returns a copy of the journal that can be moved in without changing this one
+func (journal *pendingJournal) clone() *pendingJournal {
+	return &pendingJournal{lines: append([]*JournalLine(nil), journal.lines...)}
+}
+
+// netLines returns the net amount of each asset as one line on an account, in the order
+// the assets first appear
+func netLines(account string, assets []string, amounts map[string]int64) []*JournalLine {
+	var lines []*JournalLine
+	for _, asset := range assets {
+		line := &JournalLine{Account: account, Asset: asset}
+		switch amount := amounts[asset]; {
+		case amount > 0:
+			line.Debit = amount
+		case amount < 0:
+			line.Credit = -amount
+		default:
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// splitJournalEntry splits an entry into its public entry, where the lines of brokers'
+// records are replaced by their total per asset, and the entry of each broker, holding
+// the lines of its records
+func splitJournalEntry(entry *JournalEntry) (*JournalEntry, map[string]*JournalEntry) {
+	public := &JournalEntry{
+		EntryID:   entry.EntryID,
+		TxID:      entry.TxID,
+		Function:  entry.Function,
+		Lines:     []*JournalLine{},
+		BrokerIDs: []string{},
+		PostedAt:  entry.PostedAt,
+	}
+	brokerEntries := map[string]*JournalEntry{}
+	totals := map[string]int64{}
+	var assets []string
+
+	for _, line := range entry.Lines {
+		brokerID := journalBrokerOf(line.Account)
+		if brokerID == "" {
+			public.Lines = append(public.Lines, line)
+			continue
+		}
+
+		brokerEntry, ok := brokerEntries[brokerID]
+		if !ok {
+			brokerEntry = &JournalEntry{
+				EntryID:  entry.EntryID,
+				TxID:     entry.TxID,
+				Function: entry.Function,
+				Lines:    []*JournalLine{},
+				PostedAt: entry.PostedAt,
+			}
+			brokerEntries[brokerID] = brokerEntry
+			public.BrokerIDs = append(public.BrokerIDs, brokerID)
+		}
+		brokerEntry.Lines = append(brokerEntry.Lines, line)
+		if _, ok := totals[line.Asset]; !ok {
+			assets = append(assets, line.Asset)
+		}
+		totals[line.Asset] += line.Debit - line.Credit
+	}
+
+	public.Lines = append(public.Lines, netLines(journalBrokers, assets, totals)...)
+	sort.Strings(public.BrokerIDs)
+
+	return public, brokerEntries
+}
+
+// journalAccount names the journal account of a broker's record
+func journalAccount(kind, brokerID string) string {
+	return kind + ":" + brokerID
+}
+
+// journalHolder names the journal account of a broker's own cash and securities, or of a
+// client's sub-accounts when clientID is not empty
+func journalHolder(brokerID, clientID string) string {
+	if clientID == "" {
+		return journalAccount(journalBroker, brokerID)
+	}
+	return journalAccount(journalClient, brokerID+"/"+clientID)
+}
+
+// journalHolds names the journal account of the holds on a broker's own cash and
+// securities, or on a client's sub-accounts when clientID is not empty
+func journalHolds(brokerID, clientID string) string {
+	if clientID == "" {
+		return journalAccount(journalHeld, brokerID)
+	}
+	return journalAccount(journalClientHeld, brokerID+"/"+clientID)
+}
+
+// deliver records the settlement of an instruction's quantity against its amount. The
+// buyer's cash and the seller's securities leave their holds first, up to the held parts
+// the settlement consumes, then the available balance.
+func (journal *pendingJournal) deliver(instruction *SettlementInstruction, amount Money, quantity int, consumedAmount Money, consumedQuantity int) {
+	buyer := journalHolder(instruction.BuyBrokerID, instruction.BuyClientID)
+	seller := journalHolder(instruction.SellBrokerID, instruction.SellClientID)
+
+	journal.move(journalHolds(instruction.BuyBrokerID, instruction.BuyClientID), seller, journalCash, int64(consumedAmount))
+	journal.move(buyer, seller, journalCash, int64(amount-consumedAmount))
+	journal.move(journalHolds(instruction.SellBrokerID, instruction.SellClientID), buyer, instruction.SecurityID, int64(consumedQuantity))
+	journal.move(seller, buyer, instruction.SecurityID, int64(quantity-consumedQuantity))
+}
+
+// journalMove records a movement of an asset between two journal accounts in the journal
+// of the transaction
+func (s *SettlementContract) journalMove(ctx contractapi.TransactionContextInterface, from, to, asset string, amount int64) {
+	journal := journalOf(ctx)
+	if journal == nil {
+		return
+	}
+	journal.move(from, to, asset, amount)
+}
+
+// journalMoves posts the movements collected while records were changed in memory to the
+// journal of the transaction, once the records are stored
+func (s *SettlementContract) journalMoves(ctx contractapi.TransactionContextInterface, moves *pendingJournal) {
+	journal := journalOf(ctx)
+	if journal == nil || moves == nil {
+		return
+	}
+	journal.append(moves)
+}
+
+// storedBalance returns the stored balance of a journal account, and false for external
+// accounts, which have none
+func (s *SettlementContract) storedBalance(ctx contractapi.TransactionContextInterface, account, asset string) (int64, bool, error) {
+	kind, brokerID := account, ""
+	if i := strings.Index(account, ":"); i >= 0 {
+		kind, brokerID = account[:i], account[i+1:]
+	}
+
+	switch kind {
+	case journalBroker, journalHeld, journalPledged:
+		if asset == journalCash {
+			var brokerAccount BrokerAccount
+			err := s.getStoredPrivate(ctx, brokerID, "brokerAccount-"+brokerID, &brokerAccount)
+			switch kind {
+			case journalHeld:
+				return int64(brokerAccount.ReservedBalance), true, err
+			case journalPledged:
+				return 0, true, err
+			}
+			return int64(brokerAccount.Balance - brokerAccount.ClientBalance - brokerAccount.ReservedBalance), true, err
+		}
+		var securitiesAccount SecuritiesAccount
+		err := s.getStoredPrivate(ctx, brokerID, "securitiesAccount-"+brokerID+"-"+asset, &securitiesAccount)
+		switch kind {
+		case journalHeld:
+			return int64(securitiesAccount.ReservedQty), true, err
+		case journalPledged:
+			return int64(securitiesAccount.PledgedQty), true, err
+		}
+		return int64(securitiesAccount.available()), true, err
+
+	case journalClient, journalClientHeld:
+		clientID := ""
+		if i := strings.Index(brokerID, "/"); i >= 0 {
+			brokerID, clientID = brokerID[:i], brokerID[i+1:]
+		}
+		if asset == journalCash {
+			var clientAccount ClientAccount
+			err := s.getStoredPrivate(ctx, brokerID, clientAccountKey(brokerID, clientID), &clientAccount)
+			if kind == journalClientHeld {
+				return int64(clientAccount.ReservedBalance), true, err
+			}
+			return int64(clientAccount.available()), true, err
+		}
+		var clientSecurities ClientSecuritiesAccount
+		err := s.getStoredPrivate(ctx, brokerID, clientSecuritiesAccountKey(brokerID, clientID, asset), &clientSecurities)
+		if kind == journalClientHeld {
+			return int64(clientSecurities.ReservedQty), true, err
+		}
+		return int64(clientSecurities.available()), true, err
+
+	case journalGuaranteeDeposit:
+		var deposit GuaranteeDeposit
+		err := s.getStoredPrivate(ctx, brokerID, "guaranteeDeposit-"+brokerID, &deposit)
+		return int64(deposit.Amount), true, err
+
+	case journalFundContribution:
+		contribution, err := s.GetFundContribution(ctx, brokerID)
+		if err != nil {
+			return 0, true, err
+		}
+		return int64(contribution.Amount), true, nil
+
+	case journalFeeAccount:
+		feeAccount, err := s.getFeeAccount(ctx, brokerID)
+		if err != nil {
+			return 0, true, err
+		}
+		return int64(feeAccount.Balance), true, nil
+
+	case journalVariationOwed:
+		status, err := s.GetBrokerMarginStatus(ctx, brokerID)
+		if err != nil {
+			return 0, true, err
+		}
+		return -int64(status.VariationOwed), true, nil
+
+	case journalSkinInTheGame, journalFundDeficit:
+		var fund GuaranteeFund
+		fundJSON, err := ctx.GetStub().GetState("guaranteeFund")
+		if err != nil {
+			return 0, true, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if fundJSON != nil {
+			err = json.Unmarshal(fundJSON, &fund)
+			if err != nil {
+				return 0, true, fmt.Errorf("failed to unmarshal guarantee fund: %v", err)
+			}
+		}
+		if kind == journalSkinInTheGame {
+			return int64(fund.SkinInTheGame), true, nil
+		}
+		return -int64(fund.Deficit), true, nil
+	}
+
+	return 0, false, nil
+}
+
+// getStoredPrivate reads a record from a broker's collection, leaving it empty if it does
+// not exist
+func (s *SettlementContract) getStoredPrivate(ctx contractapi.TransactionContextInterface, brokerID, key string, record interface{}) error {
+	recordJSON, err := s.getPrivateState(ctx, brokerID, key)
+	if err != nil {
+		return fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	if recordJSON == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(recordJSON, record)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %v", key, err)
+	}
+	return nil
+}
+
+// postJournal runs after every successful transaction. It refuses the transaction if its
+// lines do not add up to zero for every asset, and stores them as its journal entry: the
+// lines of each broker's records in the broker's collection, the others in the world state.
+func (s *SettlementContract) postJournal(ctx contractapi.TransactionContextInterface) error {
+	journal := journalOf(ctx)
+	if journal == nil {
+		return nil
+	}
+
+	lines := journal.lines
+	if len(lines) == 0 {
+		return nil
+	}
+
+	sums := map[string]int64{}
+	var assets []string
+	for _, line := range lines {
+		if _, ok := sums[line.Asset]; !ok {
+			assets = append(assets, line.Asset)
+		}
+		sums[line.Asset] += line.Debit - line.Credit
+	}
+	for _, asset := range assets {
+		if sums[asset] != 0 {
+			return fmt.Errorf("transaction does not balance: %s is off by %d", asset, sums[asset])
+		}
+	}
+
+	txID := ctx.GetStub().GetTxID()
+	function, _ := ctx.GetStub().GetFunctionAndParameters()
+
+	postedAt, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	entry, brokerEntries := splitJournalEntry(&JournalEntry{
+		EntryID:  "journal-" + txID,
+		TxID:     txID,
+		Function: function,
+		Lines:    lines,
+		PostedAt: postedAt,
+	})
+
+	for _, brokerID := range entry.BrokerIDs {
+		brokerEntryJSON, err := json.Marshal(brokerEntries[brokerID])
+		if err != nil {
+			return fmt.Errorf("failed to marshal journal entry: %v", err)
+		}
+
+		err = s.putPrivateState(ctx, brokerID, entry.EntryID, brokerEntryJSON)
+		if err != nil {
+			return fmt.Errorf("failed to put journal entry in collection: %v", err)
+		}
+	}
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal entry: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(entry.EntryID, entryJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put journal entry in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetJournalEntry retrieves the public journal entry of a transaction, with the lines of
+// brokers' records totalled per asset
+func (s *SettlementContract) GetJournalEntry(ctx contractapi.TransactionContextInterface, txID string) (*JournalEntry, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entryJSON, err := ctx.GetStub().GetState("journal-" + txID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if entryJSON == nil {
+		return nil, fmt.Errorf("no journal entry for transaction %s", txID)
+	}
+
+	var entry JournalEntry
+	err = json.Unmarshal(entryJSON, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal journal entry: %v", err)
+	}
+
+	return &entry, nil
+}
+
+// GetBrokerJournalEntry retrieves the lines of a broker's records in the journal entry of
+// a transaction. Only the broker and Maroclear can read them.
+func (s *SettlementContract) GetBrokerJournalEntry(ctx contractapi.TransactionContextInterface, brokerID, txID string) (*JournalEntry, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry JournalEntry
+	err = s.getStoredPrivate(ctx, brokerID, "journal-"+txID, &entry)
+	if err != nil {
+		return nil, err
+	}
+	if entry.EntryID == "" {
+		return nil, fmt.Errorf("no journal entry for broker %s in transaction %s", brokerID, txID)
+	}
+
+	return &entry, nil
+}
+
+// sharedJournalPostings returns the balances held outside the brokers' records: the
+// guarantee fund's own and the fee accounts
+func sharedJournalPostings() []journalPosting {
+	return []journalPosting{
+		{account: journalSkinInTheGame, asset: journalCash},
+		{account: journalFundDeficit, asset: journalCash},
+		{account: journalAccount(journalFeeAccount, feeAccountExchange), asset: journalCash},
+		{account: journalAccount(journalFeeAccount, feeAccountMaroclear), asset: journalCash},
+	}
+}
+
+// journalBalances adds up every journal entry, with the brokers' lines read from their
+// collections, into the balance of each account. It also returns the number of entries and
+// the entries that do not balance or whose brokers' lines do not add up to the public totals.
+func (s *SettlementContract) journalBalances(ctx contractapi.TransactionContextInterface) (map[journalPosting]int64, int, []string, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("journal-", "journal-~")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to get journal entries: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	balances := map[journalPosting]int64{}
+	entries := 0
+	unbalanced := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to iterate journal entries: %v", err)
+		}
+
+		var entry JournalEntry
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			continue // Skip if not a valid JournalEntry
+		}
+		entries++
+
+		sums := map[string]int64{}
+		totals := map[string]int64{} // public totals less the brokers' lines
+		for _, line := range entry.Lines {
+			if line.Account == journalBrokers {
+				totals[line.Asset] += line.Debit - line.Credit
+				continue
+			}
+			balances[journalPosting{account: line.Account, asset: line.Asset}] += line.Debit - line.Credit
+			sums[line.Asset] += line.Debit - line.Credit
+		}
+		for _, brokerID := range entry.BrokerIDs {
+			var brokerEntry JournalEntry
+			err = s.getStoredPrivate(ctx, brokerID, entry.EntryID, &brokerEntry)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+			for _, line := range brokerEntry.Lines {
+				balances[journalPosting{account: line.Account, asset: line.Asset}] += line.Debit - line.Credit
+				sums[line.Asset] += line.Debit - line.Credit
+				totals[line.Asset] -= line.Debit - line.Credit
+			}
+		}
+		for _, amounts := range []map[string]int64{sums, totals} {
+			if hasNonZero(amounts) {
+				unbalanced = append(unbalanced, entry.EntryID)
+				break
+			}
+		}
+	}
+
+	return balances, entries, unbalanced, nil
+}
+
+// hasNonZero tells whether any of the amounts is not zero
+func hasNonZero(amounts map[string]int64) bool {
+	for _, amount := range amounts {
+		if amount != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditLedger proves that no value was created or destroyed. It checks that every journal
+// entry balances, that the balances rebuilt from the journal match the stored balances,
+// and that for every asset what the ledger holds equals what was paid in from outside.
+// The guarantee fund totals are checked against the deposits and contributions.
+func (s *SettlementContract) AuditLedger(ctx contractapi.TransactionContextInterface) (*LedgerAudit, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	balances, entries, unbalanced, err := s.journalBalances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The shared balances are checked even before the journal first moves them
+	for _, posting := range sharedJournalPostings() {
+		balances[posting] += 0
+	}
+
+	postings := make([]journalPosting, 0, len(balances))
+	for posting := range balances {
+		postings = append(postings, posting)
+	}
+	sort.Slice(postings, func(i, j int) bool {
+		if postings[i].asset != postings[j].asset {
+			return postings[i].asset < postings[j].asset
+		}
+		return postings[i].account < postings[j].account
+	})
+
+	audit := LedgerAudit{
+		Entries:           entries,
+		UnbalancedEntries: unbalanced,
+		Assets:            []*AssetAudit{},
+		Mismatches:        []*BalanceMismatch{},
+	}
+
+	assets := map[string]*AssetAudit{}
+	for _, posting := range postings {
+		balance := balances[posting]
+
+		assetAudit, ok := assets[posting.asset]
+		if !ok {
+			assetAudit = &AssetAudit{Asset: posting.asset, External: map[string]int64{}}
+			assets[posting.asset] = assetAudit
+			audit.Assets = append(audit.Assets, assetAudit)
+		}
+
+		if isExternalJournalAccount(posting.account) {
+			assetAudit.External[posting.account] -= balance
+			continue
+		}
+		assetAudit.Held += balance
+
+		stored, hasStored, err := s.storedBalance(ctx, posting.account, posting.asset)
+		if err != nil {
+			return nil, err
+		}
+		if hasStored && stored != balance {
+			audit.Mismatches = append(audit.Mismatches, &BalanceMismatch{
+				Account: posting.account,
+				Asset:   posting.asset,
+				Journal: balance,
+				Stored:  stored,
+			})
+		}
+	}
+
+	audit.Conserved = len(unbalanced) == 0 && len(audit.Mismatches) == 0
+	for _, assetAudit := range audit.Assets {
+		paidIn := int64(0)
+		for _, amount := range assetAudit.External {
+			paidIn += amount
+		}
+		assetAudit.Balanced = assetAudit.Held == paidIn
+		if !assetAudit.Balanced {
+			audit.Conserved = false
+		}
+	}
+
+	// The fund totals are kept apart from the balances they add up
+	fundJSON, err := ctx.GetStub().GetState("guaranteeFund")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if fundJSON != nil {
+		var fund GuaranteeFund
+		err = json.Unmarshal(fundJSON, &fund)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal guarantee fund: %v", err)
+		}
+
+		audit.FundTotalAmount = fund.TotalAmount
+		audit.FundContributions = fund.Contributions
+		audit.FundTotalExpected = fund.SkinInTheGame
+		for _, posting := range postings {
+			if posting.asset != journalCash {
+				continue
+			}
+			if strings.HasPrefix(posting.account, journalGuaranteeDeposit+":") {
+				audit.FundTotalExpected += Money(balances[posting])
+			}
+			if strings.HasPrefix(posting.account, journalFundContribution+":") {
+				audit.FundContributedSum += Money(balances[posting])
+			}
+		}
+		audit.FundTotalExpected += audit.FundContributedSum
+
+		if audit.FundTotalAmount != audit.FundTotalExpected || audit.FundContributions != audit.FundContributedSum {
+			audit.Conserved = false
+		}
+	}
+
+	audit.AuditedAt, err = s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &audit, nil
+}
+
+// OpenJournal brings balances held before the journal existed into it, for the listed
+// brokers (comma-separated broker IDs) and their clients, the guarantee fund and the fee
+// accounts. Each
+// balance not yet explained by the journal is posted against the opening account. It
+// can only be run once, by Maroclear, and returns the public journal entry.
+func (s *SettlementContract) OpenJournal(ctx contractapi.TransactionContextInterface, brokerIDs string) (*JournalEntry, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	journal := journalOf(ctx)
+	if journal == nil {
+		return nil, fmt.Errorf("transaction context carries no journal")
+	}
+
+	markerJSON, err := ctx.GetStub().GetState("journalOpened")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if markerJSON != nil {
+		return nil, fmt.Errorf("journal has already been opened")
+	}
+
+	balances, _, _, err := s.journalBalances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	postings := sharedJournalPostings()
+	for _, brokerID := range strings.Split(brokerIDs, ",") {
+		brokerID = strings.TrimSpace(brokerID)
+		if brokerID == "" {
+			continue
+		}
+
+		postings = append(postings,
+			journalPosting{account: journalAccount(journalBroker, brokerID), asset: journalCash},
+			journalPosting{account: journalAccount(journalHeld, brokerID), asset: journalCash},
+			journalPosting{account: journalAccount(journalGuaranteeDeposit, brokerID), asset: journalCash},
+			journalPosting{account: journalAccount(journalFundContribution, brokerID), asset: journalCash},
+			journalPosting{account: journalAccount(journalVariationOwed, brokerID), asset: journalCash},
+		)
+
+		securitiesAccounts, err := s.getSecuritiesAccountsByBroker(ctx, brokerID)
+		if err != nil {
+			return nil, err
+		}
+		for _, securitiesAccount := range securitiesAccounts {
+			for _, kind := range []string{journalBroker, journalHeld, journalPledged} {
+				postings = append(postings, journalPosting{account: journalAccount(kind, brokerID), asset: securitiesAccount.SecurityID})
+			}
+		}
+
+		clientAccounts, err := s.GetClientAccountsByBroker(ctx, brokerID)
+		if err != nil {
+			return nil, err
+		}
+		for _, clientAccount := range clientAccounts {
+			postings = append(postings,
+				journalPosting{account: journalHolder(brokerID, clientAccount.ClientID), asset: journalCash},
+				journalPosting{account: journalHolds(brokerID, clientAccount.ClientID), asset: journalCash})
+		}
+
+		clientSecurities, err := s.GetClientSecuritiesByBroker(ctx, brokerID)
+		if err != nil {
+			return nil, err
+		}
+		for _, clientSecuritiesAccount := range clientSecurities {
+			postings = append(postings,
+				journalPosting{account: journalHolder(brokerID, clientSecuritiesAccount.ClientID), asset: clientSecuritiesAccount.SecurityID},
+				journalPosting{account: journalHolds(brokerID, clientSecuritiesAccount.ClientID), asset: clientSecuritiesAccount.SecurityID})
+		}
+	}
+
+	opened := map[journalPosting]bool{}
+	for _, posting := range postings {
+		if opened[posting] {
+			continue
+		}
+		opened[posting] = true
+
+		stored, _, err := s.storedBalance(ctx, posting.account, posting.asset)
+		if err != nil {
+			return nil, err
+		}
+
+		journal.move(journalOpening, posting.account, posting.asset, stored-balances[posting])
+	}
+
+	openedAt, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.GetStub().PutState("journalOpened", []byte(openedAt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to put journal marker in ledger: %v", err)
+	}
+
+	txID := ctx.GetStub().GetTxID()
+	entry, _ := splitJournalEntry(&JournalEntry{
+		EntryID:  "journal-" + txID,
+		TxID:     txID,
+		Function: "OpenJournal",
+		Lines:    journal.lines,
+		PostedAt: openedAt,
+	})
+
+	return entry, nil
+}
@@ -0,0 +1,184 @@
+// journal_test.go - Tests of the journal and the ledger conservation audit
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// audit runs a ledger audit
+func audit(t *testing.T, l *mockLedger) *LedgerAudit {
+	t.Helper()
+	s := &SettlementContract{}
+
+	var ledgerAudit *LedgerAudit
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		ledgerAudit, err = s.AuditLedger(ctx)
+		return err
+	})
+	return ledgerAudit
+}
+
+func TestJournalKeepsBrokerLinesPrivate(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpHouseTrade(t, l)
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	txID := l.lastTxID()
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		entry, err := s.GetJournalEntry(ctx, txID)
+		if err != nil {
+			return err
+		}
+		if want := []string{"broker1", "broker2"}; !reflect.DeepEqual(entry.BrokerIDs, want) {
+			t.Errorf("entry brokers = %v, want %v", entry.BrokerIDs, want)
+		}
+		for _, line := range entry.Lines {
+			if journalBrokerOf(line.Account) != "" {
+				t.Errorf("public entry has line %+v", *line)
+			}
+		}
+		return nil
+	})
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		entry, err := s.GetBrokerJournalEntry(ctx, "broker1", txID)
+		if err != nil {
+			return err
+		}
+		want := map[string]JournalLine{
+			journalCash: {Account: "held:broker1", Asset: journalCash, Credit: 1000}, // paid from its hold
+			"SEC002":    {Account: "broker:broker1", Asset: "SEC002", Debit: 10},
+		}
+		if len(entry.Lines) != len(want) {
+			t.Fatalf("broker1 lines = %d, want %d", len(entry.Lines), len(want))
+		}
+		for _, line := range entry.Lines {
+			if *line != want[line.Asset] {
+				t.Errorf("broker1 line = %+v, want %+v", *line, want[line.Asset])
+			}
+		}
+		return nil
+	})
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error {
+		_, err := s.GetBrokerJournalEntry(ctx, "broker1", txID)
+		return err
+	})
+
+	for key := range l.state {
+		if strings.HasPrefix(key, "journal-") && strings.Contains(string(l.state[key]), "broker:") {
+			t.Errorf("public entry %s names broker accounts: %s", key, l.state[key])
+		}
+	}
+}
+
+func TestAuditLedgerConservesValue(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpHouseTrade(t, l)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.DepositFunds(ctx, "broker1", 5000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateGuaranteeDeposit(ctx, "broker1", 1000) })
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	txID := l.lastTxID()
+
+	ledgerAudit := audit(t, l)
+	if !ledgerAudit.Conserved || len(ledgerAudit.UnbalancedEntries) != 0 || len(ledgerAudit.Mismatches) != 0 {
+		t.Fatalf("audit = %+v", ledgerAudit)
+	}
+	for _, assetAudit := range ledgerAudit.Assets {
+		if !assetAudit.Balanced {
+			t.Errorf("%s held %d, paid in %v", assetAudit.Asset, assetAudit.Held, assetAudit.External)
+		}
+	}
+
+	// A broker's lines that no longer add up to the public totals are caught
+	collection := l.collection(brokerCollection("broker1"))
+	collection["journal-"+txID] = []byte(strings.Replace(string(collection["journal-"+txID]), `"credit":1000`, `"credit":900`, 1))
+	ledgerAudit = audit(t, l)
+	if ledgerAudit.Conserved || !reflect.DeepEqual(ledgerAudit.UnbalancedEntries, []string{"journal-" + txID}) {
+		t.Fatalf("audit after tampering = %+v", ledgerAudit)
+	}
+}
+
+func TestJournalPostsClientLegsAndHolds(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpClientTrade(t, l, "broker2", "C1", "broker2", "C2")
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	txID := l.lastTxID()
+
+	// The broker's own balances do not change when two of its clients settle
+	l.must(t, "Broker2MSP", func(ctx txCtx) error {
+		entry, err := s.GetBrokerJournalEntry(ctx, "broker2", txID)
+		if err != nil {
+			return err
+		}
+		want := []JournalLine{
+			{Account: "clientHeld:broker2/C1", Asset: journalCash, Credit: 1000},
+			{Account: "client:broker2/C2", Asset: journalCash, Debit: 1000},
+			{Account: "clientHeld:broker2/C2", Asset: "SEC000", Credit: 10},
+			{Account: "client:broker2/C1", Asset: "SEC000", Debit: 10},
+		}
+		if len(entry.Lines) != len(want) {
+			t.Fatalf("broker2 lines = %d, want %d", len(entry.Lines), len(want))
+		}
+		for i, line := range entry.Lines {
+			if *line != want[i] {
+				t.Errorf("broker2 line %d = %+v, want %+v", i, *line, want[i])
+			}
+		}
+		return nil
+	})
+
+	ledgerAudit := audit(t, l)
+	if !ledgerAudit.Conserved {
+		t.Fatalf("audit = %+v", ledgerAudit)
+	}
+}
+
+func TestOpenJournalExplainsPriorBalances(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateGuaranteeDeposit(ctx, "broker1", 1000) })
+
+	// Balances written before the journal existed
+	l.state["guaranteeFund"] = []byte(`{"totalAmount":1705,"skinInTheGame":5}`)
+	collection := l.collection(brokerCollection("broker2"))
+	collection["guaranteeDeposit-broker2"] = []byte(`{"brokerID":"broker2","amount":700}`)
+	if len(audit(t, l).Mismatches) != 1 {
+		t.Fatal("unjournaled fund balance not found")
+	}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		entry, err := s.OpenJournal(ctx, "broker1,broker2")
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(entry.BrokerIDs, []string{"broker2"}) {
+			t.Errorf("entry brokers = %v, want [broker2]", entry.BrokerIDs)
+		}
+		for _, line := range entry.Lines {
+			if journalBrokerOf(line.Account) != "" {
+				t.Errorf("opening entry has line %+v", *line)
+			}
+		}
+		return nil
+	})
+
+	ledgerAudit := audit(t, l)
+	if !ledgerAudit.Conserved {
+		t.Fatalf("audit after opening = %+v", ledgerAudit)
+	}
+
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.OpenJournal(ctx, "broker1")
+		return err
+	})
+}
@@ -0,0 +1,485 @@
+// lifecycle.go - Cancellation and amendment of settlement instructions and their holds
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// InstructionAmendment is a change of quantity and price proposed by one broker and
+// applied once the broker on the other side proposes the same terms
+type InstructionAmendment struct {
+	Quantity   int    `json:"quantity"`
+	Price      Money  `json:"price"`
+	Side       string `json:"side"` // buy, sell
+	ProposedBy string `json:"proposedBy"`
+	ProposedAt string `json:"proposedAt"`
+}
+
+// isLive reports whether an instruction still holds cash and securities
+func (instruction *SettlementInstruction) isLive() bool {
+	return instruction.Status == "pending" || instruction.Status == "validated"
+}
+
+// heldAmounts returns the cash and securities held for an instruction. Live or netted
+// instructions created before holds were recorded on the instruction hold their full
+// amount and quantity.
+func (instruction *SettlementInstruction) heldAmounts() (Money, int) {
+	if (instruction.isLive() || instruction.Status == "netted") && !instruction.HoldsPlaced {
+		return instruction.TotalAmount, instruction.Quantity
+	}
+	return instruction.ReservedAmount, instruction.ReservedQuantity
+}
+
+// instructionHolds holds the accounts that carry the holds of a settlement instruction:
+// the buyer's cash and the seller's securities, on the client sub-accounts for client
+// trades and on the broker's own accounts for house trades
+type instructionHolds struct {
+	legs                    *clientLegs
+	buyerAccount            *BrokerAccount     // house buyer only
+	sellerSecuritiesAccount *SecuritiesAccount // house seller only
+
+	placed   []*Hold         // hold records to store
+	released []*Hold         // hold records to delete
+	journal  *pendingJournal // movements into and out of the holds
+}
+
+// loadInstructionHolds loads the accounts that carry an instruction's holds. legs are the
+// client sub-accounts already loaded by the caller; when nil, the client accounts are
+// loaded without a KYC check so that holds can always be released.
+func (s *SettlementContract) loadInstructionHolds(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, legs *clientLegs) (*instructionHolds, error) {
+	var err error
+
+	if legs == nil {
+		legs = &clientLegs{}
+		if instruction.BuyClientID != "" {
+			legs.buyerCash, err = s.GetClientAccount(ctx, instruction.BuyBrokerID, instruction.BuyClientID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if instruction.SellClientID != "" {
+			legs.sellerSecurities, err = s.getOrNewClientSecuritiesAccount(ctx, instruction.SellBrokerID, instruction.SellClientID, instruction.SecurityID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	holds := &instructionHolds{legs: legs, journal: newPendingJournal()}
+
+	if instruction.BuyClientID == "" {
+		holds.buyerAccount, err = s.getOrNewBrokerAccount(ctx, instruction.BuyBrokerID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get buyer broker account: %v", err)
+		}
+	}
+
+	if instruction.SellClientID == "" {
+		holds.sellerSecuritiesAccount, err = s.getOrNewSecuritiesAccount(ctx, instruction.SellBrokerID, instruction.SecurityID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get seller securities account: %v", err)
+		}
+	}
+
+	return holds, nil
+}
+
+// reserve places the instruction's holds on the buyer's cash and the seller's securities,
+// up to its total amount and quantity. Instructions are accepted whatever their provision:
+// only the available part of each balance is held, and cash or securities delivered later
+// are picked up when the instruction settles. The holds are recorded on the instruction
+// and as named holds (see holds.go). The CCP's side of a novated leg is not held.
+func (holds *instructionHolds) reserve(instruction *SettlementInstruction, currentTime string) {
+	var amount Money
+	var quantity int
+
+	if holds.legs.buyerCash != nil {
+		amount = heldPart(instruction.TotalAmount, holds.legs.buyerCash.available())
+		holds.legs.buyerCash.ReservedBalance += amount
+		holds.legs.buyerCash.LastUpdated = currentTime
+	} else if instruction.BuyBrokerID != ccpBrokerID {
+		amount = heldPart(instruction.TotalAmount, holds.buyerAccount.available())
+		holds.buyerAccount.ReservedBalance += amount
+		holds.buyerAccount.LastUpdated = currentTime
+	}
+
+	if holds.legs.sellerSecurities != nil {
+		quantity = heldQuantityPart(instruction.Quantity, holds.legs.sellerSecurities.available())
+		holds.legs.sellerSecurities.ReservedQty += quantity
+		holds.legs.sellerSecurities.LastUpdated = currentTime
+	} else if instruction.SellBrokerID != ccpBrokerID {
+		quantity = heldQuantityPart(instruction.Quantity, holds.sellerSecuritiesAccount.available())
+		holds.sellerSecuritiesAccount.ReservedQty += quantity
+		holds.sellerSecuritiesAccount.LastUpdated = currentTime
+	}
+
+	holds.journal.move(journalHolder(instruction.BuyBrokerID, instruction.BuyClientID),
+		journalHolds(instruction.BuyBrokerID, instruction.BuyClientID), journalCash, int64(amount))
+	holds.journal.move(journalHolder(instruction.SellBrokerID, instruction.SellClientID),
+		journalHolds(instruction.SellBrokerID, instruction.SellClientID), instruction.SecurityID, int64(quantity))
+
+	instruction.ReservedAmount = amount
+	instruction.ReservedQuantity = quantity
+	instruction.HoldsPlaced = true
+
+	if amount > 0 {
+		holds.placed = append(holds.placed, &Hold{
+			HoldID:        holdKey(instruction.InstructionID, "cash"),
+			InstructionID: instruction.InstructionID,
+			BrokerID:      instruction.BuyBrokerID,
+			ClientID:      instruction.BuyClientID,
+			Asset:         "cash",
+			Amount:        amount,
+			CreatedAt:     currentTime,
+		})
+	}
+	if quantity > 0 {
+		holds.placed = append(holds.placed, &Hold{
+			HoldID:        holdKey(instruction.InstructionID, "securities"),
+			InstructionID: instruction.InstructionID,
+			BrokerID:      instruction.SellBrokerID,
+			ClientID:      instruction.SellClientID,
+			Asset:         "securities",
+			SecurityID:    instruction.SecurityID,
+			Quantity:      quantity,
+			CreatedAt:     currentTime,
+		})
+	}
+}
+
+// heldPart returns how much of a requirement can be held from an available balance
+func heldPart(required, available Money) Money {
+	if available <= 0 {
+		return 0
+	}
+	if available < required {
+		return available
+	}
+	return required
+}
+
+// heldQuantityPart returns how much of a required quantity can be held from an available quantity
+func heldQuantityPart(required, available int) int {
+	if available <= 0 {
+		return 0
+	}
+	if available < required {
+		return available
+	}
+	return required
+}
+
+// release removes the instruction's holds from the accounts and clears them on the instruction
+func (holds *instructionHolds) release(instruction *SettlementInstruction, currentTime string) {
+	amount, quantity := instruction.heldAmounts()
+
+	if holds.legs.buyerCash != nil {
+		holds.legs.buyerCash.ReservedBalance -= amount
+		holds.legs.buyerCash.LastUpdated = currentTime
+	} else {
+		holds.buyerAccount.ReservedBalance -= amount
+		holds.buyerAccount.LastUpdated = currentTime
+	}
+
+	if holds.legs.sellerSecurities != nil {
+		holds.legs.sellerSecurities.ReservedQty -= quantity
+		holds.legs.sellerSecurities.LastUpdated = currentTime
+	} else {
+		holds.sellerSecuritiesAccount.ReservedQty -= quantity
+		holds.sellerSecuritiesAccount.LastUpdated = currentTime
+	}
+
+	holds.journal.move(journalHolds(instruction.BuyBrokerID, instruction.BuyClientID),
+		journalHolder(instruction.BuyBrokerID, instruction.BuyClientID), journalCash, int64(amount))
+	holds.journal.move(journalHolds(instruction.SellBrokerID, instruction.SellClientID),
+		journalHolder(instruction.SellBrokerID, instruction.SellClientID), instruction.SecurityID, int64(quantity))
+
+	instruction.ReservedAmount = 0
+	instruction.ReservedQuantity = 0
+
+	holds.released = append(holds.released,
+		&Hold{HoldID: holdKey(instruction.InstructionID, "cash"), BrokerID: instruction.BuyBrokerID},
+		&Hold{HoldID: holdKey(instruction.InstructionID, "securities"), BrokerID: instruction.SellBrokerID})
+}
+
+// save stores every account carrying the instruction's holds, journals the movements into
+// and out of the holds, and stores the hold records.
+// Released holds are deleted before placed ones are stored, as an amendment releases
+// and places holds under the same keys.
+func (holds *instructionHolds) save(ctx contractapi.TransactionContextInterface, s *SettlementContract) error {
+	for _, hold := range holds.released {
+		err := s.deleteHold(ctx, hold)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, hold := range holds.placed {
+		err := s.putHold(ctx, hold)
+		if err != nil {
+			return err
+		}
+	}
+
+	if holds.buyerAccount != nil {
+		err := s.putBrokerAccount(ctx, holds.buyerAccount)
+		if err != nil {
+			return fmt.Errorf("failed to update buyer broker account: %v", err)
+		}
+	}
+
+	if holds.sellerSecuritiesAccount != nil {
+		err := s.putSecuritiesAccount(ctx, holds.sellerSecuritiesAccount)
+		if err != nil {
+			return fmt.Errorf("failed to update seller securities account: %v", err)
+		}
+	}
+
+	err := holds.legs.save(ctx, s)
+	if err != nil {
+		return err
+	}
+	s.journalMoves(ctx, holds.journal)
+
+	return nil
+}
+
+// releaseInstructionHolds releases the holds of an instruction that will not settle and
+// stores the accounts. The caller stores the instruction.
+func (s *SettlementContract) releaseInstructionHolds(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, currentTime string) error {
+	amount, quantity := instruction.heldAmounts()
+	if amount == 0 && quantity == 0 {
+		return nil
+	}
+
+	holds, err := s.loadInstructionHolds(ctx, instruction, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load held accounts: %v", err)
+	}
+
+	holds.release(instruction, currentTime)
+
+	return holds.save(ctx, s)
+}
+
+// instructionSides returns the sides (buy, sell) of an instruction the caller's
+// organization trades on
+func instructionSides(instruction *SettlementInstruction, mspID string) []string {
+	var sides []string
+	if mspID == brokerMSPID(instruction.BuyBrokerID) {
+		sides = append(sides, "buy")
+	}
+	if mspID == brokerMSPID(instruction.SellBrokerID) {
+		sides = append(sides, "sell")
+	}
+	return sides
+}
+
+// putInstruction stores a settlement instruction and emits an event carrying it
+func (s *SettlementContract) putInstruction(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, eventName string) error {
+	instructionJSON, err := json.Marshal(instruction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settlement instruction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(instruction.InstructionID, instructionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent(eventName, instructionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set %s event: %v", eventName, err)
+	}
+
+	return nil
+}
+
+// CancelSettlementInstruction cancels a pending or validated instruction and releases its
+// holds. Maroclear cancels outright; otherwise each broker consents for its own side and
+// the instruction is cancelled once both sides have consented.
+func (s *SettlementContract) CancelSettlementInstruction(ctx contractapi.TransactionContextInterface, instructionID, reason string) error {
+	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
+	if err != nil {
+		return err
+	}
+
+	if !instruction.isLive() {
+		return fmt.Errorf("only pending or validated instructions can be cancelled, current status: %s", instruction.Status)
+	}
+
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The CCP does not consent to cancel a novated leg; only Maroclear can
+	if instruction.NovatedLeg != "" && mspID != "MaroclearMSP" {
+		return fmt.Errorf("novated instruction %s can only be cancelled by Maroclear", instructionID)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	if mspID != "MaroclearMSP" {
+		sides := instructionSides(instruction, mspID)
+		if len(sides) == 0 {
+			return fmt.Errorf("only Maroclear or the brokers of instruction %s can cancel it", instructionID)
+		}
+
+		for _, side := range sides {
+			if side == "buy" {
+				instruction.BuyCancelConsent = true
+			} else {
+				instruction.SellCancelConsent = true
+			}
+		}
+
+		// Wait for the other side's consent
+		if !instruction.BuyCancelConsent || !instruction.SellCancelConsent {
+			return s.putInstruction(ctx, instruction, "SettlementCancellationRequested")
+		}
+	}
+
+	err = s.releaseInstructionHolds(ctx, instruction, currentTime)
+	if err != nil {
+		return err
+	}
+
+	instruction.Status = "cancelled"
+	instruction.CancelReason = reason
+	instruction.CancelledBy = mspID
+	instruction.CompletedAt = currentTime
+	instruction.ProposedAmendment = nil
+
+	// The trade will not settle; a cancelled remainder leaves it partially settled
+	if instruction.ParentInstructionID == "" {
+		trade, err := s.GetTrade(ctx, instruction.TradeID)
+		if err != nil {
+			return fmt.Errorf("failed to get trade: %v", err)
+		}
+
+		trade.Status = "cancelled"
+
+		tradeJSON, err := json.Marshal(trade)
+		if err != nil {
+			return fmt.Errorf("failed to marshal trade: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(instruction.TradeID, tradeJSON)
+		if err != nil {
+			return fmt.Errorf("failed to update trade in ledger: %v", err)
+		}
+	}
+
+	return s.putInstruction(ctx, instruction, "SettlementInstructionCancelled")
+}
+
+// AmendSettlementInstruction changes the quantity and price (in centimes) of a pending or
+// validated instruction. Maroclear amends outright; otherwise one broker proposes the new
+// terms and they apply once the broker on the other side proposes the same terms. The
+// old holds are released and new ones reserved, and the instruction must be affirmed again.
+func (s *SettlementContract) AmendSettlementInstruction(ctx contractapi.TransactionContextInterface, instructionID string, quantity int, priceCentimes int64) error {
+	price := Money(priceCentimes)
+	if quantity <= 0 {
+		return fmt.Errorf("quantity must be positive")
+	}
+	if price <= 0 {
+		return fmt.Errorf("price must be positive")
+	}
+
+	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
+	if err != nil {
+		return err
+	}
+
+	if !instruction.isLive() {
+		return fmt.Errorf("only pending or validated instructions can be amended, current status: %s", instruction.Status)
+	}
+
+	// Amending one leg of a novated trade would leave the CCP with an open position
+	if instruction.NovatedLeg != "" {
+		return fmt.Errorf("novated instruction %s cannot be amended", instructionID)
+	}
+
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	currentTime := txTime.Format(time.RFC3339)
+
+	if mspID != "MaroclearMSP" {
+		sides := instructionSides(instruction, mspID)
+		if len(sides) == 0 {
+			return fmt.Errorf("only Maroclear or the brokers of instruction %s can amend it", instructionID)
+		}
+
+		// The amendment applies when the other side already proposed the same terms, or
+		// when the caller trades on both sides
+		proposal := instruction.ProposedAmendment
+		agreed := len(sides) == 2 ||
+			(proposal != nil && proposal.Side != sides[0] && proposal.Quantity == quantity && proposal.Price == price)
+
+		if !agreed {
+			instruction.ProposedAmendment = &InstructionAmendment{
+				Quantity:   quantity,
+				Price:      price,
+				Side:       sides[0],
+				ProposedBy: mspID,
+				ProposedAt: currentTime,
+			}
+			return s.putInstruction(ctx, instruction, "SettlementAmendmentProposed")
+		}
+	}
+
+	// Move the holds from the old terms to the new ones in a single read of the accounts
+	holds, err := s.loadInstructionHolds(ctx, instruction, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load held accounts: %v", err)
+	}
+
+	holds.release(instruction, currentTime)
+
+	instruction.Quantity = quantity
+	instruction.Price = price
+	instruction.TotalAmount = price.Times(quantity)
+
+	holds.reserve(instruction, currentTime)
+
+	err = holds.save(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	// Affirmations of the old terms no longer apply
+	for _, side := range []string{"buy", "sell"} {
+		err = ctx.GetStub().DelState("affirmation-" + instructionID + "-" + side)
+		if err != nil {
+			return fmt.Errorf("failed to delete affirmation from ledger: %v", err)
+		}
+	}
+
+	// Both brokers affirm the amended terms by the end of the day
+	instruction.Status = "pending"
+	instruction.BuyAffirmation = affirmationMissing
+	instruction.SellAffirmation = affirmationMissing
+	instruction.AffirmationDeadline = affirmationDeadlineFor(txTime).Format(time.RFC3339)
+	instruction.BuyCancelConsent = false
+	instruction.SellCancelConsent = false
+	instruction.ProposedAmendment = nil
+	instruction.AmendedBy = mspID
+	instruction.AmendedAt = currentTime
+
+	return s.putInstruction(ctx, instruction, "SettlementInstructionAmended")
+}
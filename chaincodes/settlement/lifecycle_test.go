@@ -0,0 +1,93 @@
+// lifecycle_test.go - Tests of instruction cancellation and amendment
+package main
+
+import (
+	"testing"
+)
+
+// heldBalances returns what instruction-trade-1 holds of broker1's cash and of broker2's SEC002
+func heldBalances(t *testing.T, l *mockLedger) (Money, int) {
+	t.Helper()
+	s := &SettlementContract{}
+
+	var cash *AccountBalance
+	var securities *SecuritiesBalance
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		cash, err = s.GetAvailableBalance(ctx, "broker1", "")
+		if err != nil {
+			return err
+		}
+		securities, err = s.GetAvailableSecurities(ctx, "broker2", "", "SEC002")
+		return err
+	})
+	return cash.Reserved, securities.Reserved
+}
+
+func TestCancellationNeedsBothBrokers(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpInstruction(t, l)
+
+	l.mustFail(t, "Broker3MSP", func(ctx txCtx) error {
+		return s.CancelSettlementInstruction(ctx, "instruction-trade-1", "booking error")
+	})
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		return s.CancelSettlementInstruction(ctx, "instruction-trade-1", "booking error")
+	})
+	if instruction := instructionOf(t, l, "instruction-trade-1"); instruction.Status != "pending" || !instruction.BuyCancelConsent {
+		t.Fatalf("instruction after one consent = %+v", instruction)
+	}
+	if cash, quantity := heldBalances(t, l); cash != 1000 || quantity != 10 {
+		t.Fatalf("held %v and %d SEC002 after one consent, want 10.00 and 10", cash, quantity)
+	}
+
+	l.must(t, "Broker2MSP", func(ctx txCtx) error {
+		return s.CancelSettlementInstruction(ctx, "instruction-trade-1", "booking error")
+	})
+	if instruction := instructionOf(t, l, "instruction-trade-1"); instruction.Status != "cancelled" {
+		t.Fatalf("instruction is %s, want cancelled", instruction.Status)
+	}
+	if cash, quantity := heldBalances(t, l); cash != 0 || quantity != 0 {
+		t.Errorf("cancelled instruction still holds %v and %d SEC002", cash, quantity)
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		trade, err := s.GetTrade(ctx, "trade-1")
+		if err != nil {
+			return err
+		}
+		if trade.Status != "cancelled" {
+			t.Errorf("trade is %s, want cancelled", trade.Status)
+		}
+		return nil
+	})
+}
+
+func TestAmendmentMovesHolds(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpHouseTrade(t, l)
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		return s.AmendSettlementInstruction(ctx, "instruction-trade-1", 5, 300)
+	})
+	if instruction := instructionOf(t, l, "instruction-trade-1"); instruction.Quantity != 10 || instruction.ProposedAmendment == nil {
+		t.Fatalf("instruction after a proposal = %+v", instruction)
+	}
+
+	// The other side must propose the same terms
+	l.must(t, "Broker2MSP", func(ctx txCtx) error {
+		return s.AmendSettlementInstruction(ctx, "instruction-trade-1", 5, 200)
+	})
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		return s.AmendSettlementInstruction(ctx, "instruction-trade-1", 5, 200)
+	})
+
+	instruction := instructionOf(t, l, "instruction-trade-1")
+	if instruction.Quantity != 5 || instruction.TotalAmount != 1000 || instruction.Status != "pending" || instruction.BuyAffirmation != affirmationMissing {
+		t.Fatalf("amended instruction = %+v", instruction)
+	}
+	if cash, quantity := heldBalances(t, l); cash != 1000 || quantity != 5 {
+		t.Errorf("amended instruction holds %v and %d SEC002, want 10.00 and 5", cash, quantity)
+	}
+}
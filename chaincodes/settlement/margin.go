@@ -0,0 +1,749 @@
+// margin.go - Guarantee deposit requirements, margin calls and withdrawals
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// errorCodeBrokerRestricted is the settlement run error code of instructions whose buyer or
+// seller is restricted for missing a margin call
+const errorCodeBrokerRestricted = "broker_restricted"
+
+// MarginParameters set the guarantee deposit each broker must hold against its open
+// unsettled exposure
+type MarginParameters struct {
+	ExposurePercent  int    `json:"exposurePercent"`  // required deposit, in percent of open exposure
+	MinimumDeposit   Money  `json:"minimumDeposit"`   // required deposit of any broker with open exposure
+	CallDeadlineDays int    `json:"callDeadlineDays"` // business days to meet a margin call
+	UpdatedBy        string `json:"updatedBy"`
+	LastUpdated      string `json:"lastUpdated"`
+}
+
+// MarginRequirement is a broker's required guarantee collateral against its open exposure
+type MarginRequirement struct {
+	BrokerID   string `json:"brokerID"`
+	Exposure   Money  `json:"exposure"` // value of the unsettled instructions it is a party to
+	Required   Money  `json:"required"`
+	Deposit    Money  `json:"deposit"`    // cash deposit
+	Collateral Money  `json:"collateral"` // cash deposit and admitted securities collateral (see collateral.go)
+	Excess     Money  `json:"excess"`     // collateral above the requirement, which can be withdrawn
+	Shortfall  Money  `json:"shortfall"`  // collateral missing to meet the requirement
+}
+
+// Margin call kinds
+const (
+	marginCallInitial   = "initial"
+	marginCallVariation = "variation"
+)
+
+// MarginCall requires a broker to top up its guarantee deposit to the required amount by
+// a deadline. A variation call requires it to pay the mark-to-market loss its deposit
+// could not cover.
+type MarginCall struct {
+	CallID    string `json:"callID"`
+	BrokerID  string `json:"brokerID"`
+	Kind      string `json:"kind"` // initial, variation
+	Exposure  Money  `json:"exposure"`
+	Required  Money  `json:"required"`
+	Deposit   Money  `json:"deposit"` // collateral when the call was made
+	Shortfall Money  `json:"shortfall"`
+	Deadline  string `json:"deadline"` // YYYY-MM-DD, last business day to meet the call
+	Status    string `json:"status"`   // open, met, missed
+	IssuedAt  string `json:"issuedAt"`
+	ClosedAt  string `json:"closedAt"`
+}
+
+// BrokerMarginStatus is a broker's open margin calls, its restriction, if any, and its
+// last mark-to-market. A broker that missed a call is restricted from new orders and from
+// settlement until its collateral meets the missed call and it owes no variation margin.
+type BrokerMarginStatus struct {
+	BrokerID            string `json:"brokerID"`
+	OpenCallID          string `json:"openCallID"`
+	OpenVariationCallID string `json:"openVariationCallID"`
+	VariationOwed       Money  `json:"variationOwed"` // mark-to-market loss not yet collected
+	MarkedValue         Money  `json:"markedValue"`   // net value of the last mark-to-market
+	MarkedDate          string `json:"markedDate"`
+	Restricted          bool   `json:"restricted"`
+	RestrictedCallID    string `json:"restrictedCallID"`
+	RestrictedAt        string `json:"restrictedAt"`
+	RequiredToRelease   Money  `json:"requiredToRelease"`
+	LastUpdated         string `json:"lastUpdated"`
+}
+
+// SetMarginParameters sets the deposit requirement, as a percentage of open exposure with
+// a minimum (in centimes), and the business days brokers have to meet a margin call
+func (s *SettlementContract) SetMarginParameters(ctx contractapi.TransactionContextInterface, exposurePercent int, minimumDepositCentimes int64, callDeadlineDays int) error {
+	minimumDeposit := Money(minimumDepositCentimes)
+
+	mspID, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if exposurePercent < 0 || minimumDeposit < 0 {
+		return fmt.Errorf("margin requirements must not be negative")
+	}
+	if callDeadlineDays < 0 {
+		return fmt.Errorf("margin call deadline must not be negative")
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	parameters := MarginParameters{
+		ExposurePercent:  exposurePercent,
+		MinimumDeposit:   minimumDeposit,
+		CallDeadlineDays: callDeadlineDays,
+		UpdatedBy:        mspID,
+		LastUpdated:      currentTime,
+	}
+
+	parametersJSON, err := json.Marshal(parameters)
+	if err != nil {
+		return fmt.Errorf("failed to marshal margin parameters: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("marginParameters", parametersJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put margin parameters in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetMarginParameters retrieves the margin parameters (no requirement until Maroclear sets them)
+func (s *SettlementContract) GetMarginParameters(ctx contractapi.TransactionContextInterface) (*MarginParameters, error) {
+	parametersJSON, err := ctx.GetStub().GetState("marginParameters")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if parametersJSON == nil {
+		return &MarginParameters{}, nil
+	}
+
+	var parameters MarginParameters
+	err = json.Unmarshal(parametersJSON, &parameters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal margin parameters: %v", err)
+	}
+
+	return &parameters, nil
+}
+
+// required returns the deposit required against an open exposure. Brokers without open
+// exposure need no deposit.
+func (parameters *MarginParameters) required(exposure Money) Money {
+	if exposure <= 0 {
+		return 0
+	}
+
+	required := Money(int64(exposure) * int64(parameters.ExposurePercent) / 100)
+	if required < parameters.MinimumDeposit {
+		required = parameters.MinimumDeposit
+	}
+	return required
+}
+
+// openExposures returns the value of the unsettled instructions each broker is a party
+// to, with the brokers in the order they were found. Both sides of an instruction are
+// exposed to its full value; the CCP is not margined.
+func (s *SettlementContract) openExposures(ctx contractapi.TransactionContextInterface) (map[string]Money, []string, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("instruction-", "instruction-~")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get instructions: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	exposures := map[string]Money{}
+	var brokerIDs []string
+	expose := func(brokerID string, amount Money) {
+		if brokerID == ccpBrokerID {
+			return
+		}
+		if _, ok := exposures[brokerID]; !ok {
+			brokerIDs = append(brokerIDs, brokerID)
+		}
+		exposures[brokerID] += amount
+	}
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to iterate instructions: %v", err)
+		}
+
+		var instruction SettlementInstruction
+		err = json.Unmarshal(queryResponse.Value, &instruction)
+		if err != nil {
+			continue // Skip if not a valid SettlementInstruction
+		}
+
+		if !instruction.isLive() && instruction.Status != "netted" && instruction.Status != "buy_in" {
+			continue
+		}
+
+		expose(instruction.BuyBrokerID, instruction.TotalAmount)
+		expose(instruction.SellBrokerID, instruction.TotalAmount)
+	}
+
+	return exposures, brokerIDs, nil
+}
+
+// depositAmount returns a broker's guarantee deposit, zero if it has none
+func (s *SettlementContract) depositAmount(ctx contractapi.TransactionContextInterface, brokerID string) (Money, error) {
+	depositJSON, err := s.getPrivateState(ctx, brokerID, "guaranteeDeposit-"+brokerID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	if depositJSON == nil {
+		return 0, nil
+	}
+
+	var deposit GuaranteeDeposit
+	err = json.Unmarshal(depositJSON, &deposit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to unmarshal guarantee deposit: %v", err)
+	}
+
+	return deposit.Amount, nil
+}
+
+// GetMarginRequirement computes a broker's required guarantee collateral from its open
+// unsettled exposure
+func (s *SettlementContract) GetMarginRequirement(ctx contractapi.TransactionContextInterface, brokerID string) (*MarginRequirement, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	parameters, err := s.GetMarginParameters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	exposures, _, err := s.openExposures(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	valuation, err := s.valueCollateral(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMarginRequirement(brokerID, exposures[brokerID], parameters, valuation), nil
+}
+
+// newMarginRequirement compares a broker's collateral with the requirement on its exposure
+func newMarginRequirement(brokerID string, exposure Money, parameters *MarginParameters, valuation *CollateralValuation) *MarginRequirement {
+	requirement := &MarginRequirement{
+		BrokerID:   brokerID,
+		Exposure:   exposure,
+		Required:   parameters.required(exposure),
+		Deposit:    valuation.CashDeposit,
+		Collateral: valuation.TotalValue,
+	}
+	if requirement.Collateral > requirement.Required {
+		requirement.Excess = requirement.Collateral - requirement.Required
+	} else {
+		requirement.Shortfall = requirement.Required - requirement.Collateral
+	}
+	return requirement
+}
+
+// GetBrokerMarginStatus retrieves a broker's open margin call and restriction
+func (s *SettlementContract) GetBrokerMarginStatus(ctx contractapi.TransactionContextInterface, brokerID string) (*BrokerMarginStatus, error) {
+	statusJSON, err := ctx.GetStub().GetState("brokerMargin-" + brokerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if statusJSON == nil {
+		return &BrokerMarginStatus{BrokerID: brokerID}, nil
+	}
+
+	var status BrokerMarginStatus
+	err = json.Unmarshal(statusJSON, &status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal broker margin status: %v", err)
+	}
+
+	return &status, nil
+}
+
+// putBrokerMarginStatus stores a broker's margin status
+func (s *SettlementContract) putBrokerMarginStatus(ctx contractapi.TransactionContextInterface, status *BrokerMarginStatus) error {
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broker margin status: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("brokerMargin-"+status.BrokerID, statusJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put broker margin status in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetMarginCall retrieves a margin call by ID
+func (s *SettlementContract) GetMarginCall(ctx contractapi.TransactionContextInterface, callID string) (*MarginCall, error) {
+	callJSON, err := ctx.GetStub().GetState(callID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if callJSON == nil {
+		return nil, fmt.Errorf("margin call %s does not exist", callID)
+	}
+
+	var call MarginCall
+	err = json.Unmarshal(callJSON, &call)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal margin call: %v", err)
+	}
+
+	return &call, nil
+}
+
+// putMarginCall stores a margin call
+func (s *SettlementContract) putMarginCall(ctx contractapi.TransactionContextInterface, call *MarginCall) error {
+	callJSON, err := json.Marshal(call)
+	if err != nil {
+		return fmt.Errorf("failed to marshal margin call: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(call.CallID, callJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put margin call in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// RunMarginCalls compares every broker's guarantee collateral with the requirement on its
+// open exposure, and calls the brokers that fall short to top up their collateral within
+// the call deadline. Brokers with a call already open are not called again.
+func (s *SettlementContract) RunMarginCalls(ctx contractapi.TransactionContextInterface) ([]*MarginCall, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	parameters, err := s.GetMarginParameters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	currentTime := txTime.Format(time.RFC3339)
+
+	deadline, err := s.addBusinessDays(ctx, txTime, parameters.CallDeadlineDays)
+	if err != nil {
+		return nil, err
+	}
+
+	exposures, brokerIDs, err := s.openExposures(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	calls := []*MarginCall{}
+	for _, brokerID := range brokerIDs {
+		status, err := s.GetBrokerMarginStatus(ctx, brokerID)
+		if err != nil {
+			return nil, err
+		}
+		if status.OpenCallID != "" {
+			continue
+		}
+
+		valuation, err := s.valueCollateral(ctx, brokerID)
+		if err != nil {
+			return nil, err
+		}
+
+		requirement := newMarginRequirement(brokerID, exposures[brokerID], parameters, valuation)
+		if requirement.Shortfall <= 0 {
+			continue
+		}
+
+		call := &MarginCall{
+			CallID:    "marginCall-" + brokerID + "-" + s.getTransactionID(ctx),
+			BrokerID:  brokerID,
+			Kind:      marginCallInitial,
+			Exposure:  requirement.Exposure,
+			Required:  requirement.Required,
+			Deposit:   requirement.Collateral,
+			Shortfall: requirement.Shortfall,
+			Deadline:  deadline.Format(calendarDateLayout),
+			Status:    "open",
+			IssuedAt:  currentTime,
+		}
+
+		err = s.putMarginCall(ctx, call)
+		if err != nil {
+			return nil, err
+		}
+
+		status.OpenCallID = call.CallID
+		status.LastUpdated = currentTime
+		err = s.putBrokerMarginStatus(ctx, status)
+		if err != nil {
+			return nil, err
+		}
+
+		calls = append(calls, call)
+	}
+
+	callsJSON, err := json.Marshal(calls)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal margin calls: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("MarginCallsIssued", callsJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set MarginCallsIssued event: %v", err)
+	}
+
+	return calls, nil
+}
+
+// EnforceMarginCalls closes the open margin calls whose deadline has passed. A call the
+// broker's collateral now covers is met; otherwise it is missed and the broker is
+// restricted from new orders and from settlement until its collateral covers the call.
+// A variation call is missed while any of the loss it called is still owed.
+func (s *SettlementContract) EnforceMarginCalls(ctx contractapi.TransactionContextInterface) ([]*MarginCall, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	today := txTime.Format(calendarDateLayout)
+	currentTime := txTime.Format(time.RFC3339)
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange("brokerMargin-", "brokerMargin-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get broker margin statuses: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var statuses []*BrokerMarginStatus
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate broker margin statuses: %v", err)
+		}
+
+		var status BrokerMarginStatus
+		err = json.Unmarshal(queryResponse.Value, &status)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal broker margin status: %v", err)
+		}
+		if status.OpenCallID != "" || status.OpenVariationCallID != "" {
+			statuses = append(statuses, &status)
+		}
+	}
+
+	closed := []*MarginCall{}
+	for _, status := range statuses {
+		changed := false
+
+		if status.OpenCallID != "" {
+			call, err := s.GetMarginCall(ctx, status.OpenCallID)
+			if err != nil {
+				return nil, err
+			}
+			if today > call.Deadline {
+				valuation, err := s.valueCollateral(ctx, status.BrokerID)
+				if err != nil {
+					return nil, err
+				}
+
+				call.ClosedAt = currentTime
+				if valuation.TotalValue >= call.Required {
+					call.Status = "met"
+				} else {
+					call.Status = "missed"
+					status.Restricted = true
+					status.RestrictedCallID = call.CallID
+					status.RestrictedAt = currentTime
+					status.RequiredToRelease = call.Required
+				}
+				status.OpenCallID = ""
+				changed = true
+
+				err = s.putMarginCall(ctx, call)
+				if err != nil {
+					return nil, err
+				}
+
+				closed = append(closed, call)
+			}
+		}
+
+		if status.OpenVariationCallID != "" {
+			call, err := s.GetMarginCall(ctx, status.OpenVariationCallID)
+			if err != nil {
+				return nil, err
+			}
+			if today > call.Deadline {
+				call.ClosedAt = currentTime
+				if status.VariationOwed <= 0 {
+					call.Status = "met"
+				} else {
+					// The broker stays restricted until the variation is paid, on top of
+					// any initial margin it already missed
+					call.Status = "missed"
+					if !status.Restricted {
+						status.Restricted = true
+						status.RestrictedCallID = call.CallID
+						status.RestrictedAt = currentTime
+						status.RequiredToRelease = 0
+					}
+				}
+				status.OpenVariationCallID = ""
+				changed = true
+
+				err = s.putMarginCall(ctx, call)
+				if err != nil {
+					return nil, err
+				}
+
+				closed = append(closed, call)
+			}
+		}
+
+		if !changed {
+			continue
+		}
+
+		status.LastUpdated = currentTime
+		err = s.putBrokerMarginStatus(ctx, status)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The stock market relays the missed calls to the trading channel, where the
+	// restricted brokers can no longer place orders
+	closedJSON, err := json.Marshal(closed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal margin calls: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("MarginCallsEnforced", closedJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set MarginCallsEnforced event: %v", err)
+	}
+
+	return closed, nil
+}
+
+// applyMarginTopUp collects the variation margin a broker owes from its topped-up
+// guarantee deposit, then meets its open margin calls, and lifts its restriction, once
+// its guarantee collateral covers them and no variation is owed. Lifting the restriction
+// emits a BrokerRestrictionLifted event. The caller's context must read its own writes.
+func (s *SettlementContract) applyMarginTopUp(ctx contractapi.TransactionContextInterface, brokerID, currentTime string) error {
+	status, err := s.GetBrokerMarginStatus(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+	if status.OpenCallID == "" && status.OpenVariationCallID == "" && !status.Restricted && status.VariationOwed <= 0 {
+		return nil
+	}
+
+	changed, released := false, false
+
+	if status.VariationOwed > 0 {
+		owed := status.VariationOwed
+		paid, err := s.collectVariationOwed(ctx, status, currentTime)
+		if err != nil {
+			return err
+		}
+		changed = status.VariationOwed != owed
+
+		if paid && status.OpenVariationCallID != "" {
+			call, err := s.GetMarginCall(ctx, status.OpenVariationCallID)
+			if err != nil {
+				return err
+			}
+			call.Status = "met"
+			call.ClosedAt = currentTime
+			err = s.putMarginCall(ctx, call)
+			if err != nil {
+				return err
+			}
+			status.OpenVariationCallID = ""
+			changed = true
+		}
+	}
+
+	valuation, err := s.valueCollateral(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+	collateral := valuation.TotalValue
+	if status.OpenCallID != "" {
+		call, err := s.GetMarginCall(ctx, status.OpenCallID)
+		if err != nil {
+			return err
+		}
+		if collateral >= call.Required {
+			call.Status = "met"
+			call.ClosedAt = currentTime
+			err = s.putMarginCall(ctx, call)
+			if err != nil {
+				return err
+			}
+			status.OpenCallID = ""
+			changed = true
+		}
+	}
+
+	if status.Restricted && collateral >= status.RequiredToRelease && status.VariationOwed <= 0 {
+		status.Restricted = false
+		status.RestrictedCallID = ""
+		status.RestrictedAt = ""
+		status.RequiredToRelease = 0
+		changed, released = true, true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	status.LastUpdated = currentTime
+	err = s.putBrokerMarginStatus(ctx, status)
+	if err != nil {
+		return err
+	}
+
+	if released {
+		statusJSON, err := json.Marshal(status)
+		if err != nil {
+			return fmt.Errorf("failed to marshal broker margin status: %v", err)
+		}
+
+		err = ctx.GetStub().SetEvent("BrokerRestrictionLifted", statusJSON)
+		if err != nil {
+			return fmt.Errorf("failed to set BrokerRestrictionLifted event: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// requireUnrestricted fails when a broker is restricted for missing a margin call
+func (s *SettlementContract) requireUnrestricted(ctx contractapi.TransactionContextInterface, brokerIDs ...string) error {
+	for _, brokerID := range brokerIDs {
+		status, err := s.GetBrokerMarginStatus(ctx, brokerID)
+		if err != nil {
+			return err
+		}
+		if status.Restricted {
+			return fmt.Errorf("broker %s is restricted for missing margin call %s", brokerID, status.RestrictedCallID)
+		}
+	}
+	return nil
+}
+
+// WithdrawGuarantee returns part of a broker's cash guarantee deposit to its cash account
+// (amount in centimes). Only the collateral in excess of the requirement on its open
+// exposure can be withdrawn, and not while a margin call is open, variation margin is owed
+// or the broker is restricted.
+func (s *SettlementContract) WithdrawGuarantee(ctx contractapi.TransactionContextInterface, brokerID string, amountCentimes int64) error {
+	amount := Money(amountCentimes)
+
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	if amount <= 0 {
+		return fmt.Errorf("withdrawal amount must be positive")
+	}
+
+	status, err := s.GetBrokerMarginStatus(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+	if status.OpenCallID != "" {
+		return fmt.Errorf("broker %s has an open margin call %s", brokerID, status.OpenCallID)
+	}
+	if status.OpenVariationCallID != "" || status.VariationOwed > 0 {
+		return fmt.Errorf("broker %s owes variation margin of %v", brokerID, status.VariationOwed)
+	}
+	if status.Restricted {
+		return fmt.Errorf("broker %s is restricted for missing margin call %s", brokerID, status.RestrictedCallID)
+	}
+
+	requirement, err := s.GetMarginRequirement(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+	if amount > requirement.Excess {
+		return fmt.Errorf("withdrawal of %v exceeds the excess collateral of %v over the requirement of %v", amount, requirement.Excess, requirement.Required)
+	}
+	if amount > requirement.Deposit {
+		return fmt.Errorf("withdrawal of %v exceeds the cash deposit of %v", amount, requirement.Deposit)
+	}
+
+	deposit, err := s.GetGuaranteeDeposit(ctx, brokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get guarantee deposit: %v", err)
+	}
+
+	brokerAccount, err := s.getOrNewBrokerAccount(ctx, brokerID)
+	if err != nil {
+		return fmt.Errorf("failed to get broker account: %v", err)
+	}
+
+	guaranteeFund, err := s.GetGuaranteeFund(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get guarantee fund: %v", err)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	deposit.Amount -= amount
+	deposit.LastUpdated = currentTime
+
+	brokerAccount.Balance += amount
+	brokerAccount.LastUpdated = currentTime
+
+	guaranteeFund.TotalAmount -= amount
+	guaranteeFund.LastUpdated = currentTime
+
+	err = s.putGuaranteeDeposit(ctx, deposit)
+	if err != nil {
+		return fmt.Errorf("failed to update guarantee deposit: %v", err)
+	}
+
+	err = s.putBrokerAccount(ctx, brokerAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update broker account: %v", err)
+	}
+	s.journalMove(ctx, journalAccount(journalGuaranteeDeposit, brokerID), journalHolder(brokerID, ""), journalCash, int64(amount))
+
+	err = s.putGuaranteeFund(ctx, guaranteeFund)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+// margin_test.go - Tests of settlement margin and margin calls
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMissedMarginCallRestrictsBroker(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.now = time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateGuaranteeDeposit(ctx, "broker1", 500000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateGuaranteeDeposit(ctx, "broker2", 5000000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 100, 100000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetMarginParameters(ctx, 10, 100000, 1) })
+
+	// 10% of the 100,000.00 broker1 owes, against a 5,000.00 deposit
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		requirement, err := s.GetMarginRequirement(ctx, "broker1")
+		if err != nil {
+			return err
+		}
+		if requirement.Required != 1000000 || requirement.Shortfall != 500000 {
+			t.Errorf("broker1 requirement = %+v", *requirement)
+		}
+		return nil
+	})
+
+	// Only the excess over the requirement can be withdrawn
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error { return s.WithdrawGuarantee(ctx, "broker1", 1) })
+	l.must(t, "Broker2MSP", func(ctx txCtx) error { return s.WithdrawGuarantee(ctx, "broker2", 4000000) })
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error { return s.WithdrawGuarantee(ctx, "broker2", 1) })
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		calls, err := s.RunMarginCalls(ctx)
+		if err != nil {
+			return err
+		}
+		if len(calls) != 1 || calls[0].BrokerID != "broker1" || calls[0].Shortfall != 500000 || calls[0].Deadline != "2026-03-03" {
+			t.Fatalf("margin calls = %v", calls)
+		}
+		return nil
+	})
+
+	l.now = time.Date(2026, 3, 3, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		missed, err := s.EnforceMarginCalls(ctx)
+		if len(missed) != 0 {
+			t.Errorf("%d margin calls enforced before their deadline", len(missed))
+		}
+		return err
+	})
+	l.now = time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		missed, err := s.EnforceMarginCalls(ctx)
+		if err != nil {
+			return err
+		}
+		if len(missed) != 1 || missed[0].Status != "missed" {
+			t.Fatalf("missed margin calls = %v", missed)
+		}
+		return nil
+	})
+
+	// A restricted broker's instructions are skipped until it tops up its deposit
+	if outcome := runBatchOn(t, l, time.Date(2026, 3, 5, 18, 0, 0, 0, time.UTC), "instruction-trade-1"); outcome.Outcome != "skipped" || outcome.ErrorCode != "broker_restricted" {
+		t.Fatalf("outcome of a restricted broker = %+v", *outcome)
+	}
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.DepositGuarantee(ctx, "broker1", 600000) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		status, err := s.GetBrokerMarginStatus(ctx, "broker1")
+		if err != nil {
+			return err
+		}
+		if status.Restricted || status.OpenCallID != "" {
+			t.Errorf("broker1 margin status after the top-up = %+v", *status)
+		}
+		return nil
+	})
+	if outcome := runBatchOn(t, l, l.now, "instruction-trade-1"); outcome.Outcome != "settled" {
+		t.Fatalf("outcome after the top-up = %+v", *outcome)
+	}
+}
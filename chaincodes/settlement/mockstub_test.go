@@ -0,0 +1,319 @@
+// mockstub_test.go - In-memory ledger for the settlement contract tests
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+)
+
+// txCtx is the transaction context passed to the contract in tests
+type txCtx = contractapi.TransactionContextInterface
+
+// mockLedger is the committed world state, private data and key-level endorsement
+// policies of a channel. As on Fabric, a transaction does not read its own writes: they
+// are only committed once it succeeds.
+type mockLedger struct {
+	state      map[string][]byte
+	private    map[string]map[string][]byte // by collection
+	policies   map[string][]byte            // by key, collection/key for private data
+	now        time.Time
+	txCount    int
+	events     []string
+	lastEvents map[string][]byte // last payload by event name
+	endorser   string            // organization of the endorsing peer, empty for a peer in every collection
+}
+
+// newLedger returns an empty ledger whose clock is a Monday morning
+func newLedger() *mockLedger {
+	return &mockLedger{
+		state:      map[string][]byte{},
+		private:    map[string]map[string][]byte{},
+		policies:   map[string][]byte{},
+		now:        time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC),
+		lastEvents: map[string][]byte{},
+	}
+}
+
+// collection returns a committed private data collection
+func (l *mockLedger) collection(name string) map[string][]byte {
+	if l.private[name] == nil {
+		l.private[name] = map[string][]byte{}
+	}
+	return l.private[name]
+}
+
+// endorses reports whether the endorsing peer is a member of a broker collection and can
+// read its private data
+func (l *mockLedger) endorses(collection string) bool {
+	brokerID := strings.TrimSuffix(strings.TrimPrefix(collection, "maroclear-"), "-balances")
+	return l.endorser == "" || l.endorser == "MaroclearMSP" || l.endorser == brokerMSPID(brokerID)
+}
+
+// mockStub is the stub of one transaction. Writes are buffered until commit.
+type mockStub struct {
+	shim.ChaincodeStubInterface
+	ledger        *mockLedger
+	writes        map[string][]byte
+	privateWrites map[string]map[string][]byte
+	policyWrites  map[string][]byte
+	transient     map[string][]byte
+	txID          string
+	timestamp     time.Time
+	eventName     string
+	eventPayload  []byte
+}
+
+// mockIterator iterates over a sorted range of keys
+type mockIterator struct {
+	keys   []string
+	values map[string][]byte
+	next   int
+}
+
+func (it *mockIterator) HasNext() bool { return it.next < len(it.keys) }
+func (it *mockIterator) Close() error  { return nil }
+func (it *mockIterator) Next() (*queryresult.KV, error) {
+	key := it.keys[it.next]
+	it.next++
+	return &queryresult.KV{Key: key, Value: it.values[key]}, nil
+}
+
+// rangeOf returns the keys in [start, end), composite keys only when asked for
+func rangeOf(values map[string][]byte, start, end string, composite bool) *mockIterator {
+	it := &mockIterator{values: values}
+	for key := range values {
+		if strings.HasPrefix(key, "\x00") != composite {
+			continue
+		}
+		if key >= start && (end == "" || key < end) {
+			it.keys = append(it.keys, key)
+		}
+	}
+	sort.Strings(it.keys)
+	return it
+}
+
+func (s *mockStub) GetTxID() string                              { return s.txID }
+func (s *mockStub) GetChannelID() string                         { return "settlement-channel" }
+func (s *mockStub) GetFunctionAndParameters() (string, []string) { return "", nil }
+func (s *mockStub) GetTransient() (map[string][]byte, error)     { return s.transient, nil }
+func (s *mockStub) GetState(key string) ([]byte, error)          { return s.ledger.state[key], nil }
+func (s *mockStub) GetStateValidationParameter(key string) ([]byte, error) {
+	return s.ledger.policies[key], nil
+}
+
+func (s *mockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.timestamp.Unix(), Nanos: int32(s.timestamp.Nanosecond())}, nil
+}
+
+func (s *mockStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("empty key")
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *mockStub) DelState(key string) error {
+	s.writes[key] = nil
+	return nil
+}
+
+func (s *mockStub) GetStateByRange(start, end string) (shim.StateQueryIteratorInterface, error) {
+	return rangeOf(s.ledger.state, start, end, false), nil
+}
+
+func (s *mockStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return "\x00" + objectType + "\x00" + strings.Join(attributes, "\x00") + "\x00", nil
+}
+
+func (s *mockStub) SplitCompositeKey(key string) (string, []string, error) {
+	parts := strings.Split(strings.Trim(key, "\x00"), "\x00")
+	return parts[0], parts[1:], nil
+}
+
+func (s *mockStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, _ := s.CreateCompositeKey(objectType, attributes)
+	if len(attributes) == 0 {
+		prefix = "\x00" + objectType + "\x00"
+	}
+	return rangeOf(s.ledger.state, prefix, prefix+"\U0010ffff", true), nil
+}
+
+func (s *mockStub) SetStateValidationParameter(key string, policy []byte) error {
+	s.policyWrites[key] = policy
+	return nil
+}
+
+func (s *mockStub) GetPrivateData(collection, key string) ([]byte, error) {
+	if !s.ledger.endorses(collection) {
+		return nil, fmt.Errorf("peer of %s is not a member of collection %s", s.ledger.endorser, collection)
+	}
+	return s.ledger.collection(collection)[key], nil
+}
+
+func (s *mockStub) GetPrivateDataHash(collection, key string) ([]byte, error) {
+	value := s.ledger.collection(collection)[key]
+	if value == nil {
+		return nil, nil
+	}
+	hash := sha256.Sum256(value)
+	return hash[:], nil
+}
+
+func (s *mockStub) PutPrivateData(collection, key string, value []byte) error {
+	if s.privateWrites[collection] == nil {
+		s.privateWrites[collection] = map[string][]byte{}
+	}
+	s.privateWrites[collection][key] = value
+	return nil
+}
+
+func (s *mockStub) DelPrivateData(collection, key string) error {
+	return s.PutPrivateData(collection, key, nil)
+}
+
+func (s *mockStub) GetPrivateDataByRange(collection, start, end string) (shim.StateQueryIteratorInterface, error) {
+	return rangeOf(s.ledger.collection(collection), start, end, false), nil
+}
+
+func (s *mockStub) GetPrivateDataByPartialCompositeKey(collection, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, _ := s.CreateCompositeKey(objectType, attributes)
+	if len(attributes) == 0 {
+		prefix = "\x00" + objectType + "\x00"
+	}
+	return rangeOf(s.ledger.collection(collection), prefix, prefix+"\U0010ffff", true), nil
+}
+
+func (s *mockStub) SetPrivateDataValidationParameter(collection, key string, policy []byte) error {
+	s.policyWrites[collection+"/"+key] = policy
+	return nil
+}
+
+func (s *mockStub) GetPrivateDataValidationParameter(collection, key string) ([]byte, error) {
+	return s.ledger.policies[collection+"/"+key], nil
+}
+
+func (s *mockStub) SetEvent(name string, payload []byte) error {
+	s.eventName, s.eventPayload = name, payload
+	return nil
+}
+
+// mockIdentity is a client of an organization
+type mockIdentity struct{ mspID string }
+
+func (id *mockIdentity) GetID() (string, error)                         { return "client-" + id.mspID, nil }
+func (id *mockIdentity) GetMSPID() (string, error)                      { return id.mspID, nil }
+func (id *mockIdentity) GetAttributeValue(string) (string, bool, error) { return "", false, nil }
+func (id *mockIdentity) AssertAttributeValue(string, string) error      { return nil }
+func (id *mockIdentity) GetX509Certificate() (*x509.Certificate, error) { return nil, nil }
+
+// mockContext is the transaction context, carrying the journal as journalContext does
+type mockContext struct {
+	stub     *mockStub
+	identity cid.ClientIdentity
+	journal  *pendingJournal
+}
+
+func (ctx *mockContext) GetStub() shim.ChaincodeStubInterface  { return ctx.stub }
+func (ctx *mockContext) GetClientIdentity() cid.ClientIdentity { return ctx.identity }
+
+func (ctx *mockContext) pendingJournal() *pendingJournal {
+	if ctx.journal == nil {
+		ctx.journal = newPendingJournal()
+	}
+	return ctx.journal
+}
+
+// tx runs fn as one transaction submitted by an organization. As on the peer, the journal
+// is posted after fn succeeds, and the writes are committed only if both succeed.
+func (l *mockLedger) tx(t *testing.T, mspID string, fn func(ctx txCtx) error) error {
+	t.Helper()
+	return l.txWithTransient(t, mspID, nil, fn)
+}
+
+// txWithTransient runs a transaction whose proposal carries a transient map
+func (l *mockLedger) txWithTransient(t *testing.T, mspID string, transient map[string][]byte, fn func(ctx txCtx) error) error {
+	t.Helper()
+	l.txCount++
+	stub := &mockStub{
+		ledger:        l,
+		writes:        map[string][]byte{},
+		privateWrites: map[string]map[string][]byte{},
+		policyWrites:  map[string][]byte{},
+		transient:     transient,
+		txID:          fmt.Sprintf("tx%04d", l.txCount),
+		timestamp:     l.now,
+	}
+	ctx := &mockContext{stub: stub, identity: &mockIdentity{mspID: mspID}}
+
+	err := fn(ctx)
+	if err != nil {
+		return err
+	}
+	err = (&SettlementContract{}).postJournal(ctx)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range stub.writes {
+		if value == nil {
+			delete(l.state, key)
+		} else {
+			l.state[key] = value
+		}
+	}
+	for collection, writes := range stub.privateWrites {
+		for key, value := range writes {
+			if value == nil {
+				delete(l.collection(collection), key)
+			} else {
+				l.collection(collection)[key] = value
+			}
+		}
+	}
+	for key, policy := range stub.policyWrites {
+		l.policies[key] = policy
+	}
+	if stub.eventName != "" {
+		l.events = append(l.events, stub.eventName)
+		l.lastEvents[stub.eventName] = stub.eventPayload
+	}
+
+	return nil
+}
+
+// lastTxID returns the ID of the last transaction run on the ledger
+func (l *mockLedger) lastTxID() string {
+	return fmt.Sprintf("tx%04d", l.txCount)
+}
+
+// must runs a transaction that has to succeed
+func (l *mockLedger) must(t *testing.T, mspID string, fn func(ctx txCtx) error) {
+	t.Helper()
+	err := l.tx(t, mspID, fn)
+	if err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+}
+
+// mustFail runs a transaction that has to fail, and returns its error
+func (l *mockLedger) mustFail(t *testing.T, mspID string, fn func(ctx txCtx) error) error {
+	t.Helper()
+	err := l.tx(t, mspID, fn)
+	if err == nil {
+		t.Fatalf("transaction succeeded, expected it to fail")
+	}
+	return err
+}
@@ -0,0 +1,283 @@
+// money.go - Fixed-point cash amounts and migration of float-valued state
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Money is a cash amount in Moroccan dirhams held as an integer number of centimes
+// (minor units, MoneyScale decimal places). It is encoded in JSON and passed to
+// chaincode functions as that integer, e.g. 150.25 MAD is 15025.
+//
+// Rounding rules: sums, differences and price*quantity products are exact. Amounts are
+// never rounded implicitly; the only rounding happens when float-valued state written
+// before this type existed is migrated, which rounds half away from zero to the centime.
+type Money int64
+
+// MoneyScale is the number of decimal places in a Money amount (1 MAD = 100 centimes)
+const MoneyScale = 2
+
+// moneyUnit is the number of minor units in one dirham
+const moneyUnit = 100
+
+// Times returns the amount for quantity units priced at m
+func (m Money) Times(quantity int) Money {
+	return m * Money(quantity)
+}
+
+// String formats the amount in dirhams, e.g. 15025 -> "150.25"
+func (m Money) String() string {
+	sign := ""
+	units := int64(m)
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, units/moneyUnit, MoneyScale, units%moneyUnit)
+}
+
+// legacyAmountToMoney converts a float amount in dirhams, as written by earlier versions
+// of the chaincode, to Money. The decimal text is rounded half away from zero to the
+// centime without going through float arithmetic, so 150.24999999999997 becomes 15025.
+func legacyAmountToMoney(text string) (Money, error) {
+	if strings.ContainsAny(text, "eE") {
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid amount %s: %v", text, err)
+		}
+		return Money(math.Round(f * moneyUnit)), nil
+	}
+
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimPrefix(text, "-")
+
+	whole, fraction := text, ""
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		whole, fraction = text[:i], text[i+1:]
+	}
+
+	roundUp := len(fraction) > MoneyScale && fraction[MoneyScale] >= '5'
+	for len(fraction) < MoneyScale {
+		fraction += "0"
+	}
+
+	units, err := strconv.ParseInt(whole+fraction[:MoneyScale], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %s: %v", text, err)
+	}
+	if roundUp {
+		units++
+	}
+	if negative {
+		units = -units
+	}
+
+	return Money(units), nil
+}
+
+// moneySchemaCentimes is the version of stored records whose amounts are Money. Records
+// written before amounts became Money carry no version.
+const moneySchemaCentimes = 1
+
+// MoneySchema tags a stored record with the version of its amounts, so the migration can
+// skip records that are already in centimes. It always encodes as moneySchemaCentimes.
+type MoneySchema int
+
+// MarshalJSON encodes the current version, whatever version the record was read with
+func (MoneySchema) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Itoa(moneySchemaCentimes)), nil
+}
+
+// legacyMoneyFields are the JSON fields that held float amounts before amounts became Money
+var legacyMoneyFields = []string{"price", "totalAmount", "balance", "reservedBalance", "clientBalance", "amount"}
+
+// migrateMoneyJSON rewrites the float amounts of a stored record as centimes. Security
+// transactions used to carry their quantity in "amount"; it moves to "quantity".
+// It reports false when the record holds no float amounts and needs no rewrite,
+// or when it is tagged with a MoneySchema and already in centimes.
+func migrateMoneyJSON(value []byte) ([]byte, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+
+	var record map[string]interface{}
+	if err := decoder.Decode(&record); err != nil {
+		return nil, false, nil // Not a JSON object, nothing to migrate
+	}
+	if _, ok := record["moneySchema"]; ok {
+		return nil, false, nil // Written in centimes
+	}
+
+	changed := false
+
+	if recordType, _ := record["type"].(string); recordType == "security" || recordType == "security_deposit" {
+		if amount, ok := record["amount"].(json.Number); ok {
+			quantity, err := amount.Float64()
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid security quantity %s: %v", amount, err)
+			}
+			record["quantity"] = int(quantity)
+			record["amount"] = 0
+			changed = true
+		}
+	}
+
+	for _, field := range legacyMoneyFields {
+		amount, ok := record[field].(json.Number)
+		if !ok {
+			continue
+		}
+
+		converted, err := legacyAmountToMoney(amount.String())
+		if err != nil {
+			return nil, false, err
+		}
+		record[field] = int64(converted)
+		changed = true
+	}
+
+	if !changed {
+		return nil, false, nil
+	}
+	record["moneySchema"] = moneySchemaCentimes
+
+	migrated, err := json.Marshal(record)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal migrated record: %v", err)
+	}
+
+	return migrated, true, nil
+}
+
+// MigrateMoneyState converts the float amounts in the world state and in the listed
+// brokers' private collections (comma-separated broker IDs) to centimes. It can only be
+// run once, by Maroclear; records written since carry a MoneySchema and are skipped.
+func (s *SettlementContract) MigrateMoneyState(ctx contractapi.TransactionContextInterface, brokerIDs string) (int, error) {
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if mspID != "MaroclearMSP" {
+		return 0, fmt.Errorf("only Maroclear can migrate ledger amounts")
+	}
+
+	markerJSON, err := ctx.GetStub().GetState("moneySchema")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if markerJSON != nil {
+		return 0, fmt.Errorf("ledger amounts have already been migrated to centimes")
+	}
+
+	migrated := 0
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get world state: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to iterate world state: %v", err)
+		}
+
+		value, changed, err := migrateMoneyJSON(queryResponse.Value)
+		if err != nil {
+			return 0, fmt.Errorf("failed to migrate %s: %v", queryResponse.Key, err)
+		}
+		if !changed {
+			continue
+		}
+
+		err = ctx.GetStub().PutState(queryResponse.Key, value)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update %s in ledger: %v", queryResponse.Key, err)
+		}
+		migrated++
+	}
+
+	for _, brokerID := range strings.Split(brokerIDs, ",") {
+		brokerID = strings.TrimSpace(brokerID)
+		if brokerID == "" {
+			continue
+		}
+
+		count, err := s.migrateBrokerCollection(ctx, brokerID)
+		if err != nil {
+			return 0, err
+		}
+		migrated += count
+	}
+
+	migratedAt, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	marker := struct {
+		Scale       int    `json:"scale"`
+		Records     int    `json:"records"`
+		MigratedBy  string `json:"migratedBy"`
+		MigratedAt  string `json:"migratedAt"`
+		Description string `json:"description"`
+	}{
+		Scale:       MoneyScale,
+		Records:     migrated,
+		MigratedBy:  mspID,
+		MigratedAt:  migratedAt,
+		Description: "amounts are integer centimes",
+	}
+
+	markerJSON, err = json.Marshal(marker)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal migration marker: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("moneySchema", markerJSON)
+	if err != nil {
+		return 0, fmt.Errorf("failed to put migration marker in ledger: %v", err)
+	}
+
+	return migrated, nil
+}
+
+// migrateBrokerCollection converts the float amounts in one broker's private collection
+func (s *SettlementContract) migrateBrokerCollection(ctx contractapi.TransactionContextInterface, brokerID string) (int, error) {
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByRange(brokerCollection(brokerID), "", "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get accounts of broker %s: %v", brokerID, err)
+	}
+	defer resultsIterator.Close()
+
+	migrated := 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to iterate accounts of broker %s: %v", brokerID, err)
+		}
+
+		value, changed, err := migrateMoneyJSON(queryResponse.Value)
+		if err != nil {
+			return 0, fmt.Errorf("failed to migrate %s: %v", queryResponse.Key, err)
+		}
+		if !changed {
+			continue
+		}
+
+		err = s.putPrivateState(ctx, brokerID, queryResponse.Key, value)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update %s in collection: %v", queryResponse.Key, err)
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
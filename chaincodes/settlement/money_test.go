@@ -0,0 +1,108 @@
+// money_test.go - Tests of Money amounts and the migration of float-valued state
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLegacyAmountToMoney(t *testing.T) {
+	for text, want := range map[string]Money{
+		"150.25":             15025,
+		"150.24999999999997": 15025,
+		"1500000":            150000000,
+		"1.5e+06":            150000000,
+		"0.1":                10,
+		"-0.005":             -1,
+	} {
+		got, err := legacyAmountToMoney(text)
+		if err != nil {
+			t.Fatalf("legacyAmountToMoney(%s) failed: %v", text, err)
+		}
+		if got != want {
+			t.Errorf("legacyAmountToMoney(%s) = %d, want %d", text, got, want)
+		}
+	}
+}
+
+func TestMigrateMoneyJSON(t *testing.T) {
+	migrated, changed, err := migrateMoneyJSON([]byte(`{"transactionID":"tx1","type":"security","amount":100}`))
+	if err != nil || !changed {
+		t.Fatalf("security transaction not migrated: %v", err)
+	}
+	var transaction Transaction
+	err = json.Unmarshal(migrated, &transaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction.Quantity != 100 || transaction.Amount != 0 {
+		t.Errorf("migrated security transaction = %s", migrated)
+	}
+
+	_, changed, err = migrateMoneyJSON([]byte(`{"brokerID":"broker1","balance":150,"moneySchema":1}`))
+	if err != nil || changed {
+		t.Errorf("record tagged with a money schema was migrated again: %v", err)
+	}
+}
+
+func TestMigrateMoneyStateSkipsRecordsInCentimes(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+
+	// Records left by the float-valued chaincode
+	l.collection(brokerCollection("broker9"))["brokerAccount-broker9"] = []byte(`{"brokerID":"broker9","balance":150.25,"reservedBalance":0}`)
+	l.state["legacy-tx"] = []byte(`{"transactionID":"legacy-tx","type":"cash","amount":12.5}`)
+
+	var before *BrokerAccount
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		before, err = s.GetBrokerAccount(ctx, "broker1")
+		return err
+	})
+
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error {
+		_, err := s.MigrateMoneyState(ctx, "broker1,broker9")
+		return err
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		migrated, err := s.MigrateMoneyState(ctx, "broker1,broker9")
+		if migrated != 2 {
+			t.Errorf("migrated %d records, want 2", migrated)
+		}
+		return err
+	})
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		after, err := s.GetBrokerAccount(ctx, "broker1")
+		if err != nil {
+			return err
+		}
+		if after.Balance != before.Balance {
+			t.Errorf("balance in centimes went from %v to %v", before.Balance, after.Balance)
+		}
+
+		legacy, err := s.GetBrokerAccount(ctx, "broker9")
+		if err != nil {
+			return err
+		}
+		if legacy.Balance != 15025 {
+			t.Errorf("migrated balance = %d, want 15025", legacy.Balance)
+		}
+		return nil
+	})
+
+	var transaction map[string]interface{}
+	err := json.Unmarshal(l.state["legacy-tx"], &transaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction["amount"] != float64(1250) || transaction["moneySchema"] != float64(moneySchemaCentimes) {
+		t.Errorf("migrated transaction = %s", l.state["legacy-tx"])
+	}
+
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.MigrateMoneyState(ctx, "broker1,broker9")
+		return err
+	})
+}
@@ -0,0 +1,564 @@
+// netting.go - Multilateral netting of the instructions due on a settlement date
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// NettingBatch groups the instructions due on a settlement date that are settled together
+// through net positions instead of one gross settlement each
+type NettingBatch struct {
+	BatchID           string   `json:"batchID"`
+	SettlementDate    string   `json:"settlementDate"` // YYYY-MM-DD
+	InstructionIDs    []string `json:"instructionIDs"`
+	TradeIDs          []string `json:"tradeIDs"`
+	NetInstructionIDs []string `json:"netInstructionIDs"`
+	BrokerIDs         []string `json:"brokerIDs"`   // brokers holding the net instructions, in the same order
+	GrossAmount       Money    `json:"grossAmount"` // cash the instructions would move gross
+	NetAmount         Money    `json:"netAmount"`   // cash paid by the net payers
+	Status            string   `json:"status"`      // pending, settled, failed, canceled
+	FailureReason     string   `json:"failureReason"`
+	CreatedAt         string   `json:"createdAt"`
+	SettledAt         string   `json:"settledAt"`
+}
+
+// NetSecuritiesPosition is a broker's net delivery of one security: positive when the
+// broker receives securities, negative when it delivers them
+type NetSecuritiesPosition struct {
+	SecurityID string `json:"securityID"`
+	Quantity   int    `json:"quantity"`
+}
+
+// NetSettlementInstruction is one broker's net obligation in a netting batch
+type NetSettlementInstruction struct {
+	NetInstructionID string                   `json:"netInstructionID"`
+	BatchID          string                   `json:"batchID"`
+	BrokerID         string                   `json:"brokerID"`
+	SettlementDate   string                   `json:"settlementDate"`
+	CashAmount       Money                    `json:"cashAmount"` // positive when the broker receives cash, negative when it pays
+	Securities       []*NetSecuritiesPosition `json:"securities"`
+	InstructionIDs   []string                 `json:"instructionIDs"`
+	TradeIDs         []string                 `json:"tradeIDs"`
+	Status           string                   `json:"status"` // pending, settled, failed, canceled
+	CreatedAt        string                   `json:"createdAt"`
+	SettledAt        string                   `json:"settledAt"`
+}
+
+// netInstructionFor returns the broker's net instruction in a batch, adding it on first use
+func netInstructionFor(netInstructions map[string]*NetSettlementInstruction, order *[]*NetSettlementInstruction, batch *NettingBatch, brokerID string) *NetSettlementInstruction {
+	if netInstruction, ok := netInstructions[brokerID]; ok {
+		return netInstruction
+	}
+
+	netInstruction := &NetSettlementInstruction{
+		NetInstructionID: "netInstruction-" + strings.TrimPrefix(batch.BatchID, "nettingBatch-") + "-" + brokerID,
+		BatchID:          batch.BatchID,
+		BrokerID:         brokerID,
+		SettlementDate:   batch.SettlementDate,
+		Securities:       []*NetSecuritiesPosition{},
+		InstructionIDs:   []string{},
+		TradeIDs:         []string{},
+		Status:           "pending",
+		CreatedAt:        batch.CreatedAt,
+	}
+	netInstructions[brokerID] = netInstruction
+	*order = append(*order, netInstruction)
+
+	return netInstruction
+}
+
+// addSecurities adds a quantity of a security to a net instruction's positions
+func (netInstruction *NetSettlementInstruction) addSecurities(securityID string, quantity int) {
+	for _, position := range netInstruction.Securities {
+		if position.SecurityID == securityID {
+			position.Quantity += quantity
+			return
+		}
+	}
+	netInstruction.Securities = append(netInstruction.Securities, &NetSecuritiesPosition{SecurityID: securityID, Quantity: quantity})
+}
+
+// addInstruction records an underlying instruction on a net instruction
+func (netInstruction *NetSettlementInstruction) addInstruction(instruction *SettlementInstruction) {
+	for _, instructionID := range netInstruction.InstructionIDs {
+		if instructionID == instruction.InstructionID {
+			return
+		}
+	}
+	netInstruction.InstructionIDs = append(netInstruction.InstructionIDs, instruction.InstructionID)
+	netInstruction.TradeIDs = append(netInstruction.TradeIDs, instruction.TradeID)
+}
+
+// RunNetting nets the instructions due on a settlement date (YYYY-MM-DD) that both brokers
+// affirmed, or whose affirmation deadline has passed. It computes each broker's net cash
+// obligation and net securities obligation per security as net settlement instructions,
+// and takes the underlying instructions out of gross settlement until SettleNetting or
+// CancelNetting. Past settlement dates cannot be netted.
+func (s *SettlementContract) RunNetting(ctx contractapi.TransactionContextInterface, settlementDate string) (*NettingBatch, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = time.Parse(calendarDateLayout, settlementDate)
+	if err != nil {
+		return nil, fmt.Errorf("settlement date must be in YYYY-MM-DD format: %v", err)
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if today := txTime.Format(calendarDateLayout); settlementDate < today {
+		return nil, fmt.Errorf("settlement date %s is before the current business date %s", settlementDate, today)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := NettingBatch{
+		BatchID:           "nettingBatch-" + settlementDate + "-" + s.getTransactionID(ctx),
+		SettlementDate:    settlementDate,
+		InstructionIDs:    []string{},
+		TradeIDs:          []string{},
+		NetInstructionIDs: []string{},
+		BrokerIDs:         []string{},
+		Status:            "pending",
+		CreatedAt:         currentTime,
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange("instruction-", "instruction-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instructions: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	netInstructions := map[string]*NetSettlementInstruction{}
+	var order []*NetSettlementInstruction
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate instructions: %v", err)
+		}
+
+		var instruction SettlementInstruction
+		err = json.Unmarshal(queryResponse.Value, &instruction)
+		if err != nil {
+			continue // Skip if not a valid SettlementInstruction
+		}
+
+		// Only instructions due on the settlement date and ready to settle are netted
+		if !instruction.isLive() || !strings.HasPrefix(instruction.SettlementDate, settlementDate) {
+			continue
+		}
+		eligible, err := s.applyAffirmationDeadline(ctx, &instruction)
+		if err != nil {
+			return nil, err
+		}
+		if !eligible {
+			continue
+		}
+
+		// Brokers that missed a margin call are left out of netting until they meet it
+		if s.requireUnrestricted(ctx, instruction.BuyBrokerID, instruction.SellBrokerID) != nil {
+			continue
+		}
+
+		buyer := netInstructionFor(netInstructions, &order, &batch, instruction.BuyBrokerID)
+		buyer.CashAmount -= instruction.TotalAmount
+		buyer.addSecurities(instruction.SecurityID, instruction.Quantity)
+		buyer.addInstruction(&instruction)
+
+		seller := netInstructionFor(netInstructions, &order, &batch, instruction.SellBrokerID)
+		seller.CashAmount += instruction.TotalAmount
+		seller.addSecurities(instruction.SecurityID, -instruction.Quantity)
+		seller.addInstruction(&instruction)
+
+		batch.InstructionIDs = append(batch.InstructionIDs, instruction.InstructionID)
+		batch.TradeIDs = append(batch.TradeIDs, instruction.TradeID)
+		batch.GrossAmount += instruction.TotalAmount
+
+		instruction.Status = "netted"
+		instruction.NettingBatchID = batch.BatchID
+
+		instructionJSON, err := json.Marshal(instruction)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal settlement instruction: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(instruction.InstructionID, instructionJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
+		}
+	}
+
+	if len(batch.InstructionIDs) == 0 {
+		return nil, fmt.Errorf("no instructions to net for %s", settlementDate)
+	}
+
+	for _, netInstruction := range order {
+		if netInstruction.CashAmount < 0 {
+			batch.NetAmount -= netInstruction.CashAmount
+		}
+		batch.NetInstructionIDs = append(batch.NetInstructionIDs, netInstruction.NetInstructionID)
+		batch.BrokerIDs = append(batch.BrokerIDs, netInstruction.BrokerID)
+
+		err = s.putNetInstruction(ctx, netInstruction)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.putNettingBatch(ctx, &batch, "NettingBatchCreated")
+	if err != nil {
+		return nil, err
+	}
+
+	return &batch, nil
+}
+
+// SettleNetting settles a netting batch atomically: every underlying instruction settles,
+// with its client sub-accounts, and each broker's accounts move by its net positions only.
+// If any broker cannot cover its net obligations, nothing settles, the batch is marked
+// failed and its instructions return to gross settlement.
+func (s *SettlementContract) SettleNetting(ctx contractapi.TransactionContextInterface, batchID string) error {
+	// Settlement fees are collected from the accounts as left by the net movements
+	ctx = withWriteCache(ctx)
+
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch, err := s.GetNettingBatch(ctx, batchID)
+	if err != nil {
+		return err
+	}
+	if batch.Status != "pending" {
+		return fmt.Errorf("only pending netting batches can be settled, current status: %s", batch.Status)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	var instructions []*SettlementInstruction
+	for _, instructionID := range batch.InstructionIDs {
+		instruction, err := s.GetSettlementInstruction(ctx, instructionID)
+		if err != nil {
+			return err
+		}
+		if instruction.Status != "netted" || instruction.NettingBatchID != batchID {
+			return fmt.Errorf("instruction %s is no longer part of netting batch %s", instructionID, batchID)
+		}
+		instructions = append(instructions, instruction)
+	}
+
+	// Post every instruction to the cached accounts; only the final balances must be covered
+	book := newAccountBook()
+	var failure error
+	for _, instruction := range instructions {
+		failure = book.settle(ctx, s, instruction, currentTime)
+		if failure != nil {
+			break
+		}
+	}
+	if failure == nil {
+		failure = book.check()
+	}
+
+	if failure != nil {
+		return s.releaseNetting(ctx, batch, instructions, "failed", failure.Error(), currentTime)
+	}
+
+	err = book.save(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	// Complete the underlying instructions and their trades
+	for _, instruction := range instructions {
+		instruction.Status = "completed"
+		instruction.CompletedAt = currentTime
+		instruction.SettledQuantity = instruction.Quantity
+		instruction.SettledAmount = instruction.TotalAmount
+
+		instructionJSON, err := json.Marshal(instruction)
+		if err != nil {
+			return fmt.Errorf("failed to marshal settlement instruction: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(instruction.InstructionID, instructionJSON)
+		if err != nil {
+			return fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
+		}
+
+		err = s.chargeSettlementFees(ctx, instruction, instruction.TotalAmount, currentTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tradeID := range batch.TradeIDs {
+		trade, err := s.GetTrade(ctx, tradeID)
+		if err != nil {
+			return fmt.Errorf("failed to get trade: %v", err)
+		}
+
+		trade.Status = "settled"
+
+		tradeJSON, err := json.Marshal(trade)
+		if err != nil {
+			return fmt.Errorf("failed to marshal trade: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(tradeID, tradeJSON)
+		if err != nil {
+			return fmt.Errorf("failed to update trade in ledger: %v", err)
+		}
+	}
+
+	// Record the net movements of each broker
+	for i, netInstructionID := range batch.NetInstructionIDs {
+		netInstruction, err := s.GetNetSettlementInstruction(ctx, batch.BrokerIDs[i], netInstructionID)
+		if err != nil {
+			return err
+		}
+
+		netInstruction.Status = "settled"
+		netInstruction.SettledAt = currentTime
+
+		err = s.putNetInstruction(ctx, netInstruction)
+		if err != nil {
+			return err
+		}
+
+		err = s.recordNetTransactions(ctx, netInstruction, currentTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	batch.Status = "settled"
+	batch.SettledAt = currentTime
+
+	return s.putNettingBatch(ctx, batch, "NettingBatchSettled")
+}
+
+// CancelNetting cancels a pending netting batch that will not be settled, for example
+// because its settlement date has passed, and returns its instructions to gross settlement
+func (s *SettlementContract) CancelNetting(ctx contractapi.TransactionContextInterface, batchID, reason string) error {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch, err := s.GetNettingBatch(ctx, batchID)
+	if err != nil {
+		return err
+	}
+	if batch.Status != "pending" {
+		return fmt.Errorf("only pending netting batches can be canceled, current status: %s", batch.Status)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Instructions canceled on their own since netting stay as they are
+	var instructions []*SettlementInstruction
+	for _, instructionID := range batch.InstructionIDs {
+		instruction, err := s.GetSettlementInstruction(ctx, instructionID)
+		if err != nil {
+			return err
+		}
+		if instruction.Status == "netted" && instruction.NettingBatchID == batchID {
+			instructions = append(instructions, instruction)
+		}
+	}
+
+	return s.releaseNetting(ctx, batch, instructions, "canceled", reason, currentTime)
+}
+
+// releaseNetting marks a netting batch and its net instructions failed or canceled and
+// returns the underlying instructions to gross settlement, with their holds untouched
+func (s *SettlementContract) releaseNetting(ctx contractapi.TransactionContextInterface, batch *NettingBatch, instructions []*SettlementInstruction, status, reason, currentTime string) error {
+	for _, instruction := range instructions {
+		instruction.Status = "validated"
+		instruction.NettingBatchID = ""
+
+		instructionJSON, err := json.Marshal(instruction)
+		if err != nil {
+			return fmt.Errorf("failed to marshal settlement instruction: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(instruction.InstructionID, instructionJSON)
+		if err != nil {
+			return fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
+		}
+	}
+
+	for i, netInstructionID := range batch.NetInstructionIDs {
+		netInstruction, err := s.GetNetSettlementInstruction(ctx, batch.BrokerIDs[i], netInstructionID)
+		if err != nil {
+			return err
+		}
+
+		netInstruction.Status = status
+
+		err = s.putNetInstruction(ctx, netInstruction)
+		if err != nil {
+			return err
+		}
+	}
+
+	batch.Status = status
+	batch.FailureReason = reason
+	batch.SettledAt = currentTime
+
+	eventName := "NettingBatchFailed"
+	if status == "canceled" {
+		eventName = "NettingBatchCanceled"
+	}
+
+	return s.putNettingBatch(ctx, batch, eventName)
+}
+
+// recordNetTransactions records the net cash and securities movements of a broker
+func (s *SettlementContract) recordNetTransactions(ctx contractapi.TransactionContextInterface, netInstruction *NetSettlementInstruction, currentTime string) error {
+	var transactions []*Transaction
+
+	if netInstruction.CashAmount != 0 {
+		transaction := &Transaction{
+			TransactionID: "transaction-net-cash-" + netInstruction.NetInstructionID,
+			Type:          "net_cash",
+			FromID:        netInstruction.BrokerID,
+			ToID:          "netting",
+			Amount:        -netInstruction.CashAmount,
+			InstructionID: netInstruction.NetInstructionID,
+			Status:        "completed",
+			Timestamp:     currentTime,
+		}
+		if netInstruction.CashAmount > 0 {
+			transaction.FromID, transaction.ToID = "netting", netInstruction.BrokerID
+			transaction.Amount = netInstruction.CashAmount
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	for _, position := range netInstruction.Securities {
+		if position.Quantity == 0 {
+			continue
+		}
+
+		transaction := &Transaction{
+			TransactionID: "transaction-net-securities-" + netInstruction.NetInstructionID + "-" + position.SecurityID,
+			Type:          "net_security",
+			FromID:        netInstruction.BrokerID,
+			ToID:          "netting",
+			SecurityID:    position.SecurityID,
+			Quantity:      -position.Quantity,
+			InstructionID: netInstruction.NetInstructionID,
+			Status:        "completed",
+			Timestamp:     currentTime,
+		}
+		if position.Quantity > 0 {
+			transaction.FromID, transaction.ToID = "netting", netInstruction.BrokerID
+			transaction.Quantity = position.Quantity
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	for _, transaction := range transactions {
+		err := s.putTransaction(ctx, transaction)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putNettingBatch stores a netting batch and emits an event carrying it
+func (s *SettlementContract) putNettingBatch(ctx contractapi.TransactionContextInterface, batch *NettingBatch, eventName string) error {
+	batchJSON, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal netting batch: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(batch.BatchID, batchJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put netting batch in ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent(eventName, batchJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set %s event: %v", eventName, err)
+	}
+
+	return nil
+}
+
+// putNetInstruction stores a net settlement instruction in its broker's collection. Only the
+// batch, with the gross and total net amounts, is public.
+func (s *SettlementContract) putNetInstruction(ctx contractapi.TransactionContextInterface, netInstruction *NetSettlementInstruction) error {
+	netInstructionJSON, err := json.Marshal(netInstruction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal net settlement instruction: %v", err)
+	}
+
+	err = s.putPrivateState(ctx, netInstruction.BrokerID, netInstruction.NetInstructionID, netInstructionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put net settlement instruction in collection: %v", err)
+	}
+
+	return nil
+}
+
+// GetNettingBatch retrieves a netting batch by ID
+func (s *SettlementContract) GetNettingBatch(ctx contractapi.TransactionContextInterface, batchID string) (*NettingBatch, error) {
+	batchJSON, err := ctx.GetStub().GetState(batchID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if batchJSON == nil {
+		return nil, fmt.Errorf("netting batch %s does not exist", batchID)
+	}
+
+	var batch NettingBatch
+	err = json.Unmarshal(batchJSON, &batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal netting batch: %v", err)
+	}
+
+	return &batch, nil
+}
+
+// GetNetSettlementInstruction retrieves a broker's net settlement instruction by ID
+func (s *SettlementContract) GetNetSettlementInstruction(ctx contractapi.TransactionContextInterface, brokerID, netInstructionID string) (*NetSettlementInstruction, error) {
+	netInstructionJSON, err := s.getPrivateState(ctx, brokerID, netInstructionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	if netInstructionJSON == nil {
+		return nil, fmt.Errorf("net settlement instruction %s does not exist", netInstructionID)
+	}
+
+	var netInstruction NetSettlementInstruction
+	err = json.Unmarshal(netInstructionJSON, &netInstruction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal net settlement instruction: %v", err)
+	}
+
+	return &netInstruction, nil
+}
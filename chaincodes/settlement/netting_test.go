@@ -0,0 +1,203 @@
+// netting_test.go - Tests of multilateral netting
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// setUpNetting creates two affirmed instructions in opposite directions between broker1 and
+// broker2 on SEC002 at 1.00: broker1 buys 500 and sells 300. It returns their settlement date.
+func setUpNetting(t *testing.T, l *mockLedger) string {
+	t.Helper()
+	s := &SettlementContract{}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	trades := []struct {
+		tradeID, buyBrokerID, sellBrokerID string
+		quantity                           int
+	}{
+		{"trade-1", "broker1", "broker2", 500},
+		{"trade-2", "broker2", "broker1", 300},
+	}
+	for _, trade := range trades {
+		trade := trade
+		instructionID := "instruction-" + trade.tradeID
+		l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+			return s.ImportTrade(ctx, trade.tradeID, "order-b", "order-s", trade.buyBrokerID, trade.sellBrokerID, "", "",
+				"SEC002", trade.quantity, 100, "pending", "2026-03-02T09:00:00Z", "")
+		})
+		l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, trade.tradeID) })
+		l.must(t, brokerMSPID(trade.buyBrokerID), func(ctx txCtx) error {
+			return s.AffirmInstruction(ctx, instructionID, "buy", "SEC002", trade.quantity, 100)
+		})
+		l.must(t, brokerMSPID(trade.sellBrokerID), func(ctx txCtx) error {
+			return s.AffirmInstruction(ctx, instructionID, "sell", "SEC002", trade.quantity, 100)
+		})
+	}
+
+	var settlementDate string
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		instruction, err := s.GetSettlementInstruction(ctx, "instruction-trade-1")
+		if err != nil {
+			return err
+		}
+		settlementDate = instruction.SettlementDate[:len(calendarDateLayout)]
+		return nil
+	})
+	return settlementDate
+}
+
+func TestRunNettingComputesNetObligations(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	settlementDate := setUpNetting(t, l)
+
+	var batch *NettingBatch
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		batch, err = s.RunNetting(ctx, settlementDate)
+		return err
+	})
+	if batch.GrossAmount != 80000 || batch.NetAmount != 20000 || len(batch.InstructionIDs) != 2 {
+		t.Fatalf("batch = %+v", batch)
+	}
+
+	want := map[string]struct {
+		cash     Money
+		quantity int
+	}{
+		"broker1": {-20000, 200},
+		"broker2": {20000, -200},
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		for i, netInstructionID := range batch.NetInstructionIDs {
+			netInstruction, err := s.GetNetSettlementInstruction(ctx, batch.BrokerIDs[i], netInstructionID)
+			if err != nil {
+				return err
+			}
+			w := want[netInstruction.BrokerID]
+			if netInstruction.CashAmount != w.cash || len(netInstruction.Securities) != 1 || netInstruction.Securities[0].Quantity != w.quantity {
+				t.Errorf("net instruction of %s = %+v", netInstruction.BrokerID, netInstruction)
+			}
+		}
+		return nil
+	})
+
+	// Net obligations are only in the brokers' collections
+	for key := range l.state {
+		if strings.HasPrefix(key, "netInstruction-") {
+			t.Errorf("net instruction %s is in the world state", key)
+		}
+	}
+	for i, netInstructionID := range batch.NetInstructionIDs {
+		if l.collection(brokerCollection(batch.BrokerIDs[i]))[netInstructionID] == nil {
+			t.Errorf("net instruction %s is not in the collection of %s", netInstructionID, batch.BrokerIDs[i])
+		}
+	}
+
+	// Netted instructions no longer settle gross
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error {
+		return s.CancelSettlementInstruction(ctx, "instruction-trade-1", "cancelled by broker")
+	})
+}
+
+func TestSettleNettingMovesNetPositions(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	settlementDate := setUpNetting(t, l)
+
+	var batch *NettingBatch
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		batch, err = s.RunNetting(ctx, settlementDate)
+		return err
+	})
+
+	var before *SecuritiesAccount
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		before, err = s.GetSecuritiesAccount(ctx, "broker2", "SEC002")
+		return err
+	})
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SettleNetting(ctx, batch.BatchID) })
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		settled, err := s.GetNettingBatch(ctx, batch.BatchID)
+		if err != nil {
+			return err
+		}
+		if settled.Status != "settled" {
+			t.Errorf("batch status = %s (%s)", settled.Status, settled.FailureReason)
+		}
+
+		for _, tradeID := range []string{"trade-1", "trade-2"} {
+			instruction, err := s.GetSettlementInstruction(ctx, "instruction-"+tradeID)
+			if err != nil {
+				return err
+			}
+			if instruction.Status != "completed" {
+				t.Errorf("%s status = %s", instruction.InstructionID, instruction.Status)
+			}
+		}
+
+		buyer, err := s.GetSecuritiesAccount(ctx, "broker1", "SEC002")
+		if err != nil {
+			return err
+		}
+		seller, err := s.GetSecuritiesAccount(ctx, "broker2", "SEC002")
+		if err != nil {
+			return err
+		}
+		if buyer.Quantity != 200 || seller.Quantity != before.Quantity-200 {
+			t.Errorf("SEC002 held by broker1 = %d, by broker2 = %d (was %d)", buyer.Quantity, seller.Quantity, before.Quantity)
+		}
+		return nil
+	})
+
+	netCash := "transaction-net-cash-" + batch.NetInstructionIDs[0]
+	if !transactionIDs(t, l, batch.BrokerIDs[0])[netCash] {
+		t.Errorf("history of %s is missing %s", batch.BrokerIDs[0], netCash)
+	}
+}
+
+func TestUnsettledNettingBatchIsCanceled(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	settlementDate := setUpNetting(t, l)
+
+	var batch *NettingBatch
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		batch, err = s.RunNetting(ctx, settlementDate)
+		return err
+	})
+
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error { return s.CancelNetting(ctx, batch.BatchID, "not settled") })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CancelNetting(ctx, batch.BatchID, "not settled") })
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error { return s.SettleNetting(ctx, batch.BatchID) })
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		canceled, err := s.GetNettingBatch(ctx, batch.BatchID)
+		if err != nil {
+			return err
+		}
+		if canceled.Status != "canceled" || canceled.FailureReason != "not settled" {
+			t.Errorf("batch = %+v", *canceled)
+		}
+		return nil
+	})
+	for _, instructionID := range batch.InstructionIDs {
+		if instruction := instructionOf(t, l, instructionID); instruction.Status != "validated" || instruction.NettingBatchID != "" {
+			t.Errorf("%s is %s in batch %q, want back in gross settlement", instructionID, instruction.Status, instruction.NettingBatchID)
+		}
+	}
+
+	// Once its date has passed, a settlement date can no longer be netted
+	l.now = settlementDay.AddDate(0, 0, 1)
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.RunNetting(ctx, settlementDate)
+		return err
+	})
+}
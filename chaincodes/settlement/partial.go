@@ -0,0 +1,214 @@
+// partial.go - Partial settlement of instructions whose cash or securities are short
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// PartialSettlementThresholds control when an instruction settles partially: a partial
+// settlement must deliver at least MinQuantity securities worth at least MinAmount
+type PartialSettlementThresholds struct {
+	MinQuantity int    `json:"minQuantity"`
+	MinAmount   Money  `json:"minAmount"`
+	UpdatedBy   string `json:"updatedBy"`
+	LastUpdated string `json:"lastUpdated"`
+}
+
+// SetPartialSettlementThresholds sets the minimum quantity and cash value (in centimes) of
+// a partial settlement
+func (s *SettlementContract) SetPartialSettlementThresholds(ctx contractapi.TransactionContextInterface, minQuantity int, minAmountCentimes int64) error {
+	mspID, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if minQuantity < 1 {
+		return fmt.Errorf("minimum quantity must be at least 1")
+	}
+	if minAmountCentimes < 0 {
+		return fmt.Errorf("minimum amount must not be negative")
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	thresholds := PartialSettlementThresholds{
+		MinQuantity: minQuantity,
+		MinAmount:   Money(minAmountCentimes),
+		UpdatedBy:   mspID,
+		LastUpdated: currentTime,
+	}
+
+	thresholdsJSON, err := json.Marshal(thresholds)
+	if err != nil {
+		return fmt.Errorf("failed to marshal partial settlement thresholds: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("partialSettlementThresholds", thresholdsJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put partial settlement thresholds in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetPartialSettlementThresholds retrieves the partial settlement thresholds
+// (any quantity of at least one security until Maroclear configures them)
+func (s *SettlementContract) GetPartialSettlementThresholds(ctx contractapi.TransactionContextInterface) (*PartialSettlementThresholds, error) {
+	thresholdsJSON, err := ctx.GetStub().GetState("partialSettlementThresholds")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if thresholdsJSON == nil {
+		return &PartialSettlementThresholds{MinQuantity: 1}, nil
+	}
+
+	var thresholds PartialSettlementThresholds
+	err = json.Unmarshal(thresholdsJSON, &thresholds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal partial settlement thresholds: %v", err)
+	}
+
+	return &thresholds, nil
+}
+
+// SetPartialSettlement opts one side (buy or sell) of an instruction in or out of partial
+// settlement. Only the broker on that side can set it, and an instruction only settles
+// partially when both sides have opted in.
+func (s *SettlementContract) SetPartialSettlement(ctx contractapi.TransactionContextInterface, instructionID, side string, allowed bool) error {
+	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
+	if err != nil {
+		return err
+	}
+
+	if !instruction.isLive() {
+		return fmt.Errorf("only pending or validated instructions can be changed, current status: %s", instruction.Status)
+	}
+
+	var brokerID string
+	switch side {
+	case "buy":
+		brokerID = instruction.BuyBrokerID
+	case "sell":
+		brokerID = instruction.SellBrokerID
+	default:
+		return fmt.Errorf("side must be 'buy' or 'sell'")
+	}
+
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != brokerMSPID(brokerID) {
+		return fmt.Errorf("only %s can set partial settlement for the %s side of instruction %s", brokerMSPID(brokerID), side, instructionID)
+	}
+
+	if side == "buy" {
+		instruction.BuyAllowsPartial = allowed
+	} else {
+		instruction.SellAllowsPartial = allowed
+	}
+
+	return s.putInstruction(ctx, instruction, "PartialSettlementUpdated")
+}
+
+// partialQuantity returns the quantity an instruction settles partially given the cash and
+// securities it can draw on, or 0 when it must not settle partially: a side has not opted
+// in, or the quantity is below the thresholds
+func (s *SettlementContract) partialQuantity(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, cashAvailable Money, securitiesAvailable int) (int, error) {
+	if !instruction.BuyAllowsPartial || !instruction.SellAllowsPartial {
+		return 0, nil
+	}
+
+	// Settle what the seller can deliver and the buyer can pay for
+	quantity := securitiesAvailable
+	if instruction.Price > 0 {
+		if byCash := int(cashAvailable / instruction.Price); byCash < quantity {
+			quantity = byCash
+		}
+	}
+	if quantity <= 0 || quantity >= instruction.Quantity {
+		return 0, nil
+	}
+
+	thresholds, err := s.GetPartialSettlementThresholds(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if quantity < thresholds.MinQuantity || instruction.Price.Times(quantity) < thresholds.MinAmount {
+		return 0, nil
+	}
+
+	return quantity, nil
+}
+
+// createRemainderInstruction opens the child instruction for the part of an instruction
+// left unsettled by a partial settlement. The child takes over the holds the settled part
+// did not consume and inherits the affirmations and partial settlement indicators.
+func (s *SettlementContract) createRemainderInstruction(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, settledQuantity int, settledAmount, heldAmount Money, heldQuantity int, currentTime string) (*SettlementInstruction, error) {
+	child := *instruction
+	child.InstructionID = fmt.Sprintf("instruction-%s-part%d", instruction.TradeID, instruction.PartNumber+1)
+	child.ParentInstructionID = instruction.InstructionID
+	child.PartNumber = instruction.PartNumber + 1
+	child.Quantity = instruction.Quantity - settledQuantity
+	child.TotalAmount = instruction.TotalAmount - settledAmount
+	child.Status = "validated"
+	child.CreatedAt = currentTime
+	child.CompletedAt = ""
+	child.ReservedAmount = heldAmount
+	child.ReservedQuantity = heldQuantity
+	child.HoldsPlaced = true
+	child.BuyCancelConsent = false
+	child.SellCancelConsent = false
+	child.ProposedAmendment = nil
+	child.SettledQuantity = 0
+	child.SettledAmount = 0
+	child.ChildInstructionID = ""
+
+	if heldAmount > 0 {
+		err := s.putHold(ctx, &Hold{
+			HoldID:        holdKey(child.InstructionID, "cash"),
+			InstructionID: child.InstructionID,
+			BrokerID:      child.BuyBrokerID,
+			ClientID:      child.BuyClientID,
+			Asset:         "cash",
+			Amount:        heldAmount,
+			CreatedAt:     currentTime,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if heldQuantity > 0 {
+		err := s.putHold(ctx, &Hold{
+			HoldID:        holdKey(child.InstructionID, "securities"),
+			InstructionID: child.InstructionID,
+			BrokerID:      child.SellBrokerID,
+			ClientID:      child.SellClientID,
+			Asset:         "securities",
+			SecurityID:    child.SecurityID,
+			Quantity:      heldQuantity,
+			CreatedAt:     currentTime,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	childJSON, err := json.Marshal(child)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal settlement instruction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(child.InstructionID, childJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put settlement instruction in ledger: %v", err)
+	}
+
+	return &child, nil
+}
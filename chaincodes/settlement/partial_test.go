@@ -0,0 +1,106 @@
+// partial_test.go - Tests of partial settlement
+package main
+
+import (
+	"testing"
+)
+
+// setUpShortTrade creates an affirmed instruction for broker1 to buy 1,000 SEC002 at 1.00
+// from broker2, which holds 800
+func setUpShortTrade(t *testing.T, l *mockLedger) {
+	t.Helper()
+	s := &SettlementContract{}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 1000, 100, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.AffirmInstruction(ctx, "instruction-trade-1", "buy", "", 0, 0) })
+	l.must(t, "Broker2MSP", func(ctx txCtx) error { return s.AffirmInstruction(ctx, "instruction-trade-1", "sell", "", 0, 0) })
+}
+
+// securitiesHeld returns the quantity of a security a broker holds
+func securitiesHeld(t *testing.T, l *mockLedger, brokerID, securityID string) int {
+	t.Helper()
+	s := &SettlementContract{}
+
+	var quantity int
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		account, err := s.GetSecuritiesAccount(ctx, brokerID, securityID)
+		if err != nil {
+			return err
+		}
+		quantity = account.Quantity
+		return nil
+	})
+	return quantity
+}
+
+func TestShortSellerSettlesPartially(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpShortTrade(t, l)
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.SetPartialSettlement(ctx, "instruction-trade-1", "buy", true) })
+	l.must(t, "Broker2MSP", func(ctx txCtx) error { return s.SetPartialSettlement(ctx, "instruction-trade-1", "sell", true) })
+
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+
+	parent := instructionOf(t, l, "instruction-trade-1")
+	if parent.Status != "partially_settled" || parent.SettledQuantity != 800 || parent.ChildInstructionID != "instruction-trade-1-part1" {
+		t.Fatalf("parent instruction = %+v", parent)
+	}
+	child := instructionOf(t, l, parent.ChildInstructionID)
+	if child.Status != "validated" || child.Quantity != 200 || child.ReservedAmount != 20000 {
+		t.Fatalf("remainder instruction = %+v", child)
+	}
+	if quantity := securitiesHeld(t, l, "broker1", "SEC002"); quantity != 800 {
+		t.Fatalf("broker1 holds %d SEC002 after the partial settlement, want 800", quantity)
+	}
+
+	// The remainder settles once the seller has the securities
+	l.must(t, "Broker2MSP", func(ctx txCtx) error { return s.DepositSecurities(ctx, "broker2", "SEC002", 200) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, child.InstructionID) })
+
+	if child = instructionOf(t, l, child.InstructionID); child.Status != "completed" || child.SettledQuantity != 200 {
+		t.Fatalf("remainder instruction = %+v", child)
+	}
+	if quantity := securitiesHeld(t, l, "broker1", "SEC002"); quantity != 1000 {
+		t.Errorf("broker1 holds %d SEC002, want 1000", quantity)
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		trade, err := s.GetTrade(ctx, "trade-1")
+		if err != nil {
+			return err
+		}
+		if trade.Status != "settled" {
+			t.Errorf("trade is %s, want settled", trade.Status)
+		}
+		return nil
+	})
+}
+
+func TestNoPartialSettlementWithoutBothSidesOrBelowThresholds(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpShortTrade(t, l)
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.SetPartialSettlement(ctx, "instruction-trade-1", "buy", true) })
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error {
+		return s.SetPartialSettlement(ctx, "instruction-trade-1", "sell", true)
+	})
+
+	l.now = settlementDay
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	if instruction := instructionOf(t, l, "instruction-trade-1"); instruction.Status != "validated" || instruction.SettledQuantity != 0 || instruction.ChildInstructionID != "" {
+		t.Fatalf("instruction settled partially with one side opted in: %+v", instruction)
+	}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetPartialSettlementThresholds(ctx, 900, 0) })
+	l.must(t, "Broker2MSP", func(ctx txCtx) error { return s.SetPartialSettlement(ctx, "instruction-trade-1", "sell", true) })
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	if instruction := instructionOf(t, l, "instruction-trade-1"); instruction.Status != "validated" || instruction.SettledQuantity != 0 || instruction.ChildInstructionID != "" {
+		t.Fatalf("instruction settled 800 partially below a 900 minimum: %+v", instruction)
+	}
+}
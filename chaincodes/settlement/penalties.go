@@ -0,0 +1,487 @@
+// penalties.go - Daily cash penalties on late settlement, charged monthly
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// penaltyRateScale is the number of penalty rate units in one: rates are in hundredths of
+// a basis point of the instruction value per day
+const penaltyRateScale = 1000000
+
+// PenaltyRates are the daily late-settlement penalty rates, in hundredths of a basis point
+// of the instruction value, by fail reason
+type PenaltyRates struct {
+	CashFailRate       int    `json:"cashFailRate"`       // buyer_insufficient_funds
+	SecuritiesFailRate int    `json:"securitiesFailRate"` // seller_insufficient_securities
+	UpdatedBy          string `json:"updatedBy"`
+	LastUpdated        string `json:"lastUpdated"`
+}
+
+// Penalty is one day's penalty on an instruction that is still unsettled after its
+// settlement date. The failing broker pays it to the counterparty broker.
+type Penalty struct {
+	PenaltyID        string `json:"penaltyID"`
+	InstructionID    string `json:"instructionID"`
+	Date             string `json:"date"` // YYYY-MM-DD
+	FailReason       string `json:"failReason"`
+	FailingBrokerID  string `json:"failingBrokerID"`
+	CounterpartyID   string `json:"counterpartyID"`
+	InstructionValue Money  `json:"instructionValue"`
+	Rate             int    `json:"rate"`
+	Amount           Money  `json:"amount"`
+	Status           string `json:"status"` // accrued, charged
+	ChargeID         string `json:"chargeID"`
+	AccruedAt        string `json:"accruedAt"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// PenaltyPosition is a broker's penalties in a monthly charge
+type PenaltyPosition struct {
+	BrokerID string `json:"brokerID"`
+	Paid     Money  `json:"paid"`
+	Received Money  `json:"received"`
+	Net      Money  `json:"net"` // received less paid
+}
+
+// PenaltyCharge is the monthly charge of the penalties accrued in a month
+type PenaltyCharge struct {
+	ChargeID   string             `json:"chargeID"`
+	Month      string             `json:"month"` // YYYY-MM
+	PenaltyIDs []string           `json:"penaltyIDs"`
+	Positions  []*PenaltyPosition `json:"positions"`
+	Total      Money              `json:"total"`
+	ChargedAt  string             `json:"chargedAt"`
+}
+
+// penaltyKey returns the key of an instruction's penalty for a day. Keys start with the
+// date so that a month's penalties are one range.
+func penaltyKey(date, instructionID string) string {
+	return "penalty-" + date + "-" + instructionID
+}
+
+// SetPenaltyRates sets the daily penalty rates, in hundredths of a basis point of the
+// instruction value
+func (s *SettlementContract) SetPenaltyRates(ctx contractapi.TransactionContextInterface, cashFailRate, securitiesFailRate int) error {
+	mspID, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	if cashFailRate < 0 || securitiesFailRate < 0 {
+		return fmt.Errorf("penalty rates must not be negative")
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	rates := PenaltyRates{
+		CashFailRate:       cashFailRate,
+		SecuritiesFailRate: securitiesFailRate,
+		UpdatedBy:          mspID,
+		LastUpdated:        currentTime,
+	}
+
+	ratesJSON, err := json.Marshal(rates)
+	if err != nil {
+		return fmt.Errorf("failed to marshal penalty rates: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("penaltyRates", ratesJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put penalty rates in ledger: %v", err)
+	}
+
+	return nil
+}
+
+// GetPenaltyRates retrieves the daily penalty rates (no penalties until Maroclear sets them)
+func (s *SettlementContract) GetPenaltyRates(ctx contractapi.TransactionContextInterface) (*PenaltyRates, error) {
+	ratesJSON, err := ctx.GetStub().GetState("penaltyRates")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if ratesJSON == nil {
+		return &PenaltyRates{}, nil
+	}
+
+	var rates PenaltyRates
+	err = json.Unmarshal(ratesJSON, &rates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal penalty rates: %v", err)
+	}
+
+	return &rates, nil
+}
+
+// AccruePenalties accrues a day's penalty on every instruction still unsettled after its
+// settlement date. The fail reason is the side that cannot settle: the buyer when its cash
+// is short, otherwise the seller when its securities are short or it is being bought in.
+// Instructions short on neither side are not penalized. Accruing a day twice adds nothing.
+// The shortfall is read from the balances as they stand, so only the current business
+// date can be accrued: a day that was missed is not penalized afterwards.
+func (s *SettlementContract) AccruePenalties(ctx contractapi.TransactionContextInterface, date string) ([]*Penalty, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	day, err := time.Parse(calendarDateLayout, date)
+	if err != nil {
+		return nil, fmt.Errorf("date must be in YYYY-MM-DD format: %v", err)
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if today := txTime.Format(calendarDateLayout); date != today {
+		return nil, fmt.Errorf("penalties can only be accrued for the current business date %s, not %s", today, date)
+	}
+
+	businessDay, err := s.isBusinessDay(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	if !businessDay {
+		return nil, fmt.Errorf("%s is not a business day", date)
+	}
+
+	rates, err := s.GetPenaltyRates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange("instruction-", "instruction-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instructions: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	book := newAccountBook()
+	penalties := []*Penalty{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate instructions: %v", err)
+		}
+
+		var instruction SettlementInstruction
+		err = json.Unmarshal(queryResponse.Value, &instruction)
+		if err != nil {
+			continue // Skip if not a valid SettlementInstruction
+		}
+
+		// Only instructions still unsettled on or after their settlement date
+		if !instruction.isLive() && instruction.Status != "buy_in" {
+			continue
+		}
+		settlementDate, err := time.Parse(time.RFC3339, instruction.SettlementDate)
+		if err != nil {
+			continue // Skip if date can't be parsed
+		}
+		if settlementDate.UTC().Format(calendarDateLayout) > date {
+			continue
+		}
+
+		failReason := errorCodeInsufficientSecurities
+		if instruction.Status != "buy_in" {
+			failReason, err = book.shortfall(ctx, s, &instruction)
+			if err != nil || failReason == "" {
+				continue // Not failing for lack of cash or securities
+			}
+		}
+
+		penaltyID := penaltyKey(date, instruction.InstructionID)
+		existingJSON, err := ctx.GetStub().GetState(penaltyID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if existingJSON != nil {
+			continue
+		}
+
+		penalty := Penalty{
+			PenaltyID:        penaltyID,
+			InstructionID:    instruction.InstructionID,
+			Date:             date,
+			FailReason:       failReason,
+			FailingBrokerID:  instruction.SellBrokerID,
+			CounterpartyID:   instruction.BuyBrokerID,
+			InstructionValue: instruction.TotalAmount,
+			Rate:             rates.SecuritiesFailRate,
+			Status:           "accrued",
+			AccruedAt:        currentTime,
+		}
+		if failReason == errorCodeInsufficientFunds {
+			penalty.FailingBrokerID, penalty.CounterpartyID = instruction.BuyBrokerID, instruction.SellBrokerID
+			penalty.Rate = rates.CashFailRate
+		}
+		penalty.Amount = instruction.TotalAmount * Money(penalty.Rate) / penaltyRateScale
+		if penalty.Amount == 0 {
+			continue
+		}
+
+		penaltyJSON, err := json.Marshal(penalty)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal penalty: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(penaltyID, penaltyJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to put penalty in ledger: %v", err)
+		}
+
+		penalties = append(penalties, &penalty)
+	}
+
+	penaltiesJSON, err := json.Marshal(penalties)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal penalties: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("PenaltiesAccrued", penaltiesJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set PenaltiesAccrued event: %v", err)
+	}
+
+	return penalties, nil
+}
+
+// ChargePenalties charges the penalties accrued in a month (YYYY-MM). Each broker's
+// penalties paid and received are netted: a net payer's BrokerAccount is debited, from its
+// own funds first and then through the default waterfall, and a net receiver's is
+// credited. A month is charged once.
+func (s *SettlementContract) ChargePenalties(ctx contractapi.TransactionContextInterface, month string) (*PenaltyCharge, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Payers covered by the default waterfall read the fund as left by earlier payers
+	ctx = withWriteCache(ctx)
+
+	_, err = time.Parse("2006-01", month)
+	if err != nil {
+		return nil, fmt.Errorf("month must be in YYYY-MM format: %v", err)
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if month >= txTime.Format("2006-01") {
+		return nil, fmt.Errorf("penalties of %s can only be charged after the month ends", month)
+	}
+
+	chargeID := "penaltyCharge-" + month
+	existingJSON, err := ctx.GetStub().GetState(chargeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingJSON != nil {
+		return nil, fmt.Errorf("penalties of %s are already charged", month)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	penalties, err := s.penaltiesInRange(ctx, "penalty-"+month+"-", "penalty-"+month+"-~")
+	if err != nil {
+		return nil, err
+	}
+
+	charge := PenaltyCharge{
+		ChargeID:   chargeID,
+		Month:      month,
+		PenaltyIDs: []string{},
+		Positions:  []*PenaltyPosition{},
+		ChargedAt:  currentTime,
+	}
+
+	positions := map[string]*PenaltyPosition{}
+	position := func(brokerID string) *PenaltyPosition {
+		if p, ok := positions[brokerID]; ok {
+			return p
+		}
+		p := &PenaltyPosition{BrokerID: brokerID}
+		positions[brokerID] = p
+		charge.Positions = append(charge.Positions, p)
+		return p
+	}
+
+	for _, penalty := range penalties {
+		if penalty.Status != "accrued" {
+			continue
+		}
+
+		position(penalty.FailingBrokerID).Paid += penalty.Amount
+		position(penalty.CounterpartyID).Received += penalty.Amount
+		charge.Total += penalty.Amount
+		charge.PenaltyIDs = append(charge.PenaltyIDs, penalty.PenaltyID)
+
+		penalty.Status = "charged"
+		penalty.ChargeID = chargeID
+
+		penaltyJSON, err := json.Marshal(penalty)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal penalty: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(penalty.PenaltyID, penaltyJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update penalty in ledger: %v", err)
+		}
+	}
+
+	// Net payers first, so receivers are credited what was collected
+	for _, payers := range []bool{true, false} {
+		for _, p := range charge.Positions {
+			p.Net = p.Received - p.Paid
+			if p.Net == 0 || (p.Net < 0) != payers {
+				continue
+			}
+
+			account, err := s.getOrNewBrokerAccount(ctx, p.BrokerID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get broker account: %v", err)
+			}
+
+			transaction := &Transaction{
+				TransactionID: "transaction-penalty-" + month + "-" + p.BrokerID,
+				Type:          "penalty",
+				FromID:        "penalties",
+				ToID:          p.BrokerID,
+				Amount:        p.Net,
+				Status:        "completed",
+				Timestamp:     currentTime,
+			}
+			if payers {
+				err = s.collectFromBroker(ctx, account, -p.Net, journalPenalties, chargeID+"-"+p.BrokerID, "penalties", currentTime)
+				if err != nil {
+					return nil, err
+				}
+				transaction.FromID, transaction.ToID = p.BrokerID, "penalties"
+				transaction.Amount = -p.Net
+			} else {
+				account.Balance += p.Net
+				account.LastUpdated = currentTime
+				s.journalMove(ctx, journalPenalties, journalHolder(p.BrokerID, ""), journalCash, int64(p.Net))
+			}
+
+			err = s.putBrokerAccount(ctx, account)
+			if err != nil {
+				return nil, fmt.Errorf("failed to update broker account: %v", err)
+			}
+
+			err = s.putTransaction(ctx, transaction)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	chargeJSON, err := json.Marshal(charge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal penalty charge: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(chargeID, chargeJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put penalty charge in ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("PenaltiesCharged", chargeJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set PenaltiesCharged event: %v", err)
+	}
+
+	return &charge, nil
+}
+
+// GetPenaltyCharge retrieves the penalty charge of a month (YYYY-MM)
+func (s *SettlementContract) GetPenaltyCharge(ctx contractapi.TransactionContextInterface, month string) (*PenaltyCharge, error) {
+	chargeJSON, err := ctx.GetStub().GetState("penaltyCharge-" + month)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if chargeJSON == nil {
+		return nil, fmt.Errorf("penalties of %s are not charged", month)
+	}
+
+	var charge PenaltyCharge
+	err = json.Unmarshal(chargeJSON, &charge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal penalty charge: %v", err)
+	}
+
+	return &charge, nil
+}
+
+// GetPenalties retrieves the penalty ledger of a broker: the penalties it pays and the
+// ones it receives, for a month (YYYY-MM) or for all months when month is empty
+func (s *SettlementContract) GetPenalties(ctx contractapi.TransactionContextInterface, brokerID, month string) ([]*Penalty, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := "penalty-"
+	if month != "" {
+		prefix += month + "-"
+	}
+
+	penalties, err := s.penaltiesInRange(ctx, prefix, prefix+"~")
+	if err != nil {
+		return nil, err
+	}
+
+	brokerPenalties := []*Penalty{}
+	for _, penalty := range penalties {
+		if penalty.FailingBrokerID == brokerID || penalty.CounterpartyID == brokerID {
+			brokerPenalties = append(brokerPenalties, penalty)
+		}
+	}
+
+	return brokerPenalties, nil
+}
+
+// penaltiesInRange retrieves the penalties with keys in a range
+func (s *SettlementContract) penaltiesInRange(ctx contractapi.TransactionContextInterface, startKey, endKey string) ([]*Penalty, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get penalties: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var penalties []*Penalty
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate penalties: %v", err)
+		}
+
+		var penalty Penalty
+		err = json.Unmarshal(queryResponse.Value, &penalty)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal penalty: %v", err)
+		}
+		penalties = append(penalties, &penalty)
+	}
+
+	return penalties, nil
+}
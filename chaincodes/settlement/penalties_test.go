@@ -0,0 +1,107 @@
+// penalties_test.go - Tests of settlement fail penalties
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPenaltiesAccrueDailyAndAreChargedMonthly(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 1000, 10000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error { return s.SetPenaltyRates(ctx, 200, 100) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetPenaltyRates(ctx, 200, 100) })
+
+	// broker2 is short of securities from the settlement date on 2026-03-04; penalties
+	// accrue from the day after, once a day at the end of the day
+	for _, day := range []struct {
+		date string
+		want int
+	}{{"2026-03-04", 0}, {"2026-03-05", 1}, {"2026-03-06", 1}} {
+		date, want := day.date, day.want
+		midnight, _ := time.Parse(calendarDateLayout, date)
+		l.now = midnight.Add(20 * time.Hour)
+		l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+			penalties, err := s.AccruePenalties(ctx, date)
+			if err != nil {
+				return err
+			}
+			if len(penalties) != want {
+				t.Fatalf("%d penalties accrued on %s, want %d", len(penalties), date, want)
+			}
+			for _, penalty := range penalties {
+				if penalty.FailingBrokerID != "broker2" || penalty.CounterpartyID != "broker1" ||
+					penalty.FailReason != "seller_insufficient_securities" || penalty.Amount != 1000 {
+					t.Errorf("penalty on %s = %+v", date, *penalty)
+				}
+			}
+			return nil
+		})
+	}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		penalties, err := s.AccruePenalties(ctx, "2026-03-06")
+		if len(penalties) != 0 {
+			t.Errorf("2026-03-06 accrued twice: %d penalties", len(penalties))
+		}
+		return err
+	})
+	// A past day is not accrued from today's balances
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.AccruePenalties(ctx, "2026-03-05")
+		return err
+	})
+
+	// A month is charged once it is over, and only once
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.ChargePenalties(ctx, "2026-03")
+		return err
+	})
+	l.now = time.Date(2026, 4, 1, 9, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		charge, err := s.ChargePenalties(ctx, "2026-03")
+		if err != nil {
+			return err
+		}
+		if charge.Total != 2000 || len(charge.PenaltyIDs) != 2 {
+			t.Errorf("charge = %+v", *charge)
+		}
+		return nil
+	})
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.ChargePenalties(ctx, "2026-03")
+		return err
+	})
+
+	if balance := cashBalance(t, l, "broker1"); balance != 150000000+2000 {
+		t.Errorf("broker1 balance = %v", balance)
+	}
+	if balance := cashBalance(t, l, "broker2"); balance != 50000000-2000 {
+		t.Errorf("broker2 balance = %v", balance)
+	}
+
+	l.mustFail(t, "Broker3MSP", func(ctx txCtx) error {
+		_, err := s.GetPenalties(ctx, "broker2", "2026-03")
+		return err
+	})
+	l.must(t, "Broker2MSP", func(ctx txCtx) error {
+		penalties, err := s.GetPenalties(ctx, "broker2", "2026-03")
+		if err != nil {
+			return err
+		}
+		if len(penalties) != 2 {
+			t.Fatalf("broker2 has %d penalties, want 2", len(penalties))
+		}
+		for _, penalty := range penalties {
+			if penalty.Status != "charged" || penalty.ChargeID != "penaltyCharge-2026-03" {
+				t.Errorf("penalty = %+v", *penalty)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,262 @@
+// prices.go - Official closing and reference prices published by the stock market
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ClosingPrice is the official price of a security on a trading day, as published by the
+// stock market. Maroclear values collateral and marks open instructions to market with
+// the closing price; the reference price is the one the next session's price limits are
+// set around. A correction replaces the price with a new version and keeps the previous
+// ones.
+type ClosingPrice struct {
+	SecurityID       string `json:"securityID"`
+	Date             string `json:"date"` // YYYY-MM-DD
+	Price            Money  `json:"price"`
+	ReferencePrice   Money  `json:"referencePrice"`
+	Version          int    `json:"version"`
+	CorrectionReason string `json:"correctionReason"`
+	PublishedBy      string `json:"publishedBy"`
+	PublishedAt      string `json:"publishedAt"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
+}
+
+// closingPriceKey returns the key of a security's current closing price on a day. Keys
+// end with the date so that a security's prices are one range in date order.
+func closingPriceKey(securityID, date string) string {
+	return "closingPrice-" + securityID + "-" + date
+}
+
+// closingPriceVersionKey returns the key of one version of a security's closing price on
+// a day. Versions are zero-padded so that they range in order.
+func closingPriceVersionKey(securityID, date string, version int) string {
+	return fmt.Sprintf("closingPriceVersion-%s-%s-%04d", securityID, date, version)
+}
+
+// requireStockMarket fails unless the caller belongs to the stock market
+func (s *SettlementContract) requireStockMarket(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return "", err
+	}
+	if mspID != "StockMarketMSP" {
+		return "", fmt.Errorf("only StockMarket is authorized to publish prices")
+	}
+	return mspID, nil
+}
+
+// ImportClosingPrice publishes the official closing and reference prices (in centimes) of
+// a security on a past or current business day (YYYY-MM-DD). A reference price of zero
+// defaults to the closing price. A published price can only be changed by a correction.
+func (s *SettlementContract) ImportClosingPrice(ctx contractapi.TransactionContextInterface, securityID, date string, priceCentimes, referencePriceCentimes int64) error {
+	existing, err := s.getClosingPrice(ctx, securityID, date)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("closing price of %s on %s is already published, correct it instead", securityID, date)
+	}
+
+	return s.publishClosingPrice(ctx, securityID, date, Money(priceCentimes), Money(referencePriceCentimes), 1, "")
+}
+
+// CorrectClosingPrice replaces the published closing and reference prices (in centimes)
+// of a security on a day with a new version, giving the reason for the correction. The
+// previous versions are kept. Valuations and marks already made are not rerun.
+func (s *SettlementContract) CorrectClosingPrice(ctx contractapi.TransactionContextInterface, securityID, date string, priceCentimes, referencePriceCentimes int64, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("a correction requires a reason")
+	}
+
+	existing, err := s.getClosingPrice(ctx, securityID, date)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf("no closing price of %s is published on %s", securityID, date)
+	}
+
+	return s.publishClosingPrice(ctx, securityID, date, Money(priceCentimes), Money(referencePriceCentimes), existing.Version+1, reason)
+}
+
+// publishClosingPrice stores a version of a security's closing price as its current price
+// and emits a ClosingPricePublished event
+func (s *SettlementContract) publishClosingPrice(ctx contractapi.TransactionContextInterface, securityID, date string, price, referencePrice Money, version int, reason string) error {
+	mspID, err := s.requireStockMarket(ctx)
+	if err != nil {
+		return err
+	}
+
+	if securityID == "" {
+		return fmt.Errorf("security ID is required")
+	}
+
+	day, err := time.Parse(calendarDateLayout, date)
+	if err != nil {
+		return fmt.Errorf("date must be in YYYY-MM-DD format: %v", err)
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	if date > txTime.Format(calendarDateLayout) {
+		return fmt.Errorf("prices cannot be published for a future date %s", date)
+	}
+
+	businessDay, err := s.isBusinessDay(ctx, day)
+	if err != nil {
+		return err
+	}
+	if !businessDay {
+		return fmt.Errorf("%s is not a business day", date)
+	}
+
+	if price <= 0 {
+		return fmt.Errorf("price must be positive")
+	}
+	if referencePrice < 0 {
+		return fmt.Errorf("reference price cannot be negative")
+	}
+	if referencePrice == 0 {
+		referencePrice = price
+	}
+
+	closingPrice := ClosingPrice{
+		SecurityID:       securityID,
+		Date:             date,
+		Price:            price,
+		ReferencePrice:   referencePrice,
+		Version:          version,
+		CorrectionReason: reason,
+		PublishedBy:      mspID,
+		PublishedAt:      txTime.Format(time.RFC3339),
+	}
+
+	closingPriceJSON, err := json.Marshal(closingPrice)
+	if err != nil {
+		return fmt.Errorf("failed to marshal closing price: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(closingPriceKey(securityID, date), closingPriceJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put closing price in ledger: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(closingPriceVersionKey(securityID, date, version), closingPriceJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put closing price version in ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("ClosingPricePublished", closingPriceJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set ClosingPricePublished event: %v", err)
+	}
+
+	return nil
+}
+
+// getClosingPrice returns the current closing price of a security on a day, nil if none
+// is published
+func (s *SettlementContract) getClosingPrice(ctx contractapi.TransactionContextInterface, securityID, date string) (*ClosingPrice, error) {
+	closingPriceJSON, err := ctx.GetStub().GetState(closingPriceKey(securityID, date))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if closingPriceJSON == nil {
+		return nil, nil
+	}
+
+	var closingPrice ClosingPrice
+	err = json.Unmarshal(closingPriceJSON, &closingPrice)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal closing price: %v", err)
+	}
+
+	return &closingPrice, nil
+}
+
+// GetClosingPrice retrieves the current closing price of a security on a day (YYYY-MM-DD)
+func (s *SettlementContract) GetClosingPrice(ctx contractapi.TransactionContextInterface, securityID, date string) (*ClosingPrice, error) {
+	closingPrice, err := s.getClosingPrice(ctx, securityID, date)
+	if err != nil {
+		return nil, err
+	}
+	if closingPrice == nil {
+		return nil, fmt.Errorf("no closing price of %s is published on %s", securityID, date)
+	}
+
+	return closingPrice, nil
+}
+
+// GetClosingPriceVersions retrieves every version of a security's closing price on a day,
+// the original first
+func (s *SettlementContract) GetClosingPriceVersions(ctx contractapi.TransactionContextInterface, securityID, date string) ([]*ClosingPrice, error) {
+	return s.queryClosingPrices(ctx, securityID, closingPriceVersionKey(securityID, date, 0), closingPriceVersionKey(securityID, date, 9999))
+}
+
+// GetClosingPrices retrieves the current closing prices of a security from one day to
+// another (YYYY-MM-DD, both included), in date order
+func (s *SettlementContract) GetClosingPrices(ctx contractapi.TransactionContextInterface, securityID, fromDate, toDate string) ([]*ClosingPrice, error) {
+	_, err := time.Parse(calendarDateLayout, fromDate)
+	if err != nil {
+		return nil, fmt.Errorf("from date must be in YYYY-MM-DD format: %v", err)
+	}
+	_, err = time.Parse(calendarDateLayout, toDate)
+	if err != nil {
+		return nil, fmt.Errorf("to date must be in YYYY-MM-DD format: %v", err)
+	}
+	if fromDate > toDate {
+		return nil, fmt.Errorf("from date %s is after to date %s", fromDate, toDate)
+	}
+
+	return s.queryClosingPrices(ctx, securityID, closingPriceKey(securityID, fromDate), closingPriceKey(securityID, toDate)+"~")
+}
+
+// queryClosingPrices returns a security's closing prices stored in a key range
+func (s *SettlementContract) queryClosingPrices(ctx contractapi.TransactionContextInterface, securityID, startKey, endKey string) ([]*ClosingPrice, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get closing prices: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	closingPrices := []*ClosingPrice{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate closing prices: %v", err)
+		}
+
+		var closingPrice ClosingPrice
+		err = json.Unmarshal(queryResponse.Value, &closingPrice)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal closing price: %v", err)
+		}
+		if closingPrice.SecurityID == securityID {
+			closingPrices = append(closingPrices, &closingPrice)
+		}
+	}
+
+	return closingPrices, nil
+}
+
+// latestClosingPrice returns the latest closing price of a security on or before a day,
+// nil if there is none
+func (s *SettlementContract) latestClosingPrice(ctx contractapi.TransactionContextInterface, securityID, date string) (*ClosingPrice, error) {
+	closingPrices, err := s.queryClosingPrices(ctx, securityID, closingPriceKey(securityID, ""), closingPriceKey(securityID, date)+"~")
+	if err != nil {
+		return nil, err
+	}
+	if len(closingPrices) == 0 {
+		return nil, nil
+	}
+
+	return closingPrices[len(closingPrices)-1], nil
+}
@@ -0,0 +1,56 @@
+// prices_test.go - Tests of closing prices published by the stock market
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClosingPricesArePublishedOnceAndCorrected(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.now = time.Date(2026, 3, 5, 18, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error { return s.ImportClosingPrice(ctx, "SEC002", "2026-03-02", 1000, 0) })
+	for _, date := range []string{"2026-03-02", "2026-03-03", "2026-03-04"} {
+		date := date
+		l.must(t, "StockMarketMSP", func(ctx txCtx) error { return s.ImportClosingPrice(ctx, "SEC002", date, 1000, 990) })
+	}
+	// A security whose ID extends another one's does not show up in its range
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error { return s.ImportClosingPrice(ctx, "SEC0021", "2026-03-03", 5, 0) })
+
+	// A published price is corrected rather than published again, and future prices are refused
+	for _, date := range []string{"2026-03-02", "2026-03-06"} {
+		date := date
+		l.mustFail(t, "StockMarketMSP", func(ctx txCtx) error { return s.ImportClosingPrice(ctx, "SEC002", date, 1000, 0) })
+	}
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error {
+		return s.CorrectClosingPrice(ctx, "SEC002", "2026-03-03", 1200, 0, "fat finger")
+	})
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		prices, err := s.GetClosingPrices(ctx, "SEC002", "2026-03-03", "2026-03-05")
+		if err != nil {
+			return err
+		}
+		if len(prices) != 2 {
+			t.Fatalf("%d SEC002 prices from 2026-03-03, want 2", len(prices))
+		}
+		if prices[0].Date != "2026-03-03" || prices[0].Price != 1200 || prices[0].Version != 2 || prices[0].ReferencePrice != 1200 {
+			t.Errorf("corrected price = %+v", *prices[0])
+		}
+		if prices[1].Date != "2026-03-04" || prices[1].Price != 1000 || prices[1].ReferencePrice != 990 {
+			t.Errorf("price = %+v", *prices[1])
+		}
+
+		versions, err := s.GetClosingPriceVersions(ctx, "SEC002", "2026-03-03")
+		if err != nil {
+			return err
+		}
+		if len(versions) != 2 || versions[0].Price != 1000 || versions[1].CorrectionReason != "fat finger" {
+			t.Errorf("price versions = %v", versions)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,554 @@
+// queue.go - Settlement queue: priority ordering, recycling and gridlock resolution
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// maxGridlockSearch is the largest gridlock searched exhaustively for the subset of
+// instructions that settles the most value; larger gridlocks drop their lowest-priority
+// instructions until the rest can settle together
+const maxGridlockSearch = 12
+
+// Error codes of instructions that did not settle in a settlement run. Fails carry the
+// failure reason passed to processFail.
+const (
+	errorCodeInsufficientFunds      = "buyer_insufficient_funds"
+	errorCodeInsufficientSecurities = "seller_insufficient_securities"
+	errorCodeAwaitingAffirmation    = "awaiting_affirmation"
+	errorCodeSettlementError        = "settlement_error"
+)
+
+// SettlementRun reports the outcome of one run of the settlement queue, for Maroclear
+// operations to reconcile against
+type SettlementRun struct {
+	RunID            string                `json:"runID"`
+	BusinessDate     string                `json:"businessDate"` // YYYY-MM-DD
+	CutoffTime       string                `json:"cutoffTime"`   // instructions due by the end of the business date, as of this time
+	FinalRun         bool                  `json:"finalRun"`     // instructions left unsettled fail instead of being recycled
+	Considered       []string              `json:"considered"`
+	Outcomes         []*InstructionOutcome `json:"outcomes"`
+	Settled          []string              `json:"settled"`
+	PartiallySettled []string              `json:"partiallySettled"`
+	Recycled         []string              `json:"recycled"`
+	BoughtIn         []string              `json:"boughtIn"` // buy-in opened after the seller's extension period
+	Failed           []string              `json:"failed"`
+	Gridlocked       []string              `json:"gridlocked"` // settled together to resolve a gridlock
+	TotalCash        Money                 `json:"totalCash"`
+	TotalSecurities  int                   `json:"totalSecurities"`
+	RunAt            string                `json:"runAt"`
+}
+
+// InstructionOutcome is what a settlement run did with one instruction
+type InstructionOutcome struct {
+	InstructionID string `json:"instructionID"`
+	TradeID       string `json:"tradeID"`
+	Outcome       string `json:"outcome"`   // settled, partially_settled, recycled, buy_in, failed, skipped
+	ErrorCode     string `json:"errorCode"` // why it did not settle in full, empty when it did
+	Error         string `json:"error"`
+	Amount        Money  `json:"amount"`   // cash moved
+	Quantity      int    `json:"quantity"` // securities moved
+}
+
+// record adds an instruction's outcome to the run and its totals
+func (run *SettlementRun) record(outcome *InstructionOutcome) {
+	run.Outcomes = append(run.Outcomes, outcome)
+	run.TotalCash += outcome.Amount
+	run.TotalSecurities += outcome.Quantity
+
+	switch outcome.Outcome {
+	case "settled":
+		run.Settled = append(run.Settled, outcome.InstructionID)
+	case "partially_settled":
+		run.PartiallySettled = append(run.PartiallySettled, outcome.InstructionID)
+	case "recycled":
+		run.Recycled = append(run.Recycled, outcome.InstructionID)
+	case "buy_in":
+		run.BoughtIn = append(run.BoughtIn, outcome.InstructionID)
+	case "failed":
+		run.Failed = append(run.Failed, outcome.InstructionID)
+	}
+}
+
+// SetInstructionPriority sets the priority of an instruction in the settlement queue:
+// higher priorities settle first
+func (s *SettlementContract) SetInstructionPriority(ctx contractapi.TransactionContextInterface, instructionID string, priority int) error {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
+	if err != nil {
+		return err
+	}
+
+	if !instruction.isLive() {
+		return fmt.Errorf("only pending or validated instructions can be changed, current status: %s", instruction.Status)
+	}
+
+	instruction.Priority = priority
+
+	return s.putInstruction(ctx, instruction, "InstructionPriorityUpdated")
+}
+
+// RunSettlementQueue settles the instructions that are due, in priority order. Instructions
+// that cannot settle are retried as others settle, and instructions that can only settle
+// together (a gridlock) are settled as the subset worth the most. Whatever still cannot
+// settle is recycled to the next run, or on the final run of the day settles partially or
+// fails.
+func (s *SettlementContract) RunSettlementQueue(ctx contractapi.TransactionContextInterface, finalRun bool) (*SettlementRun, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.runSettlementQueue(ctx, finalRun)
+}
+
+// GetSettlementRun retrieves the report of a settlement queue run
+func (s *SettlementContract) GetSettlementRun(ctx contractapi.TransactionContextInterface, runID string) (*SettlementRun, error) {
+	runJSON, err := ctx.GetStub().GetState(runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if runJSON == nil {
+		return nil, fmt.Errorf("settlement run %s does not exist", runID)
+	}
+
+	var run SettlementRun
+	err = json.Unmarshal(runJSON, &run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal settlement run: %v", err)
+	}
+
+	return &run, nil
+}
+
+// runSettlementQueue runs the settlement queue. Every settlement is first posted to an
+// account book, so instructions see each other's postings; the book is then stored at once.
+func (s *SettlementContract) runSettlementQueue(ctx contractapi.TransactionContextInterface, finalRun bool) (*SettlementRun, error) {
+	// Later settlements and fails read the accounts written by earlier ones
+	ctx = withWriteCache(ctx)
+
+	// Transaction time for comparison, so every endorser picks the same instructions
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Maroclear only settles on business days
+	businessDay, err := s.isBusinessDay(ctx, txTime)
+	if err != nil {
+		return nil, err
+	}
+	if !businessDay {
+		return nil, fmt.Errorf("%s is not a business day", txTime.Format(calendarDateLayout))
+	}
+	today := txTime.Format(calendarDateLayout)
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	run := SettlementRun{
+		RunID:            "settlementRun-" + s.getTransactionID(ctx),
+		BusinessDate:     today,
+		CutoffTime:       currentTime,
+		FinalRun:         finalRun,
+		Considered:       []string{},
+		Outcomes:         []*InstructionOutcome{},
+		Settled:          []string{},
+		PartiallySettled: []string{},
+		Recycled:         []string{},
+		BoughtIn:         []string{},
+		Failed:           []string{},
+		Gridlocked:       []string{},
+		RunAt:            currentTime,
+	}
+
+	queue, awaiting, err := s.dueInstructions(ctx, today)
+	if err != nil {
+		return nil, err
+	}
+	for _, instruction := range queue {
+		run.Considered = append(run.Considered, instruction.InstructionID)
+	}
+
+	// Instructions of brokers that missed a margin call stay in the queue until they meet it
+	var unrestricted []*SettlementInstruction
+	for _, instruction := range queue {
+		err = s.requireUnrestricted(ctx, instruction.BuyBrokerID, instruction.SellBrokerID)
+		if err != nil {
+			run.record(&InstructionOutcome{
+				InstructionID: instruction.InstructionID,
+				TradeID:       instruction.TradeID,
+				Outcome:       "skipped",
+				ErrorCode:     errorCodeBrokerRestricted,
+				Error:         err.Error(),
+			})
+			continue
+		}
+		unrestricted = append(unrestricted, instruction)
+	}
+	queue = unrestricted
+	for _, instruction := range awaiting {
+		run.Considered = append(run.Considered, instruction.InstructionID)
+		run.record(&InstructionOutcome{
+			InstructionID: instruction.InstructionID,
+			TradeID:       instruction.TradeID,
+			Outcome:       "skipped",
+			ErrorCode:     errorCodeAwaitingAffirmation,
+			Error:         "awaiting affirmation until " + instruction.AffirmationDeadline,
+		})
+	}
+
+	// Load the accounts once; instructions whose clients cannot settle fail to load and
+	// are left to the end of the run
+	book := newAccountBook()
+	for _, instruction := range queue {
+		_ = book.load(ctx, s, instruction)
+	}
+
+	// Settle in priority order, retrying what could not settle as long as others settle
+	settled := map[string]bool{}
+	for {
+		progress := true
+		for progress {
+			progress = false
+			for _, instruction := range queue {
+				if settled[instruction.InstructionID] {
+					continue
+				}
+				// A novated leg settles with its paired leg, the CCP passing the cash and
+				// securities through, or alone from the CCP's own accounts
+				if paired := queuedPair(queue, instruction); paired != nil && !settled[paired.InstructionID] {
+					if trial := book.try(ctx, s, []*SettlementInstruction{instruction, paired}, currentTime); trial != nil {
+						book = trial
+						settled[instruction.InstructionID] = true
+						settled[paired.InstructionID] = true
+						progress = true
+						continue
+					}
+				}
+				if trial := book.try(ctx, s, []*SettlementInstruction{instruction}, currentTime); trial != nil {
+					book = trial
+					settled[instruction.InstructionID] = true
+					progress = true
+				}
+			}
+		}
+
+		var remaining []*SettlementInstruction
+		for _, instruction := range queue {
+			if !settled[instruction.InstructionID] {
+				remaining = append(remaining, instruction)
+			}
+		}
+
+		// No single instruction can settle: look for instructions that settle together
+		trial, gridlocked := book.resolveGridlock(ctx, s, remaining, currentTime)
+		if trial == nil {
+			break
+		}
+		book = trial
+		for _, instruction := range gridlocked {
+			settled[instruction.InstructionID] = true
+			run.Gridlocked = append(run.Gridlocked, instruction.InstructionID)
+		}
+	}
+
+	err = book.save(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instruction := range book.settled {
+		err = s.recordSettlement(ctx, instruction, currentTime)
+		if err != nil {
+			return nil, err
+		}
+		run.record(&InstructionOutcome{
+			InstructionID: instruction.InstructionID,
+			TradeID:       instruction.TradeID,
+			Outcome:       "settled",
+			Amount:        instruction.TotalAmount,
+			Quantity:      instruction.Quantity,
+		})
+	}
+
+	// What is left is recycled, or on the final run settles partially or fails
+	for _, instruction := range queue {
+		if settled[instruction.InstructionID] {
+			continue
+		}
+
+		outcome := &InstructionOutcome{
+			InstructionID: instruction.InstructionID,
+			TradeID:       instruction.TradeID,
+			Outcome:       "recycled",
+		}
+		outcome.ErrorCode, err = book.shortfall(ctx, s, instruction)
+		if err != nil {
+			outcome.ErrorCode = errorCodeSettlementError
+			outcome.Error = err.Error()
+		}
+
+		if !finalRun {
+			instruction.RecycleCount++
+
+			instructionJSON, err := json.Marshal(instruction)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal settlement instruction: %v", err)
+			}
+
+			err = ctx.GetStub().PutState(instruction.InstructionID, instructionJSON)
+			if err != nil {
+				return nil, fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
+			}
+
+			run.record(outcome)
+			continue
+		}
+
+		// The paired leg of a novated trade may already have settled or failed this one.
+		// An error aborts the run, as the instruction's writes so far are already staged.
+		executed, err := s.GetSettlementInstruction(ctx, instruction.InstructionID)
+		if err != nil {
+			return nil, err
+		}
+		if executed.isLive() {
+			err = s.executeSettlement(ctx, instruction.InstructionID, true)
+			if err != nil {
+				return nil, fmt.Errorf("failed to settle or fail instruction %s: %v", instruction.InstructionID, err)
+			}
+
+			executed, err = s.GetSettlementInstruction(ctx, instruction.InstructionID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch executed.Status {
+		case "partially_settled":
+			outcome.Outcome = "partially_settled"
+			outcome.Amount = executed.SettledAmount
+			outcome.Quantity = executed.SettledQuantity
+		case "completed":
+			outcome.Outcome = "settled"
+			outcome.ErrorCode = ""
+			outcome.Amount = executed.SettledAmount
+			outcome.Quantity = executed.SettledQuantity
+		case "buy_in":
+			outcome.Outcome = "buy_in"
+		default:
+			// A seller in its extension period stays in the queue
+			if executed.isLive() {
+				outcome.Outcome = "recycled"
+			} else {
+				outcome.Outcome = "failed"
+			}
+		}
+		run.record(outcome)
+	}
+
+	runJSON, err := json.Marshal(run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal settlement run: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(run.RunID, runJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put settlement run in ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("SettlementRunCompleted", runJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set SettlementRunCompleted event: %v", err)
+	}
+
+	return &run, nil
+}
+
+// dueInstructions returns the instructions due on or before a business date that are
+// eligible for settlement, highest priority first, then oldest settlement date, most
+// recycled and largest amount, and the due instructions still awaiting affirmation
+func (s *SettlementContract) dueInstructions(ctx contractapi.TransactionContextInterface, today string) ([]*SettlementInstruction, []*SettlementInstruction, error) {
+	pendingInstructions, err := s.GetPendingSettlementInstructions(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get pending instructions: %v", err)
+	}
+
+	var queue, awaiting []*SettlementInstruction
+	for _, instruction := range pendingInstructions {
+		// Parse settlement date
+		settlementDate, err := time.Parse(time.RFC3339, instruction.SettlementDate)
+		if err != nil {
+			continue // Skip if date can't be parsed
+		}
+
+		// Only instructions due or past due, comparing calendar days
+		if settlementDate.UTC().Format(calendarDateLayout) > today {
+			continue
+		}
+
+		eligible, err := s.applyAffirmationDeadline(ctx, instruction)
+		if err != nil {
+			return nil, nil, err
+		}
+		if eligible {
+			queue = append(queue, instruction)
+		} else {
+			awaiting = append(awaiting, instruction)
+		}
+	}
+
+	sort.SliceStable(queue, func(i, j int) bool {
+		a, b := queue[i], queue[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if a.SettlementDate != b.SettlementDate {
+			return a.SettlementDate < b.SettlementDate
+		}
+		if a.RecycleCount != b.RecycleCount {
+			return a.RecycleCount > b.RecycleCount
+		}
+		return a.TotalAmount > b.TotalAmount
+	})
+
+	return queue, awaiting, nil
+}
+
+// resolveGridlock looks for instructions, none of which can settle alone, that can settle
+// together. Small gridlocks are searched for the subset that settles the most value;
+// larger ones drop their lowest-priority instructions until the rest can settle. It returns
+// the book with the subset settled and the subset, or nil when nothing can settle.
+func (book *accountBook) resolveGridlock(ctx contractapi.TransactionContextInterface, s *SettlementContract, remaining []*SettlementInstruction, currentTime string) (*accountBook, []*SettlementInstruction) {
+	if len(remaining) < 2 {
+		return nil, nil
+	}
+
+	if len(remaining) > maxGridlockSearch {
+		for subset := remaining; len(subset) >= 2; subset = subset[:len(subset)-1] {
+			if trial := book.try(ctx, s, subset, currentTime); trial != nil {
+				return trial, subset
+			}
+		}
+		return nil, nil
+	}
+
+	var best *accountBook
+	var bestSubset []*SettlementInstruction
+	var bestValue Money
+	for mask := 1; mask < 1<<len(remaining); mask++ {
+		var subset []*SettlementInstruction
+		var value Money
+		for i, instruction := range remaining {
+			if mask&(1<<i) != 0 {
+				subset = append(subset, instruction)
+				value += instruction.TotalAmount
+			}
+		}
+
+		// Single instructions were already tried
+		if len(subset) < 2 || value <= bestValue {
+			continue
+		}
+		if trial := book.try(ctx, s, subset, currentTime); trial != nil {
+			best, bestSubset, bestValue = trial, subset, value
+		}
+	}
+
+	return best, bestSubset
+}
+
+// recordSettlement completes an instruction settled through an account book: it stores the
+// instruction and its settled trade, records the cash and securities transactions and
+// charges the settlement fees. A novated trade is settled with its second leg.
+func (s *SettlementContract) recordSettlement(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, currentTime string) error {
+	instruction.Status = "completed"
+	instruction.CompletedAt = currentTime
+	instruction.SettledQuantity = instruction.Quantity
+	instruction.SettledAmount = instruction.TotalAmount
+
+	err := s.putTransaction(ctx, &Transaction{
+		TransactionID: "transaction-cash-" + instruction.InstructionID,
+		Type:          "cash",
+		FromID:        instruction.BuyBrokerID,
+		ToID:          instruction.SellBrokerID,
+		FromClientID:  instruction.BuyClientID,
+		ToClientID:    instruction.SellClientID,
+		Amount:        instruction.TotalAmount,
+		InstructionID: instruction.InstructionID,
+		Status:        "completed",
+		Timestamp:     currentTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.putTransaction(ctx, &Transaction{
+		TransactionID: "transaction-securities-" + instruction.InstructionID,
+		Type:          "security",
+		FromID:        instruction.SellBrokerID,
+		ToID:          instruction.BuyBrokerID,
+		FromClientID:  instruction.SellClientID,
+		ToClientID:    instruction.BuyClientID,
+		SecurityID:    instruction.SecurityID,
+		Quantity:      instruction.Quantity,
+		InstructionID: instruction.InstructionID,
+		Status:        "completed",
+		Timestamp:     currentTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	instructionJSON, err := json.Marshal(instruction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settlement instruction: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(instruction.InstructionID, instructionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
+	}
+
+	err = s.chargeSettlementFees(ctx, instruction, instruction.TotalAmount, currentTime)
+	if err != nil {
+		return err
+	}
+
+	tradeSettled, err := s.novatedTradeSettled(ctx, instruction)
+	if err != nil {
+		return err
+	}
+	if !tradeSettled {
+		return nil
+	}
+
+	trade, err := s.GetTrade(ctx, instruction.TradeID)
+	if err != nil {
+		return fmt.Errorf("failed to get trade: %v", err)
+	}
+
+	trade.Status = "settled"
+
+	tradeJSON, err := json.Marshal(trade)
+	if err != nil {
+		return fmt.Errorf("failed to marshal trade: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(instruction.TradeID, tradeJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update trade in ledger: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+// queue_test.go - Tests of the settlement queue and gridlock resolution
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// setUpGridlock creates three affirmed instructions due on 2026-03-05. broker1 buys 800
+// SEC002 from broker2 for 2,000,000.00, more than its cash, and sells them back for
+// 800,000.00 before it holds them: neither settles alone, both settle together.
+// broker1 also buys 10 SEC002 for 10,000,000.00, which it can never pay.
+func setUpGridlock(t *testing.T, l *mockLedger) {
+	t.Helper()
+	s := &SettlementContract{}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	trades := []struct {
+		tradeID, buyBrokerID, sellBrokerID string
+		quantity                           int
+		price                              int64
+	}{
+		{"trade-1", "broker1", "broker2", 800, 250000},
+		{"trade-2", "broker2", "broker1", 800, 100000},
+		{"trade-3", "broker1", "broker2", 10, 100000000},
+	}
+	for _, trade := range trades {
+		trade := trade
+		l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+			return s.ImportTrade(ctx, trade.tradeID, "order-b", "order-s", trade.buyBrokerID, trade.sellBrokerID, "", "",
+				"SEC002", trade.quantity, trade.price, "pending", "2026-03-02T09:00:00Z", "")
+		})
+		l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, trade.tradeID) })
+	}
+	for _, brokerID := range []string{"broker1", "broker2"} {
+		brokerID := brokerID
+		l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateGuaranteeDeposit(ctx, brokerID, 100000) })
+	}
+
+	// Past the affirmation deadline, on the settlement date
+	l.now = time.Date(2026, 3, 5, 10, 0, 0, 0, time.UTC)
+}
+
+// runQueue runs the settlement queue
+func runQueue(t *testing.T, l *mockLedger, finalRun bool) *SettlementRun {
+	t.Helper()
+	s := &SettlementContract{}
+
+	var run *SettlementRun
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		run, err = s.RunSettlementQueue(ctx, finalRun)
+		return err
+	})
+	return run
+}
+
+// sorted returns a sorted copy of a list of IDs
+func sorted(ids []string) []string {
+	ids = append([]string{}, ids...)
+	sort.Strings(ids)
+	return ids
+}
+
+func TestGridlockSettlesTogether(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpGridlock(t, l)
+
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error {
+		_, err := s.RunSettlementQueue(ctx, false)
+		return err
+	})
+
+	run := runQueue(t, l, false)
+	gridlock := []string{"instruction-trade-1", "instruction-trade-2"}
+	if !reflect.DeepEqual(sorted(run.Gridlocked), gridlock) || !reflect.DeepEqual(sorted(run.Settled), gridlock) {
+		t.Fatalf("run settled %v, of which gridlocked %v; want %v", run.Settled, run.Gridlocked, gridlock)
+	}
+	if !reflect.DeepEqual(run.Recycled, []string{"instruction-trade-3"}) {
+		t.Fatalf("run recycled %v, want [instruction-trade-3]", run.Recycled)
+	}
+	if instruction := instructionOf(t, l, "instruction-trade-3"); instruction.Status != "validated" || instruction.RecycleCount != 1 {
+		t.Errorf("recycled instruction = %+v", instruction)
+	}
+
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		account, err := s.GetBrokerAccount(ctx, "broker1")
+		if err != nil {
+			return err
+		}
+		if account.Balance != 150000000-200000000+80000000 {
+			t.Errorf("broker1 balance = %v, want 300000.00", account.Balance)
+		}
+		return nil
+	})
+	if quantity := securitiesHeld(t, l, "broker1", "SEC002"); quantity != 0 {
+		t.Errorf("broker1 holds %d SEC002, want 0", quantity)
+	}
+}
+
+func TestSettlementRunReportsOutcomes(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpGridlock(t, l)
+
+	run := runQueue(t, l, false)
+	if run.BusinessDate != "2026-03-05" || run.FinalRun || run.TotalCash != 280000000 || run.TotalSecurities != 1600 {
+		t.Fatalf("run = %+v", run)
+	}
+
+	var final *SettlementRun
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error {
+		_, err := s.BatchSettlement(ctx)
+		return err
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		final, err = s.BatchSettlement(ctx)
+		return err
+	})
+	want := InstructionOutcome{
+		InstructionID: "instruction-trade-3",
+		TradeID:       "trade-3",
+		Outcome:       "failed",
+		ErrorCode:     errorCodeInsufficientFunds,
+	}
+	if !final.FinalRun || len(final.Outcomes) != 1 || *final.Outcomes[0] != want || !reflect.DeepEqual(final.Failed, []string{want.InstructionID}) {
+		t.Fatalf("final run = %+v", final)
+	}
+
+	// The runs are recorded for reconciliation
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		for _, r := range []*SettlementRun{run, final} {
+			stored, err := s.GetSettlementRun(ctx, r.RunID)
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(stored, r) {
+				t.Errorf("stored run = %+v, want %+v", stored, r)
+			}
+		}
+		return nil
+	})
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
@@ -16,86 +17,175 @@ type SettlementContract struct {
 
 // SettlementInstruction represents instructions for settlement
 type SettlementInstruction struct {
-	InstructionID  string  `json:"instructionID"`
-	TradeID        string  `json:"tradeID"`
-	BuyBrokerID    string  `json:"buyBrokerID"`
-	SellBrokerID   string  `json:"sellBrokerID"`
-	SecurityID     string  `json:"securityID"`
-	Quantity       int     `json:"quantity"`
-	Price          float64 `json:"price"`
-	TotalAmount    float64 `json:"totalAmount"`
-	Status         string  `json:"status"` // pending, validated, completed, failed
-	CreatedAt      string  `json:"createdAt"`
-	SettlementDate string  `json:"settlementDate"`
-	CompletedAt    string  `json:"completedAt"`
+	InstructionID  string `json:"instructionID"`
+	TradeID        string `json:"tradeID"`
+	BuyBrokerID    string `json:"buyBrokerID"`
+	SellBrokerID   string `json:"sellBrokerID"`
+	BuyClientID    string `json:"buyClientID"`  // empty for the broker's own (house) trades
+	SellClientID   string `json:"sellClientID"` // empty for the broker's own (house) trades
+	SecurityID     string `json:"securityID"`
+	Quantity       int    `json:"quantity"`
+	Price          Money  `json:"price"`
+	TotalAmount    Money  `json:"totalAmount"`
+	Status         string `json:"status"` // pending, validated, netted, completed, partially_settled, buy_in, bought_in, failed, cancelled
+	CreatedAt      string `json:"createdAt"`
+	TradeDate      string `json:"tradeDate"`      // YYYY-MM-DD
+	SettlementDays int    `json:"settlementDays"` // cycle applied, in business days (T+n)
+	SettlementDate string `json:"settlementDate"`
+	CompletedAt    string `json:"completedAt"`
+
+	// Affirmation of each side by its broker (see affirmations.go)
+	BuyAffirmation      string `json:"buyAffirmation"`  // "", affirmed, mismatched, deemed
+	SellAffirmation     string `json:"sellAffirmation"` // "", affirmed, mismatched, deemed
+	AffirmationDeadline string `json:"affirmationDeadline"`
+
+	// Holds on the buyer's cash and the seller's securities, released if the
+	// instruction is cancelled or fails (see lifecycle.go)
+	ReservedAmount   Money `json:"reservedAmount"`
+	ReservedQuantity int   `json:"reservedQuantity"`
+	HoldsPlaced      bool  `json:"holdsPlaced"` // false for instructions created before holds were recorded
+
+	// Cancellation and amendment by mutual consent (see lifecycle.go)
+	BuyCancelConsent  bool                  `json:"buyCancelConsent"`
+	SellCancelConsent bool                  `json:"sellCancelConsent"`
+	CancelReason      string                `json:"cancelReason"`
+	CancelledBy       string                `json:"cancelledBy"`
+	ProposedAmendment *InstructionAmendment `json:"proposedAmendment"`
+	AmendedBy         string                `json:"amendedBy"`
+	AmendedAt         string                `json:"amendedAt"`
+
+	// Partial settlement (see partial.go). A partially settled instruction records what
+	// settled and the child instruction carrying the remainder.
+	BuyAllowsPartial    bool   `json:"buyAllowsPartial"`
+	SellAllowsPartial   bool   `json:"sellAllowsPartial"`
+	SettledQuantity     int    `json:"settledQuantity"`
+	SettledAmount       Money  `json:"settledAmount"`
+	ParentInstructionID string `json:"parentInstructionID"`
+	ChildInstructionID  string `json:"childInstructionID"`
+	PartNumber          int    `json:"partNumber"`
+
+	// Netting (see netting.go). A netted instruction settles with its netting batch.
+	NettingBatchID string `json:"nettingBatchID"`
+
+	// Settlement queue (see queue.go). Higher priorities settle first; an instruction is
+	// recycled to the next run when it cannot settle yet.
+	Priority     int `json:"priority"`
+	RecycleCount int `json:"recycleCount"`
+
+	// Buy-in (see buyin.go) of an instruction the seller failed to deliver
+	BuyIn *BuyIn `json:"buyIn"`
+
+	// Novation (see ccp.go). In central counterparty mode a trade settles as a buy leg and a
+	// sell leg against the CCP, each naming the other.
+	NovatedLeg          string `json:"novatedLeg"` // "", buy, sell
+	PairedInstructionID string `json:"pairedInstructionID"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
 }
 
 // Trade represents a matched trade between buy and sell orders
 type Trade struct {
-	TradeID      string  `json:"tradeID"`
-	BuyOrderID   string  `json:"buyOrderID"`
-	SellOrderID  string  `json:"sellOrderID"`
-	BuyBrokerID  string  `json:"buyBrokerID"`
-	SellBrokerID string  `json:"sellBrokerID"`
-	SecurityID   string  `json:"securityID"`
-	Quantity     int     `json:"quantity"`
-	Price        float64 `json:"price"`
-	Status       string  `json:"status"` // pending, approved, rejected, settled
-	MatchTime    string  `json:"matchTime"`
+	TradeID      string `json:"tradeID"`
+	BuyOrderID   string `json:"buyOrderID"`
+	SellOrderID  string `json:"sellOrderID"`
+	BuyBrokerID  string `json:"buyBrokerID"`
+	SellBrokerID string `json:"sellBrokerID"`
+	BuyClientID  string `json:"buyClientID"`
+	SellClientID string `json:"sellClientID"`
+	SecurityID   string `json:"securityID"`
+	Quantity     int    `json:"quantity"`
+	Price        Money  `json:"price"`
+	Status       string `json:"status"` // pending, approved, rejected, partially_settled, settled, bought_in, cancelled
+	MatchTime    string `json:"matchTime"`
+	MakerSide    string `json:"makerSide"` // buy, sell; empty when the market did not report it
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
 }
 
-// BrokerAccount represents a broker's cash account
+// BrokerAccount represents a broker's cash account.
+// It is kept in the broker's private data collection (see collections.go).
 type BrokerAccount struct {
-	BrokerID        string  `json:"brokerID"`
-	Balance         float64 `json:"balance"`
-	ReservedBalance float64 `json:"reservedBalance"`
-	LastUpdated     string  `json:"lastUpdated"`
+	BrokerID        string `json:"brokerID"`
+	Balance         Money  `json:"balance"`
+	ReservedBalance Money  `json:"reservedBalance"`
+	ClientBalance   Money  `json:"clientBalance"` // part of Balance held for clients (omnibus total)
+	LastUpdated     string `json:"lastUpdated"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
 }
 
-// SecuritiesAccount represents a broker's securities account
+// SecuritiesAccount represents a broker's securities account.
+// It is kept in the broker's private data collection (see collections.go).
 type SecuritiesAccount struct {
 	AccountID   string `json:"accountID"`
 	BrokerID    string `json:"brokerID"`
 	SecurityID  string `json:"securityID"`
 	Quantity    int    `json:"quantity"`
 	ReservedQty int    `json:"reservedQty"`
+	ClientQty   int    `json:"clientQty"`  // part of Quantity held for clients (omnibus total)
+	PledgedQty  int    `json:"pledgedQty"` // own quantity pledged as guarantee collateral (see collateral.go)
 	LastUpdated string `json:"lastUpdated"`
 }
 
-// GuaranteeDeposit represents a broker's guarantee deposit with the exchange
+// GuaranteeDeposit represents a broker's guarantee deposit with the exchange.
+// It is kept in the broker's private data collection (see collections.go).
 type GuaranteeDeposit struct {
-	BrokerID    string  `json:"brokerID"`
-	Amount      float64 `json:"amount"`
-	LastUpdated string  `json:"lastUpdated"`
+	BrokerID    string `json:"brokerID"`
+	Amount      Money  `json:"amount"`
+	LastUpdated string `json:"lastUpdated"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
 }
 
-// GuaranteeFund represents the exchange's central guarantee fund
+// GuaranteeFund represents the exchange's central guarantee fund. TotalAmount is the
+// brokers' deposits and contributions and the exchange's skin in the game; losses beyond
+// them are the deficit (see defaults.go).
 type GuaranteeFund struct {
-	TotalAmount float64 `json:"totalAmount"`
-	LastUpdated string  `json:"lastUpdated"`
+	TotalAmount     Money  `json:"totalAmount"`
+	Contributions   Money  `json:"contributions"`   // brokers' mutualized contributions
+	SkinInTheGame   Money  `json:"skinInTheGame"`   // the exchange's own capital
+	Deficit         Money  `json:"deficit"`         // losses the waterfall could not absorb
+	DeficitAssessed Money  `json:"deficitAssessed"` // part of the deficit under replenishment assessments
+	LastUpdated     string `json:"lastUpdated"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
 }
 
 // Transaction represents a cash or security transaction
 type Transaction struct {
-	TransactionID string  `json:"transactionID"`
-	Type          string  `json:"type"`       // cash, security
-	FromID        string  `json:"fromID"`     // broker ID
-	ToID          string  `json:"toID"`       // broker ID
-	SecurityID    string  `json:"securityID"` // for security transactions
-	Amount        float64 `json:"amount"`     // cash amount or security quantity
-	InstructionID string  `json:"instructionID"`
-	Status        string  `json:"status"` // completed, failed
-	Timestamp     string  `json:"timestamp"`
+	TransactionID string `json:"transactionID"`
+	Type          string `json:"type"`         // cash, security
+	FromID        string `json:"fromID"`       // broker ID
+	ToID          string `json:"toID"`         // broker ID
+	FromClientID  string `json:"fromClientID"` // client ID, empty for house movements
+	ToClientID    string `json:"toClientID"`   // client ID, empty for house movements
+	SecurityID    string `json:"securityID"`   // for security transactions
+	Amount        Money  `json:"amount"`       // cash amount, for cash transactions
+	Quantity      int    `json:"quantity"`     // security quantity, for security transactions
+	InstructionID string `json:"instructionID"`
+	Status        string `json:"status"` // completed, failed
+	Timestamp     string `json:"timestamp"`
+
+	MoneySchema MoneySchema `json:"moneySchema"` // amounts are in centimes (see money.go)
 }
 
-// Helper function to get deterministic timestamp
-func (s *SettlementContract) getTransactionTimestamp(ctx contractapi.TransactionContextInterface) string {
+// getTxTime returns the proposal's transaction timestamp, which is the same on every
+// endorsing peer. The chaincode never reads the peer's clock, so endorsements agree.
+func (s *SettlementContract) getTxTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
 	timestamp, err := ctx.GetStub().GetTxTimestamp()
 	if err != nil {
-		// Fallback to current time if timestamp not available
-		return time.Now().Format(time.RFC3339)
+		return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %v", err)
 	}
-	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).Format(time.RFC3339)
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+}
+
+// Helper function to get deterministic timestamp
+func (s *SettlementContract) getTransactionTimestamp(ctx contractapi.TransactionContextInterface) (string, error) {
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	return txTime.Format(time.RFC3339), nil
 }
 
 // Helper function to get deterministic transaction ID
@@ -103,9 +193,82 @@ func (s *SettlementContract) getTransactionID(ctx contractapi.TransactionContext
 	return ctx.GetStub().GetTxID()
 }
 
+// nonBrokerParties are the Maroclear-side parties of transactions: deposits and withdrawals,
+// the initial allocation, the guarantee fund, netting and penalties. Fee accounts are too.
+var nonBrokerParties = map[string]bool{"external": true, "system": true, "guarantee": true, "netting": true, "penalties": true}
+
+// brokers returns the brokers whose cash or securities a transaction moves
+func (transaction *Transaction) brokers() []string {
+	var brokerIDs []string
+	for _, id := range []string{transaction.FromID, transaction.ToID} {
+		if nonBrokerParties[id] || strings.HasPrefix(id, "feeAccount-") {
+			continue
+		}
+		if len(brokerIDs) > 0 && brokerIDs[0] == id {
+			continue
+		}
+		brokerIDs = append(brokerIDs, id)
+	}
+	return brokerIDs
+}
+
+// putTransaction records a cash or security transaction in the collection of each broker
+// it moves cash or securities for, so amounts and quantities stay out of the world state
+func (s *SettlementContract) putTransaction(ctx contractapi.TransactionContextInterface, transaction *Transaction) error {
+	transactionJSON, err := json.Marshal(transaction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal transaction: %v", err)
+	}
+
+	for _, brokerID := range transaction.brokers() {
+		err = s.putPrivateState(ctx, brokerID, transaction.TransactionID, transactionJSON)
+		if err != nil {
+			return fmt.Errorf("failed to put transaction in collection: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// function to get the caller's organization
+func (s *SettlementContract) getClientOrgID(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get MSP ID: %v", err)
+	}
+
+	return mspID, nil
+}
+
+// brokerMSPID returns the MSP ID of the organization operating a broker (broker1 -> Broker1MSP)
+func brokerMSPID(brokerID string) string {
+	id := strings.ToLower(brokerID)
+	if id == "" {
+		return ""
+	}
+	return strings.ToUpper(id[:1]) + id[1:] + "MSP"
+}
+
+// authorizeBrokerOrMaroclear checks that the caller belongs to the broker's organization or to Maroclear
+func (s *SettlementContract) authorizeBrokerOrMaroclear(ctx contractapi.TransactionContextInterface, brokerID string) error {
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	if mspID != "MaroclearMSP" && mspID != brokerMSPID(brokerID) {
+		return fmt.Errorf("only %s or Maroclear can manage accounts of broker %s", brokerMSPID(brokerID), brokerID)
+	}
+
+	return nil
+}
+
 // InitializeBrokerSecurities creates initial securities holdings for brokers
 func (s *SettlementContract) InitializeBrokerSecurities(ctx contractapi.TransactionContextInterface) error {
-	currentTime := s.getTransactionTimestamp(ctx)
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
 	txID := s.getTransactionID(ctx)
 
 	// Define initial securities for Broker2
@@ -124,7 +287,7 @@ func (s *SettlementContract) InitializeBrokerSecurities(ctx contractapi.Transact
 		accountID := fmt.Sprintf("securitiesAccount-broker2-%s", security.SecurityID)
 
 		// Check if account already exists
-		existingAccountJSON, err := ctx.GetStub().GetState(accountID)
+		existingAccountJSON, err := s.getPrivateState(ctx, "broker2", accountID)
 		if err != nil {
 			return fmt.Errorf("failed to read existing securities account: %v", err)
 		}
@@ -140,14 +303,9 @@ func (s *SettlementContract) InitializeBrokerSecurities(ctx contractapi.Transact
 			existingAccount.Quantity += security.Quantity
 			existingAccount.LastUpdated = currentTime
 
-			updatedAccountJSON, err := json.Marshal(existingAccount)
-			if err != nil {
-				return fmt.Errorf("failed to marshal updated securities account: %v", err)
-			}
-
-			err = ctx.GetStub().PutState(accountID, updatedAccountJSON)
+			err = s.putSecuritiesAccount(ctx, &existingAccount)
 			if err != nil {
-				return fmt.Errorf("failed to update securities account in ledger: %v", err)
+				return fmt.Errorf("failed to update securities account: %v", err)
 			}
 		} else {
 			// Create new account
@@ -160,17 +318,15 @@ func (s *SettlementContract) InitializeBrokerSecurities(ctx contractapi.Transact
 				LastUpdated: currentTime,
 			}
 
-			accountJSON, err := json.Marshal(account)
-			if err != nil {
-				return fmt.Errorf("failed to marshal securities account: %v", err)
-			}
-
-			err = ctx.GetStub().PutState(accountID, accountJSON)
+			err = s.putSecuritiesAccount(ctx, &account)
 			if err != nil {
-				return fmt.Errorf("failed to put securities account in ledger: %v", err)
+				return fmt.Errorf("failed to store securities account: %v", err)
 			}
 		}
 
+		// The securities enter the ledger from their issuer
+		s.journalMove(ctx, journalIssuer, journalHolder("broker2", ""), security.SecurityID, int64(security.Quantity))
+
 		// Record the securities deposit transaction with deterministic ID
 		transactionID := fmt.Sprintf("transaction-init-securities-broker2-%s-%s-%d", security.SecurityID, txID, i)
 		transaction := Transaction{
@@ -179,37 +335,32 @@ func (s *SettlementContract) InitializeBrokerSecurities(ctx contractapi.Transact
 			FromID:        "system",
 			ToID:          "broker2",
 			SecurityID:    security.SecurityID,
-			Amount:        float64(security.Quantity),
+			Quantity:      security.Quantity,
 			InstructionID: "",
 			Status:        "completed",
 			Timestamp:     currentTime,
 		}
 
-		transactionJSON, err := json.Marshal(transaction)
+		err = s.putTransaction(ctx, &transaction)
 		if err != nil {
-			return fmt.Errorf("failed to marshal securities transaction: %v", err)
-		}
-
-		err = ctx.GetStub().PutState(transactionID, transactionJSON)
-		if err != nil {
-			return fmt.Errorf("failed to save securities transaction in ledger: %v", err)
+			return fmt.Errorf("failed to save securities transaction: %v", err)
 		}
 	}
 
 	// Initialize cash for brokers
 	brokerInitialBalances := []struct {
 		BrokerID string
-		Balance  float64
+		Balance  Money
 	}{
-		{"broker1", 1500000.0}, // 1.5 Million MAD for Broker1
-		{"broker2", 500000.0},  // 500,000 MAD for Broker2
+		{"broker1", 150000000}, // 1.5 Million MAD for Broker1
+		{"broker2", 50000000},  // 500,000 MAD for Broker2
 	}
 
 	for j, broker := range brokerInitialBalances {
 		accountID := fmt.Sprintf("brokerAccount-%s", broker.BrokerID)
 
 		// Check if account already exists
-		existingAccountJSON, err := ctx.GetStub().GetState(accountID)
+		existingAccountJSON, err := s.getPrivateState(ctx, broker.BrokerID, accountID)
 		if err != nil {
 			return fmt.Errorf("failed to read existing broker account: %v", err)
 		}
@@ -223,15 +374,12 @@ func (s *SettlementContract) InitializeBrokerSecurities(ctx contractapi.Transact
 				LastUpdated:     currentTime,
 			}
 
-			accountJSON, err := json.Marshal(account)
+			err = s.putBrokerAccount(ctx, &account)
 			if err != nil {
-				return fmt.Errorf("failed to marshal broker account: %v", err)
+				return fmt.Errorf("failed to store broker account: %v", err)
 			}
 
-			err = ctx.GetStub().PutState(accountID, accountJSON)
-			if err != nil {
-				return fmt.Errorf("failed to put broker account in ledger: %v", err)
-			}
+			s.journalMove(ctx, journalSystem, journalHolder(broker.BrokerID, ""), journalCash, int64(broker.Balance))
 
 			// Record the cash deposit transaction with deterministic ID
 			transactionID := fmt.Sprintf("transaction-init-cash-%s-%s-%d", broker.BrokerID, txID, j)
@@ -247,14 +395,9 @@ func (s *SettlementContract) InitializeBrokerSecurities(ctx contractapi.Transact
 				Timestamp:     currentTime,
 			}
 
-			transactionJSON, err := json.Marshal(transaction)
-			if err != nil {
-				return fmt.Errorf("failed to marshal cash transaction: %v", err)
-			}
-
-			err = ctx.GetStub().PutState(transactionID, transactionJSON)
+			err = s.putTransaction(ctx, &transaction)
 			if err != nil {
-				return fmt.Errorf("failed to save cash transaction in ledger: %v", err)
+				return fmt.Errorf("failed to save cash transaction: %v", err)
 			}
 		}
 	}
@@ -264,7 +407,10 @@ func (s *SettlementContract) InitializeBrokerSecurities(ctx contractapi.Transact
 
 // InitLedger initializes the ledger with sample data including broker securities
 func (s *SettlementContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
-	currentTime := s.getTransactionTimestamp(ctx)
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
 
 	// Initialize the guarantee fund
 	guaranteeFund := GuaranteeFund{
@@ -272,14 +418,9 @@ func (s *SettlementContract) InitLedger(ctx contractapi.TransactionContextInterf
 		LastUpdated: currentTime,
 	}
 
-	guaranteeFundJSON, err := json.Marshal(guaranteeFund)
-	if err != nil {
-		return fmt.Errorf("failed to marshal guarantee fund: %v", err)
-	}
-
-	err = ctx.GetStub().PutState("guaranteeFund", guaranteeFundJSON)
+	err = s.putGuaranteeFund(ctx, &guaranteeFund)
 	if err != nil {
-		return fmt.Errorf("failed to put guarantee fund in ledger: %v", err)
+		return err
 	}
 
 	// Initialize broker securities and accounts
@@ -291,19 +432,29 @@ func (s *SettlementContract) InitLedger(ctx contractapi.TransactionContextInterf
 	return nil
 }
 
-// CreateBrokerAccount creates a new broker account
-func (s *SettlementContract) CreateBrokerAccount(ctx contractapi.TransactionContextInterface, brokerID string, initialBalance float64) error {
+// CreateBrokerAccount creates a new broker account with an initial balance in centimes
+func (s *SettlementContract) CreateBrokerAccount(ctx contractapi.TransactionContextInterface, brokerID string, initialBalanceCentimes int64) error {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	initialBalance := Money(initialBalanceCentimes)
+
 	// Check if the broker account already exists
-	brokerAccountJSON, err := ctx.GetStub().GetState("brokerAccount-" + brokerID)
+	brokerAccountJSON, err := s.getPrivateState(ctx, brokerID, "brokerAccount-"+brokerID)
 	if err != nil {
-		return fmt.Errorf("failed to read from world state: %v", err)
+		return fmt.Errorf("failed to read from private data collection: %v", err)
 	}
 	if brokerAccountJSON != nil {
 		return fmt.Errorf("broker account %s already exists", brokerID)
 	}
 
 	// Create broker account
-	currentTime := time.Now().Format(time.RFC3339)
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
 	brokerAccount := BrokerAccount{
 		BrokerID:        brokerID,
 		Balance:         initialBalance,
@@ -312,24 +463,20 @@ func (s *SettlementContract) CreateBrokerAccount(ctx contractapi.TransactionCont
 	}
 
 	// Store broker account in ledger
-	brokerAccountJSON, err = json.Marshal(brokerAccount)
+	err = s.putBrokerAccount(ctx, &brokerAccount)
 	if err != nil {
-		return fmt.Errorf("failed to marshal broker account: %v", err)
-	}
-
-	err = ctx.GetStub().PutState("brokerAccount-"+brokerID, brokerAccountJSON)
-	if err != nil {
-		return fmt.Errorf("failed to put broker account in ledger: %v", err)
+		return fmt.Errorf("failed to store broker account: %v", err)
 	}
+	s.journalMove(ctx, journalSystem, journalHolder(brokerID, ""), journalCash, int64(initialBalance))
 
 	return nil
 }
 
 // GetBrokerAccount retrieves a broker account by ID
 func (s *SettlementContract) GetBrokerAccount(ctx contractapi.TransactionContextInterface, brokerID string) (*BrokerAccount, error) {
-	brokerAccountJSON, err := ctx.GetStub().GetState("brokerAccount-" + brokerID)
+	brokerAccountJSON, err := s.getPrivateState(ctx, brokerID, "brokerAccount-"+brokerID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from world state: %v", err)
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
 	}
 	if brokerAccountJSON == nil {
 		return nil, fmt.Errorf("broker account %s does not exist", brokerID)
@@ -346,20 +493,28 @@ func (s *SettlementContract) GetBrokerAccount(ctx contractapi.TransactionContext
 
 // CreateSecuritiesAccount creates a new securities account for a broker and security
 func (s *SettlementContract) CreateSecuritiesAccount(ctx contractapi.TransactionContextInterface, brokerID, securityID string, initialQuantity int) error {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
 	// Create account ID
 	accountID := "securitiesAccount-" + brokerID + "-" + securityID
 
 	// Check if the account already exists
-	accountJSON, err := ctx.GetStub().GetState(accountID)
+	accountJSON, err := s.getPrivateState(ctx, brokerID, accountID)
 	if err != nil {
-		return fmt.Errorf("failed to read from world state: %v", err)
+		return fmt.Errorf("failed to read from private data collection: %v", err)
 	}
 	if accountJSON != nil {
 		return fmt.Errorf("securities account for broker %s and security %s already exists", brokerID, securityID)
 	}
 
 	// Create securities account
-	currentTime := time.Now().Format(time.RFC3339)
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
 	account := SecuritiesAccount{
 		AccountID:   accountID,
 		BrokerID:    brokerID,
@@ -370,15 +525,11 @@ func (s *SettlementContract) CreateSecuritiesAccount(ctx contractapi.Transaction
 	}
 
 	// Store account in ledger
-	accountJSON, err = json.Marshal(account)
-	if err != nil {
-		return fmt.Errorf("failed to marshal securities account: %v", err)
-	}
-
-	err = ctx.GetStub().PutState(accountID, accountJSON)
+	err = s.putSecuritiesAccount(ctx, &account)
 	if err != nil {
-		return fmt.Errorf("failed to put securities account in ledger: %v", err)
+		return fmt.Errorf("failed to store securities account: %v", err)
 	}
+	s.journalMove(ctx, journalIssuer, journalHolder(brokerID, ""), securityID, int64(initialQuantity))
 
 	return nil
 }
@@ -386,9 +537,9 @@ func (s *SettlementContract) CreateSecuritiesAccount(ctx contractapi.Transaction
 // GetSecuritiesAccount retrieves a securities account by broker ID and security ID
 func (s *SettlementContract) GetSecuritiesAccount(ctx contractapi.TransactionContextInterface, brokerID, securityID string) (*SecuritiesAccount, error) {
 	accountID := "securitiesAccount-" + brokerID + "-" + securityID
-	accountJSON, err := ctx.GetStub().GetState(accountID)
+	accountJSON, err := s.getPrivateState(ctx, brokerID, accountID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from world state: %v", err)
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
 	}
 	if accountJSON == nil {
 		return nil, fmt.Errorf("securities account for broker %s and security %s does not exist", brokerID, securityID)
@@ -403,19 +554,29 @@ func (s *SettlementContract) GetSecuritiesAccount(ctx contractapi.TransactionCon
 	return &account, nil
 }
 
-// CreateGuaranteeDeposit creates a new guarantee deposit for a broker
-func (s *SettlementContract) CreateGuaranteeDeposit(ctx contractapi.TransactionContextInterface, brokerID string, initialAmount float64) error {
+// CreateGuaranteeDeposit creates a new guarantee deposit for a broker (amount in centimes)
+func (s *SettlementContract) CreateGuaranteeDeposit(ctx contractapi.TransactionContextInterface, brokerID string, initialAmountCentimes int64) error {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	initialAmount := Money(initialAmountCentimes)
+
 	// Check if the deposit already exists
-	depositJSON, err := ctx.GetStub().GetState("guaranteeDeposit-" + brokerID)
+	depositJSON, err := s.getPrivateState(ctx, brokerID, "guaranteeDeposit-"+brokerID)
 	if err != nil {
-		return fmt.Errorf("failed to read from world state: %v", err)
+		return fmt.Errorf("failed to read from private data collection: %v", err)
 	}
 	if depositJSON != nil {
 		return fmt.Errorf("guarantee deposit for broker %s already exists", brokerID)
 	}
 
 	// Create guarantee deposit
-	currentTime := time.Now().Format(time.RFC3339)
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
 	deposit := GuaranteeDeposit{
 		BrokerID:    brokerID,
 		Amount:      initialAmount,
@@ -423,15 +584,11 @@ func (s *SettlementContract) CreateGuaranteeDeposit(ctx contractapi.TransactionC
 	}
 
 	// Store deposit in ledger
-	depositJSON, err = json.Marshal(deposit)
+	err = s.putGuaranteeDeposit(ctx, &deposit)
 	if err != nil {
-		return fmt.Errorf("failed to marshal guarantee deposit: %v", err)
-	}
-
-	err = ctx.GetStub().PutState("guaranteeDeposit-"+brokerID, depositJSON)
-	if err != nil {
-		return fmt.Errorf("failed to put guarantee deposit in ledger: %v", err)
+		return fmt.Errorf("failed to store guarantee deposit: %v", err)
 	}
+	s.journalMove(ctx, journalSystem, journalAccount(journalGuaranteeDeposit, brokerID), journalCash, int64(initialAmount))
 
 	// Update guarantee fund
 	guaranteeFund, err := s.GetGuaranteeFund(ctx)
@@ -442,14 +599,9 @@ func (s *SettlementContract) CreateGuaranteeDeposit(ctx contractapi.TransactionC
 	guaranteeFund.TotalAmount += initialAmount
 	guaranteeFund.LastUpdated = currentTime
 
-	guaranteeFundJSON, err := json.Marshal(guaranteeFund)
+	err = s.putGuaranteeFund(ctx, guaranteeFund)
 	if err != nil {
-		return fmt.Errorf("failed to marshal guarantee fund: %v", err)
-	}
-
-	err = ctx.GetStub().PutState("guaranteeFund", guaranteeFundJSON)
-	if err != nil {
-		return fmt.Errorf("failed to update guarantee fund in ledger: %v", err)
+		return err
 	}
 
 	return nil
@@ -457,9 +609,9 @@ func (s *SettlementContract) CreateGuaranteeDeposit(ctx contractapi.TransactionC
 
 // GetGuaranteeDeposit retrieves a guarantee deposit by broker ID
 func (s *SettlementContract) GetGuaranteeDeposit(ctx contractapi.TransactionContextInterface, brokerID string) (*GuaranteeDeposit, error) {
-	depositJSON, err := ctx.GetStub().GetState("guaranteeDeposit-" + brokerID)
+	depositJSON, err := s.getPrivateState(ctx, brokerID, "guaranteeDeposit-"+brokerID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from world state: %v", err)
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
 	}
 	if depositJSON == nil {
 		return nil, fmt.Errorf("guarantee deposit for broker %s does not exist", brokerID)
@@ -493,8 +645,17 @@ func (s *SettlementContract) GetGuaranteeFund(ctx contractapi.TransactionContext
 	return &guaranteeFund, nil
 }
 
-// DepositGuarantee allows a broker to deposit additional funds to their guarantee deposit
-func (s *SettlementContract) DepositGuarantee(ctx contractapi.TransactionContextInterface, brokerID string, amount float64) error {
+// DepositGuarantee allows a broker to deposit additional funds to their guarantee deposit (amount in centimes)
+func (s *SettlementContract) DepositGuarantee(ctx contractapi.TransactionContextInterface, brokerID string, amountCentimes int64) error {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	// Margin calls are checked against the deposit after the top-up
+	ctx = withWriteCache(ctx)
+
+	amount := Money(amountCentimes)
 	if amount <= 0 {
 		return fmt.Errorf("deposit amount must be positive")
 	}
@@ -505,9 +666,10 @@ func (s *SettlementContract) DepositGuarantee(ctx contractapi.TransactionContext
 		return fmt.Errorf("failed to get broker account: %v", err)
 	}
 
-	// Check if broker has sufficient funds
-	if brokerAccount.Balance < amount {
-		return fmt.Errorf("insufficient funds in broker account")
+	// Check if broker has sufficient available funds of its own; client funds and funds
+	// held for settlement cannot be pledged
+	if brokerAccount.available() < amount {
+		return fmt.Errorf("insufficient available balance in broker account")
 	}
 
 	// Get guarantee deposit
@@ -524,7 +686,10 @@ func (s *SettlementContract) DepositGuarantee(ctx contractapi.TransactionContext
 
 	// Update broker account
 	brokerAccount.Balance -= amount
-	brokerAccount.LastUpdated = time.Now().Format(time.RFC3339)
+	brokerAccount.LastUpdated, err = s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
 
 	// Update guarantee deposit
 	deposit.Amount += amount
@@ -535,39 +700,25 @@ func (s *SettlementContract) DepositGuarantee(ctx contractapi.TransactionContext
 	guaranteeFund.LastUpdated = brokerAccount.LastUpdated
 
 	// Store updated broker account
-	brokerAccountJSON, err := json.Marshal(brokerAccount)
-	if err != nil {
-		return fmt.Errorf("failed to marshal broker account: %v", err)
-	}
-
-	err = ctx.GetStub().PutState("brokerAccount-"+brokerID, brokerAccountJSON)
+	err = s.putBrokerAccount(ctx, brokerAccount)
 	if err != nil {
-		return fmt.Errorf("failed to update broker account in ledger: %v", err)
+		return fmt.Errorf("failed to update broker account: %v", err)
 	}
 
 	// Store updated guarantee deposit
-	depositJSON, err := json.Marshal(deposit)
-	if err != nil {
-		return fmt.Errorf("failed to marshal guarantee deposit: %v", err)
-	}
-
-	err = ctx.GetStub().PutState("guaranteeDeposit-"+brokerID, depositJSON)
-	if err != nil {
-		return fmt.Errorf("failed to update guarantee deposit in ledger: %v", err)
-	}
-
-	// Store updated guarantee fund
-	guaranteeFundJSON, err := json.Marshal(guaranteeFund)
+	err = s.putGuaranteeDeposit(ctx, deposit)
 	if err != nil {
-		return fmt.Errorf("failed to marshal guarantee fund: %v", err)
+		return fmt.Errorf("failed to update guarantee deposit: %v", err)
 	}
+	s.journalMove(ctx, journalHolder(brokerID, ""), journalAccount(journalGuaranteeDeposit, brokerID), journalCash, int64(amount))
 
-	err = ctx.GetStub().PutState("guaranteeFund", guaranteeFundJSON)
+	err = s.putGuaranteeFund(ctx, guaranteeFund)
 	if err != nil {
-		return fmt.Errorf("failed to update guarantee fund in ledger: %v", err)
+		return err
 	}
 
-	return nil
+	// A top-up meets the broker's open margin call and lifts its restriction once covered
+	return s.applyMarginTopUp(ctx, brokerID, deposit.LastUpdated)
 }
 
 func (s *SettlementContract) CreateSettlementInstruction(ctx contractapi.TransactionContextInterface, tradeID string) error {
@@ -581,6 +732,14 @@ func (s *SettlementContract) CreateSettlementInstruction(ctx contractapi.Transac
 		return fmt.Errorf("settlement instruction for trade %s already exists", tradeID)
 	}
 
+	novation, err := s.getNovation(ctx, tradeID)
+	if err != nil {
+		return err
+	}
+	if novation != nil {
+		return fmt.Errorf("trade %s was already novated into %s and %s", tradeID, novation.BuyLegID, novation.SellLegID)
+	}
+
 	// Get the trade
 	tradeJSON, err := ctx.GetStub().GetState(tradeID)
 	if err != nil {
@@ -602,96 +761,89 @@ func (s *SettlementContract) CreateSettlementInstruction(ctx contractapi.Transac
 	}
 
 	// Calculate total amount
-	totalAmount := float64(trade.Quantity) * trade.Price
+	totalAmount := trade.Price.Times(trade.Quantity)
 
 	// Create settlement instruction
-	currentTime := time.Now().Format(time.RFC3339)
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	currentTime := txTime.Format(time.RFC3339)
 
-	// Set settlement date to T+3 (in a real system, this would account for business days)
-	settlementDate := time.Now().AddDate(0, 0, 3).Format(time.RFC3339)
+	// The trade date is the day the trade was matched
+	tradeDate, err := time.Parse(time.RFC3339, trade.MatchTime)
+	if err != nil {
+		return fmt.Errorf("match time %q of trade %s is not an RFC3339 time: %v", trade.MatchTime, tradeID, err)
+	}
+	tradeDate = tradeDate.UTC()
+
+	// Settle T+n business days after the trade date, n being the cycle of the security's class
+	settlementDate, settlementDays, err := s.settlementDateFor(ctx, trade.SecurityID, tradeDate)
+	if err != nil {
+		return err
+	}
+
+	// Both brokers must affirm the instruction by the end of the trade date
+	affirmationDeadline := affirmationDeadlineFor(tradeDate)
 
 	instruction := SettlementInstruction{
 		InstructionID:  instructionID,
 		TradeID:        tradeID,
 		BuyBrokerID:    trade.BuyBrokerID,
 		SellBrokerID:   trade.SellBrokerID,
+		BuyClientID:    trade.BuyClientID,
+		SellClientID:   trade.SellClientID,
 		SecurityID:     trade.SecurityID,
 		Quantity:       trade.Quantity,
 		Price:          trade.Price,
 		TotalAmount:    totalAmount,
 		Status:         "pending",
 		CreatedAt:      currentTime,
-		SettlementDate: settlementDate,
+		TradeDate:      tradeDate.Format(calendarDateLayout),
+		SettlementDays: settlementDays,
+		SettlementDate: settlementDate.Format(time.RFC3339),
 		CompletedAt:    "",
-	}
 
-	// Store the instruction in ledger
-	instructionJSON, err = json.Marshal(instruction)
-	if err != nil {
-		return fmt.Errorf("failed to marshal settlement instruction: %v", err)
+		AffirmationDeadline: affirmationDeadline.Format(time.RFC3339),
 	}
 
-	err = ctx.GetStub().PutState(instructionID, instructionJSON)
+	// In central counterparty mode the trade settles as two legs against the CCP
+	clearingMode, err := s.GetClearingMode(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to put settlement instruction in ledger: %v", err)
-	}
-
-	// Reserve funds for the buyer
-	buyerAccount, err := s.GetBrokerAccount(ctx, trade.BuyBrokerID)
-	if err != nil {
-		// If account doesn't exist, create it
-		err = s.CreateBrokerAccount(ctx, trade.BuyBrokerID, 0)
-		if err != nil {
-			return fmt.Errorf("failed to create buyer broker account: %v", err)
-		}
-		buyerAccount, err = s.GetBrokerAccount(ctx, trade.BuyBrokerID)
-		if err != nil {
-			return fmt.Errorf("failed to get buyer broker account: %v", err)
-		}
+		return err
 	}
-
-	// Check if buyer has sufficient funds
-	if buyerAccount.Balance < totalAmount {
-		return fmt.Errorf("buyer broker does not have sufficient funds for settlement")
+	if clearingMode.Mode == clearingModeCCP {
+		return s.novateInstruction(ctx, &instruction, currentTime)
 	}
 
-	// Reserve the funds
-	buyerAccount.ReservedBalance += totalAmount
-	buyerAccount.LastUpdated = currentTime
-
-	buyerAccountJSON, err := json.Marshal(buyerAccount)
+	// Load the client sub-accounts; clients must have passed KYC to settle
+	legs, err := s.loadClientLegs(ctx, &instruction)
 	if err != nil {
-		return fmt.Errorf("failed to marshal buyer broker account: %v", err)
+		return fmt.Errorf("failed to load client accounts: %v", err)
 	}
 
-	err = ctx.GetStub().PutState("brokerAccount-"+trade.BuyBrokerID, buyerAccountJSON)
+	// Hold the buyer's available funds and the seller's available securities
+	holds, err := s.loadInstructionHolds(ctx, &instruction, legs)
 	if err != nil {
-		return fmt.Errorf("failed to update buyer broker account: %v", err)
+		return err
 	}
 
-	// Reserve securities for the seller
-	sellerSecuritiesAccount, err := s.GetSecuritiesAccount(ctx, trade.SellBrokerID, trade.SecurityID)
-	if err != nil {
-		return fmt.Errorf("seller broker does not have securities account for this security: %v", err)
-	}
+	holds.reserve(&instruction, currentTime)
 
-	// Check if seller has sufficient securities
-	if sellerSecuritiesAccount.Quantity < trade.Quantity {
-		return fmt.Errorf("seller broker does not have sufficient securities for settlement")
+	err = holds.save(ctx, s)
+	if err != nil {
+		return err
 	}
 
-	// Reserve the securities
-	sellerSecuritiesAccount.ReservedQty += trade.Quantity
-	sellerSecuritiesAccount.LastUpdated = currentTime
-
-	sellerSecuritiesAccountJSON, err := json.Marshal(sellerSecuritiesAccount)
+	// Store the instruction in ledger
+	instructionJSON, err = json.Marshal(instruction)
 	if err != nil {
-		return fmt.Errorf("failed to marshal seller securities account: %v", err)
+		return fmt.Errorf("failed to marshal settlement instruction: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(sellerSecuritiesAccount.AccountID, sellerSecuritiesAccountJSON)
+	err = ctx.GetStub().PutState(instructionID, instructionJSON)
 	if err != nil {
-		return fmt.Errorf("failed to update seller securities account: %v", err)
+		return fmt.Errorf("failed to put settlement instruction in ledger: %v", err)
 	}
 
 	// Emit an event for the settlement instruction creation
@@ -722,7 +874,9 @@ func (s *SettlementContract) GetSettlementInstruction(ctx contractapi.Transactio
 	return &instruction, nil
 }
 
-// ValidateSettlementInstruction allows brokers to validate a settlement instruction
+// ValidateSettlementInstruction validates a settlement instruction whose affirmation
+// deadline has passed. Instructions affirmed by both brokers through AffirmInstruction
+// are validated as soon as the second side affirms.
 func (s *SettlementContract) ValidateSettlementInstruction(ctx contractapi.TransactionContextInterface, instructionID string) error {
 	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
 	if err != nil {
@@ -734,8 +888,15 @@ func (s *SettlementContract) ValidateSettlementInstruction(ctx contractapi.Trans
 		return fmt.Errorf("only pending instructions can be validated, current status: %s", instruction.Status)
 	}
 
-	// Update instruction status
-	instruction.Status = "validated"
+	// Update instruction status once both sides affirmed or the deadline passed
+	eligible, err := s.applyAffirmationDeadline(ctx, instruction)
+	if err != nil {
+		return err
+	}
+	if !eligible {
+		return fmt.Errorf("instruction %s is awaiting affirmation until %s (buy side: %q, sell side: %q)",
+			instructionID, instruction.AffirmationDeadline, instruction.BuyAffirmation, instruction.SellAffirmation)
+	}
 
 	// Store the updated instruction
 	instructionJSON, err := json.Marshal(instruction)
@@ -776,8 +937,44 @@ func (s *SettlementContract) GetTrade(ctx contractapi.TransactionContextInterfac
 	return &trade, nil
 }
 
-// ExecuteSettlement executes the settlement for a given instruction
+// ExecuteSettlement settles an instruction outside the settlement runs, once its settlement
+// date has come. Maroclear or either broker of the instruction can submit it. An instruction
+// that cannot settle stays in the settlement queue: only the final settlement run fails it.
 func (s *SettlementContract) ExecuteSettlement(ctx contractapi.TransactionContextInterface, instructionID string) error {
+	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
+	if err != nil {
+		return err
+	}
+
+	mspID, err := s.getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != "MaroclearMSP" && len(instructionSides(instruction, mspID)) == 0 {
+		return fmt.Errorf("only Maroclear or the brokers of instruction %s can settle it", instructionID)
+	}
+
+	settlementDate, err := time.Parse(time.RFC3339, instruction.SettlementDate)
+	if err != nil {
+		return fmt.Errorf("invalid settlement date %s of instruction %s: %v", instruction.SettlementDate, instructionID, err)
+	}
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	if settlementDate.UTC().Format(calendarDateLayout) > txTime.Format(calendarDateLayout) {
+		return fmt.Errorf("instruction %s settles on %s", instructionID, settlementDate.UTC().Format(calendarDateLayout))
+	}
+
+	return s.executeSettlement(ctx, instructionID, false)
+}
+
+// executeSettlement settles an instruction. When it cannot settle, it fails if failUnsettled
+// is set (the final settlement run), and is otherwise left in the queue with an error.
+func (s *SettlementContract) executeSettlement(ctx contractapi.TransactionContextInterface, instructionID string, failUnsettled bool) error {
+	// Settlement fees are collected from the accounts as left by the settlement
+	ctx = withWriteCache(ctx)
+
 	// Get the instruction
 	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
 	if err != nil {
@@ -789,7 +986,30 @@ func (s *SettlementContract) ExecuteSettlement(ctx contractapi.TransactionContex
 		return fmt.Errorf("only validated or pending instructions can be executed, current status: %s", instruction.Status)
 	}
 
-	currentTime := time.Now().Format(time.RFC3339)
+	// Pending instructions need both affirmations, or their affirmation deadline to have passed
+	eligible, err := s.applyAffirmationDeadline(ctx, instruction)
+	if err != nil {
+		return err
+	}
+	if !eligible {
+		return fmt.Errorf("instruction %s is awaiting affirmation until %s", instructionID, instruction.AffirmationDeadline)
+	}
+
+	// Brokers that missed a margin call cannot settle until they meet it
+	err = s.requireUnrestricted(ctx, instruction.BuyBrokerID, instruction.SellBrokerID)
+	if err != nil {
+		return err
+	}
+
+	// A novated leg settles with its paired leg through the CCP
+	if instruction.NovatedLeg != "" {
+		return s.executeNovatedSettlement(ctx, instruction, failUnsettled)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
 
 	// 1. Transfer funds from buyer to seller
 	buyerAccount, err := s.GetBrokerAccount(ctx, instruction.BuyBrokerID)
@@ -797,19 +1017,28 @@ func (s *SettlementContract) ExecuteSettlement(ctx contractapi.TransactionContex
 		return fmt.Errorf("failed to get buyer broker account: %v", err)
 	}
 
-	// Verify buyer has sufficient funds
-	if buyerAccount.Balance < instruction.TotalAmount {
-		return s.ProcessFail(ctx, instructionID, "buyer_insufficient_funds")
+	// Load the client sub-accounts settled by this instruction
+	legs, err := s.loadClientLegs(ctx, instruction)
+	if err != nil {
+		return fmt.Errorf("failed to load client accounts: %v", err)
 	}
 
-	sellerAccount, err := s.GetBrokerAccount(ctx, instruction.SellBrokerID)
-	if err != nil {
-		// If seller account doesn't exist, create it
-		err = s.CreateBrokerAccount(ctx, instruction.SellBrokerID, 0)
-		if err != nil {
-			return fmt.Errorf("failed to create seller broker account: %v", err)
-		}
-		sellerAccount, err = s.GetBrokerAccount(ctx, instruction.SellBrokerID)
+	// The instruction's own holds are available to it, on top of the available balance
+	heldAmount, heldQuantity := instruction.heldAmounts()
+
+	var cashAvailable Money
+	if legs.buyerCash != nil {
+		cashAvailable = legs.buyerCash.available() + heldAmount
+	} else {
+		cashAvailable = buyerAccount.available() + heldAmount
+	}
+
+	// Two clients of the same broker settle against one cash and one securities account
+	sameBroker := instruction.BuyBrokerID == instruction.SellBrokerID
+
+	sellerAccount := buyerAccount
+	if !sameBroker {
+		sellerAccount, err = s.getOrNewBrokerAccount(ctx, instruction.SellBrokerID)
 		if err != nil {
 			return fmt.Errorf("failed to get seller broker account: %v", err)
 		}
@@ -821,50 +1050,109 @@ func (s *SettlementContract) ExecuteSettlement(ctx contractapi.TransactionContex
 		return fmt.Errorf("failed to get seller securities account: %v", err)
 	}
 
-	// Verify seller has sufficient securities
-	if sellerSecuritiesAccount.Quantity < instruction.Quantity {
-		return s.ProcessFail(ctx, instructionID, "seller_insufficient_securities")
+	var securitiesAvailable int
+	if legs.sellerSecurities != nil {
+		securitiesAvailable = legs.sellerSecurities.available() + heldQuantity
+	} else {
+		securitiesAvailable = sellerSecuritiesAccount.available() + heldQuantity
 	}
 
-	buyerSecuritiesAccount, err := s.GetSecuritiesAccount(ctx, instruction.BuyBrokerID, instruction.SecurityID)
-	if err != nil {
-		// If buyer securities account doesn't exist, create it
-		err = s.CreateSecuritiesAccount(ctx, instruction.BuyBrokerID, instruction.SecurityID, 0)
+	// Settle in full when both sides are provisioned, otherwise settle partially if both
+	// brokers opted in and the thresholds are met, otherwise fail
+	quantity, amount := instruction.Quantity, instruction.TotalAmount
+	if cashAvailable < amount || securitiesAvailable < quantity {
+		quantity, err = s.partialQuantity(ctx, instruction, cashAvailable, securitiesAvailable)
 		if err != nil {
-			return fmt.Errorf("failed to create buyer securities account: %v", err)
+			return err
 		}
-		buyerSecuritiesAccount, err = s.GetSecuritiesAccount(ctx, instruction.BuyBrokerID, instruction.SecurityID)
+		if quantity == 0 {
+			failureReason := "seller_insufficient_securities"
+			if cashAvailable < amount {
+				failureReason = "buyer_insufficient_funds"
+			}
+			if !failUnsettled {
+				return fmt.Errorf("instruction %s cannot settle (%s) and stays in the settlement queue", instructionID, failureReason)
+			}
+			return s.processFail(ctx, instructionID, failureReason)
+		}
+		amount = instruction.Price.Times(quantity)
+	}
+
+	// The settled part consumes the holds first; what it does not consume stays held
+	consumedAmount, consumedQuantity := amount, quantity
+	if heldAmount < consumedAmount {
+		consumedAmount = heldAmount
+	}
+	if heldQuantity < consumedQuantity {
+		consumedQuantity = heldQuantity
+	}
+
+	buyerSecuritiesAccount := sellerSecuritiesAccount
+	if !sameBroker {
+		buyerSecuritiesAccount, err = s.getOrNewSecuritiesAccount(ctx, instruction.BuyBrokerID, instruction.SecurityID)
 		if err != nil {
 			return fmt.Errorf("failed to get buyer securities account: %v", err)
 		}
 	}
 
-	// Update accounts
+	// Update accounts, consuming the holds placed when the instruction was created
+	instruction.ReservedAmount = 0
+	instruction.ReservedQuantity = 0
+
 	// 1. Update cash accounts
-	buyerAccount.Balance -= instruction.TotalAmount
-	buyerAccount.ReservedBalance -= instruction.TotalAmount
+	buyerAccount.Balance -= amount
+	if instruction.BuyClientID == "" {
+		buyerAccount.ReservedBalance -= consumedAmount
+	}
 	buyerAccount.LastUpdated = currentTime
 
-	sellerAccount.Balance += instruction.TotalAmount
+	sellerAccount.Balance += amount
 	sellerAccount.LastUpdated = currentTime
 
 	// 2. Update securities accounts
-	sellerSecuritiesAccount.Quantity -= instruction.Quantity
-	sellerSecuritiesAccount.ReservedQty -= instruction.Quantity
+	sellerSecuritiesAccount.Quantity -= quantity
+	if instruction.SellClientID == "" {
+		sellerSecuritiesAccount.ReservedQty -= consumedQuantity
+	}
 	sellerSecuritiesAccount.LastUpdated = currentTime
 
-	buyerSecuritiesAccount.Quantity += instruction.Quantity
+	buyerSecuritiesAccount.Quantity += quantity
 	buyerSecuritiesAccount.LastUpdated = currentTime
 
-	// 3. Create transactions for funds and securities
+	// 3. Post to client sub-accounts and keep the broker-level client totals in step
+	if legs.buyerCash != nil {
+		legs.buyerCash.Balance -= amount
+		legs.buyerCash.ReservedBalance -= consumedAmount
+		legs.buyerCash.LastUpdated = currentTime
+		buyerAccount.ClientBalance -= amount
+
+		legs.buyerSecurities.Quantity += quantity
+		legs.buyerSecurities.LastUpdated = currentTime
+		buyerSecuritiesAccount.ClientQty += quantity
+	}
+
+	if legs.sellerCash != nil {
+		legs.sellerCash.Balance += amount
+		legs.sellerCash.LastUpdated = currentTime
+		sellerAccount.ClientBalance += amount
+
+		legs.sellerSecurities.Quantity -= quantity
+		legs.sellerSecurities.ReservedQty -= consumedQuantity
+		legs.sellerSecurities.LastUpdated = currentTime
+		sellerSecuritiesAccount.ClientQty -= quantity
+	}
+
+	// 4. Create transactions for funds and securities
 	cashTransactionID := "transaction-cash-" + instruction.InstructionID
 	cashTransaction := Transaction{
 		TransactionID: cashTransactionID,
 		Type:          "cash",
 		FromID:        instruction.BuyBrokerID,
 		ToID:          instruction.SellBrokerID,
+		FromClientID:  instruction.BuyClientID,
+		ToClientID:    instruction.SellClientID,
 		SecurityID:    "",
-		Amount:        instruction.TotalAmount,
+		Amount:        amount,
 		InstructionID: instruction.InstructionID,
 		Status:        "completed",
 		Timestamp:     currentTime,
@@ -876,18 +1164,22 @@ func (s *SettlementContract) ExecuteSettlement(ctx contractapi.TransactionContex
 		Type:          "security",
 		FromID:        instruction.SellBrokerID,
 		ToID:          instruction.BuyBrokerID,
+		FromClientID:  instruction.SellClientID,
+		ToClientID:    instruction.BuyClientID,
 		SecurityID:    instruction.SecurityID,
-		Amount:        float64(instruction.Quantity),
+		Quantity:      quantity,
 		InstructionID: instruction.InstructionID,
 		Status:        "completed",
 		Timestamp:     currentTime,
 	}
 
-	// 4. Update instruction status
+	// 5. Update instruction status
 	instruction.Status = "completed"
 	instruction.CompletedAt = currentTime
+	instruction.SettledQuantity = quantity
+	instruction.SettledAmount = amount
 
-	// 5. Update trade status
+	// 6. Update trade status
 	trade, err := s.GetTrade(ctx, instruction.TradeID)
 	if err != nil {
 		return fmt.Errorf("failed to get trade: %v", err)
@@ -895,68 +1187,74 @@ func (s *SettlementContract) ExecuteSettlement(ctx contractapi.TransactionContex
 
 	trade.Status = "settled"
 
-	// 6. Save all changes to ledger
-	// Save broker accounts
-	buyerAccountJSON, err := json.Marshal(buyerAccount)
-	if err != nil {
-		return fmt.Errorf("failed to marshal buyer broker account: %v", err)
-	}
+	// The unsettled remainder of a partial settlement stays open as a child instruction,
+	// with the holds the settled part did not consume
+	eventName := "SettlementExecuted"
+	if quantity < instruction.Quantity {
+		child, err := s.createRemainderInstruction(ctx, instruction, quantity, amount,
+			heldAmount-consumedAmount, heldQuantity-consumedQuantity, currentTime)
+		if err != nil {
+			return err
+		}
 
-	err = ctx.GetStub().PutState("brokerAccount-"+instruction.BuyBrokerID, buyerAccountJSON)
-	if err != nil {
-		return fmt.Errorf("failed to update buyer broker account in ledger: %v", err)
+		instruction.Status = "partially_settled"
+		instruction.ChildInstructionID = child.InstructionID
+		trade.Status = "partially_settled"
+		eventName = "SettlementPartiallyExecuted"
 	}
 
-	sellerAccountJSON, err := json.Marshal(sellerAccount)
+	// 7. Save all changes to ledger
+	// Save broker accounts
+	err = s.putBrokerAccount(ctx, buyerAccount)
 	if err != nil {
-		return fmt.Errorf("failed to marshal seller broker account: %v", err)
+		return fmt.Errorf("failed to update buyer broker account: %v", err)
 	}
 
-	err = ctx.GetStub().PutState("brokerAccount-"+instruction.SellBrokerID, sellerAccountJSON)
-	if err != nil {
-		return fmt.Errorf("failed to update seller broker account in ledger: %v", err)
+	if !sameBroker {
+		err = s.putBrokerAccount(ctx, sellerAccount)
+		if err != nil {
+			return fmt.Errorf("failed to update seller broker account: %v", err)
+		}
 	}
 
 	// Save securities accounts
-	buyerSecuritiesAccountJSON, err := json.Marshal(buyerSecuritiesAccount)
+	err = s.putSecuritiesAccount(ctx, sellerSecuritiesAccount)
 	if err != nil {
-		return fmt.Errorf("failed to marshal buyer securities account: %v", err)
-	}
-
-	err = ctx.GetStub().PutState(buyerSecuritiesAccount.AccountID, buyerSecuritiesAccountJSON)
-	if err != nil {
-		return fmt.Errorf("failed to update buyer securities account in ledger: %v", err)
+		return fmt.Errorf("failed to update seller securities account: %v", err)
 	}
 
-	sellerSecuritiesAccountJSON, err := json.Marshal(sellerSecuritiesAccount)
-	if err != nil {
-		return fmt.Errorf("failed to marshal seller securities account: %v", err)
+	if !sameBroker {
+		err = s.putSecuritiesAccount(ctx, buyerSecuritiesAccount)
+		if err != nil {
+			return fmt.Errorf("failed to update buyer securities account: %v", err)
+		}
 	}
 
-	err = ctx.GetStub().PutState(sellerSecuritiesAccount.AccountID, sellerSecuritiesAccountJSON)
+	// Save client sub-accounts
+	err = legs.save(ctx, s)
 	if err != nil {
-		return fmt.Errorf("failed to update seller securities account in ledger: %v", err)
+		return err
 	}
 
-	// Save transactions
-	cashTransactionJSON, err := json.Marshal(cashTransaction)
-	if err != nil {
-		return fmt.Errorf("failed to marshal cash transaction: %v", err)
-	}
+	moves := newPendingJournal()
+	moves.deliver(instruction, amount, quantity, consumedAmount, consumedQuantity)
+	s.journalMoves(ctx, moves)
 
-	err = ctx.GetStub().PutState(cashTransactionID, cashTransactionJSON)
+	// The holds are consumed, or moved to the remainder of a partial settlement
+	err = s.deleteInstructionHolds(ctx, instruction)
 	if err != nil {
-		return fmt.Errorf("failed to save cash transaction in ledger: %v", err)
+		return err
 	}
 
-	securitiesTransactionJSON, err := json.Marshal(securitiesTransaction)
+	// Save transactions
+	err = s.putTransaction(ctx, &cashTransaction)
 	if err != nil {
-		return fmt.Errorf("failed to marshal securities transaction: %v", err)
+		return fmt.Errorf("failed to save cash transaction: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(securitiesTransactionID, securitiesTransactionJSON)
+	err = s.putTransaction(ctx, &securitiesTransaction)
 	if err != nil {
-		return fmt.Errorf("failed to save securities transaction in ledger: %v", err)
+		return fmt.Errorf("failed to save securities transaction: %v", err)
 	}
 
 	// Save instruction
@@ -981,24 +1279,63 @@ func (s *SettlementContract) ExecuteSettlement(ctx contractapi.TransactionContex
 		return fmt.Errorf("failed to update trade in ledger: %v", err)
 	}
 
+	err = s.chargeSettlementFees(ctx, instruction, amount, currentTime)
+	if err != nil {
+		return err
+	}
+
 	// Emit an event for the settlement execution
-	err = ctx.GetStub().SetEvent("SettlementExecuted", instructionJSON)
+	err = ctx.GetStub().SetEvent(eventName, instructionJSON)
 	if err != nil {
-		return fmt.Errorf("failed to set SettlementExecuted event: %v", err)
+		return fmt.Errorf("failed to set %s event: %v", eventName, err)
 	}
 
 	return nil
 }
 
-// ProcessFail handles settlement failures
+// ProcessFail fails a settlement instruction by hand. Only Maroclear can fail instructions;
+// settlement runs fail them through processFail.
 func (s *SettlementContract) ProcessFail(ctx contractapi.TransactionContextInterface, instructionID string, failureReason string) error {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.processFail(ctx, instructionID, failureReason)
+}
+
+// processFail handles settlement failures
+func (s *SettlementContract) processFail(ctx contractapi.TransactionContextInterface, instructionID string, failureReason string) error {
+	// The default waterfall reads the accounts as left by releasing the holds
+	ctx = withWriteCache(ctx)
+
 	// Get the instruction
 	instruction, err := s.GetSettlementInstruction(ctx, instructionID)
 	if err != nil {
 		return err
 	}
 
-	currentTime := time.Now().Format(time.RFC3339)
+	// Only live instructions can fail, so holds are released and compensation paid once
+	if !instruction.isLive() {
+		return fmt.Errorf("only pending or validated instructions can fail, current status: %s", instruction.Status)
+	}
+
+	currentTime, err := s.getTransactionTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A seller that cannot deliver gets an extension period and is then bought in (see
+	// buyin.go); cash compensation is the last resort
+	if failureReason == "seller_insufficient_securities" {
+		return s.extendOrBuyIn(ctx, instruction, currentTime)
+	}
+
+	// Release the holds of the instruction
+	err = s.releaseInstructionHolds(ctx, instruction, currentTime)
+	if err != nil {
+		return err
+	}
 
 	// Update instruction status
 	instruction.Status = "failed"
@@ -1015,7 +1352,12 @@ func (s *SettlementContract) ProcessFail(ctx contractapi.TransactionContextInter
 		return fmt.Errorf("failed to update settlement instruction in ledger: %v", err)
 	}
 
-	// Get the guarantee deposit of the defaulting broker
+	return s.compensateFail(ctx, instruction, failureReason, currentTime)
+}
+
+// compensateFail compensates the counterparty of a failed instruction in cash through the
+// default waterfall (see defaults.go), starting with the defaulting broker's guarantee deposit
+func (s *SettlementContract) compensateFail(ctx contractapi.TransactionContextInterface, instruction *SettlementInstruction, failureReason, currentTime string) error {
 	var defaultingBrokerID string
 	if failureReason == "buyer_insufficient_funds" {
 		defaultingBrokerID = instruction.BuyBrokerID
@@ -1025,101 +1367,59 @@ func (s *SettlementContract) ProcessFail(ctx contractapi.TransactionContextInter
 		return fmt.Errorf("unknown failure reason: %s", failureReason)
 	}
 
-	deposit, err := s.GetGuaranteeDeposit(ctx, defaultingBrokerID)
-	if err != nil {
-		return fmt.Errorf("failed to get guarantee deposit: %v", err)
-	}
-
-	// Get the guarantee fund
-	guaranteeFund, err := s.GetGuaranteeFund(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get guarantee fund: %v", err)
-	}
-
-	// Determine how much to use from deposit and fund
-	var amountNeeded float64
+	// Determine the amount to compensate
+	var amountNeeded Money
 	if failureReason == "buyer_insufficient_funds" {
 		amountNeeded = instruction.TotalAmount
 	} else {
 		// For securities failure, convert to cash value
-		amountNeeded = float64(instruction.Quantity) * instruction.Price
+		amountNeeded = instruction.Price.Times(instruction.Quantity)
 	}
 
-	// Use deposit first, then fund if needed
-	var amountFromDeposit float64
-	var amountFromFund float64
-
-	if deposit.Amount >= amountNeeded {
-		amountFromDeposit = amountNeeded
-		amountFromFund = 0
+	// Compensate the affected counterparty
+	var counterpartyID, counterpartyClientID string
+	if failureReason == "buyer_insufficient_funds" {
+		counterpartyID = instruction.SellBrokerID
+		counterpartyClientID = instruction.SellClientID
 	} else {
-		amountFromDeposit = deposit.Amount
-		amountFromFund = amountNeeded - amountFromDeposit
-	}
-
-	// Update deposit
-	deposit.Amount -= amountFromDeposit
-	deposit.LastUpdated = currentTime
-
-	// Update fund
-	guaranteeFund.TotalAmount -= amountFromFund
-	guaranteeFund.LastUpdated = currentTime
-
-	// Store updated deposit
-	depositJSON, err := json.Marshal(deposit)
-	if err != nil {
-		return fmt.Errorf("failed to marshal guarantee deposit: %v", err)
-	}
-
-	err = ctx.GetStub().PutState("guaranteeDeposit-"+defaultingBrokerID, depositJSON)
-	if err != nil {
-		return fmt.Errorf("failed to update guarantee deposit in ledger: %v", err)
+		counterpartyID = instruction.BuyBrokerID
+		counterpartyClientID = instruction.BuyClientID
 	}
 
-	// Store updated fund
-	guaranteeFundJSON, err := json.Marshal(guaranteeFund)
+	loss, err := s.coverDefault(ctx, defaultingBrokerID, amountNeeded, journalHolder(counterpartyID, counterpartyClientID),
+		instruction.InstructionID, failureReason, currentTime)
 	if err != nil {
-		return fmt.Errorf("failed to marshal guarantee fund: %v", err)
+		return err
 	}
 
-	err = ctx.GetStub().PutState("guaranteeFund", guaranteeFundJSON)
+	counterpartyAccount, err := s.getOrNewBrokerAccount(ctx, counterpartyID)
 	if err != nil {
-		return fmt.Errorf("failed to update guarantee fund in ledger: %v", err)
+		return fmt.Errorf("failed to get counterparty broker account: %v", err)
 	}
 
-	// Compensate the affected counterparty
-	var counterpartyID string
-	if failureReason == "buyer_insufficient_funds" {
-		counterpartyID = instruction.SellBrokerID
-	} else {
-		counterpartyID = instruction.BuyBrokerID
-	}
+	// Add compensation to counterparty; a client's compensation belongs to the client
+	counterpartyAccount.Balance += loss.Amount
+	counterpartyAccount.LastUpdated = currentTime
 
-	counterpartyAccount, err := s.GetBrokerAccount(ctx, counterpartyID)
-	if err != nil {
-		// If counterparty account doesn't exist, create it
-		err = s.CreateBrokerAccount(ctx, counterpartyID, 0)
+	if counterpartyClientID != "" {
+		clientAccount, err := s.GetClientAccount(ctx, counterpartyID, counterpartyClientID)
 		if err != nil {
-			return fmt.Errorf("failed to create counterparty broker account: %v", err)
+			return fmt.Errorf("failed to get counterparty client account: %v", err)
 		}
-		counterpartyAccount, err = s.GetBrokerAccount(ctx, counterpartyID)
-		if err != nil {
-			return fmt.Errorf("failed to get counterparty broker account: %v", err)
-		}
-	}
 
-	// Add compensation to counterparty
-	counterpartyAccount.Balance += (amountFromDeposit + amountFromFund)
-	counterpartyAccount.LastUpdated = currentTime
+		clientAccount.Balance += loss.Amount
+		clientAccount.LastUpdated = currentTime
+		counterpartyAccount.ClientBalance += loss.Amount
 
-	counterpartyAccountJSON, err := json.Marshal(counterpartyAccount)
-	if err != nil {
-		return fmt.Errorf("failed to marshal counterparty broker account: %v", err)
+		err = s.putClientAccount(ctx, clientAccount)
+		if err != nil {
+			return fmt.Errorf("failed to update counterparty client account: %v", err)
+		}
 	}
 
-	err = ctx.GetStub().PutState("brokerAccount-"+counterpartyID, counterpartyAccountJSON)
+	err = s.putBrokerAccount(ctx, counterpartyAccount)
 	if err != nil {
-		return fmt.Errorf("failed to update counterparty broker account in ledger: %v", err)
+		return fmt.Errorf("failed to update counterparty broker account: %v", err)
 	}
 
 	// Record the compensation transaction
@@ -1129,37 +1429,35 @@ func (s *SettlementContract) ProcessFail(ctx contractapi.TransactionContextInter
 		Type:          "compensation",
 		FromID:        "guarantee", // Indicate it's from the guarantee system
 		ToID:          counterpartyID,
+		ToClientID:    counterpartyClientID,
 		SecurityID:    "",
-		Amount:        amountFromDeposit + amountFromFund,
+		Amount:        loss.Amount,
 		InstructionID: instruction.InstructionID,
 		Status:        "completed",
 		Timestamp:     currentTime,
 	}
 
-	compensationTransactionJSON, err := json.Marshal(compensationTransaction)
+	err = s.putTransaction(ctx, &compensationTransaction)
 	if err != nil {
-		return fmt.Errorf("failed to marshal compensation transaction: %v", err)
-	}
-
-	err = ctx.GetStub().PutState(compensationTransactionID, compensationTransactionJSON)
-	if err != nil {
-		return fmt.Errorf("failed to save compensation transaction in ledger: %v", err)
+		return fmt.Errorf("failed to save compensation transaction: %v", err)
 	}
 
 	// Emit an event for the settlement failure
 	failureEvent := struct {
-		InstructionID      string  `json:"instructionID"`
-		FailureReason      string  `json:"failureReason"`
-		DefaultingBroker   string  `json:"defaultingBroker"`
-		Counterparty       string  `json:"counterparty"`
-		CompensationAmount float64 `json:"compensationAmount"`
-		Timestamp          string  `json:"timestamp"`
+		InstructionID      string `json:"instructionID"`
+		FailureReason      string `json:"failureReason"`
+		DefaultingBroker   string `json:"defaultingBroker"`
+		Counterparty       string `json:"counterparty"`
+		CompensationAmount Money  `json:"compensationAmount"`
+		DefaultLossID      string `json:"defaultLossID"`
+		Timestamp          string `json:"timestamp"`
 	}{
-		InstructionID:      instructionID,
+		InstructionID:      instruction.InstructionID,
 		FailureReason:      failureReason,
 		DefaultingBroker:   defaultingBrokerID,
 		Counterparty:       counterpartyID,
-		CompensationAmount: amountFromDeposit + amountFromFund,
+		CompensationAmount: loss.Amount,
+		DefaultLossID:      loss.LossID,
 		Timestamp:          currentTime,
 	}
 
@@ -1176,10 +1474,15 @@ func (s *SettlementContract) ProcessFail(ctx contractapi.TransactionContextInter
 	return nil
 }
 
-// GetTransactionHistory retrieves all transactions for a broker
+// GetTransactionHistory retrieves all transactions for a broker from its collection
 func (s *SettlementContract) GetTransactionHistory(ctx contractapi.TransactionContextInterface, brokerID string) ([]*Transaction, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get all transactions
-	resultsIterator, err := ctx.GetStub().GetStateByRange("transaction-", "transaction-~")
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByRange(brokerCollection(brokerID), "transaction-", "transaction-~")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get transactions: %v", err)
 	}
@@ -1238,75 +1541,51 @@ func (s *SettlementContract) GetPendingSettlementInstructions(ctx contractapi.Tr
 	return instructions, nil
 }
 
-// BatchSettlement processes all pending settlements that are due
-func (s *SettlementContract) BatchSettlement(ctx contractapi.TransactionContextInterface) error {
-	// Get all pending instructions
-	pendingInstructions, err := s.GetPendingSettlementInstructions(ctx)
+// BatchSettlement processes all pending settlements that are due, as the final run of the
+// settlement queue (see queue.go), and returns the recorded run
+func (s *SettlementContract) BatchSettlement(ctx contractapi.TransactionContextInterface) (*SettlementRun, error) {
+	_, err := s.requireMaroclear(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get pending instructions: %v", err)
+		return nil, err
 	}
 
-	// Current time for comparison
-	currentTime := time.Now()
-
-	// Process each instruction that is due for settlement
-	for _, instruction := range pendingInstructions {
-		// Parse settlement date
-		settlementDate, err := time.Parse(time.RFC3339, instruction.SettlementDate)
-		if err != nil {
-			continue // Skip if date can't be parsed
-		}
+	return s.runSettlementQueue(ctx, true)
+}
 
-		// Execute settlement if due or past due
-		if !currentTime.Before(settlementDate) {
-			err = s.ExecuteSettlement(ctx, instruction.InstructionID)
-			if err != nil {
-				// Log error but continue with other settlements
-				fmt.Printf("Failed to execute settlement for instruction %s: %v\n", instruction.InstructionID, err)
-			}
-		}
+// DepositFunds deposits funds to a broker's account (amount in centimes)
+func (s *SettlementContract) DepositFunds(ctx contractapi.TransactionContextInterface, brokerID string, amountCentimes int64) error {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
-
-// DepositFunds deposits funds to a broker's account
-func (s *SettlementContract) DepositFunds(ctx contractapi.TransactionContextInterface, brokerID string, amount float64) error {
+	amount := Money(amountCentimes)
 	if amount <= 0 {
 		return fmt.Errorf("deposit amount must be positive")
 	}
 
 	// Get or create broker account
-	brokerAccount, err := s.GetBrokerAccount(ctx, brokerID)
+	brokerAccount, err := s.getOrNewBrokerAccount(ctx, brokerID)
 	if err != nil {
-		// If account doesn't exist, create it
-		err = s.CreateBrokerAccount(ctx, brokerID, 0)
-		if err != nil {
-			return fmt.Errorf("failed to create broker account: %v", err)
-		}
-		brokerAccount, err = s.GetBrokerAccount(ctx, brokerID)
-		if err != nil {
-			return fmt.Errorf("failed to get broker account: %v", err)
-		}
+		return fmt.Errorf("failed to get broker account: %v", err)
 	}
 
 	// Update balance
 	brokerAccount.Balance += amount
-	brokerAccount.LastUpdated = time.Now().Format(time.RFC3339)
-
-	// Store updated account
-	brokerAccountJSON, err := json.Marshal(brokerAccount)
+	brokerAccount.LastUpdated, err = s.getTransactionTimestamp(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal broker account: %v", err)
+		return err
 	}
 
-	err = ctx.GetStub().PutState("brokerAccount-"+brokerID, brokerAccountJSON)
+	// Store updated account
+	err = s.putBrokerAccount(ctx, brokerAccount)
 	if err != nil {
-		return fmt.Errorf("failed to update broker account in ledger: %v", err)
+		return fmt.Errorf("failed to update broker account: %v", err)
 	}
+	s.journalMove(ctx, journalSystem, journalHolder(brokerID, ""), journalCash, int64(amount))
 
 	// Record deposit transaction
-	depositTransactionID := fmt.Sprintf("transaction-deposit-%s-%d", brokerID, time.Now().UnixNano())
+	depositTransactionID := fmt.Sprintf("transaction-deposit-%s-%s", brokerID, s.getTransactionID(ctx))
 	depositTransaction := Transaction{
 		TransactionID: depositTransactionID,
 		Type:          "deposit",
@@ -1319,21 +1598,22 @@ func (s *SettlementContract) DepositFunds(ctx contractapi.TransactionContextInte
 		Timestamp:     brokerAccount.LastUpdated,
 	}
 
-	depositTransactionJSON, err := json.Marshal(depositTransaction)
-	if err != nil {
-		return fmt.Errorf("failed to marshal deposit transaction: %v", err)
-	}
-
-	err = ctx.GetStub().PutState(depositTransactionID, depositTransactionJSON)
+	err = s.putTransaction(ctx, &depositTransaction)
 	if err != nil {
-		return fmt.Errorf("failed to save deposit transaction in ledger: %v", err)
+		return fmt.Errorf("failed to save deposit transaction: %v", err)
 	}
 
 	return nil
 }
 
-// WithdrawFunds withdraws funds from a broker's account
-func (s *SettlementContract) WithdrawFunds(ctx contractapi.TransactionContextInterface, brokerID string, amount float64) error {
+// WithdrawFunds withdraws funds from a broker's account (amount in centimes)
+func (s *SettlementContract) WithdrawFunds(ctx contractapi.TransactionContextInterface, brokerID string, amountCentimes int64) error {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
+	amount := Money(amountCentimes)
 	if amount <= 0 {
 		return fmt.Errorf("withdrawal amount must be positive")
 	}
@@ -1344,29 +1624,27 @@ func (s *SettlementContract) WithdrawFunds(ctx contractapi.TransactionContextInt
 		return fmt.Errorf("failed to get broker account: %v", err)
 	}
 
-	// Check available balance
-	availableBalance := brokerAccount.Balance - brokerAccount.ReservedBalance
-	if availableBalance < amount {
+	// Check available balance; client funds are withdrawn through WithdrawClientFunds
+	if brokerAccount.available() < amount {
 		return fmt.Errorf("insufficient available balance for withdrawal")
 	}
 
 	// Update balance
 	brokerAccount.Balance -= amount
-	brokerAccount.LastUpdated = time.Now().Format(time.RFC3339)
-
-	// Store updated account
-	brokerAccountJSON, err := json.Marshal(brokerAccount)
+	brokerAccount.LastUpdated, err = s.getTransactionTimestamp(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal broker account: %v", err)
+		return err
 	}
 
-	err = ctx.GetStub().PutState("brokerAccount-"+brokerID, brokerAccountJSON)
+	// Store updated account
+	err = s.putBrokerAccount(ctx, brokerAccount)
 	if err != nil {
-		return fmt.Errorf("failed to update broker account in ledger: %v", err)
+		return fmt.Errorf("failed to update broker account: %v", err)
 	}
+	s.journalMove(ctx, journalHolder(brokerID, ""), journalSystem, journalCash, int64(amount))
 
 	// Record withdrawal transaction
-	withdrawalTransactionID := fmt.Sprintf("transaction-withdrawal-%s-%d", brokerID, time.Now().UnixNano())
+	withdrawalTransactionID := fmt.Sprintf("transaction-withdrawal-%s-%s", brokerID, s.getTransactionID(ctx))
 	withdrawalTransaction := Transaction{
 		TransactionID: withdrawalTransactionID,
 		Type:          "withdrawal",
@@ -1379,14 +1657,9 @@ func (s *SettlementContract) WithdrawFunds(ctx contractapi.TransactionContextInt
 		Timestamp:     brokerAccount.LastUpdated,
 	}
 
-	withdrawalTransactionJSON, err := json.Marshal(withdrawalTransaction)
-	if err != nil {
-		return fmt.Errorf("failed to marshal withdrawal transaction: %v", err)
-	}
-
-	err = ctx.GetStub().PutState(withdrawalTransactionID, withdrawalTransactionJSON)
+	err = s.putTransaction(ctx, &withdrawalTransaction)
 	if err != nil {
-		return fmt.Errorf("failed to save withdrawal transaction in ledger: %v", err)
+		return fmt.Errorf("failed to save withdrawal transaction: %v", err)
 	}
 
 	return nil
@@ -1394,69 +1667,76 @@ func (s *SettlementContract) WithdrawFunds(ctx contractapi.TransactionContextInt
 
 // DepositSecurities deposits securities to a broker's securities account
 func (s *SettlementContract) DepositSecurities(ctx contractapi.TransactionContextInterface, brokerID, securityID string, quantity int) error {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return err
+	}
+
 	if quantity <= 0 {
 		return fmt.Errorf("deposit quantity must be positive")
 	}
 
 	// Get or create securities account
-	securitiesAccount, err := s.GetSecuritiesAccount(ctx, brokerID, securityID)
+	securitiesAccount, err := s.getOrNewSecuritiesAccount(ctx, brokerID, securityID)
 	if err != nil {
-		// If account doesn't exist, create it
-		err = s.CreateSecuritiesAccount(ctx, brokerID, securityID, 0)
-		if err != nil {
-			return fmt.Errorf("failed to create securities account: %v", err)
-		}
-		securitiesAccount, err = s.GetSecuritiesAccount(ctx, brokerID, securityID)
-		if err != nil {
-			return fmt.Errorf("failed to get securities account: %v", err)
-		}
+		return fmt.Errorf("failed to get securities account: %v", err)
 	}
 
 	// Update quantity
 	securitiesAccount.Quantity += quantity
-	securitiesAccount.LastUpdated = time.Now().Format(time.RFC3339)
-
-	// Store updated account
-	securitiesAccountJSON, err := json.Marshal(securitiesAccount)
+	securitiesAccount.LastUpdated, err = s.getTransactionTimestamp(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal securities account: %v", err)
+		return err
 	}
 
-	err = ctx.GetStub().PutState(securitiesAccount.AccountID, securitiesAccountJSON)
+	// Store updated account
+	err = s.putSecuritiesAccount(ctx, securitiesAccount)
 	if err != nil {
-		return fmt.Errorf("failed to update securities account in ledger: %v", err)
+		return fmt.Errorf("failed to update securities account: %v", err)
 	}
+	s.journalMove(ctx, journalIssuer, journalHolder(brokerID, ""), securityID, int64(quantity))
 
 	// Record deposit transaction
-	depositTransactionID := fmt.Sprintf("transaction-sec-deposit-%s-%s-%d", brokerID, securityID, time.Now().UnixNano())
+	depositTransactionID := fmt.Sprintf("transaction-sec-deposit-%s-%s-%s", brokerID, securityID, s.getTransactionID(ctx))
 	depositTransaction := Transaction{
 		TransactionID: depositTransactionID,
 		Type:          "security_deposit",
 		FromID:        "external",
 		ToID:          brokerID,
 		SecurityID:    securityID,
-		Amount:        float64(quantity),
+		Quantity:      quantity,
 		InstructionID: "",
 		Status:        "completed",
 		Timestamp:     securitiesAccount.LastUpdated,
 	}
 
-	depositTransactionJSON, err := json.Marshal(depositTransaction)
-	if err != nil {
-		return fmt.Errorf("failed to marshal securities deposit transaction: %v", err)
-	}
-
-	err = ctx.GetStub().PutState(depositTransactionID, depositTransactionJSON)
+	err = s.putTransaction(ctx, &depositTransaction)
 	if err != nil {
-		return fmt.Errorf("failed to save securities deposit transaction in ledger: %v", err)
+		return fmt.Errorf("failed to save securities deposit transaction: %v", err)
 	}
 
 	return nil
 }
 
 func (s *SettlementContract) ImportTrade(ctx contractapi.TransactionContextInterface,
-	tradeID, buyOrderID, sellOrderID, buyBrokerID, sellBrokerID, securityID string,
-	quantity int, price float64, status, matchTime string) error {
+	tradeID, buyOrderID, sellOrderID, buyBrokerID, sellBrokerID, buyClientID, sellClientID, securityID string,
+	quantity int, priceCentimes int64, status, matchTime, makerSide string) error {
+
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The maker side sets which fee rates apply to each side (see fees.go)
+	if makerSide != "" && makerSide != "buy" && makerSide != "sell" {
+		return fmt.Errorf("maker side must be buy, sell or empty")
+	}
+
+	// The match time sets the trade date, from which the settlement date is computed
+	_, err = time.Parse(time.RFC3339, matchTime)
+	if err != nil {
+		return fmt.Errorf("match time must be an RFC3339 time: %v", err)
+	}
 
 	// Check if trade already exists (prevents duplicate trade creation)
 	existingTradeJSON, err := ctx.GetStub().GetState(tradeID)
@@ -1474,11 +1754,14 @@ func (s *SettlementContract) ImportTrade(ctx contractapi.TransactionContextInter
 		SellOrderID:  sellOrderID,
 		BuyBrokerID:  buyBrokerID,
 		SellBrokerID: sellBrokerID,
+		BuyClientID:  buyClientID,
+		SellClientID: sellClientID,
 		SecurityID:   securityID,
 		Quantity:     quantity,
-		Price:        price,
+		Price:        Money(priceCentimes),
 		Status:       status,
 		MatchTime:    matchTime,
+		MakerSide:    makerSide,
 	}
 
 	// Marshal and store the trade
@@ -1491,7 +1774,11 @@ func (s *SettlementContract) ImportTrade(ctx contractapi.TransactionContextInter
 }
 
 func main() {
-	chaincode, err := contractapi.NewChaincode(&SettlementContract{})
+	contract := &SettlementContract{}
+	contract.TransactionContextHandler = &journalContext{}
+	contract.AfterTransaction = contract.postJournal
+
+	chaincode, err := contractapi.NewChaincode(contract)
 	if err != nil {
 		fmt.Printf("Error creating settlement chaincode: %s", err.Error())
 		return
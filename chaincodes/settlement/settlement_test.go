@@ -0,0 +1,137 @@
+// settlement_test.go - Tests of settlement between brokers' house accounts
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// settlementDay is the settlement date of trades made on the ledger's first day
+var settlementDay = time.Date(2026, 3, 5, 10, 0, 0, 0, time.UTC)
+
+// setUpHouseTrade creates an affirmed instruction for broker1 to buy 10 SEC002 at 1.00
+// from broker2's house account
+func setUpHouseTrade(t *testing.T, l *mockLedger) {
+	t.Helper()
+	s := &SettlementContract{}
+
+	setUpInstruction(t, l)
+	l.must(t, "Broker1MSP", func(ctx txCtx) error {
+		return s.AffirmInstruction(ctx, "instruction-trade-1", "buy", "SEC002", 10, 100)
+	})
+	l.must(t, "Broker2MSP", func(ctx txCtx) error {
+		return s.AffirmInstruction(ctx, "instruction-trade-1", "sell", "SEC002", 10, 100)
+	})
+}
+
+// transactionIDs returns the IDs of a broker's transaction history
+func transactionIDs(t *testing.T, l *mockLedger, brokerID string) map[string]bool {
+	t.Helper()
+	s := &SettlementContract{}
+
+	ids := map[string]bool{}
+	l.must(t, brokerMSPID(brokerID), func(ctx txCtx) error {
+		transactions, err := s.GetTransactionHistory(ctx, brokerID)
+		for _, transaction := range transactions {
+			ids[transaction.TransactionID] = true
+		}
+		return err
+	})
+	return ids
+}
+
+func TestSettlementTransactionsStayInBrokerCollections(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	setUpHouseTrade(t, l)
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+
+	for key := range l.state {
+		if strings.HasPrefix(key, "transaction-") {
+			t.Errorf("transaction %s is in the world state", key)
+		}
+	}
+
+	for _, brokerID := range []string{"broker1", "broker2"} {
+		ids := transactionIDs(t, l, brokerID)
+		for _, id := range []string{"transaction-cash-instruction-trade-1", "transaction-securities-instruction-trade-1"} {
+			if !ids[id] {
+				t.Errorf("history of %s is missing %s", brokerID, id)
+			}
+		}
+	}
+
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error {
+		_, err := s.GetTransactionHistory(ctx, "broker1")
+		return err
+	})
+}
+
+func TestDepositIsRecordedOnlyForItsBroker(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.DepositFunds(ctx, "broker1", 5000) })
+
+	deposit := "transaction-deposit-broker1-" + l.lastTxID()
+	if !transactionIDs(t, l, "broker1")[deposit] {
+		t.Errorf("history of broker1 is missing %s", deposit)
+	}
+	if transactionIDs(t, l, "broker2")[deposit] {
+		t.Errorf("history of broker2 has %s", deposit)
+	}
+}
+
+func TestOnlyABrokerOrMaroclearMovesItsFunds(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error { return s.WithdrawFunds(ctx, "broker1", 5000) })
+	l.mustFail(t, "StockMarketMSP", func(ctx txCtx) error { return s.DepositFunds(ctx, "broker2", 5000) })
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error { return s.CreateBrokerAccount(ctx, "broker4", 5000) })
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 100, 1000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	if balance := cashBalance(t, l, "broker1"); balance != 150000000 {
+		t.Errorf("broker1 balance = %v", balance)
+	}
+	if balance := cashBalance(t, l, "broker2"); balance != 50000000 {
+		t.Errorf("broker2 balance = %v", balance)
+	}
+
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.WithdrawFunds(ctx, "broker1", 5000) })
+}
+
+func TestEndorsementsOfAProposalAgree(t *testing.T) {
+	s := &SettlementContract{}
+
+	// Two peers endorsing the same proposals, which carry the same timestamp
+	ledgers := []*mockLedger{newLedger(), newLedger()}
+	for _, l := range ledgers {
+		l.now = settlementDay
+		setUpHouseTrade(t, l)
+		l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.DepositFunds(ctx, "broker1", 5000) })
+		l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	}
+
+	if !reflect.DeepEqual(ledgers[0].state, ledgers[1].state) || !reflect.DeepEqual(ledgers[0].private, ledgers[1].private) {
+		t.Fatal("endorsements of the same proposals differ")
+	}
+
+	var history []*Transaction
+	ledgers[0].must(t, "Broker1MSP", func(ctx txCtx) error {
+		var err error
+		history, err = s.GetTransactionHistory(ctx, "broker1")
+		return err
+	})
+	for _, transaction := range history {
+		if transaction.Timestamp != settlementDay.Format(time.RFC3339) {
+			t.Errorf("%s is stamped %s, not with its proposal time", transaction.TransactionID, transaction.Timestamp)
+		}
+	}
+}
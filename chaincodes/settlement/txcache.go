@@ -0,0 +1,108 @@
+// txcache.go - Read-your-writes view of the world state within one transaction
+package main
+
+import (
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// cachedStub returns the values a transaction has already written when it reads them back.
+// Fabric reads only see the state committed before the transaction, so functions that
+// chain several settlements in one transaction read through this stub. Range queries
+// still see the committed state only.
+type cachedStub struct {
+	shim.ChaincodeStubInterface
+	state   map[string][]byte            // written keys, nil when deleted
+	private map[string]map[string][]byte // written private keys by collection, nil when deleted
+}
+
+// cachedContext is a transaction context whose stub reads its own writes
+type cachedContext struct {
+	contractapi.TransactionContextInterface
+	stub *cachedStub
+}
+
+// GetStub returns the read-your-writes stub
+func (ctx *cachedContext) GetStub() shim.ChaincodeStubInterface {
+	return ctx.stub
+}
+
+// withWriteCache returns a context that reads its own writes
+func withWriteCache(ctx contractapi.TransactionContextInterface) contractapi.TransactionContextInterface {
+	if _, ok := ctx.(*cachedContext); ok {
+		return ctx
+	}
+
+	return &cachedContext{
+		TransactionContextInterface: ctx,
+		stub: &cachedStub{
+			ChaincodeStubInterface: ctx.GetStub(),
+			state:                  map[string][]byte{},
+			private:                map[string]map[string][]byte{},
+		},
+	}
+}
+
+// GetState returns the value written by this transaction, or the committed value
+func (stub *cachedStub) GetState(key string) ([]byte, error) {
+	if value, ok := stub.state[key]; ok {
+		return value, nil
+	}
+	return stub.ChaincodeStubInterface.GetState(key)
+}
+
+// PutState writes the value and remembers it
+func (stub *cachedStub) PutState(key string, value []byte) error {
+	err := stub.ChaincodeStubInterface.PutState(key, value)
+	if err != nil {
+		return err
+	}
+	stub.state[key] = value
+	return nil
+}
+
+// DelState deletes the key and remembers the deletion
+func (stub *cachedStub) DelState(key string) error {
+	err := stub.ChaincodeStubInterface.DelState(key)
+	if err != nil {
+		return err
+	}
+	stub.state[key] = nil
+	return nil
+}
+
+// GetPrivateData returns the private value written by this transaction, or the committed value
+func (stub *cachedStub) GetPrivateData(collection, key string) ([]byte, error) {
+	if value, ok := stub.private[collection][key]; ok {
+		return value, nil
+	}
+	return stub.ChaincodeStubInterface.GetPrivateData(collection, key)
+}
+
+// PutPrivateData writes the private value and remembers it
+func (stub *cachedStub) PutPrivateData(collection, key string, value []byte) error {
+	err := stub.ChaincodeStubInterface.PutPrivateData(collection, key, value)
+	if err != nil {
+		return err
+	}
+	stub.rememberPrivate(collection, key, value)
+	return nil
+}
+
+// DelPrivateData deletes the private key and remembers the deletion
+func (stub *cachedStub) DelPrivateData(collection, key string) error {
+	err := stub.ChaincodeStubInterface.DelPrivateData(collection, key)
+	if err != nil {
+		return err
+	}
+	stub.rememberPrivate(collection, key, nil)
+	return nil
+}
+
+// rememberPrivate records a private write of this transaction
+func (stub *cachedStub) rememberPrivate(collection, key string, value []byte) {
+	if stub.private[collection] == nil {
+		stub.private[collection] = map[string][]byte{}
+	}
+	stub.private[collection][key] = value
+}
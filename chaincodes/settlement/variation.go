@@ -0,0 +1,553 @@
+// variation.go - Daily mark-to-market of unsettled instructions and variation margin
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// MarkedInstruction is one side of an open instruction marked to the closing price
+type MarkedInstruction struct {
+	InstructionID string `json:"instructionID"`
+	Side          string `json:"side"` // buy, sell
+	SecurityID    string `json:"securityID"`
+	Quantity      int    `json:"quantity"`
+	Price         Money  `json:"price"`
+	ClosingPrice  Money  `json:"closingPrice"`
+	PriceDate     string `json:"priceDate"`
+	Value         Money  `json:"value"` // gain (positive) or loss (negative) of the side at the closing price
+}
+
+// BrokerMark is a broker's mark-to-market on a date, net across its open instructions.
+// The change since its previous mark is its variation margin: a gain is paid into its
+// guarantee deposit and a loss collected from it, and what the deposit cannot cover is
+// called.
+type BrokerMark struct {
+	BrokerID      string               `json:"brokerID"`
+	Date          string               `json:"date"` // YYYY-MM-DD
+	Instructions  []*MarkedInstruction `json:"instructions"`
+	NetValue      Money                `json:"netValue"`
+	PreviousValue Money                `json:"previousValue"`
+	Variation     Money                `json:"variation"` // NetValue - PreviousValue
+	Offset        Money                `json:"offset"`    // gain set against variation still owed
+	Paid          Money                `json:"paid"`      // paid into the deposit
+	Collected     Money                `json:"collected"` // collected from the deposit
+	Called        Money                `json:"called"`    // loss the deposit could not cover
+	CallID        string               `json:"callID"`
+}
+
+// MarkToMarketRun is the daily mark-to-market of every open instruction
+type MarkToMarketRun struct {
+	Date           string        `json:"date"` // YYYY-MM-DD
+	Marks          []*BrokerMark `json:"marks"`
+	TotalPaid      Money         `json:"totalPaid"`
+	TotalCollected Money         `json:"totalCollected"`
+	TotalCalled    Money         `json:"totalCalled"`
+	RunAt          string        `json:"runAt"`
+}
+
+// markToMarketKey returns the key of a broker's mark on a date
+func markToMarketKey(date, brokerID string) string {
+	return "markToMarket-" + date + "-" + brokerID
+}
+
+// RunMarkToMarket marks every open instruction to the latest closing prices on or before
+// a business date (YYYY-MM-DD) and settles each broker's variation margin through its
+// guarantee deposit. Losses the deposit cannot cover are called, to be paid by the call
+// deadline. Dates are marked once, in order. The CCP's sides are not marked.
+func (s *SettlementContract) RunMarkToMarket(ctx contractapi.TransactionContextInterface, date string) (*MarkToMarketRun, error) {
+	// Deposits and the guarantee fund are written for several brokers
+	ctx = withWriteCache(ctx)
+
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	day, err := time.Parse(calendarDateLayout, date)
+	if err != nil {
+		return nil, fmt.Errorf("date must be in YYYY-MM-DD format: %v", err)
+	}
+
+	txTime, err := s.getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if date > txTime.Format(calendarDateLayout) {
+		return nil, fmt.Errorf("a future date %s cannot be marked", date)
+	}
+
+	businessDay, err := s.isBusinessDay(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	if !businessDay {
+		return nil, fmt.Errorf("%s is not a business day", date)
+	}
+
+	lastDateJSON, err := ctx.GetStub().GetState("markToMarketLastDate")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if lastDateJSON != nil && date <= string(lastDateJSON) {
+		return nil, fmt.Errorf("mark-to-market already ran for %s", string(lastDateJSON))
+	}
+
+	currentTime := txTime.Format(time.RFC3339)
+
+	parameters, err := s.GetMarginParameters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, err := s.addBusinessDays(ctx, txTime, parameters.CallDeadlineDays)
+	if err != nil {
+		return nil, err
+	}
+
+	marks, brokerIDs, err := s.markOpenInstructions(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+
+	// Brokers marked before whose instructions have all closed unwind their previous mark
+	resultsIterator, err := ctx.GetStub().GetStateByRange("brokerMargin-", "brokerMargin-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get broker margin statuses: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate broker margin statuses: %v", err)
+		}
+
+		var status BrokerMarginStatus
+		err = json.Unmarshal(queryResponse.Value, &status)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal broker margin status: %v", err)
+		}
+		if _, ok := marks[status.BrokerID]; !ok && status.MarkedValue != 0 {
+			marks[status.BrokerID] = &BrokerMark{BrokerID: status.BrokerID, Instructions: []*MarkedInstruction{}}
+			brokerIDs = append(brokerIDs, status.BrokerID)
+		}
+	}
+
+	guaranteeFund, err := s.GetGuaranteeFund(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	run := MarkToMarketRun{
+		Date:  date,
+		Marks: []*BrokerMark{},
+		RunAt: currentTime,
+	}
+
+	for _, brokerID := range brokerIDs {
+		mark := marks[brokerID]
+		mark.Date = date
+
+		status, err := s.GetBrokerMarginStatus(ctx, brokerID)
+		if err != nil {
+			return nil, err
+		}
+
+		mark.PreviousValue = status.MarkedValue
+		mark.Variation = mark.NetValue - mark.PreviousValue
+
+		deposit, err := s.getOrNewGuaranteeDeposit(ctx, brokerID)
+		if err != nil {
+			return nil, err
+		}
+
+		if mark.Variation > 0 {
+			// A gain first pays off the variation the broker still owes
+			mark.Offset = mark.Variation
+			if mark.Offset > status.VariationOwed {
+				mark.Offset = status.VariationOwed
+			}
+			status.VariationOwed -= mark.Offset
+			mark.Paid = mark.Variation - mark.Offset
+			deposit.Amount += mark.Paid
+		} else if mark.Variation < 0 {
+			mark.Collected = -mark.Variation
+			if mark.Collected > deposit.Amount {
+				mark.Collected = deposit.Amount
+			}
+			deposit.Amount -= mark.Collected
+			mark.Called = -mark.Variation - mark.Collected
+		}
+
+		if mark.Paid > 0 || mark.Collected > 0 {
+			deposit.LastUpdated = currentTime
+			guaranteeFund.TotalAmount += mark.Paid - mark.Collected
+
+			err = s.putGuaranteeDeposit(ctx, deposit)
+			if err != nil {
+				return nil, fmt.Errorf("failed to update guarantee deposit: %v", err)
+			}
+		}
+
+		// A gain is paid from the CCP's unmarked sides and a loss is paid to them, from the
+		// deposit or as variation owed
+		s.journalMove(ctx, journalCCPVariation, journalAccount(journalVariationOwed, brokerID), journalCash, int64(mark.Offset))
+		s.journalMove(ctx, journalCCPVariation, journalAccount(journalGuaranteeDeposit, brokerID), journalCash, int64(mark.Paid))
+		s.journalMove(ctx, journalAccount(journalGuaranteeDeposit, brokerID), journalCCPVariation, journalCash, int64(mark.Collected))
+		s.journalMove(ctx, journalAccount(journalVariationOwed, brokerID), journalCCPVariation, journalCash, int64(mark.Called))
+
+		// A loss the deposit cannot cover is called, on top of any variation still owed
+		if mark.Called > 0 {
+			status.VariationOwed += mark.Called
+
+			if status.OpenVariationCallID == "" {
+				call := &MarginCall{
+					CallID:    "marginCall-" + brokerID + "-" + s.getTransactionID(ctx),
+					BrokerID:  brokerID,
+					Kind:      marginCallVariation,
+					Exposure:  -mark.NetValue,
+					Required:  status.VariationOwed,
+					Deposit:   deposit.Amount,
+					Shortfall: status.VariationOwed,
+					Deadline:  deadline.Format(calendarDateLayout),
+					Status:    "open",
+					IssuedAt:  currentTime,
+				}
+				status.OpenVariationCallID = call.CallID
+				mark.CallID = call.CallID
+
+				err = s.putMarginCall(ctx, call)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				call, err := s.GetMarginCall(ctx, status.OpenVariationCallID)
+				if err != nil {
+					return nil, err
+				}
+				call.Required = status.VariationOwed
+				call.Shortfall = status.VariationOwed
+				mark.CallID = call.CallID
+
+				err = s.putMarginCall(ctx, call)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if mark.Offset > 0 && status.VariationOwed == 0 && status.OpenVariationCallID != "" {
+			call, err := s.GetMarginCall(ctx, status.OpenVariationCallID)
+			if err != nil {
+				return nil, err
+			}
+			call.Status = "met"
+			call.ClosedAt = currentTime
+			mark.CallID = call.CallID
+
+			err = s.putMarginCall(ctx, call)
+			if err != nil {
+				return nil, err
+			}
+			status.OpenVariationCallID = ""
+		}
+
+		status.MarkedValue = mark.NetValue
+		status.MarkedDate = date
+		status.LastUpdated = currentTime
+		err = s.putBrokerMarginStatus(ctx, status)
+		if err != nil {
+			return nil, err
+		}
+
+		// Paying off the variation owed can lift a restriction for a missed call
+		if mark.Offset > 0 {
+			err = s.applyMarginTopUp(ctx, brokerID, currentTime)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		markJSON, err := json.Marshal(mark)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal mark-to-market: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(markToMarketKey(date, brokerID), markJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to put mark-to-market in ledger: %v", err)
+		}
+
+		run.Marks = append(run.Marks, mark)
+		run.TotalPaid += mark.Paid
+		run.TotalCollected += mark.Collected
+		run.TotalCalled += mark.Called
+	}
+
+	guaranteeFund.LastUpdated = currentTime
+	err = s.putGuaranteeFund(ctx, guaranteeFund)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.GetStub().PutState("markToMarketLastDate", []byte(date))
+	if err != nil {
+		return nil, fmt.Errorf("failed to put mark-to-market date in ledger: %v", err)
+	}
+
+	runJSON, err := json.Marshal(run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal mark-to-market run: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("markToMarketRun-"+date, runJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put mark-to-market run in ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("MarkToMarketCompleted", runJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set MarkToMarketCompleted event: %v", err)
+	}
+
+	return &run, nil
+}
+
+// markOpenInstructions marks both sides of every open instruction to the latest closing
+// price on or before a date, and nets the marks per broker. It returns the brokers in the
+// order they were found. Every open security must have a closing price.
+func (s *SettlementContract) markOpenInstructions(ctx contractapi.TransactionContextInterface, date string) (map[string]*BrokerMark, []string, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("instruction-", "instruction-~")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get instructions: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	marks := map[string]*BrokerMark{}
+	var brokerIDs []string
+	closingPrices := map[string]*ClosingPrice{}
+
+	add := func(brokerID string, marked *MarkedInstruction) {
+		if brokerID == ccpBrokerID {
+			return
+		}
+		mark, ok := marks[brokerID]
+		if !ok {
+			mark = &BrokerMark{BrokerID: brokerID, Instructions: []*MarkedInstruction{}}
+			marks[brokerID] = mark
+			brokerIDs = append(brokerIDs, brokerID)
+		}
+		mark.Instructions = append(mark.Instructions, marked)
+		mark.NetValue += marked.Value
+	}
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to iterate instructions: %v", err)
+		}
+
+		var instruction SettlementInstruction
+		err = json.Unmarshal(queryResponse.Value, &instruction)
+		if err != nil {
+			continue // Skip if not a valid SettlementInstruction
+		}
+
+		if !instruction.isLive() && instruction.Status != "netted" && instruction.Status != "buy_in" {
+			continue
+		}
+
+		closingPrice, ok := closingPrices[instruction.SecurityID]
+		if !ok {
+			closingPrice, err = s.latestClosingPrice(ctx, instruction.SecurityID, date)
+			if err != nil {
+				return nil, nil, err
+			}
+			if closingPrice == nil {
+				return nil, nil, fmt.Errorf("no closing price for %s on or before %s", instruction.SecurityID, date)
+			}
+			closingPrices[instruction.SecurityID] = closingPrice
+		}
+
+		// The buyer gains what the security rose above the instruction price; the seller the reverse
+		gain := (closingPrice.Price - instruction.Price).Times(instruction.Quantity)
+
+		add(instruction.BuyBrokerID, &MarkedInstruction{
+			InstructionID: instruction.InstructionID,
+			Side:          "buy",
+			SecurityID:    instruction.SecurityID,
+			Quantity:      instruction.Quantity,
+			Price:         instruction.Price,
+			ClosingPrice:  closingPrice.Price,
+			PriceDate:     closingPrice.Date,
+			Value:         gain,
+		})
+		add(instruction.SellBrokerID, &MarkedInstruction{
+			InstructionID: instruction.InstructionID,
+			Side:          "sell",
+			SecurityID:    instruction.SecurityID,
+			Quantity:      instruction.Quantity,
+			Price:         instruction.Price,
+			ClosingPrice:  closingPrice.Price,
+			PriceDate:     closingPrice.Date,
+			Value:         -gain,
+		})
+	}
+
+	return marks, brokerIDs, nil
+}
+
+// getOrNewGuaranteeDeposit returns a broker's guarantee deposit, or an empty one
+func (s *SettlementContract) getOrNewGuaranteeDeposit(ctx contractapi.TransactionContextInterface, brokerID string) (*GuaranteeDeposit, error) {
+	depositJSON, err := s.getPrivateState(ctx, brokerID, "guaranteeDeposit-"+brokerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	if depositJSON == nil {
+		return &GuaranteeDeposit{BrokerID: brokerID}, nil
+	}
+
+	var deposit GuaranteeDeposit
+	err = json.Unmarshal(depositJSON, &deposit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal guarantee deposit: %v", err)
+	}
+
+	return &deposit, nil
+}
+
+// collectVariationOwed collects the variation margin a broker still owes from its guarantee
+// deposit, after a top-up. It returns true once nothing is owed. The caller stores the status.
+func (s *SettlementContract) collectVariationOwed(ctx contractapi.TransactionContextInterface, status *BrokerMarginStatus, currentTime string) (bool, error) {
+	if status.VariationOwed <= 0 {
+		return true, nil
+	}
+
+	deposit, err := s.getOrNewGuaranteeDeposit(ctx, status.BrokerID)
+	if err != nil {
+		return false, err
+	}
+
+	collected := status.VariationOwed
+	if collected > deposit.Amount {
+		collected = deposit.Amount
+	}
+	if collected <= 0 {
+		return false, nil
+	}
+
+	guaranteeFund, err := s.GetGuaranteeFund(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	deposit.Amount -= collected
+	deposit.LastUpdated = currentTime
+	guaranteeFund.TotalAmount -= collected
+	guaranteeFund.LastUpdated = currentTime
+	status.VariationOwed -= collected
+
+	err = s.putGuaranteeDeposit(ctx, deposit)
+	if err != nil {
+		return false, fmt.Errorf("failed to update guarantee deposit: %v", err)
+	}
+	s.journalMove(ctx, journalAccount(journalGuaranteeDeposit, status.BrokerID), journalAccount(journalVariationOwed, status.BrokerID), journalCash, int64(collected))
+
+	err = s.putGuaranteeFund(ctx, guaranteeFund)
+	if err != nil {
+		return false, err
+	}
+
+	return status.VariationOwed == 0, nil
+}
+
+// GetMarkToMarket retrieves a broker's mark-to-market on a date (YYYY-MM-DD)
+func (s *SettlementContract) GetMarkToMarket(ctx contractapi.TransactionContextInterface, brokerID, date string) (*BrokerMark, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	markJSON, err := ctx.GetStub().GetState(markToMarketKey(date, brokerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if markJSON == nil {
+		return nil, fmt.Errorf("broker %s was not marked to market on %s", brokerID, date)
+	}
+
+	var mark BrokerMark
+	err = json.Unmarshal(markJSON, &mark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal mark-to-market: %v", err)
+	}
+
+	return &mark, nil
+}
+
+// GetMarkToMarketRun retrieves the mark-to-market of a date (YYYY-MM-DD)
+func (s *SettlementContract) GetMarkToMarketRun(ctx contractapi.TransactionContextInterface, date string) (*MarkToMarketRun, error) {
+	_, err := s.requireMaroclear(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	runJSON, err := ctx.GetStub().GetState("markToMarketRun-" + date)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if runJSON == nil {
+		return nil, fmt.Errorf("mark-to-market did not run for %s", date)
+	}
+
+	var run MarkToMarketRun
+	err = json.Unmarshal(runJSON, &run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal mark-to-market run: %v", err)
+	}
+
+	return &run, nil
+}
+
+// GetMarginCalls retrieves the history of a broker's initial and variation margin calls,
+// oldest first
+func (s *SettlementContract) GetMarginCalls(ctx contractapi.TransactionContextInterface, brokerID string) ([]*MarginCall, error) {
+	err := s.authorizeBrokerOrMaroclear(ctx, brokerID)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange("marginCall-"+brokerID+"-", "marginCall-"+brokerID+"-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get margin calls: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	calls := []*MarginCall{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate margin calls: %v", err)
+		}
+
+		var call MarginCall
+		err = json.Unmarshal(queryResponse.Value, &call)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal margin call: %v", err)
+		}
+		if call.BrokerID == brokerID {
+			calls = append(calls, &call)
+		}
+	}
+
+	sort.SliceStable(calls, func(i, j int) bool {
+		return calls[i].IssuedAt < calls[j].IssuedAt
+	})
+
+	return calls, nil
+}
@@ -0,0 +1,135 @@
+// variation_test.go - Tests of marking unsettled instructions to market
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// guaranteeDeposited returns the amount of a broker's guarantee deposit
+func guaranteeDeposited(t *testing.T, l *mockLedger, brokerID string) Money {
+	t.Helper()
+	s := &SettlementContract{}
+
+	var amount Money
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		deposit, err := s.getOrNewGuaranteeDeposit(ctx, brokerID)
+		if err != nil {
+			return err
+		}
+		amount = deposit.Amount
+		return nil
+	})
+	return amount
+}
+
+// marginStatus returns a broker's margin status
+func marginStatus(t *testing.T, l *mockLedger, brokerID string) *BrokerMarginStatus {
+	t.Helper()
+	s := &SettlementContract{}
+
+	var status *BrokerMarginStatus
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		var err error
+		status, err = s.GetBrokerMarginStatus(ctx, brokerID)
+		return err
+	})
+	return status
+}
+
+func TestVariationMarginFollowsClosingPrices(t *testing.T) {
+	l := newLedger()
+	s := &SettlementContract{}
+	l.now = time.Date(2026, 3, 2, 18, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.InitLedger(ctx) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.SetMarginParameters(ctx, 10, 0, 1) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		return s.ImportTrade(ctx, "trade-1", "order-b", "order-s", "broker1", "broker2", "", "",
+			"SEC002", 100, 100000, "pending", "2026-03-02T09:00:00Z", "")
+	})
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateSettlementInstruction(ctx, "trade-1") })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.CreateGuaranteeDeposit(ctx, "broker1", 50000) })
+
+	// SEC002 closes at 900.00: broker1 bought 10,000.00 above the market and pays the
+	// variation to broker2, from its 500.00 deposit and then through a call for the rest
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error { return s.ImportClosingPrice(ctx, "SEC002", "2026-03-02", 90000, 0) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		run, err := s.RunMarkToMarket(ctx, "2026-03-02")
+		if err != nil {
+			return err
+		}
+		if len(run.Marks) != 2 {
+			t.Fatalf("%d brokers marked, want 2", len(run.Marks))
+		}
+		for _, mark := range run.Marks {
+			switch mark.BrokerID {
+			case "broker1":
+				if mark.Variation != -1000000 || mark.Collected != 50000 || mark.Called != 950000 || mark.CallID == "" {
+					t.Errorf("broker1 mark = %+v", *mark)
+				}
+			case "broker2":
+				if mark.Variation != 1000000 || mark.Paid != 1000000 {
+					t.Errorf("broker2 mark = %+v", *mark)
+				}
+			}
+		}
+		return nil
+	})
+	l.mustFail(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.RunMarkToMarket(ctx, "2026-03-02")
+		return err
+	})
+	if amount := guaranteeDeposited(t, l, "broker2"); amount != 1000000 {
+		t.Errorf("broker2 deposit = %v, want the 10,000.00 variation", amount)
+	}
+
+	// broker2's deposit is tied up by its own requirement, and broker1 still owes its call
+	l.mustFail(t, "Broker2MSP", func(ctx txCtx) error { return s.WithdrawGuarantee(ctx, "broker2", 1) })
+	l.mustFail(t, "Broker1MSP", func(ctx txCtx) error { return s.WithdrawGuarantee(ctx, "broker1", 1) })
+
+	// A missed variation call restricts the broker until it pays what it owes
+	l.now = time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.EnforceMarginCalls(ctx)
+		return err
+	})
+	if status := marginStatus(t, l, "broker1"); !status.Restricted || status.VariationOwed != 950000 {
+		t.Fatalf("broker1 margin status after the missed call = %+v", *status)
+	}
+	l.must(t, "Broker1MSP", func(ctx txCtx) error { return s.DepositGuarantee(ctx, "broker1", 2000000) })
+	if status := marginStatus(t, l, "broker1"); status.Restricted || status.VariationOwed != 0 {
+		t.Fatalf("broker1 margin status after the top-up = %+v", *status)
+	}
+	if amount := guaranteeDeposited(t, l, "broker1"); amount != 1050000 {
+		t.Errorf("broker1 deposit = %v, want 10,500.00", amount)
+	}
+
+	// SEC002 closes at 1,100.00: the variation reverses
+	l.must(t, "StockMarketMSP", func(ctx txCtx) error { return s.ImportClosingPrice(ctx, "SEC002", "2026-03-03", 110000, 0) })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.RunMarkToMarket(ctx, "2026-03-03")
+		return err
+	})
+	if amount := guaranteeDeposited(t, l, "broker1"); amount != 3050000 {
+		t.Errorf("broker1 deposit = %v, want 30,500.00", amount)
+	}
+	if status := marginStatus(t, l, "broker2"); status.VariationOwed != 1000000 || status.OpenVariationCallID == "" {
+		t.Errorf("broker2 margin status = %+v", *status)
+	}
+
+	// Once settled, the instruction's variation is given back and no call stays open
+	l.now = settlementDay
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error { return s.ExecuteSettlement(ctx, "instruction-trade-1") })
+	l.must(t, "MaroclearMSP", func(ctx txCtx) error {
+		_, err := s.RunMarkToMarket(ctx, "2026-03-05")
+		return err
+	})
+	for _, brokerID := range []string{"broker1", "broker2"} {
+		if status := marginStatus(t, l, brokerID); status.MarkedValue != 0 || status.VariationOwed != 0 || status.OpenVariationCallID != "" {
+			t.Errorf("%s margin status after settlement = %+v", brokerID, *status)
+		}
+	}
+	if amount := guaranteeDeposited(t, l, "broker1"); amount != 2050000 {
+		t.Errorf("broker1 deposit = %v, want 20,500.00", amount)
+	}
+}
@@ -25,11 +25,17 @@ echo "Generating SettlementChannel transaction..."
 configtxgen -profile SettlementChannel -outputCreateChannelTx ./channel-artifacts/settlement-channel.tx -channelID settlement-channel
 echo "✅ SettlementChannel transaction created"
 
+# Generate RegulatoryChannel transaction
+echo "Generating RegulatoryChannel transaction..."
+configtxgen -profile RegulatoryChannel -outputCreateChannelTx ./channel-artifacts/regulatory-channel.tx -channelID regulatory-channel
+echo "✅ RegulatoryChannel transaction created"
+
 echo "Generating anchor peer updates for TradingChannel..."
 # Generate anchor peer updates for TradingChannel
 configtxgen -profile TradingChannel -outputAnchorPeersUpdate ./channel-artifacts/StockMarketMSPanchors_trading-channel.tx -channelID trading-channel -asOrg StockMarketMSP
 configtxgen -profile TradingChannel -outputAnchorPeersUpdate ./channel-artifacts/Broker1MSPanchors_trading-channel.tx -channelID trading-channel -asOrg Broker1MSP
 configtxgen -profile TradingChannel -outputAnchorPeersUpdate ./channel-artifacts/Broker2MSPanchors_trading-channel.tx -channelID trading-channel -asOrg Broker2MSP
+configtxgen -profile TradingChannel -outputAnchorPeersUpdate ./channel-artifacts/AMMCMSPanchors_trading-channel.tx -channelID trading-channel -asOrg AMMCMSP
 echo "✅ TradingChannel anchor peer updates created"
 
 echo "Generating anchor peer updates for SettlementChannel..."
@@ -40,4 +46,10 @@ configtxgen -profile SettlementChannel -outputAnchorPeersUpdate ./channel-artifa
 configtxgen -profile SettlementChannel -outputAnchorPeersUpdate ./channel-artifacts/Broker2MSPanchors_settlement-channel.tx -channelID settlement-channel -asOrg Broker2MSP
 echo "✅ SettlementChannel anchor peer updates created"
 
+echo "Generating anchor peer updates for RegulatoryChannel..."
+# Generate anchor peer updates for RegulatoryChannel
+configtxgen -profile RegulatoryChannel -outputAnchorPeersUpdate ./channel-artifacts/AMMCMSPanchors_regulatory-channel.tx -channelID regulatory-channel -asOrg AMMCMSP
+configtxgen -profile RegulatoryChannel -outputAnchorPeersUpdate ./channel-artifacts/StockMarketMSPanchors_regulatory-channel.tx -channelID regulatory-channel -asOrg StockMarketMSP
+echo "✅ RegulatoryChannel anchor peer updates created"
+
 echo "Channel artifacts generation completed successfully!"
\ No newline at end of file
@@ -6,12 +6,17 @@ set -e
 # Variables
 TRADING_CHANNEL="trading-channel"
 SETTLEMENT_CHANNEL="settlement-channel"
+REGULATORY_CHANNEL="regulatory-channel"
 ORDERER_ADDR="orderer0.orderer:7050"
 ORDERER_CA="/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/orderer/orderers/orderer0.orderer/tls/ca.crt"
 
 # Define the endorsement policies with single quotes to avoid shell interpretation issues
 POLICY_TRADING='OR("StockMarketMSP.peer","Broker1MSP.peer","Broker2MSP.peer")'
 POLICY_SETTLEMENT='AND("MaroclearMSP.peer",OR("StockMarketMSP.peer","Broker1MSP.peer","Broker2MSP.peer"))'
+POLICY_REGULATORY='OR("AMMCMSP.peer","StockMarketMSP.peer")'
+
+# Private data collections holding broker balances on the settlement channel (path inside the CLI container)
+COLLECTIONS_SETTLEMENT="/opt/gopath/src/github.com/chaincode/settlement/collections_config.json"
 
 # Create packages directory if it doesn't exist
 mkdir -p ./packages
@@ -19,7 +24,7 @@ mkdir -p ./packages
 echo "Setting up go modules for chaincodes..."
 
 # Setup proper Go modules for each chaincode
-for CC_DIR in order-matching settlement; do
+for CC_DIR in order-matching settlement compliance; do
   echo "Preparing $CC_DIR chaincode..."
   
   # Create proper go.mod file with Go 1.17
@@ -78,12 +83,19 @@ if [ ! -f "./packages/settlement.tar.gz" ]; then
   peer lifecycle chaincode package ./packages/settlement.tar.gz --path ./chaincodes/settlement --lang golang --label settlement_1
 fi
 
+# Package compliance chaincode (Regulatory channel)
+if [ ! -f "./packages/compliance.tar.gz" ]; then
+  echo "Creating compliance package..."
+  peer lifecycle chaincode package ./packages/compliance.tar.gz --path ./chaincodes/compliance --lang golang --label compliance_1
+fi
+
 echo "✅ Chaincodes packaged"
 
 # Copy packages to CLI container
 echo "Copying packages to CLI container..."
 docker cp ./packages/order-matching.tar.gz cli:/opt/gopath/src/github.com/hyperledger/fabric/peer/
 docker cp ./packages/settlement.tar.gz cli:/opt/gopath/src/github.com/hyperledger/fabric/peer/
+docker cp ./packages/compliance.tar.gz cli:/opt/gopath/src/github.com/hyperledger/fabric/peer/
 
 ############################################################
 # INSTALL AND APPROVE ORDER-MATCHING CHAINCODE ON TRADING CHANNEL
@@ -240,7 +252,7 @@ docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.c
 export CORE_PEER_ADDRESS=peer0.maroclear:7051 && \
 export CORE_PEER_LOCALMSPID=MaroclearMSP && \
 export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/maroclear/peers/peer0.maroclear/tls/ca.crt && \
-peer lifecycle chaincode approveformyorg -o $ORDERER_ADDR --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --package-id $PACKAGE_ID_MAROCLEAR_SETTLE --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --tls --cafile $ORDERER_CA"
+peer lifecycle chaincode approveformyorg -o $ORDERER_ADDR --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --package-id $PACKAGE_ID_MAROCLEAR_SETTLE --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --collections-config $COLLECTIONS_SETTLEMENT --tls --cafile $ORDERER_CA"
 
 # Approve chaincode for StockMarket
 echo "Approving for StockMarket on settlement channel..."
@@ -248,7 +260,7 @@ docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.c
 export CORE_PEER_ADDRESS=peer0.stockmarket:7051 && \
 export CORE_PEER_LOCALMSPID=StockMarketMSP && \
 export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/stockmarket/peers/peer0.stockmarket/tls/ca.crt && \
-peer lifecycle chaincode approveformyorg -o $ORDERER_ADDR --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --package-id $PACKAGE_ID_STOCKMARKET_SETTLE --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --tls --cafile $ORDERER_CA"
+peer lifecycle chaincode approveformyorg -o $ORDERER_ADDR --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --package-id $PACKAGE_ID_STOCKMARKET_SETTLE --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --collections-config $COLLECTIONS_SETTLEMENT --tls --cafile $ORDERER_CA"
 
 # Approve chaincode for Broker1
 echo "Approving for Broker1 on settlement channel..."
@@ -256,7 +268,7 @@ docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.c
 export CORE_PEER_ADDRESS=peer0.broker1:7051 && \
 export CORE_PEER_LOCALMSPID=Broker1MSP && \
 export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/broker1/peers/peer0.broker1/tls/ca.crt && \
-peer lifecycle chaincode approveformyorg -o $ORDERER_ADDR --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --package-id $PACKAGE_ID_BROKER1_SETTLE --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --tls --cafile $ORDERER_CA"
+peer lifecycle chaincode approveformyorg -o $ORDERER_ADDR --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --package-id $PACKAGE_ID_BROKER1_SETTLE --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --collections-config $COLLECTIONS_SETTLEMENT --tls --cafile $ORDERER_CA"
 
 # Approve chaincode for Broker2
 echo "Approving for Broker2 on settlement channel..."
@@ -264,7 +276,7 @@ docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.c
 export CORE_PEER_ADDRESS=peer0.broker2:7051 && \
 export CORE_PEER_LOCALMSPID=Broker2MSP && \
 export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/broker2/peers/peer0.broker2/tls/ca.crt && \
-peer lifecycle chaincode approveformyorg -o $ORDERER_ADDR --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --package-id $PACKAGE_ID_BROKER2_SETTLE --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --tls --cafile $ORDERER_CA"
+peer lifecycle chaincode approveformyorg -o $ORDERER_ADDR --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --package-id $PACKAGE_ID_BROKER2_SETTLE --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --collections-config $COLLECTIONS_SETTLEMENT --tls --cafile $ORDERER_CA"
 
 echo "✅ Settlement chaincode approved by all organizations"
 
@@ -274,7 +286,7 @@ docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.c
 export CORE_PEER_ADDRESS=peer0.maroclear:7051 && \
 export CORE_PEER_LOCALMSPID=MaroclearMSP && \
 export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/maroclear/peers/peer0.maroclear/tls/ca.crt && \
-peer lifecycle chaincode checkcommitreadiness --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --tls --cafile $ORDERER_CA --output json"
+peer lifecycle chaincode checkcommitreadiness --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --collections-config $COLLECTIONS_SETTLEMENT --tls --cafile $ORDERER_CA --output json"
 
 # Commit the chaincode definition
 echo "Committing settlement chaincode on settlement channel..."
@@ -282,7 +294,7 @@ docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.c
 export CORE_PEER_ADDRESS=peer0.maroclear:7051 && \
 export CORE_PEER_LOCALMSPID=MaroclearMSP && \
 export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/maroclear/peers/peer0.maroclear/tls/ca.crt && \
-peer lifecycle chaincode commit -o $ORDERER_ADDR --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --tls --cafile $ORDERER_CA \
+peer lifecycle chaincode commit -o $ORDERER_ADDR --channelID $SETTLEMENT_CHANNEL --name settlement --version 1.0 --sequence 1 --signature-policy '$POLICY_SETTLEMENT' --collections-config $COLLECTIONS_SETTLEMENT --tls --cafile $ORDERER_CA \
    --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/maroclear/peers/peer0.maroclear/tls/ca.crt \
    --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
    --peerAddresses peer0.broker1:7051 --tlsRootCertFiles /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/broker1/peers/peer0.broker1/tls/ca.crt \
@@ -297,4 +309,80 @@ export CORE_PEER_LOCALMSPID=MaroclearMSP && \
 export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/maroclear/peers/peer0.maroclear/tls/ca.crt && \
 peer lifecycle chaincode querycommitted --channelID $SETTLEMENT_CHANNEL --name settlement --cafile $ORDERER_CA"
 
+############################################################
+# INSTALL AND APPROVE COMPLIANCE CHAINCODE ON REGULATORY CHANNEL
+############################################################
+echo "Installing compliance chaincode for the Regulatory channel..."
+
+# Install on AMMC peer
+echo "Installing on AMMC peer for regulatory channel..."
+docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/users/Admin@ammc/msp && \
+export CORE_PEER_ADDRESS=peer0.ammc:7051 && \
+export CORE_PEER_LOCALMSPID=AMMCMSP && \
+export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/peers/peer0.ammc/tls/ca.crt && \
+peer lifecycle chaincode install /opt/gopath/src/github.com/hyperledger/fabric/peer/compliance.tar.gz && \
+PACKAGE_ID=\$(peer lifecycle chaincode queryinstalled | grep 'compliance_1' | awk '{print \$3}' | sed 's/,//') && \
+echo \$PACKAGE_ID > /opt/gopath/src/github.com/hyperledger/fabric/peer/package_id_ammc_comply.txt"
+PACKAGE_ID_AMMC_COMPLY=$(docker exec cli cat /opt/gopath/src/github.com/hyperledger/fabric/peer/package_id_ammc_comply.txt)
+
+# Install on StockMarket peer
+echo "Installing on StockMarket peer for regulatory channel..."
+docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/stockmarket/users/Admin@stockmarket/msp && \
+export CORE_PEER_ADDRESS=peer0.stockmarket:7051 && \
+export CORE_PEER_LOCALMSPID=StockMarketMSP && \
+export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/stockmarket/peers/peer0.stockmarket/tls/ca.crt && \
+peer lifecycle chaincode install /opt/gopath/src/github.com/hyperledger/fabric/peer/compliance.tar.gz && \
+PACKAGE_ID=\$(peer lifecycle chaincode queryinstalled | grep 'compliance_1' | awk '{print \$3}' | sed 's/,//') && \
+echo \$PACKAGE_ID > /opt/gopath/src/github.com/hyperledger/fabric/peer/package_id_stockmarket_comply.txt"
+PACKAGE_ID_STOCKMARKET_COMPLY=$(docker exec cli cat /opt/gopath/src/github.com/hyperledger/fabric/peer/package_id_stockmarket_comply.txt)
+
+echo "✅ Compliance chaincode installed on peers for regulatory channel"
+
+echo "Approving compliance chaincode for organizations..."
+
+# Approve chaincode for AMMC
+echo "Approving for AMMC on regulatory channel..."
+docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/users/Admin@ammc/msp && \
+export CORE_PEER_ADDRESS=peer0.ammc:7051 && \
+export CORE_PEER_LOCALMSPID=AMMCMSP && \
+export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/peers/peer0.ammc/tls/ca.crt && \
+peer lifecycle chaincode approveformyorg -o $ORDERER_ADDR --channelID $REGULATORY_CHANNEL --name compliance --version 1.0 --package-id $PACKAGE_ID_AMMC_COMPLY --sequence 1 --signature-policy '$POLICY_REGULATORY' --tls --cafile $ORDERER_CA"
+
+# Approve chaincode for StockMarket
+echo "Approving for StockMarket on regulatory channel..."
+docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/stockmarket/users/Admin@stockmarket/msp && \
+export CORE_PEER_ADDRESS=peer0.stockmarket:7051 && \
+export CORE_PEER_LOCALMSPID=StockMarketMSP && \
+export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/stockmarket/peers/peer0.stockmarket/tls/ca.crt && \
+peer lifecycle chaincode approveformyorg -o $ORDERER_ADDR --channelID $REGULATORY_CHANNEL --name compliance --version 1.0 --package-id $PACKAGE_ID_STOCKMARKET_COMPLY --sequence 1 --signature-policy '$POLICY_REGULATORY' --tls --cafile $ORDERER_CA"
+
+echo "✅ Compliance chaincode approved by all organizations"
+
+# Check commit readiness
+echo "Checking commit readiness for compliance chaincode..."
+docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/users/Admin@ammc/msp && \
+export CORE_PEER_ADDRESS=peer0.ammc:7051 && \
+export CORE_PEER_LOCALMSPID=AMMCMSP && \
+export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/peers/peer0.ammc/tls/ca.crt && \
+peer lifecycle chaincode checkcommitreadiness --channelID $REGULATORY_CHANNEL --name compliance --version 1.0 --sequence 1 --signature-policy '$POLICY_REGULATORY' --tls --cafile $ORDERER_CA --output json"
+
+# Commit the chaincode definition
+echo "Committing compliance chaincode on regulatory channel..."
+docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/users/Admin@ammc/msp && \
+export CORE_PEER_ADDRESS=peer0.ammc:7051 && \
+export CORE_PEER_LOCALMSPID=AMMCMSP && \
+export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/peers/peer0.ammc/tls/ca.crt && \
+peer lifecycle chaincode commit -o $ORDERER_ADDR --channelID $REGULATORY_CHANNEL --name compliance --version 1.0 --sequence 1 --signature-policy '$POLICY_REGULATORY' --tls --cafile $ORDERER_CA \
+   --peerAddresses peer0.ammc:7051 --tlsRootCertFiles /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/peers/peer0.ammc/tls/ca.crt \
+   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/stockmarket/peers/peer0.stockmarket/tls/ca.crt"
+
+echo "✅ Compliance chaincode committed on regulatory channel"
+
+# Query committed to confirm
+docker exec cli bash -c "export CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/users/Admin@ammc/msp && \
+export CORE_PEER_ADDRESS=peer0.ammc:7051 && \
+export CORE_PEER_LOCALMSPID=AMMCMSP && \
+export CORE_PEER_TLS_ROOTCERT_FILE=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ammc/peers/peer0.ammc/tls/ca.crt && \
+peer lifecycle chaincode querycommitted --channelID $REGULATORY_CHANNEL --name compliance --cafile $ORDERER_CA"
+
 echo "✅ All chaincodes have been successfully installed, approved and committed on their respective channels!"
\ No newline at end of file
@@ -157,6 +157,82 @@ settlement_instruction_exists() {
   fi
 }
 
+# Function to affirm one side (buy or sell) of a settlement instruction as the broker on that side
+affirm_settlement_instruction() {
+  local INSTRUCTION_ID=$1
+  local SIDE=$2
+  local BROKER_ID=$3
+  local SECURITY_ID=$4
+  local QUANTITY=$5
+  local PRICE=$6
+  
+  # Broker IDs map to their organization, e.g. BROKER1 -> broker1 / Broker1MSP
+  local BROKER_ORG=$(echo "$BROKER_ID" | tr '[:upper:]' '[:lower:]')
+  local BROKER_MSP="$(echo ${BROKER_ORG:0:1} | tr '[:lower:]' '[:upper:]')${BROKER_ORG:1}MSP"
+  
+  set_peer_env "$BROKER_ORG" "$BROKER_MSP"
+  
+  log "Affirming $SIDE side of $INSTRUCTION_ID as $BROKER_MSP"
+  
+  execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC \
+    --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/maroclear/peers/peer0.maroclear/tls/ca.crt \
+    --peerAddresses peer0.${BROKER_ORG}:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
+    -c '{\"Args\":[\"AffirmInstruction\",\"$INSTRUCTION_ID\",\"$SIDE\",\"$SECURITY_ID\",\"$QUANTITY\",\"$PRICE\"]}'" \
+    "Failed to affirm $SIDE side of settlement instruction $INSTRUCTION_ID"
+  sleep 3
+}
+
+# Function to collect the private balance records read when settling a trade into
+# SETTLEMENT_TRANSIENT, for --transient: the accounts, client sub-accounts, guarantee
+# deposits (margin) and the instruction's holds of both brokers. Each broker's peer is only
+# a member of its own broker's collection, so it reads the counterparty's records from the
+# transient map; the chaincode checks them against the private data hashes on the channel.
+build_settlement_transient() {
+  local BUY_BROKER_ID=$1
+  local SELL_BROKER_ID=$2
+  local BUY_CLIENT_ID=$3
+  local SELL_CLIENT_ID=$4
+  local SECURITY_ID=$5
+  local INSTRUCTION_ID=$6
+  
+  set_peer_env "maroclear" "MaroclearMSP"
+  
+  local ENTRIES=()
+  local SIDE BROKER_ID CLIENT_ID HELD KEY RECORD
+  for SIDE in buy sell; do
+    if [[ "$SIDE" == "buy" ]]; then
+      BROKER_ID=$BUY_BROKER_ID
+      CLIENT_ID=$BUY_CLIENT_ID
+      HELD=cash
+    else
+      BROKER_ID=$SELL_BROKER_ID
+      CLIENT_ID=$SELL_CLIENT_ID
+      HELD=securities
+    fi
+    
+    local KEYS=("brokerAccount-$BROKER_ID" "securitiesAccount-$BROKER_ID-$SECURITY_ID" "guaranteeDeposit-$BROKER_ID")
+    if [[ -n "$CLIENT_ID" ]]; then
+      KEYS+=("clientAccount-$BROKER_ID-$CLIENT_ID" "clientSecuritiesAccount-$BROKER_ID-$CLIENT_ID-$SECURITY_ID")
+    fi
+    if [[ -n "$INSTRUCTION_ID" ]]; then
+      KEYS+=("hold-$INSTRUCTION_ID-$HELD")
+    fi
+    
+    for KEY in "${KEYS[@]}"; do
+      RECORD=$($CLI bash -c "export CORE_PEER_MSPCONFIGPATH=$CORE_PEER_MSPCONFIGPATH && \
+      export CORE_PEER_ADDRESS=$CORE_PEER_ADDRESS && \
+      export CORE_PEER_LOCALMSPID=$CORE_PEER_LOCALMSPID && \
+      export CORE_PEER_TLS_ROOTCERT_FILE=$CORE_PEER_TLS_ROOTCERT_FILE && \
+      peer chaincode query -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC -c '{\"Args\":[\"GetPrivateBalanceRecord\",\"$BROKER_ID\",\"$KEY\"]}'") \
+        || handle_error "Failed to read private balance record $KEY"
+      # Records that do not exist yet are passed empty
+      ENTRIES+=("\"$KEY\":\"$(printf '%s' "$RECORD" | base64 | tr -d '\n')\"")
+    done
+  done
+  
+  SETTLEMENT_TRANSIENT="{$(IFS=,; echo "${ENTRIES[*]}")}"
+}
+
 # Function to get trade details
 get_trade_details() {
   local TRADE_ID=$1
@@ -190,7 +266,7 @@ set_peer_env "stockmarket" "StockMarketMSP"
 log "Creating Apple security (SEC001)"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateSecurity\",\"SEC001\",\"AAPL\",\"APP001\",\"Apple Inc.\",\"1000000\",\"150.25\"]}'" \
+  -c '{\"Args\":[\"CreateSecurity\",\"SEC001\",\"AAPL\",\"APP001\",\"Apple Inc.\",\"1000000\",\"15025\"]}'" \
   "Failed to create Apple security"
 sleep 3
 
@@ -198,7 +274,7 @@ sleep 3
 log "Creating Microsoft security (SEC002)"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateSecurity\",\"SEC002\",\"MSFT\",\"MSF001\",\"Microsoft Corporation\",\"800000\",\"300.50\"]}'" \
+  -c '{\"Args\":[\"CreateSecurity\",\"SEC002\",\"MSFT\",\"MSF001\",\"Microsoft Corporation\",\"800000\",\"30050\"]}'" \
   "Failed to create Microsoft security"
 sleep 3
 
@@ -206,7 +282,7 @@ sleep 3
 log "Creating Alphabet security (SEC003)"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateSecurity\",\"SEC003\",\"GOOGL\",\"GOO001\",\"Alphabet Inc.\",\"500000\",\"135.75\"]}'" \
+  -c '{\"Args\":[\"CreateSecurity\",\"SEC003\",\"GOOGL\",\"GOO001\",\"Alphabet Inc.\",\"500000\",\"13575\"]}'" \
   "Failed to create Alphabet security"
 sleep 3
 
@@ -221,7 +297,7 @@ log "Adding Apple to regulatory channel"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $REGULATORY_CHANNEL -n $COMPLIANCE_CC \
   --peerAddresses peer0.ammc:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-  -c '{\"Args\":[\"AddSecurity\",\"SEC001\",\"AAPL\",\"Apple Inc.\",\"APP001\",\"1000000\",\"150.25\",\"10.0\",\"false\"]}'" \
+  -c '{\"Args\":[\"AddSecurity\",\"SEC001\",\"AAPL\",\"Apple Inc.\",\"APP001\",\"1000000\",\"15025\",\"10.0\",\"false\"]}'" \
   "Failed to add Apple to regulatory channel"
 sleep 3
 
@@ -230,7 +306,7 @@ log "Adding Microsoft to regulatory channel"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $REGULATORY_CHANNEL -n $COMPLIANCE_CC \
   --peerAddresses peer0.ammc:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-  -c '{\"Args\":[\"AddSecurity\",\"SEC002\",\"MSFT\",\"Microsoft Corporation\",\"MSF001\",\"800000\",\"300.50\",\"10.0\",\"false\"]}'" \
+  -c '{\"Args\":[\"AddSecurity\",\"SEC002\",\"MSFT\",\"Microsoft Corporation\",\"MSF001\",\"800000\",\"30050\",\"10.0\",\"false\"]}'" \
   "Failed to add Microsoft to regulatory channel"
 sleep 3
 
@@ -239,7 +315,7 @@ log "Adding Alphabet to regulatory channel"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $REGULATORY_CHANNEL -n $COMPLIANCE_CC \
   --peerAddresses peer0.ammc:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-  -c '{\"Args\":[\"AddSecurity\",\"SEC003\",\"GOOGL\",\"Alphabet Inc.\",\"GOO001\",\"500000\",\"135.75\",\"10.0\",\"false\"]}'" \
+  -c '{\"Args\":[\"AddSecurity\",\"SEC003\",\"GOOGL\",\"Alphabet Inc.\",\"GOO001\",\"500000\",\"13575\",\"10.0\",\"false\"]}'" \
   "Failed to add Alphabet to regulatory channel"
 sleep 3
 
@@ -254,7 +330,7 @@ log "Creating Broker1 account in settlement channel"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC \
   --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-  -c '{\"Args\":[\"CreateBrokerAccount\",\"BROKER1\",\"1000000\"]}'" \
+  -c '{\"Args\":[\"CreateBrokerAccount\",\"BROKER1\",\"100000000\"]}'" \
   "Failed to create broker1 account"
 sleep 3
 
@@ -262,7 +338,7 @@ log "Creating Broker2 account in settlement channel"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC \
   --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-  -c '{\"Args\":[\"CreateBrokerAccount\",\"BROKER2\",\"1500000\"]}'" \
+  -c '{\"Args\":[\"CreateBrokerAccount\",\"BROKER2\",\"150000000\"]}'" \
   "Failed to create broker2 account"
 sleep 3
 
@@ -277,7 +353,7 @@ log "Adding Broker1 to regulatory channel"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $REGULATORY_CHANNEL -n $COMPLIANCE_CC \
   --peerAddresses peer0.ammc:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-  -c '{\"Args\":[\"AddBroker\",\"BROKER1\",\"Broker One Ltd.\",\"100000\",\"low\"]}'" \
+  -c '{\"Args\":[\"AddBroker\",\"BROKER1\",\"Broker One Ltd.\",\"10000000\",\"low\"]}'" \
   "Failed to add Broker1 to regulatory channel"
 sleep 3
 
@@ -286,12 +362,36 @@ log "Adding Broker2 to regulatory channel"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $REGULATORY_CHANNEL -n $COMPLIANCE_CC \
   --peerAddresses peer0.ammc:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
   --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-  -c '{\"Args\":[\"AddBroker\",\"BROKER2\",\"Broker Two Ltd.\",\"150000\",\"low\"]}'" \
+  -c '{\"Args\":[\"AddBroker\",\"BROKER2\",\"Broker Two Ltd.\",\"15000000\",\"low\"]}'" \
   "Failed to add Broker2 to regulatory channel"
 sleep 3
 
 log "Brokers added to regulatory channel successfully"
 
+# Step 4.1: Replicating the AMMC restriction set onto the trading channel
+log "Step 4.1: Replicating AMMC restriction set to trading channel"
+set_peer_env "ammc" "AMMCMSP"
+
+QUERY_CMD="peer chaincode query -C $REGULATORY_CHANNEL -n $COMPLIANCE_CC -c '{\"Args\":[\"GetRestrictionSet\"]}'"
+RESTRICTION_SET=$($CLI bash -c "export CORE_PEER_MSPCONFIGPATH=$CORE_PEER_MSPCONFIGPATH && \
+export CORE_PEER_ADDRESS=$CORE_PEER_ADDRESS && \
+export CORE_PEER_LOCALMSPID=$CORE_PEER_LOCALMSPID && \
+export CORE_PEER_TLS_ROOTCERT_FILE=$CORE_PEER_TLS_ROOTCERT_FILE && \
+$QUERY_CMD" 2>&1)
+check_success "Retrieved restriction set from regulatory channel"
+
+# Escape the quotes so the set can be passed as a single chaincode argument
+RESTRICTION_SET_ARG=$(echo "$RESTRICTION_SET" | sed 's/"/\\"/g')
+
+# AMMC signs the sync; the stock market peer endorses it on the trading channel
+execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
+  --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
+  -c '{\"Args\":[\"SyncRestrictions\",\"$RESTRICTION_SET_ARG\"]}'" \
+  "Failed to sync restriction set to trading channel"
+sleep 3
+
+log "Restriction set replicated to trading channel successfully"
+
 # Step 5: Creating securities accounts in settlement channel
 log "Step 5: Creating securities accounts in settlement channel"
 set_peer_env "maroclear" "MaroclearMSP"
@@ -344,6 +444,15 @@ sleep 3
 
 log "Securities accounts created in settlement channel successfully"
 
+# Step 5.1: Settling equities on the trade date so the demo trades can be executed right away
+log "Step 5.1: Setting the equity settlement cycle to T+0"
+execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC \
+  --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
+  --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
+  -c '{\"Args\":[\"SetSettlementCycle\",\"equity\",\"0\"]}'" \
+  "Failed to set the equity settlement cycle"
+sleep 3
+
 # Step 6: Creating buy and sell orders
 log "Step 6: Creating buy and sell orders"
 set_peer_env "broker1" "Broker1MSP"
@@ -352,19 +461,19 @@ set_peer_env "broker1" "Broker1MSP"
 log "Creating buy orders from Broker1"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.broker1:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateOrder\",\"BUY001\",\"BROKER1\",\"SEC001\",\"buy\",\"100\",\"152.50\"]}'" \
+  -c '{\"Args\":[\"CreateOrder\",\"BUY001\",\"BROKER1\",\"\",\"SEC001\",\"buy\",\"100\",\"15250\"]}'" \
   "Failed to create buy order BUY001"
 sleep 2
 
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.broker1:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateOrder\",\"BUY002\",\"BROKER1\",\"SEC002\",\"buy\",\"50\",\"302.75\"]}'" \
+  -c '{\"Args\":[\"CreateOrder\",\"BUY002\",\"BROKER1\",\"\",\"SEC002\",\"buy\",\"50\",\"30275\"]}'" \
   "Failed to create buy order BUY002"
 sleep 2
 
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.broker1:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateOrder\",\"BUY003\",\"BROKER1\",\"SEC003\",\"buy\",\"75\",\"137.25\"]}'" \
+  -c '{\"Args\":[\"CreateOrder\",\"BUY003\",\"BROKER1\",\"\",\"SEC003\",\"buy\",\"75\",\"13725\"]}'" \
   "Failed to create buy order BUY003"
 sleep 2
 
@@ -373,19 +482,19 @@ set_peer_env "broker2" "Broker2MSP"
 log "Creating sell orders from Broker2"
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.broker2:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateOrder\",\"SELL001\",\"BROKER2\",\"SEC001\",\"sell\",\"100\",\"151.75\"]}'" \
+  -c '{\"Args\":[\"CreateOrder\",\"SELL001\",\"BROKER2\",\"\",\"SEC001\",\"sell\",\"100\",\"15175\"]}'" \
   "Failed to create sell order SELL001"
 sleep 2
 
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.broker2:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateOrder\",\"SELL002\",\"BROKER2\",\"SEC002\",\"sell\",\"50\",\"301.50\"]}'" \
+  -c '{\"Args\":[\"CreateOrder\",\"SELL002\",\"BROKER2\",\"\",\"SEC002\",\"sell\",\"50\",\"30150\"]}'" \
   "Failed to create sell order SELL002"
 sleep 2
 
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.broker2:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateOrder\",\"SELL003\",\"BROKER2\",\"SEC003\",\"sell\",\"75\",\"136.50\"]}'" \
+  -c '{\"Args\":[\"CreateOrder\",\"SELL003\",\"BROKER2\",\"\",\"SEC003\",\"sell\",\"75\",\"13650\"]}'" \
   "Failed to create sell order SELL003"
 sleep 2
 
@@ -455,11 +564,14 @@ for TRADE_ID in "${TRADE_IDS[@]}"; do
   SELL_ORDER_ID=$(echo $TRADE_DETAILS | grep -o '"sellOrderID":"[^"]*' | head -1 | cut -d'"' -f4)
   BUY_BROKER_ID=$(echo $TRADE_DETAILS | grep -o '"buyBrokerID":"[^"]*' | head -1 | cut -d'"' -f4)
   SELL_BROKER_ID=$(echo $TRADE_DETAILS | grep -o '"sellBrokerID":"[^"]*' | head -1 | cut -d'"' -f4)
+  BUY_CLIENT_ID=$(echo $TRADE_DETAILS | grep -o '"buyClientID":"[^"]*' | head -1 | cut -d'"' -f4)
+  SELL_CLIENT_ID=$(echo $TRADE_DETAILS | grep -o '"sellClientID":"[^"]*' | head -1 | cut -d'"' -f4)
   SECURITY_ID=$(echo $TRADE_DETAILS | grep -o '"securityID":"[^"]*' | head -1 | cut -d'"' -f4)
   QUANTITY=$(echo $TRADE_DETAILS | grep -o '"quantity":[^,]*' | head -1 | cut -d':' -f2)
   PRICE=$(echo $TRADE_DETAILS | grep -o '"price":[^,]*' | head -1 | cut -d':' -f2)
   STATUS=$(echo $TRADE_DETAILS | grep -o '"status":"[^"]*' | head -1 | cut -d'"' -f4)
   MATCH_TIME=$(echo $TRADE_DETAILS | grep -o '"matchTime":"[^"]*' | head -1 | cut -d'"' -f4)
+  MAKER_SIDE=$(echo $TRADE_DETAILS | grep -o '"makerSide":"[^"]*' | head -1 | cut -d'"' -f4)
   
   log "Trade details: BuyOrderID=$BUY_ORDER_ID, SellOrderID=$SELL_ORDER_ID, BuyBrokerID=$BUY_BROKER_ID, SellBrokerID=$SELL_BROKER_ID, SecurityID=$SECURITY_ID, Quantity=$QUANTITY, Price=$PRICE, Status=$STATUS, MatchTime=$MATCH_TIME"
   
@@ -472,7 +584,7 @@ for TRADE_ID in "${TRADE_IDS[@]}"; do
     execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $REGULATORY_CHANNEL -n $COMPLIANCE_CC \
       --peerAddresses peer0.ammc:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
       --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-      -c '{\"Args\":[\"ImportTrade\",\"$TRADE_ID\",\"$BUY_ORDER_ID\",\"$SELL_ORDER_ID\",\"$BUY_BROKER_ID\",\"$SELL_BROKER_ID\",\"$SECURITY_ID\",\"$QUANTITY\",\"$PRICE\",\"$STATUS\",\"$MATCH_TIME\"]}'" \
+      -c '{\"Args\":[\"ImportTrade\",\"$TRADE_ID\",\"$BUY_ORDER_ID\",\"$SELL_ORDER_ID\",\"$BUY_BROKER_ID\",\"$SELL_BROKER_ID\",\"$BUY_CLIENT_ID\",\"$SELL_CLIENT_ID\",\"$SECURITY_ID\",\"$QUANTITY\",\"$PRICE\",\"$STATUS\",\"$MATCH_TIME\"]}'" \
       "Failed to import trade to regulatory channel"
     sleep 3
     
@@ -546,7 +658,7 @@ for TRADE_ID in "${TRADE_IDS[@]}"; do
       execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC \
         --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
         --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-        -c '{\"Args\":[\"ImportTrade\",\"$TRADE_ID\",\"$BUY_ORDER_ID\",\"$SELL_ORDER_ID\",\"$BUY_BROKER_ID\",\"$SELL_BROKER_ID\",\"$SECURITY_ID\",\"$QUANTITY\",\"$PRICE\",\"$COMPLIANCE_STATUS\",\"$MATCH_TIME\"]}'" \
+        -c '{\"Args\":[\"ImportTrade\",\"$TRADE_ID\",\"$BUY_ORDER_ID\",\"$SELL_ORDER_ID\",\"$BUY_BROKER_ID\",\"$SELL_BROKER_ID\",\"$BUY_CLIENT_ID\",\"$SELL_CLIENT_ID\",\"$SECURITY_ID\",\"$QUANTITY\",\"$PRICE\",\"$COMPLIANCE_STATUS\",\"$MATCH_TIME\",\"$MAKER_SIDE\"]}'" \
         "Failed to import trade to settlement channel"
       sleep 3
       
@@ -572,10 +684,14 @@ for TRADE_ID in "${TRADE_IDS[@]}"; do
     
     if [[ "$INSTRUCTION" == *"does not exist"* || "$INSTRUCTION" == *"Error"* ]]; then
       log "Creating settlement instruction for trade $TRADE_ID"
+      build_settlement_transient "$BUY_BROKER_ID" "$SELL_BROKER_ID" "$BUY_CLIENT_ID" "$SELL_CLIENT_ID" "$SECURITY_ID" "$INSTRUCTION_ID"
       
       execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC \
         --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
         --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
+        --peerAddresses peer0.broker1:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/broker1/peers/peer0.broker1/tls/ca.crt \
+        --peerAddresses peer0.broker2:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/broker2/peers/peer0.broker2/tls/ca.crt \
+        --transient '$SETTLEMENT_TRANSIENT' \
         -c '{\"Args\":[\"CreateSettlementInstruction\",\"$TRADE_ID\"]}'" \
         "Failed to create settlement instruction"
       sleep 3
@@ -583,17 +699,26 @@ for TRADE_ID in "${TRADE_IDS[@]}"; do
       log "Settlement instruction already exists for trade $TRADE_ID, skipping creation"
     fi
     
-    # Step 9.4.3: Execute settlement
+    # Step 9.4.3: Both brokers affirm the instruction
+    affirm_settlement_instruction "$INSTRUCTION_ID" "buy" "$BUY_BROKER_ID" "$SECURITY_ID" "$QUANTITY" "$PRICE"
+    affirm_settlement_instruction "$INSTRUCTION_ID" "sell" "$SELL_BROKER_ID" "$SECURITY_ID" "$QUANTITY" "$PRICE"
+    set_peer_env "maroclear" "MaroclearMSP"
+    
+    # Step 9.4.4: Execute settlement
     log "Executing settlement for trade $TRADE_ID"
+    build_settlement_transient "$BUY_BROKER_ID" "$SELL_BROKER_ID" "$BUY_CLIENT_ID" "$SELL_CLIENT_ID" "$SECURITY_ID" "$INSTRUCTION_ID"
     
     execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC \
       --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
       --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
+      --peerAddresses peer0.broker1:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/broker1/peers/peer0.broker1/tls/ca.crt \
+      --peerAddresses peer0.broker2:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/broker2/peers/peer0.broker2/tls/ca.crt \
+      --transient '$SETTLEMENT_TRANSIENT' \
       -c '{\"Args\":[\"ExecuteSettlement\",\"$INSTRUCTION_ID\"]}'" \
       "Failed to execute settlement"
     sleep 3
     
-    # Step 9.4.4: Update trade status to "settled" in trading channel
+    # Step 9.4.5: Update trade status to "settled" in trading channel
     log "Updating trade status to settled in trading channel"
     set_peer_env "stockmarket" "StockMarketMSP"
     
@@ -618,13 +743,13 @@ set_peer_env "broker1" "Broker1MSP"
 
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.broker1:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateOrder\",\"BUY004\",\"BROKER1\",\"SEC001\",\"buy\",\"150\",\"150.50\"]}'" \
+  -c '{\"Args\":[\"CreateOrder\",\"BUY004\",\"BROKER1\",\"\",\"SEC001\",\"buy\",\"150\",\"15050\"]}'" \
   "Failed to create buy order BUY004"
 sleep 2
 
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.broker1:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateOrder\",\"BUY005\",\"BROKER1\",\"SEC002\",\"buy\",\"75\",\"301.00\"]}'" \
+  -c '{\"Args\":[\"CreateOrder\",\"BUY005\",\"BROKER1\",\"\",\"SEC002\",\"buy\",\"75\",\"30100\"]}'" \
   "Failed to create buy order BUY005"
 sleep 2
 
@@ -634,13 +759,13 @@ set_peer_env "broker2" "Broker2MSP"
 
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.broker2:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateOrder\",\"SELL004\",\"BROKER2\",\"SEC001\",\"sell\",\"150\",\"150.25\"]}'" \
+  -c '{\"Args\":[\"CreateOrder\",\"SELL004\",\"BROKER2\",\"\",\"SEC001\",\"sell\",\"150\",\"15025\"]}'" \
   "Failed to create sell order SELL004"
 sleep 2
 
 execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $TRADING_CHANNEL -n $ORDER_MATCHING_CC \
   --peerAddresses peer0.broker2:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
-  -c '{\"Args\":[\"CreateOrder\",\"SELL005\",\"BROKER2\",\"SEC002\",\"sell\",\"75\",\"300.80\"]}'" \
+  -c '{\"Args\":[\"CreateOrder\",\"SELL005\",\"BROKER2\",\"\",\"SEC002\",\"sell\",\"75\",\"30080\"]}'" \
   "Failed to create sell order SELL005"
 sleep 2
 
@@ -704,11 +829,14 @@ for TRADE_ID in "${NEW_TRADE_IDS[@]}"; do
   SELL_ORDER_ID=$(echo $TRADE_DETAILS | grep -o '"sellOrderID":"[^"]*' | head -1 | cut -d'"' -f4)
   BUY_BROKER_ID=$(echo $TRADE_DETAILS | grep -o '"buyBrokerID":"[^"]*' | head -1 | cut -d'"' -f4)
   SELL_BROKER_ID=$(echo $TRADE_DETAILS | grep -o '"sellBrokerID":"[^"]*' | head -1 | cut -d'"' -f4)
+  BUY_CLIENT_ID=$(echo $TRADE_DETAILS | grep -o '"buyClientID":"[^"]*' | head -1 | cut -d'"' -f4)
+  SELL_CLIENT_ID=$(echo $TRADE_DETAILS | grep -o '"sellClientID":"[^"]*' | head -1 | cut -d'"' -f4)
   SECURITY_ID=$(echo $TRADE_DETAILS | grep -o '"securityID":"[^"]*' | head -1 | cut -d'"' -f4)
   QUANTITY=$(echo $TRADE_DETAILS | grep -o '"quantity":[^,]*' | head -1 | cut -d':' -f2)
   PRICE=$(echo $TRADE_DETAILS | grep -o '"price":[^,]*' | head -1 | cut -d':' -f2)
   STATUS=$(echo $TRADE_DETAILS | grep -o '"status":"[^"]*' | head -1 | cut -d'"' -f4)
   MATCH_TIME=$(echo $TRADE_DETAILS | grep -o '"matchTime":"[^"]*' | head -1 | cut -d'"' -f4)
+  MAKER_SIDE=$(echo $TRADE_DETAILS | grep -o '"makerSide":"[^"]*' | head -1 | cut -d'"' -f4)
   
   # Import to regulatory channel
   log "Importing new trade $TRADE_ID to regulatory channel"
@@ -717,7 +845,7 @@ for TRADE_ID in "${NEW_TRADE_IDS[@]}"; do
   execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $REGULATORY_CHANNEL -n $COMPLIANCE_CC \
     --peerAddresses peer0.ammc:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
     --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-    -c '{\"Args\":[\"ImportTrade\",\"$TRADE_ID\",\"$BUY_ORDER_ID\",\"$SELL_ORDER_ID\",\"$BUY_BROKER_ID\",\"$SELL_BROKER_ID\",\"$SECURITY_ID\",\"$QUANTITY\",\"$PRICE\",\"$STATUS\",\"$MATCH_TIME\"]}'" \
+    -c '{\"Args\":[\"ImportTrade\",\"$TRADE_ID\",\"$BUY_ORDER_ID\",\"$SELL_ORDER_ID\",\"$BUY_BROKER_ID\",\"$SELL_BROKER_ID\",\"$BUY_CLIENT_ID\",\"$SELL_CLIENT_ID\",\"$SECURITY_ID\",\"$QUANTITY\",\"$PRICE\",\"$STATUS\",\"$MATCH_TIME\"]}'" \
     "Failed to import new trade to regulatory channel"
   sleep 3
   
@@ -754,24 +882,37 @@ for TRADE_ID in "${NEW_TRADE_IDS[@]}"; do
     execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC \
       --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
       --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
-      -c '{\"Args\":[\"ImportTrade\",\"$TRADE_ID\",\"$BUY_ORDER_ID\",\"$SELL_ORDER_ID\",\"$BUY_BROKER_ID\",\"$SELL_BROKER_ID\",\"$SECURITY_ID\",\"$QUANTITY\",\"$PRICE\",\"$COMPLIANCE_STATUS\",\"$MATCH_TIME\"]}'" \
+      -c '{\"Args\":[\"ImportTrade\",\"$TRADE_ID\",\"$BUY_ORDER_ID\",\"$SELL_ORDER_ID\",\"$BUY_BROKER_ID\",\"$SELL_BROKER_ID\",\"$BUY_CLIENT_ID\",\"$SELL_CLIENT_ID\",\"$SECURITY_ID\",\"$QUANTITY\",\"$PRICE\",\"$COMPLIANCE_STATUS\",\"$MATCH_TIME\",\"$MAKER_SIDE\"]}'" \
       "Failed to import new trade to settlement channel"
     sleep 3
     
     # Create settlement instruction
     log "Creating settlement instruction for new trade $TRADE_ID"
+    build_settlement_transient "$BUY_BROKER_ID" "$SELL_BROKER_ID" "$BUY_CLIENT_ID" "$SELL_CLIENT_ID" "$SECURITY_ID" "instruction-$TRADE_ID"
     execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC \
       --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
       --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
+      --peerAddresses peer0.broker1:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/broker1/peers/peer0.broker1/tls/ca.crt \
+      --peerAddresses peer0.broker2:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/broker2/peers/peer0.broker2/tls/ca.crt \
+      --transient '$SETTLEMENT_TRANSIENT' \
       -c '{\"Args\":[\"CreateSettlementInstruction\",\"$TRADE_ID\"]}'" \
       "Failed to create settlement instruction for new trade"
     sleep 3
     
+    # Both brokers affirm the instruction
+    affirm_settlement_instruction "instruction-$TRADE_ID" "buy" "$BUY_BROKER_ID" "$SECURITY_ID" "$QUANTITY" "$PRICE"
+    affirm_settlement_instruction "instruction-$TRADE_ID" "sell" "$SELL_BROKER_ID" "$SECURITY_ID" "$QUANTITY" "$PRICE"
+    set_peer_env "maroclear" "MaroclearMSP"
+    
     # Execute settlement
     log "Executing settlement for new trade $TRADE_ID"
+    build_settlement_transient "$BUY_BROKER_ID" "$SELL_BROKER_ID" "$BUY_CLIENT_ID" "$SELL_CLIENT_ID" "$SECURITY_ID" "instruction-$TRADE_ID"
     execute_peer_command "peer chaincode invoke -o $ORDERER_ADDRESS --tls --cafile $ORDERER_CA -C $SETTLEMENT_CHANNEL -n $SETTLEMENT_CC \
       --peerAddresses peer0.maroclear:7051 --tlsRootCertFiles $CORE_PEER_TLS_ROOTCERT_FILE \
       --peerAddresses peer0.stockmarket:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/stockmarket/peers/peer0.stockmarket/tls/ca.crt \
+      --peerAddresses peer0.broker1:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/broker1/peers/peer0.broker1/tls/ca.crt \
+      --peerAddresses peer0.broker2:7051 --tlsRootCertFiles ${DOCKER_CRYPTO_PATH}/broker2/peers/peer0.broker2/tls/ca.crt \
+      --transient '$SETTLEMENT_TRANSIENT' \
       -c '{\"Args\":[\"ExecuteSettlement\",\"instruction-$TRADE_ID\"]}'" \
       "Failed to execute settlement for new trade"
     sleep 3